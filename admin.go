@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// admins are the callers allowed the admin routes, set from the admins
+// setting as key:<label>, org:<org> or sub:<subject>
+var admins []string
+
+// cancelWait is how long cancelling a running job waits for it to stop
+// before answering with 202
+const cancelWait = 10 * time.Second
+
+// clockTicks is the unit of the CPU times in /proc/<pid>/stat
+const clockTicks = 100
+
+// isAdmin reports whether the caller may use the admin routes
+func isAdmin(p Principal) bool {
+	return p.KeyLabel != "" && slices.Contains(admins, "key:"+p.KeyLabel) ||
+		p.Org != "" && slices.Contains(admins, "org:"+p.Org) ||
+		p.Subject != "" && slices.Contains(admins, "sub:"+p.Subject)
+}
+
+// requireAdmin answers 403 to callers who aren't admins
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := principalFrom(r.Context()); !ok || !isAdmin(p) {
+			writeError(w, "Admin routes need an admin's credentials", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// A jobCancelledError fails a job that was cancelled
+type jobCancelledError struct {
+	by string
+}
+
+func (e *jobCancelledError) Error() string { return "Job was cancelled by " + e.by }
+
+// cancelledBy is what a job cancelled by who fails with
+func cancelledBy(who string) error {
+	return &statusError{status: http.StatusConflict, errCode: "JOB_CANCELLED", err: &jobCancelledError{by: who}}
+}
+
+// jobCancellation returns the error a job running in ctx was cancelled
+// with, or nil if it wasn't
+func jobCancellation(ctx context.Context) error {
+	var ce *jobCancelledError
+	if err := context.Cause(ctx); errors.As(err, &ce) {
+		return err
+	}
+	return nil
+}
+
+// cancel stops a queued or running job, failing it with JOB_CANCELLED. A
+// running job's package manager is killed with its process group and its
+// workspace removed. It returns the job and whether it has finished yet;
+// jobs another replica runs are asked to stop, and finish when it notices.
+// Jobs that have finished already fail with 409.
+func (m *JobManager) cancel(ctx context.Context, id, by string) (Job, bool, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if ok && job.FinishedAt == nil && job.cancel != nil {
+		job.cancel(cancelledBy(by))
+		m.mu.Unlock()
+		return m.awaitCancelled(ctx, job)
+	}
+	m.mu.Unlock()
+	snapshot, ok, err := m.get(ctx, id)
+	if err != nil {
+		return Job{}, false, err
+	}
+	if !ok {
+		return Job{}, false, &statusError{status: http.StatusNotFound, err: errors.New("Job not found")}
+	}
+	if snapshot.FinishedAt != nil {
+		return snapshot, true, &statusError{status: http.StatusConflict, err: fmt.Errorf("Job has already %s", snapshot.Status)}
+	}
+	if m.queue == nil {
+		return snapshot, false, nil
+	}
+	// A queued job is failed where it waits; a running one by its replica
+	if withdrawn, err := m.queue.withdraw(ctx, id); err != nil {
+		return Job{}, false, err
+	} else if withdrawn {
+		return m.cancelQueued(ctx, id, by)
+	}
+	if err := m.queue.requestCancel(ctx, id, by); err != nil {
+		return Job{}, false, err
+	}
+	return snapshot, false, nil
+}
+
+// awaitCancelled waits up to cancelWait for a job this replica runs to stop
+func (m *JobManager) awaitCancelled(ctx context.Context, job *Job) (Job, bool, error) {
+	timeout := time.After(cancelWait)
+	for seen := 0; ; {
+		events, closed, changed := job.events.since(seen)
+		seen += len(events)
+		if closed {
+			break
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			snapshot, _, err := m.get(ctx, job.ID)
+			return snapshot, false, err
+		case <-ctx.Done():
+			return Job{}, false, ctx.Err()
+		}
+	}
+	snapshot, _, err := m.get(ctx, job.ID)
+	return snapshot, true, err
+}
+
+// cancelQueued fails a job taken off the shared queue before any replica
+// claimed it
+func (m *JobManager) cancelQueued(ctx context.Context, id, by string) (Job, bool, error) {
+	rec, ok, err := m.queue.load(ctx, id)
+	if err != nil || !ok {
+		return Job{}, false, err
+	}
+	job, req := rec.job()
+	job.FinishedAt = timePtr(time.Now().UTC())
+	job.failed(cancelledBy(by))
+	if err := m.queue.save(ctx, newJobRecord(job)); err != nil {
+		return Job{}, false, err
+	}
+	n, err := m.queue.redis.int(ctx, "LLEN", m.queue.key("events", id))
+	if err != nil {
+		return Job{}, false, err
+	}
+	now := time.Now().UTC()
+	if err := m.queue.appendEvents(ctx, id, []JobEvent{
+		{ID: int(n) + 1, Type: "log", Time: now, Stream: "server", Line: job.Error},
+		{ID: int(n) + 2, Type: "status", Time: now, Phase: PhaseDone, Status: JobFailed},
+	}, true); err != nil {
+		return Job{}, false, err
+	}
+	job.logger.Info("queued job cancelled", "by", by)
+	if req != nil {
+		m.finished(ctx, *job, req.Options.CallbackURL)
+	}
+	return *job, true, nil
+}
+
+// JobResources are what a running job is using on the replica running it
+type JobResources struct {
+	// WorkspaceBytes is the size of the job's workspace
+	WorkspaceBytes int64 `json:"workspace_bytes"`
+	// Step, PID and StepSeconds describe the tool the job is running, if it
+	// is running one, whose process group MemoryBytes and CPUSeconds measure
+	Step        string  `json:"step,omitempty"`
+	PID         int     `json:"pid,omitempty"`
+	StepSeconds float64 `json:"step_seconds,omitempty"`
+	MemoryBytes int64   `json:"memory_bytes,omitempty"`
+	CPUSeconds  float64 `json:"cpu_seconds,omitempty"`
+}
+
+// resourcesOf measures what a job this replica runs is using, or returns
+// nil if it has no workspace yet
+func resourcesOf(job Job) *JobResources {
+	if job.workDir == "" {
+		return nil
+	}
+	res := &JobResources{}
+	res.WorkspaceBytes, _ = diskUsage(job.workDir)
+	tool, ok := job.notes.runningTool()
+	if !ok {
+		return res
+	}
+	res.Step, res.PID, res.StepSeconds = tool.step, tool.pid, time.Since(tool.started).Seconds()
+	if tool.cgroup != "" {
+		res.MemoryBytes, res.CPUSeconds = cgroupUsage(tool.cgroup)
+	} else {
+		res.MemoryBytes, res.CPUSeconds = processGroupUsage(tool.pid)
+	}
+	return res
+}
+
+// cgroupUsage reads the memory and CPU time a cgroup's processes use
+func cgroupUsage(dir string) (memory int64, cpu float64) {
+	if b, err := os.ReadFile(filepath.Join(dir, "memory.current")); err == nil {
+		memory, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if usec, ok := strings.CutPrefix(line, "usage_usec "); ok {
+				n, _ := strconv.ParseInt(usec, 10, 64)
+				cpu = float64(n) / 1e6
+			}
+		}
+	}
+	return memory, cpu
+}
+
+// processGroupUsage adds up the resident memory and CPU time of the
+// processes in a process group from /proc
+func processGroupUsage(pgid int) (memory int64, cpu float64) {
+	entries, _ := os.ReadDir("/proc")
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The fields after the command, which may hold spaces, start with
+		// the state; the group, CPU times and RSS follow
+		_, rest, ok := strings.Cut(string(b), ") ")
+		fields := strings.Fields(rest)
+		if !ok || len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		cpu += float64(utime+stime) / clockTicks
+		memory += rss * int64(os.Getpagesize())
+	}
+	return memory, cpu
+}
+
+// An AdminJob is a queued or running job as the admin API lists it
+type AdminJob struct {
+	jobResponse
+	// Worker is the replica running the job, with a shared job queue
+	Worker string `json:"worker,omitempty"`
+	// Resources are what the job is using, for jobs the answering replica
+	// runs
+	Resources *JobResources `json:"resources,omitempty"`
+}
+
+// handleAdminJobs serves GET /admin/jobs?status=queued,running, the jobs
+// waiting or running, running ones first
+func (m *JobManager) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	statuses := splitList(r.URL.Query().Get("status"))
+	if len(statuses) == 0 {
+		statuses = []string{string(JobRunning), string(JobQueued)}
+	}
+	for _, s := range statuses {
+		if s != string(JobRunning) && s != string(JobQueued) {
+			writeError(w, "status must be queued or running", http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := r.Context()
+	var jobs []AdminJob
+	seen := make(map[string]bool)
+	m.mu.Lock()
+	for _, job := range m.jobs {
+		if slices.Contains(statuses, string(job.Status)) {
+			seen[job.ID] = true
+			jobs = append(jobs, AdminJob{jobResponse: newJobResponse(*job)})
+			if job.Status == JobRunning && m.queue != nil {
+				jobs[len(jobs)-1].Worker = m.queue.worker
+			}
+		}
+	}
+	m.mu.Unlock()
+	for i, job := range jobs {
+		jobs[i].Resources = resourcesOf(job.Job)
+	}
+	if m.queue != nil {
+		add := func(id, worker string) {
+			if seen[id] {
+				return
+			}
+			if job, ok, err := m.get(ctx, id); err == nil && ok && slices.Contains(statuses, string(job.Status)) {
+				seen[id] = true
+				jobs = append(jobs, AdminJob{jobResponse: newJobResponse(job), Worker: worker})
+			}
+		}
+		running, err := m.queue.processing(ctx)
+		if err == nil {
+			for worker, ids := range running {
+				for _, id := range ids {
+					add(id, worker)
+				}
+			}
+		}
+		queued, qerr := m.queue.queued(ctx)
+		if err = errors.Join(err, qerr); err != nil {
+			writeError(w, fmt.Sprintf("Failed to read the job queue: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		for _, id := range queued {
+			add(id, "")
+		}
+	}
+	slices.SortStableFunc(jobs, func(a, b AdminJob) int {
+		if a.Status != b.Status {
+			if a.Status == JobRunning {
+				return -1
+			}
+			return 1
+		}
+		if a.Status == JobQueued {
+			return a.QueuePosition - b.QueuePosition
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": jobs})
+}
+
+// handleAdminLogs serves GET /admin/jobs/{id}/logs, the job's output and
+// status changes so far as text
+func (m *JobManager) handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	events, _, _ := m.eventLog(job).since(0)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, ev := range events {
+		line := ev.Line
+		if ev.Type == "status" {
+			line = fmt.Sprintf("%s (%s)", ev.Status, ev.Phase)
+		}
+		fmt.Fprintf(w, "%s %-6s %s\n", ev.Time.Format(time.RFC3339), ev.Stream, line)
+	}
+}
+
+// handleAdminCancel serves POST /admin/jobs/{id}/cancel, answering 200 with
+// the failed job once it has stopped and 202 while it is stopping
+func (m *JobManager) handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	m.writeCancelled(w, r, "an administrator ("+usageCaller(p)+")")
+}
+
+// writeCancelled cancels the job named by the request and answers with it
+func (m *JobManager) writeCancelled(w http.ResponseWriter, r *http.Request, by string) {
+	job, finished, err := m.cancel(r.Context(), r.PathValue("id"), by)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	loggerFrom(r.Context()).Info("job cancelled", "job_id", job.ID, "by", by, "finished", finished)
+	status := http.StatusOK
+	if !finished {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, newJobResponse(job))
+}
+
+// handleAdminPromote serves POST /admin/jobs/{id}/promote, moving a queued
+// job to the front of the queue
+func (m *JobManager) handleAdminPromote(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	promoted := false
+	m.mu.Lock()
+	if job, ok := m.jobs[id]; ok && job.Status == JobQueued && job.slot != nil {
+		promoted = job.slot.promote()
+	}
+	m.mu.Unlock()
+	if !promoted && m.queue != nil {
+		var err error
+		if promoted, err = m.queue.promote(r.Context(), id); err != nil {
+			writeError(w, fmt.Sprintf("Failed to promote job: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if !promoted {
+		writeError(w, fmt.Sprintf("Only queued jobs can be promoted: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	loggerFrom(r.Context()).Info("job promoted", "job_id", id)
+	writeJSON(w, http.StatusOK, newJobResponse(job))
+}
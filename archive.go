@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// An archiveFormat is one of the output formats a client can ask for
+type archiveFormat struct {
+	// Name is the value of the format query parameter
+	Name string
+	// ContentType is the response media type, also used for Accept negotiation
+	ContentType string
+	// Extension is appended to the ecosystem's ArchiveName
+	Extension string
+	// Write streams srcDir to w with entries under root, compressed at the
+	// given deflate level, where 0 stores files uncompressed. Formats that
+	// don't use deflate ignore it
+	Write func(w io.Writer, srcDir, root string, level int) error
+	// Deflate is whether the format takes the compression options
+	Deflate bool
+	// LayerType is the media type of the archive as an OCI layer
+	LayerType string
+}
+
+var zipFormat = &archiveFormat{
+	Name:        "zip",
+	ContentType: "application/zip",
+	Extension:   ".zip",
+	Write:       writeZip,
+	Deflate:     true,
+	LayerType:   "application/zip",
+}
+
+// tar.gz keeps Unix permissions and symlinks, which Docker builds and
+// Lambda layers rely on
+var tarGzFormat = &archiveFormat{
+	Name:        "tar.gz",
+	ContentType: "application/gzip",
+	Extension:   ".tar.gz",
+	Write:       writeTarGz,
+	Deflate:     true,
+	LayerType:   "application/vnd.oci.image.layer.v1.tar+gzip",
+}
+
+// tar.zst compresses node_modules and site-packages trees considerably
+// better and faster than gzip
+var tarZstFormat = &archiveFormat{
+	Name:        "tar.zst",
+	ContentType: "application/zstd",
+	Extension:   ".tar.zst",
+	Write:       writeTarZst,
+	LayerType:   "application/vnd.oci.image.layer.v1.tar+zstd",
+}
+
+// archiveFormats lists the supported formats; the first is the default
+var archiveFormats = []*archiveFormat{zipFormat, tarGzFormat, tarZstFormat}
+
+// compression and compressionLevel are how zip and tar.gz archives are
+// compressed unless a request asks otherwise, set from the compression and
+// compression_level settings. node_modules trees are mostly tiny or already
+// compressed files, so storing them or deflating at level 1 saves a lot of
+// CPU time for little extra size.
+var (
+	compression      = "deflate"
+	compressionLevel = 6
+)
+
+// compressionMethods are the valid values of the compression option
+var compressionMethods = []string{"store", "deflate"}
+
+// resolveCompression checks the compression options against the archive
+// format and fills them in from the server defaults
+func (o *InstallOptions) resolveCompression(format *archiveFormat) error {
+	if !format.Deflate {
+		if o.Compression != "" || o.CompressionLevel != 0 {
+			return badRequest("compression is not supported for %s archives, which use the server's zstd_level", format.Name)
+		}
+		return nil
+	}
+	if o.Compression != "" && !slices.Contains(compressionMethods, o.Compression) {
+		return badRequest("Invalid compression %q: must be one of %s", o.Compression, strings.Join(compressionMethods, ", "))
+	}
+	if o.CompressionLevel != 0 {
+		if o.CompressionLevel < 1 || o.CompressionLevel > 9 {
+			return badRequest("Invalid compression_level %d: must be between 1 and 9", o.CompressionLevel)
+		}
+		if o.Compression == "store" {
+			return badRequest("compression_level can't be combined with store")
+		}
+		o.Compression = "deflate"
+		return nil
+	}
+	if o.Compression == "" {
+		o.Compression = compression
+	}
+	if o.Compression == "deflate" {
+		o.CompressionLevel = compressionLevel
+	}
+	return nil
+}
+
+// deflateLevel is the level archives are written at; 0 stores them
+func (o InstallOptions) deflateLevel() int {
+	if o.Compression == "store" {
+		return flate.NoCompression
+	}
+	return o.CompressionLevel
+}
+
+// zstdLevel is the zstd compression level used for tar.zst, from 1 (fastest)
+// to 22 (smallest). It is set from ZSTD_LEVEL at startup.
+var zstdLevel = 3
+
+// negotiateFormat picks the archive format from the format query parameter,
+// falling back to the first supported type in the Accept header
+func negotiateFormat(r *http.Request) (*archiveFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range archiveFormats {
+			if f.Name == name {
+				return f, nil
+			}
+		}
+		return nil, badRequest("Unsupported format %q", name)
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		for _, f := range archiveFormats {
+			if f.ContentType == mediaType {
+				return f, nil
+			}
+		}
+	}
+	return archiveFormats[0], nil
+}
+
+// filename is the download name for an ecosystem's archive in format f
+func (f *archiveFormat) filename(eco *Ecosystem) string {
+	return eco.ArchiveName + f.Extension
+}
+
+// archiveModTime is the modification time of every archive entry. Archives
+// are reproducible: the same installed files always give the same bytes, so
+// identical results share a digest. 1980 is the earliest time zip can hold.
+var archiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveMode normalizes an entry's mode, so the umask the package manager
+// ran with doesn't change the archive: directories and executables get
+// 0755, other files 0644 and symlinks 0777
+func archiveMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
+
+// walkArchive calls fn for every path under srcDir with its slash-separated
+// name under root, in lexical order. Directory names end in "/". For symlinks, link is the
+// target, which must be relative and stay inside srcDir.
+func walkArchive(srcDir, root string, fn func(p, name string, info os.FileInfo, link string) error) error {
+	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		if relPath == ".." || relPath == "." && root == "" {
+			return nil
+		}
+		name := path.Join(root, filepath.ToSlash(relPath))
+		if info.IsDir() {
+			return fn(p, name+"/", info, "")
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = symlinkTarget(srcDir, p); err != nil {
+				return err
+			}
+		}
+		return fn(p, name, info, link)
+	})
+}
+
+// symlinkTarget reads the symlink at p, rejecting links that would point
+// outside srcDir once the archive is extracted
+func symlinkTarget(srcDir, p string) (string, error) {
+	target, err := os.Readlink(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %w", p, err)
+	}
+	resolved := filepath.Join(filepath.Dir(p), target)
+	if filepath.IsAbs(target) || !isWithin(srcDir, resolved) {
+		return "", fmt.Errorf("symlink %s points outside the archived directory: %s", p, target)
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// isWithin reports whether p is dir or lies beneath it
+func isWithin(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeZip streams srcDir to w as a zip archive whose entries live under root.
+// Unix modes are kept, and symlinks are stored as symlink entries rather
+// than followed.
+func writeZip(w io.Writer, srcDir, root string, level int) error {
+	zipWriter := zip.NewWriter(w)
+	method := zip.Store
+	if level != flate.NoCompression {
+		method = zip.Deflate
+		zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+
+	err := walkArchive(srcDir, root, func(p, name string, info os.FileInfo, link string) error {
+		// The header keeps the Unix mode, so executables such as the
+		// scripts in node_modules/.bin stay executable once extracted
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Modified = archiveModTime
+		header.SetMode(archiveMode(info.Mode()))
+		if info.IsDir() {
+			header.Method = zip.Store
+			if _, err := zipWriter.CreateHeader(header); err != nil {
+				return fmt.Errorf("failed to create directory header in zip for %s: %w", name, err)
+			}
+			return nil
+		}
+		if link != "" {
+			header.Method = zip.Store
+			header.UncompressedSize64 = 0
+			linkInZip, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return fmt.Errorf("failed to create symlink entry in zip for %s: %w", name, err)
+			}
+			_, err = io.WriteString(linkInZip, link)
+			return err
+		}
+		// Sockets, FIFOs and devices have no content to archive, and
+		// reading a FIFO would block
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		header.Method = method
+		fileInZip, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("failed to create zip entry for %s: %w", p, err)
+		}
+		return copyFile(fileInZip, p)
+	})
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// writeTarGz streams srcDir to w as a gzipped tar whose entries live under root
+func writeTarGz(w io.Writer, srcDir, root string, level int) error {
+	gzipWriter, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if err := writeTar(gzipWriter, srcDir, root); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// writeTarZst streams srcDir to w as a zstd-compressed tar whose entries live under root
+func writeTarZst(w io.Writer, srcDir, root string, _ int) error {
+	zstdWriter, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)))
+	if err != nil {
+		return err
+	}
+	if err := writeTar(zstdWriter, srcDir, root); err != nil {
+		zstdWriter.Close()
+		return err
+	}
+	return zstdWriter.Close()
+}
+
+// writeTar streams srcDir to w as an uncompressed tar whose entries live
+// under root, preserving file modes and symlinks
+func writeTar(w io.Writer, srcDir, root string) error {
+	tarWriter := tar.NewWriter(w)
+
+	err := walkArchive(srcDir, root, func(p, name string, info os.FileInfo, link string) error {
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		// Don't leak the server's user and group names
+		header.Uname, header.Gname = "", ""
+		header.Uid, header.Gid = 0, 0
+		header.Mode = int64(archiveMode(info.Mode()).Perm())
+		header.ModTime = archiveModTime
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(tarWriter, p)
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// copyFile copies the contents of the file at p to w
+func copyFile(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s for archiving: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to copy file %s to archive: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// pnpmTree lays out a node_modules the way pnpm does: packages live in
+// .pnpm and are linked into place, next to the scripts in .bin
+func pnpmTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "node_modules", ".pnpm", "left-pad@1.3.0", "node_modules", "left-pad")
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pkg, "index.js"), []byte("module.exports = leftPad\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "node_modules", ".bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "left-pad"), []byte("#!/bin/sh\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".pnpm/left-pad@1.3.0/node_modules/left-pad", filepath.Join(dir, "node_modules", "left-pad")); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "node_modules")
+}
+
+// readZip writes srcDir as a zip and returns its entries by name
+func readZip(t *testing.T, srcDir string) map[string]*zip.File {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeZip(&buf, srcDir, "node_modules", flate.DefaultCompression); err != nil {
+		t.Fatalf("writeZip: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	entries := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	return entries
+}
+
+func TestWriteZipBinModes(t *testing.T) {
+	entries := readZip(t, pnpmTree(t))
+	for name, want := range map[string]os.FileMode{
+		"node_modules/.bin/left-pad":                                       0755,
+		"node_modules/.pnpm/left-pad@1.3.0/node_modules/left-pad/index.js": 0644,
+		"node_modules/.bin/":                                               os.ModeDir | 0755,
+	} {
+		f, ok := entries[name]
+		if !ok {
+			t.Errorf("%s missing from zip", name)
+			continue
+		}
+		if got := f.Mode(); got != want {
+			t.Errorf("%s has mode %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestWriteZipSymlinks(t *testing.T) {
+	entries := readZip(t, pnpmTree(t))
+	f, ok := entries["node_modules/left-pad"]
+	if !ok {
+		t.Fatal("node_modules/left-pad missing from zip")
+	}
+	if f.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("node_modules/left-pad has mode %v, want a symlink", f.Mode())
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ".pnpm/left-pad@1.3.0/node_modules/left-pad"; string(target) != want {
+		t.Errorf("node_modules/left-pad points to %q, want %q", target, want)
+	}
+	if _, ok := entries["node_modules/left-pad/index.js"]; ok {
+		t.Error("symlink was followed: node_modules/left-pad/index.js is in the zip")
+	}
+}
+
+func TestWriteZipRejectsOutsideSymlink(t *testing.T) {
+	srcDir := pnpmTree(t)
+	if err := os.Symlink("../../etc", filepath.Join(srcDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeZip(io.Discard, srcDir, "node_modules", flate.DefaultCompression); err == nil {
+		t.Error("writeZip archived a symlink pointing outside the directory")
+	}
+}
+
+func TestWriteZipSkipsFIFOs(t *testing.T) {
+	srcDir := pnpmTree(t)
+	if err := syscall.Mkfifo(filepath.Join(srcDir, "fifo"), 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	entries := readZip(t, srcDir)
+	if _, ok := entries["node_modules/fifo"]; ok {
+		t.Error("writeZip archived a FIFO")
+	}
+	if _, ok := entries["node_modules/.bin/left-pad"]; !ok {
+		t.Error("node_modules/.bin/left-pad missing from zip")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// errArtifactNotFound is returned by ArtifactStore.Open for unknown or expired digests
+var errArtifactNotFound = errors.New("artifact not found")
+
+// digestPattern matches a lowercase hex SHA-256 digest
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// An ArtifactStore keeps built archives addressed by their SHA-256 digest
+type ArtifactStore interface {
+	// Create starts a new artifact; nothing is visible until it is committed
+	Create() (ArtifactWriter, error)
+	// Open returns the artifact with the given digest
+	Open(digest string) (*Artifact, error)
+	// Expire removes artifacts last written before cutoff
+	Expire(cutoff time.Time) error
+}
+
+// An ArtifactWriter receives the bytes of one artifact
+type ArtifactWriter interface {
+	io.Writer
+	// Commit stores the artifact and returns its digest
+	Commit(meta ArtifactMeta) (string, error)
+	// Abort discards the partially written artifact
+	Abort()
+}
+
+// ArtifactMeta describes how an artifact should be served
+type ArtifactMeta struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	// SkippedScripts lists the packages whose install scripts were skipped
+	SkippedScripts []string `json:"skipped_scripts,omitempty"`
+	// PrunedBytes is how much the prune option removed
+	PrunedBytes int64 `json:"pruned_bytes,omitempty"`
+	// Packages lists the installed packages, to describe them in an SBOM
+	Packages []Package `json:"packages,omitempty"`
+	// Report is the install report, served at /artifacts/{digest}/report
+	Report *InstallReport `json:"report,omitempty"`
+}
+
+// An Artifact is an open stored archive
+type Artifact struct {
+	io.ReadSeekCloser
+	ArtifactMeta
+	Digest  string
+	Size    int64
+	ModTime time.Time
+}
+
+// diskStore is an ArtifactStore backed by a local directory. Each artifact is
+// stored as <digest> with its metadata alongside in <digest>.json.
+type diskStore struct {
+	dir string
+}
+
+func newDiskStore(dir string) (*diskStore, error) {
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "pip_artifacts_"); err != nil {
+			return nil, fmt.Errorf("failed to create artifact directory: %v", err)
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %v", err)
+	}
+	return &diskStore{dir: dir}, nil
+}
+
+func (s *diskStore) Create() (ArtifactWriter, error) {
+	f, err := os.CreateTemp(s.dir, ".upload_")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create artifact: %v", err)
+	}
+	return &diskWriter{store: s, f: f, hash: sha256.New()}, nil
+}
+
+func (s *diskStore) Open(digest string) (*Artifact, error) {
+	if !digestPattern.MatchString(digest) {
+		return nil, errArtifactNotFound
+	}
+	metaBytes, err := os.ReadFile(filepath.Join(s.dir, digest+".json"))
+	if err != nil {
+		return nil, errArtifactNotFound
+	}
+	var meta ArtifactMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, fmt.Errorf("corrupt metadata for artifact %s: %v", digest, err)
+	}
+	f, err := os.Open(filepath.Join(s.dir, digest))
+	if err != nil {
+		return nil, errArtifactNotFound
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Artifact{
+		ReadSeekCloser: f,
+		ArtifactMeta:   meta,
+		Digest:         digest,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+	}, nil
+}
+
+func (s *diskStore) Expire(cutoff time.Time) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !digestPattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		p := filepath.Join(s.dir, entry.Name())
+		os.Remove(p + ".json")
+		os.Remove(p)
+		slog.Info("expired artifact", "digest", entry.Name())
+	}
+	return nil
+}
+
+type diskWriter struct {
+	store *diskStore
+	f     *os.File
+	hash  hash.Hash
+}
+
+func (w *diskWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	return w.f.Write(p)
+}
+
+func (w *diskWriter) Commit(meta ArtifactMeta) (string, error) {
+	defer os.Remove(w.f.Name())
+	if err := w.f.Close(); err != nil {
+		return "", fmt.Errorf("Failed to write artifact: %v", err)
+	}
+	digest := hex.EncodeToString(w.hash.Sum(nil))
+	p := filepath.Join(w.store.dir, digest)
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p+".json", metaBytes, 0644); err != nil {
+		return "", fmt.Errorf("Failed to write artifact metadata: %v", err)
+	}
+	// An identical artifact may already exist; renaming over it refreshes its TTL
+	if err := os.Rename(w.f.Name(), p); err != nil {
+		return "", fmt.Errorf("Failed to store artifact: %v", err)
+	}
+	return digest, nil
+}
+
+func (w *diskWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// expireArtifacts periodically removes artifacts older than ttl
+func expireArtifacts(store ArtifactStore, ttl time.Duration) {
+	for range time.Tick(time.Minute) {
+		if err := store.Expire(time.Now().Add(-ttl)); err != nil {
+			slog.Error("failed to expire artifacts", "error", err)
+		}
+	}
+}
+
+// digestHeader carries an artifact's SHA-256 in responses. Streamed installs
+// send it as a trailer, since the digest is only known once the archive has
+// been written.
+const digestHeader = "X-Artifact-Digest"
+
+// artifactURL is the path an artifact is served from
+func artifactURL(digest string) string {
+	return "/artifacts/" + digest
+}
+
+// serveArtifact streams an artifact with its stored content type and filename
+func serveArtifact(w http.ResponseWriter, r *http.Request, store ArtifactStore, digest string) {
+	artifact, err := store.Open(digest)
+	if errors.Is(err, errArtifactNotFound) {
+		writeError(w, "Artifact not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("failed to open artifact", "digest", digest, "error", err)
+		writeError(w, "Failed to open artifact", http.StatusInternalServerError)
+		return
+	}
+	defer artifact.Close()
+	writeArtifact(w, r, artifact)
+}
+
+// openArtifactMeta reads the metadata of the artifact with the given digest,
+// writing the error response if it can't
+func openArtifactMeta(w http.ResponseWriter, r *http.Request, store ArtifactStore, digest string) (*Artifact, bool) {
+	artifact, err := store.Open(digest)
+	if errors.Is(err, errArtifactNotFound) {
+		writeError(w, "Artifact not found or expired", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		loggerFrom(r.Context()).Error("failed to open artifact", "digest", digest, "error", err)
+		writeError(w, "Failed to open artifact", http.StatusInternalServerError)
+		return nil, false
+	}
+	artifact.Close()
+	return artifact, true
+}
+
+// writeArtifact streams an open artifact as the response body. Downloads with
+// GET can be resumed with Range requests, and revalidated against the
+// artifact's digest as its ETag.
+func writeArtifact(w http.ResponseWriter, r *http.Request, artifact *Artifact) {
+	w.Header().Set("Content-Type", artifact.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", artifact.Filename))
+	w.Header().Set(digestHeader, artifact.Digest)
+	setSkippedScripts(w, artifact.SkippedScripts)
+	setPrunedBytes(w, artifact.PrunedBytes)
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		w.Header().Set("ETag", `"`+artifact.Digest+`"`)
+		http.ServeContent(w, r, artifact.Filename, artifact.ModTime, artifact)
+		return
+	}
+	// Installs answer POSTs, whose ETag describes their inputs instead
+	w.Header().Set("Content-Length", fmt.Sprint(artifact.Size))
+	if _, err := io.Copy(w, artifact); err != nil {
+		loggerFrom(r.Context()).Warn("failed to stream artifact", "digest", artifact.Digest, "error", err)
+	}
+}
+
+// artifactHandler serves GET /artifacts/{sha}
+func artifactHandler(store ArtifactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveArtifact(w, r, store, strings.ToLower(r.PathValue("sha")))
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// An Auditor runs an ecosystem's vulnerability scanner over an install
+type Auditor struct {
+	// Tool is the scanner's executable
+	Tool string
+	// Args builds its command line; outputDir is the installed directory
+	// relative to the workspace
+	Args func(outputDir string) []string
+	// Parse reads the advisories from the scanner's standard output
+	Parse func(out []byte) ([]Advisory, error)
+	// Fix, if set, runs Tool to upgrade vulnerable dependencies
+	Fix *AuditFixer
+}
+
+// An AuditFixer rewrites a project's manifests so vulnerable dependencies
+// resolve to patched versions
+type AuditFixer struct {
+	Args []string
+	// Files are the manifests the fix may change. Those the ecosystem doesn't
+	// require are lock files, which are unfrozen for the install that
+	// applies the fix.
+	Files []string
+}
+
+// An Advisory is one known vulnerability affecting an installed package
+type Advisory struct {
+	ID      string `json:"id"`
+	Package string `json:"package"`
+	// Versions lists the installed versions of the package it affects
+	Versions []string `json:"versions,omitempty"`
+	// Severity is critical, high, moderate, low, info or unknown
+	Severity           string `json:"severity"`
+	Title              string `json:"title"`
+	URL                string `json:"url,omitempty"`
+	VulnerableVersions string `json:"vulnerable_versions,omitempty"`
+	PatchedVersions    string `json:"patched_versions,omitempty"`
+}
+
+// An AuditReport lists the advisories found by an audit
+type AuditReport struct {
+	Ecosystem  string     `json:"ecosystem"`
+	Advisories []Advisory `json:"advisories"`
+	// Counts is the number of advisories of each severity
+	Counts map[string]int `json:"counts"`
+	// Fixed lists the advisories an audit fix resolved
+	Fixed []Advisory `json:"fixed,omitempty"`
+	// Files holds the manifests an audit fix changed, by name
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// auditHandler returns the POST /audit/<name> handler for an ecosystem
+func (in *Installer) auditHandler(eco *Ecosystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in.handleAudit(w, r, eco)
+	}
+}
+
+// handleAudit installs the request's manifests like /install/<name>, then
+// responds with the scanner's findings instead of the installed packages.
+// Results are not cached, as advisory databases change.
+func (in *Installer) handleAudit(w http.ResponseWriter, r *http.Request, eco *Ecosystem) {
+	req, err := decodeRequest(r, eco)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if req.Options.CallbackURL != "" {
+		writeError(w, "callback_url is only supported for asynchronous jobs", http.StatusBadRequest)
+		return
+	}
+	logger := loggerFrom(r.Context()).With("ecosystem", eco.Name)
+	ctx := withLogger(r.Context(), logger)
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if err := checkAuditTool(eco); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	done, ok := in.admit(ctx, w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	defer removeWorkspace(tmpDir)
+	outputDir, err := runInstall(ctx, eco, req, tmpDir, nil)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	report, err := runAudit(ctx, eco, req, tmpDir, outputDir)
+	if err == nil && req.Options.AuditFix {
+		report, err = runAuditFix(ctx, eco, req, tmpDir, report)
+	}
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	logger.Info("audit completed", "advisories", len(report.Advisories), "fixed", len(report.Fixed))
+	writeJSON(w, http.StatusOK, report)
+}
+
+// checkAuditTool reports whether eco's scanner is installed. Containers are
+// expected to ship it in their image.
+func checkAuditTool(eco *Ecosystem) error {
+	if _, isDocker := installExecutor.(*dockerExecutor); isDocker {
+		return nil
+	}
+	if _, err := exec.LookPath(eco.Audit.Tool); err != nil {
+		return &statusError{status: http.StatusNotImplemented, err: fmt.Errorf("%s is not installed on this server", eco.Audit.Tool)}
+	}
+	return nil
+}
+
+// runAudit scans an install in workDir. Scanners exit with an error when they
+// find vulnerabilities, so that only fails the audit if the output can't be
+// read.
+func runAudit(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir, outputDir string) (report *AuditReport, err error) {
+	ctx, span := tracer.Start(ctx, eco.Name+" audit", trace.WithAttributes(ecosystemAttr(eco)))
+	defer func() { endSpan(span, err) }()
+
+	rel, err := filepath.Rel(workDir, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = runTool(ctx, eco, req, workDir, toolRun{step: "audit", tool: eco.Audit.Tool, args: eco.Audit.Args(rel), stdout: &out})
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	advisories, parseErr := eco.Audit.Parse(out.Bytes())
+	if parseErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Failed to read %s output: %v", eco.Audit.Tool, parseErr)
+	}
+	return newAuditReport(eco, advisories), nil
+}
+
+// runAuditFix applies the audit fix to an audited install, installs again
+// with the changed manifests and audits the result. The new report lists
+// what the fix resolved and the manifests it changed.
+func runAuditFix(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string, before *AuditReport) (*AuditReport, error) {
+	fix := eco.Audit.Fix
+	if err := runTool(ctx, eco, req, workDir, toolRun{step: "audit fix", tool: eco.Audit.Tool, args: fix.Args}); err != nil {
+		return nil, err
+	}
+
+	fixed := &InstallRequest{Files: make(map[string]string), Options: req.Options, Format: req.Format}
+	for name, content := range req.Files {
+		fixed.Files[name] = content
+	}
+	for _, name := range fix.Files {
+		if !slices.ContainsFunc(eco.Files, func(mf ManifestFile) bool { return mf.Name == name && mf.Required }) {
+			delete(fixed.Files, name)
+		}
+	}
+	outputDir, err := runInstall(ctx, eco, fixed, workDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	after, err := runAudit(ctx, eco, req, workDir, outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, adv := range before.Advisories {
+		if !slices.ContainsFunc(after.Advisories, func(a Advisory) bool { return a.ID == adv.ID }) {
+			after.Fixed = append(after.Fixed, adv)
+		}
+	}
+	for _, name := range fix.Files {
+		content, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil || string(content) == req.Files[name] {
+			continue
+		}
+		if after.Files == nil {
+			after.Files = make(map[string]string)
+		}
+		after.Files[name] = string(content)
+	}
+	return after, nil
+}
+
+// severityOrder ranks severities from most to least severe
+var severityOrder = []string{"critical", "high", "moderate", "low", "info", "unknown"}
+
+func severityRank(severity string) int {
+	for i, s := range severityOrder {
+		if s == severity {
+			return i
+		}
+	}
+	return len(severityOrder) - 1
+}
+
+// newAuditReport sorts advisories by severity, package and ID and counts them
+func newAuditReport(eco *Ecosystem, advisories []Advisory) *AuditReport {
+	sort.SliceStable(advisories, func(i, j int) bool {
+		a, b := advisories[i], advisories[j]
+		if ra, rb := severityRank(a.Severity), severityRank(b.Severity); ra != rb {
+			return ra < rb
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.ID < b.ID
+	})
+	report := &AuditReport{Ecosystem: eco.Name, Advisories: advisories, Counts: make(map[string]int)}
+	if report.Advisories == nil {
+		report.Advisories = []Advisory{}
+	}
+	for _, a := range advisories {
+		report.Counts[a.Severity]++
+	}
+	return report
+}
+
+// npmAdvisory is an advisory in the npm audit format that yarn 1 and pnpm
+// report
+type npmAdvisory struct {
+	ID                 json.Number `json:"id"`
+	GitHubAdvisoryID   string      `json:"github_advisory_id"`
+	ModuleName         string      `json:"module_name"`
+	Severity           string      `json:"severity"`
+	Title              string      `json:"title"`
+	URL                string      `json:"url"`
+	VulnerableVersions string      `json:"vulnerable_versions"`
+	PatchedVersions    string      `json:"patched_versions"`
+	Findings           []struct {
+		Version string `json:"version"`
+	} `json:"findings"`
+}
+
+func (a npmAdvisory) advisory() Advisory {
+	adv := Advisory{
+		ID:                 a.ID.String(),
+		Package:            a.ModuleName,
+		Severity:           a.Severity,
+		Title:              a.Title,
+		URL:                a.URL,
+		VulnerableVersions: a.VulnerableVersions,
+		PatchedVersions:    a.PatchedVersions,
+	}
+	if a.GitHubAdvisoryID != "" {
+		adv.ID = a.GitHubAdvisoryID
+	}
+	for _, f := range a.Findings {
+		if f.Version != "" && !slices.Contains(adv.Versions, f.Version) {
+			adv.Versions = append(adv.Versions, f.Version)
+		}
+	}
+	return adv
+}
+
+// parseNpmAudit reads pnpm audit --json output
+func parseNpmAudit(out []byte) ([]Advisory, error) {
+	var report struct {
+		Advisories map[string]npmAdvisory `json:"advisories"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, err
+	}
+	var advisories []Advisory
+	for _, a := range report.Advisories {
+		advisories = append(advisories, a.advisory())
+	}
+	return advisories, nil
+}
+
+// parseYarnAudit reads yarn audit --json output, a stream of JSON events with
+// one auditAdvisory event per vulnerable dependency path
+func parseYarnAudit(out []byte) ([]Advisory, error) {
+	byID := make(map[string]*Advisory)
+	var order []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var event struct {
+			Type string `json:"type"`
+			Data struct {
+				Advisory npmAdvisory `json:"advisory"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		if event.Type != "auditAdvisory" {
+			continue
+		}
+		adv := event.Data.Advisory.advisory()
+		if seen := byID[adv.ID]; seen != nil {
+			for _, v := range adv.Versions {
+				if !slices.Contains(seen.Versions, v) {
+					seen.Versions = append(seen.Versions, v)
+				}
+			}
+			continue
+		}
+		byID[adv.ID] = &adv
+		order = append(order, adv.ID)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	advisories := make([]Advisory, len(order))
+	for i, id := range order {
+		advisories[i] = *byID[id]
+	}
+	return advisories, nil
+}
+
+// parsePipAudit reads pip-audit --format json output. pip-audit doesn't
+// report severities.
+func parsePipAudit(out []byte) ([]Advisory, error) {
+	var report struct {
+		Dependencies []struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Vulns   []struct {
+				ID          string   `json:"id"`
+				FixVersions []string `json:"fix_versions"`
+				Description string   `json:"description"`
+			} `json:"vulns"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, err
+	}
+	var advisories []Advisory
+	for _, dep := range report.Dependencies {
+		for _, v := range dep.Vulns {
+			title, _, _ := strings.Cut(strings.TrimSpace(v.Description), "\n")
+			advisories = append(advisories, Advisory{
+				ID:              v.ID,
+				Package:         dep.Name,
+				Versions:        []string{dep.Version},
+				Severity:        "unknown",
+				Title:           title,
+				URL:             "https://osv.dev/vulnerability/" + v.ID,
+				PatchedVersions: strings.Join(v.FixVersions, ", "),
+			})
+		}
+	}
+	return advisories, nil
+}
+
+// pipAuditor scans a pip or Poetry install's site-packages with pip-audit
+var pipAuditor = &Auditor{
+	Tool: "pip-audit",
+	Args: func(outputDir string) []string {
+		return []string{"--path", outputDir, "--format", "json", "--progress-spinner", "off"}
+	},
+	Parse: parsePipAudit,
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog records every install, who asked for it and what it installed,
+// set up from the audit_log setting; nil when unset
+var auditLog *auditTrail
+
+// maxAuditRecord caps the length of a line read back from the audit log
+const maxAuditRecord = 64 << 20
+
+var auditWriteFailures = newCounterVec("pip_install_audit_write_failures_total",
+	"Install records that couldn't be written to the audit log.")
+
+// An AuditRecord is one install in the audit log
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// RequestID is set for installs answered synchronously and JobID for jobs
+	RequestID string `json:"request_id,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	// Caller is the API key label or, as sub:<subject>, the JWT subject
+	Caller    string `json:"caller,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	Ecosystem string `json:"ecosystem"`
+	// InputHash is the hash of the install's inputs the result cache is
+	// keyed on, and Files the SHA-256 of each manifest sent
+	InputHash string            `json:"input_sha256"`
+	Files     map[string]string `json:"files"`
+	// Options are the install options, with credentials in URLs removed
+	Options InstallOptions `json:"options"`
+	// Outcome is succeeded, cached or failed
+	Outcome         string  `json:"outcome"`
+	Status          int     `json:"status,omitempty"`
+	ErrorCode       string  `json:"error_code,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	ArtifactDigest  string  `json:"artifact_sha256,omitempty"`
+	// Packages are the packages the install resolved, for those that
+	// succeeded
+	Packages []Package `json:"packages,omitempty"`
+}
+
+// An auditTrail appends AuditRecords to a file, one JSON object per line.
+// The file is only ever appended to.
+type auditTrail struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAuditLog(path string) (*auditTrail, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditTrail{path: path, f: f}, nil
+}
+
+// newAuditRecord starts the record of an install by the given caller
+func newAuditRecord(ecosystem string, req *InstallRequest, key string, p Principal) AuditRecord {
+	rec := AuditRecord{
+		Caller:    usageCaller(p),
+		Tenant:    p.Tenant,
+		Ecosystem: ecosystem,
+		InputHash: key,
+		Files:     make(map[string]string, len(req.Files)),
+		Options:   req.Options,
+	}
+	for name, content := range req.Files {
+		sum := sha256.Sum256([]byte(content))
+		rec.Files[name] = hex.EncodeToString(sum[:])
+	}
+	rec.Options.Registry = withoutCredentials(rec.Options.Registry)
+	rec.Options.CallbackURL = withoutCredentials(rec.Options.CallbackURL)
+	return rec
+}
+
+// withoutCredentials removes the user info and query from a URL
+func withoutCredentials(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil && u.RawQuery == "" {
+		return raw
+	}
+	u.User, u.RawQuery = nil, ""
+	return u.String()
+}
+
+// write appends a record, adding the packages of the artifact it names.
+// Failures are logged and counted rather than failing the install. Nil
+// trails write nothing.
+func (a *auditTrail) write(rec AuditRecord, store ArtifactStore) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if rec.ArtifactDigest != "" {
+		if artifact, err := store.Open(rec.ArtifactDigest); err == nil {
+			artifact.Close()
+			rec.Packages = artifact.Packages
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err == nil {
+		a.mu.Lock()
+		_, err = a.f.Write(append(line, '\n'))
+		a.mu.Unlock()
+	}
+	if err != nil {
+		auditWriteFailures.inc()
+		slog.Error("failed to write audit record", "path", a.path, "error", err)
+	}
+}
+
+// recordInstall writes the record of an install answered synchronously once
+// its response, recorded by w, has been written
+func (a *auditTrail) recordInstall(rec AuditRecord, w *statusRecorder, start time.Time, store ArtifactStore) {
+	rec.RequestID = w.Header().Get(requestIDHeader)
+	rec.Status = w.status
+	rec.DurationSeconds = time.Since(start).Seconds()
+	rec.ArtifactDigest = w.Header().Get(digestHeader)
+	switch {
+	case rec.ArtifactDigest == "":
+		rec.Outcome = string(JobFailed)
+	case w.Header().Get("X-Cache") == "HIT":
+		rec.Outcome = "cached"
+	default:
+		rec.Outcome = string(JobSucceeded)
+	}
+	a.write(rec, store)
+}
+
+// recordJob writes the record of a finished job
+func (a *auditTrail) recordJob(job Job, req *InstallRequest, store ArtifactStore) {
+	if a == nil || req == nil {
+		return
+	}
+	var p Principal
+	if job.Owner != nil {
+		p = *job.Owner
+	}
+	rec := newAuditRecord(job.Ecosystem, req, job.cacheKey, p)
+	rec.JobID = job.ID
+	rec.Outcome = string(job.Status)
+	if job.Cached {
+		rec.Outcome = "cached"
+	}
+	rec.Status, rec.ErrorCode, rec.Error = job.errorStatus, job.ErrorCode, job.Error
+	rec.DurationSeconds = job.FinishedAt.Sub(job.CreatedAt).Seconds()
+	rec.ArtifactDigest = job.ArtifactDigest
+	a.write(rec, store)
+}
+
+// An auditQuery selects records from the audit log
+type auditQuery struct {
+	from, to                           time.Time
+	caller, tenant, ecosystem, outcome string
+	packageName, packageVersion        string
+	limit                              int
+}
+
+func parseAuditQuery(r *http.Request) (auditQuery, error) {
+	v := r.URL.Query()
+	q := auditQuery{caller: v.Get("caller"), tenant: v.Get("tenant"), ecosystem: v.Get("ecosystem"), outcome: v.Get("outcome")}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.from, err = parseUsageTime("from", s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.to, err = parseUsageTime("to", s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit < 1 {
+			return q, badRequest("limit must be a positive number")
+		}
+	}
+	// A version follows the last @, which may also start a scoped name
+	q.packageName = v.Get("package")
+	if i := strings.LastIndex(q.packageName, "@"); i > 0 {
+		q.packageName, q.packageVersion = q.packageName[:i], q.packageName[i+1:]
+	}
+	return q, nil
+}
+
+func (q auditQuery) matches(rec AuditRecord) bool {
+	switch {
+	case !q.from.IsZero() && rec.Time.Before(q.from),
+		!q.to.IsZero() && !rec.Time.Before(q.to),
+		q.caller != "" && rec.Caller != q.caller,
+		q.tenant != "" && rec.Tenant != q.tenant,
+		q.ecosystem != "" && rec.Ecosystem != q.ecosystem,
+		q.outcome != "" && rec.Outcome != q.outcome:
+		return false
+	}
+	if q.packageName == "" {
+		return true
+	}
+	for _, pkg := range rec.Packages {
+		if strings.EqualFold(pkg.Name, q.packageName) && (q.packageVersion == "" || pkg.Version == q.packageVersion) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleQuery serves GET /admin/audit, the audit records matching the
+// query as JSON lines, oldest first
+func (a *auditTrail) handleQuery(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to read audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxAuditRecord)
+	for n := 0; sc.Scan() && (q.limit == 0 || n < q.limit); {
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || !q.matches(rec) {
+			continue
+		}
+		w.Write(append(sc.Bytes(), '\n'))
+		n++
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, r.Context().Err()) {
+		loggerFrom(r.Context()).Error("failed to read audit log", "path", a.path, "error", err)
+	}
+}
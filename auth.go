@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	authenticatedRequests = newCounterVec("pip_install_authenticated_requests_total",
+		"Requests accepted, by API key label (oidc for JWTs).", "key")
+	authFailures = newCounterVec("pip_install_auth_failures_total",
+		"Requests rejected for a missing or invalid API key or JWT.")
+)
+
+// An apiKey is one accepted bearer token. Only its hash is kept in memory.
+type apiKey struct {
+	label string
+	hash  [sha256.Size]byte
+}
+
+// An authenticator checks bearer tokens against the configured API keys and,
+// when an OIDC issuer is configured, validates them as JWTs. With neither
+// configured every request is allowed.
+type authenticator struct {
+	keys []apiKey
+	oidc *oidcVerifier
+}
+
+// A Principal is the authenticated caller of a request. It is recorded on
+// the jobs they submit for auditing.
+type Principal struct {
+	// KeyLabel names the API key that was presented
+	KeyLabel string `json:"key,omitempty"`
+	// Subject and Org are the sub and organisation claims of a JWT
+	Subject string `json:"sub,omitempty"`
+	Org     string `json:"org,omitempty"`
+	// Tenant is the tenant the caller belongs to, when tenants are set up
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// logAttrs returns the principal's identity as log attributes
+func (p Principal) logAttrs() []any {
+	attrs := []any{"subject", p.Subject, "org", p.Org}
+	if p.KeyLabel != "" {
+		attrs = []any{"api_key", p.KeyLabel}
+	}
+	if p.Tenant != "" {
+		attrs = append(attrs, "tenant", p.Tenant)
+	}
+	return attrs
+}
+
+type principalKey struct{}
+
+// withPrincipal stores the caller in ctx
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller stored in ctx by the auth middleware
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// loadAPIKeys reads label:key pairs from the comma-separated API_KEYS value
+// and from keysFile, which holds one pair per line and may contain blank
+// lines and # comments
+func loadAPIKeys(env, keysFile string) (*authenticator, error) {
+	a := &authenticator{}
+	for _, entry := range strings.Split(env, ",") {
+		if err := a.add(entry); err != nil {
+			return nil, fmt.Errorf("API_KEYS: %v", err)
+		}
+	}
+	if keysFile == "" {
+		return a, nil
+	}
+	f, err := os.Open(keysFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(text), "#") {
+			continue
+		}
+		if err := a.add(text); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", keysFile, line, err)
+		}
+	}
+	return a, scanner.Err()
+}
+
+// add parses one label:key entry, ignoring empty ones
+func (a *authenticator) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+	label, key, ok := strings.Cut(entry, ":")
+	label, key = strings.TrimSpace(label), strings.TrimSpace(key)
+	if !ok || label == "" || key == "" {
+		return fmt.Errorf("expected label:key, got %q", entry)
+	}
+	a.keys = append(a.keys, apiKey{label: label, hash: sha256.Sum256([]byte(key))})
+	return nil
+}
+
+// enabled reports whether any keys or an OIDC issuer are configured
+func (a *authenticator) enabled() bool {
+	return len(a.keys) > 0 || a.oidc != nil
+}
+
+// lookup returns the label of the key matching token. Every key is compared
+// so the time taken doesn't reveal which one matched.
+func (a *authenticator) lookup(token string) (string, bool) {
+	hash := sha256.Sum256([]byte(token))
+	var label string
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			label = k.label
+		}
+	}
+	return label, label != ""
+}
+
+// authenticate returns the caller identified by token, trying the API keys
+// first and then, if configured, validating it as a JWT
+func (a *authenticator) authenticate(ctx context.Context, token string) (Principal, error) {
+	if label, ok := a.lookup(token); ok {
+		return Principal{KeyLabel: label}, nil
+	}
+	if a.oidc != nil && strings.Count(token, ".") == 2 {
+		return a.oidc.verify(ctx, token)
+	}
+	return Principal{}, fmt.Errorf("unknown API key")
+}
+
+// require rejects requests without a valid Authorization: Bearer <token>
+// header with 401
+func (a *authenticator) require(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := bearerToken(r)
+		ctx, err := a.admit(r.Context(), token)
+		if err != nil {
+			a.reject(w, r, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// admit authenticates a bearer token, recording the caller in the returned
+// context, logs and metrics
+func (a *authenticator) admit(ctx context.Context, token string) (context.Context, error) {
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	p, err := a.authenticate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if tenants != nil {
+		p.Tenant = tenants.resolve(p)
+	}
+	if p.KeyLabel != "" {
+		authenticatedRequests.inc(p.KeyLabel)
+	} else {
+		authenticatedRequests.inc("oidc")
+	}
+	ctx = withPrincipal(ctx, p)
+	ctx = withLogger(ctx, loggerFrom(ctx).With(p.logAttrs()...))
+	annotateRequest(ctx, p.logAttrs()...)
+	return ctx, nil
+}
+
+func (a *authenticator) reject(w http.ResponseWriter, r *http.Request, reason string) {
+	authFailures.inc()
+	loggerFrom(r.Context()).Warn("rejected unauthenticated request", "path", r.URL.Path, "reason", reason)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="pip-install"`)
+	writeError(w, "Missing or invalid credentials", http.StatusUnauthorized)
+}
+
+// bearerToken extracts the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer extracts the token from an Authorization value
+func parseBearer(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
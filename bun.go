@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// Accept package.json and optional bun.lockb or bun.lock
+// When a lock file is present the install is frozen to it
+// The output is a zip of the installed node_modules
+var bunEcosystem = &Ecosystem{
+	Name: "bun",
+	Tool: "bun",
+	// The packages are Node.js packages, whose install scripts and native
+	// builds run on node
+	Runtime:  "node",
+	Registry: "https://registry.npmjs.org/",
+	Image:    "oven/bun:1.1.38-slim",
+	Files: []ManifestFile{
+		{Name: "package.json", Required: true},
+		// bun.lockb is binary; bun 1.2 writes the text bun.lock instead
+		{Name: "bun.lockb", Base64: true},
+		{Name: "bun.lock"},
+		{Name: ".npmrc", Secret: true},
+	},
+	// Files are copied out of the cache rather than hard-linked, so a
+	// package script can't change what later installs get
+	Args: func(files map[string]string) []string {
+		args := []string{"install", "--no-progress", "--backend=copyfile"}
+		if files["bun.lockb"] != "" || files["bun.lock"] != "" {
+			args = append(args, "--frozen-lockfile")
+		}
+		return args
+	},
+	RegistryArgs: func(registry string) []string {
+		return []string{"--registry=" + registry}
+	},
+	FileRegistries: npmRegistries,
+	OmitArgs: map[string][]string{
+		"dev":      {"--production"},
+		"optional": {"--omit=optional"},
+		"peer":     {"--omit=peer"},
+	},
+	NoScriptsArgs: []string{"--ignore-scripts"},
+	CacheEnv:      func(dir string) []string { return []string{"BUN_INSTALL_CACHE_DIR=" + dir} },
+	// Each package is unpacked into a directory such as lodash@4.17.21@@@1
+	CacheEntry:     leadingDirs(1),
+	ScriptPackages: npmScriptPackages,
+	Packages:       npmPackages,
+	FromPackages:   npmFromPackages,
+	LockedPackages: bunLockedPackages,
+	Overrides:      bunOverrides,
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "node_modules"), nil
+	},
+	ArchiveRoot: "node_modules",
+	ArchiveName: "node_modules",
+}
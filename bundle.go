@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// BundleOptions are the esbuild settings of a POST /bundle
+type BundleOptions struct {
+	// EntryPoints are the project files bundled, each into its own output
+	EntryPoints []string `json:"entry_points"`
+	// Platform is node (the default), browser or neutral
+	Platform string `json:"platform,omitempty"`
+	// Target lists the environments the output must run on, such as
+	// "node20" or "es2020"
+	Target []string `json:"target,omitempty"`
+	// Format is cjs, esm or iife (default esbuild's choice for the platform)
+	Format    string `json:"format,omitempty"`
+	Minify    bool   `json:"minify,omitempty"`
+	Sourcemap bool   `json:"sourcemap,omitempty"`
+	// External lists packages left out of the bundle to be loaded at run time
+	External []string `json:"external,omitempty"`
+}
+
+var (
+	bundlePlatforms = []string{"node", "browser", "neutral"}
+	bundleFormats   = []string{"cjs", "esm", "iife"}
+	// bundleTargetPattern matches esbuild targets such as node20 or es2020
+	bundleTargetPattern = regexp.MustCompile(`^[a-z]+[0-9][0-9.]*$|^esnext$`)
+)
+
+// bundleDir is the directory in the workspace esbuild writes to, which is
+// what the archive holds
+const bundleDir = ".bundle"
+
+// esbuildPath is where the project's esbuild is installed. It runs under the
+// install executor like the package manager, so it comes from the project's
+// own dependencies rather than the server.
+const esbuildPath = "node_modules/.bin/esbuild"
+
+// validate checks the bundle option against the request's files
+func (b *BundleOptions) validate(files map[string]string) error {
+	if len(b.EntryPoints) == 0 {
+		return badRequest("Invalid bundle: entry_points must list at least one file")
+	}
+	for _, entry := range b.EntryPoints {
+		if p, err := projectPath(entry); err != nil || p != entry {
+			return badRequest("Invalid bundle entry point %q: must be a path in the project", entry)
+		}
+		if _, ok := files[entry]; !ok {
+			return badRequest("Invalid bundle entry point %q: the project has no such file", entry)
+		}
+	}
+	if b.Platform != "" && !slices.Contains(bundlePlatforms, b.Platform) {
+		return badRequest("Invalid bundle platform %q: must be one of %s", b.Platform, strings.Join(bundlePlatforms, ", "))
+	}
+	if b.Format != "" && !slices.Contains(bundleFormats, b.Format) {
+		return badRequest("Invalid bundle format %q: must be one of %s", b.Format, strings.Join(bundleFormats, ", "))
+	}
+	for _, target := range b.Target {
+		if !bundleTargetPattern.MatchString(target) {
+			return badRequest("Invalid bundle target %q: must be an esbuild target such as \"node20\" or \"es2020\"", target)
+		}
+	}
+	for _, name := range b.External {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return badRequest("Invalid bundle external %q: must be a package name or path pattern", name)
+		}
+	}
+	return nil
+}
+
+// args returns esbuild's command line
+func (b *BundleOptions) args() []string {
+	platform := b.Platform
+	if platform == "" {
+		platform = "node"
+	}
+	args := append(b.EntryPoints[:len(b.EntryPoints):len(b.EntryPoints)],
+		"--bundle", "--outdir="+bundleDir, "--platform="+platform, "--log-level=warning")
+	if len(b.Target) > 0 {
+		args = append(args, "--target="+strings.Join(b.Target, ","))
+	}
+	if b.Format != "" {
+		args = append(args, "--format="+b.Format)
+	}
+	if b.Minify {
+		args = append(args, "--minify")
+	}
+	if b.Sourcemap {
+		args = append(args, "--sourcemap")
+	}
+	for _, name := range b.External {
+		args = append(args, "--external:"+name)
+	}
+	return args
+}
+
+// handleBundle serves POST /bundle?ecosystem=<yarn|pnpm>: the project's
+// dependencies are installed as for /install/<name>, then esbuild bundles
+// the bundle option's entry points and the archive holds its output instead
+// of node_modules. Bundles aren't cached, as they are built from the
+// project's sources.
+func (in *Installer) handleBundle(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("ecosystem")
+	if name == "" {
+		name = packagesEcosystem.Name
+	}
+	eco := findEcosystem(name)
+	if eco == nil || eco.Runtime != "node" {
+		writeError(w, fmt.Sprintf("Invalid ecosystem %q: bundles are built with yarn, pnpm or bun", name), http.StatusBadRequest)
+		return
+	}
+	req, err := decodeRequest(r, eco)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	bundle := req.Options.Bundle
+	if bundle == nil {
+		writeError(w, "Missing bundle option: /bundle needs the entry_points to build", http.StatusBadRequest)
+		return
+	}
+	if err := bundle.validate(req.Files); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	opts := req.Options
+	if opts.CallbackURL != "" || opts.Output != nil || opts.AuditFix || len(opts.Include) > 0 || opts.SBOM != "" || opts.LicenseReport || opts.Report || len(opts.Targets) > 0 || opts.DryRun {
+		writeError(w, "callback_url, output, audit_fix, include, sbom, license_report, report, targets and dry_run are not supported by /bundle", http.StatusBadRequest)
+		return
+	}
+
+	logger := loggerFrom(r.Context()).With("ecosystem", eco.Name)
+	ctx := withLogger(r.Context(), logger)
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	done, ok := in.admit(ctx, w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	defer removeWorkspace(tmpDir)
+	outputDir, err := runInstall(ctx, eco, req, tmpDir, nil)
+	if err == nil {
+		err = gateInstall(ctx, eco, req, tmpDir, outputDir)
+	}
+	if err == nil && len(req.Options.DenyLicenses) > 0 {
+		var pkgs []Package
+		if pkgs, err = installedPackages(eco, outputDir); err == nil {
+			err = checkLicenses(req, pkgs)
+		}
+	}
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, esbuildPath)); err != nil {
+		writeError(w, "esbuild is not installed: add it to the project's devDependencies", http.StatusBadRequest)
+		return
+	}
+	tool := filepath.Join(installExecutor.workPath(tmpDir), esbuildPath)
+	if err := runTool(ctx, eco, req, tmpDir, toolRun{step: "bundle", tool: tool, args: bundle.args()}); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", req.Format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "bundle"+req.Format.Extension))
+	if err := req.Format.Write(w, filepath.Join(tmpDir, bundleDir), "bundle", req.Options.deflateLevel()); err != nil {
+		logger.Error("failed to archive bundle", "error", err)
+		return
+	}
+	logger.Info("streamed bundle", "format", req.Format.Name, "entry_points", bundle.EntryPoints)
+}
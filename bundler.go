@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Accept Gemfile and optional Gemfile.lock
+// When Gemfile.lock is present bundler installs in deployment mode, exactly
+// the locked versions, and fails if the lock no longer matches the Gemfile
+// The output is a zip of vendor/bundle
+var bundlerEcosystem = &Ecosystem{
+	Name:     "bundler",
+	Tool:     "bundle",
+	Runtime:  "ruby",
+	Registry: "https://rubygems.org/",
+	// The full image, as gems with native extensions are compiled on install
+	Image: "ruby:3.3-bookworm",
+	Files: []ManifestFile{
+		{Name: "Gemfile", Required: true},
+		{Name: "Gemfile.lock"},
+	},
+	Args: func(files map[string]string) []string {
+		args := []string{"install", "--path", "vendor/bundle"}
+		if files["Gemfile.lock"] != "" {
+			args = append(args, "--deployment")
+		}
+		return args
+	},
+	// The Gemfile is Ruby, and gems' native extensions are built by running
+	// their extconf.rb, neither of which bundler has a way to skip
+	ScriptsAlwaysRun: true,
+	OmitArgs: map[string][]string{
+		"dev": {"--without", "development:test"},
+	},
+	// Gems bundler installs for itself, such as the version Gemfile.lock
+	// was bundled with, go to a GEM_HOME of the job's own rather than the
+	// server's, along with bundler's settings
+	WorkEnv: func(workPath string) []string {
+		return []string{
+			"GEM_HOME=" + path.Join(workPath, ".gem"), "GEM_PATH=" + path.Join(workPath, ".gem"),
+			"BUNDLE_USER_HOME=" + path.Join(workPath, ".bundle", "home"), "BUNDLE_APP_CONFIG=" + path.Join(workPath, ".bundle"),
+		}
+	},
+	// Bundler 2 warns that --path and --deployment are deprecated in favour
+	// of settings, which would be remembered in the workspace's .bundle
+	Env: []string{"BUNDLE_SILENCE_ROOT_WARNING=1", "BUNDLE_SILENCE_DEPRECATIONS=1"},
+	CacheEnv: func(dir string) []string {
+		return []string{"BUNDLE_USER_CACHE=" + dir, "BUNDLE_GLOBAL_GEM_CACHE=true"}
+	},
+	// Gems are a file each, and git sources a clone each under git
+	CacheEntry: func(rel string) string {
+		if strings.HasPrefix(rel, "git/") {
+			return leadingDirs(2)(rel)
+		}
+		return rel
+	},
+	Packages:       bundlerPackages,
+	LockedPackages: bundlerLockedPackages,
+	FromPackages:   bundlerFromPackages,
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "vendor", "bundle"), nil
+	},
+	ArchiveRoot: "vendor/bundle",
+	ArchiveName: "bundle",
+}
+
+// gemFilePattern splits a gem's file name into its name, version and
+// optional platform, such as nokogiri-1.16.7-x86_64-linux: the version is
+// the first dash-separated part starting with a digit
+var gemFilePattern = regexp.MustCompile(`^(.+?)-(\d[^-]*)(-.+)?$`)
+
+// bundlerPackages lists the gems in vendor/bundle from their installed
+// gemspecs, under ruby/<ABI version>/specifications
+func bundlerPackages(outputDir string) ([]Package, error) {
+	specs, err := filepath.Glob(filepath.Join(outputDir, "ruby", "*", "specifications", "*.gemspec"))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, spec := range specs {
+		m := gemFilePattern.FindStringSubmatch(strings.TrimSuffix(filepath.Base(spec), ".gemspec"))
+		if m == nil {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: m[1], Version: m[2], PURL: "pkg:gem/" + m[1] + "@" + m[2]})
+	}
+	return pkgs, nil
+}
+
+// gemLockSpecPattern matches a locked gem in Gemfile.lock's specs, indented
+// four spaces, such as "    rack (3.1.8)" or "    nokogiri (1.16.7-x86_64-linux)".
+// Its dependencies are indented six.
+var gemLockSpecPattern = regexp.MustCompile(`^    ([^ ]+) \(([^-)]+)(-[^)]+)?\)$`)
+
+// bundlerLockedPackages lists the gems a Gemfile.lock pins, from rubygems
+// sources and git and path ones alike
+func bundlerLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["Gemfile.lock"]
+	if lock == "" {
+		return nil, nil
+	}
+	var pkgs []Package
+	seen := map[string]bool{}
+	inSpecs := false
+	sc := bufio.NewScanner(strings.NewReader(lock))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		switch {
+		case line == "  specs:":
+			inSpecs = true
+			continue
+		case !strings.HasPrefix(line, "  "):
+			inSpecs = false
+			continue
+		}
+		m := gemLockSpecPattern.FindStringSubmatch(line)
+		// A gem locked for several platforms is listed once per platform
+		if !inSpecs || m == nil || seen[m[1]+"@"+m[2]] {
+			continue
+		}
+		seen[m[1]+"@"+m[2]] = true
+		pkgs = append(pkgs, Package{Name: m[1], Version: m[2]})
+	}
+	return pkgs, sc.Err()
+}
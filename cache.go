@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultCacheEntries is how many input keys the result cache remembers
+const defaultCacheEntries = 1000
+
+// A resultCache maps the hash of an install's inputs to the digest of the
+// archive it produced, so repeat builds can be served from the ArtifactStore
+// without running the package manager. The least recently used key is evicted
+// once the cache is full; entries whose artifact has expired are dropped on lookup.
+type resultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // of *cacheEntry, most recently used first
+	entries    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	digest string
+}
+
+func newResultCache(maxEntries int) *resultCache {
+	return &resultCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the stored artifact built from key, if it is still available.
+// The caller must close the returned artifact.
+func (c *resultCache) lookup(store ArtifactStore, key string) (*Artifact, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		cacheRequests.inc("miss")
+		return nil, false
+	}
+	artifact, err := store.Open(el.Value.(*cacheEntry).digest)
+	if err != nil {
+		cacheRequests.inc("miss")
+		c.mu.Lock()
+		if cur, ok := c.entries[key]; ok && cur == el {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	cacheRequests.inc("hit")
+	return artifact, true
+}
+
+// add records that key produced the artifact with the given digest
+func (c *resultCache) add(key, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).digest = digest
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, digest: digest})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey hashes the ecosystem, the archive format, the normalized manifest
+// files, the project's other files and their modes as sent, and every
+// option that can change the installed result
+func cacheKey(eco *Ecosystem, req *InstallRequest) string {
+	h := sha256.New()
+	h.Write([]byte(eco.Name + "\x00" + req.Format.Name + "\x00"))
+	if req.cacheNamespace != "" {
+		h.Write([]byte("namespace\x00" + req.cacheNamespace + "\x00"))
+	}
+
+	names := make([]string, 0, len(req.Files))
+	for name := range req.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := req.Files[name]
+		if eco.manifestFile(name) {
+			content = normalizeManifest(content)
+		}
+		h.Write([]byte(name + "\x00" + content + "\x00"))
+		if mode, ok := req.modes[name]; ok {
+			h.Write([]byte("mode\x00" + mode.String() + "\x00"))
+		}
+	}
+
+	// Delivery settings do not affect what gets installed
+	opts := req.Options
+	opts.CallbackURL = ""
+	opts.Timeout = ""
+	opts.Output = nil
+	optBytes, _ := json.Marshal(opts)
+	h.Write(optBytes)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeManifest removes differences that don't change a manifest's
+// meaning: line endings, trailing whitespace and trailing blank lines
+func normalizeManifest(content string) string {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// cacheBypassed reports whether the client asked for a forced rebuild with
+// Cache-Control: no-cache
+func cacheBypassed(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// inputETag is the ETag of install responses, derived from the hash of their
+// inputs. It is weak because the same inputs may build archives that differ
+// byte for byte, such as when a registry publishes a newer matching release.
+func inputETag(key string) string {
+	return `W/"` + key + `"`
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// them weakly
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Accept Cargo.toml and optional Cargo.lock
+// The crates they depend on are vendored with cargo vendor, locked to
+// Cargo.lock when it is present
+// The output is a zip of the vendor directory and the .cargo/config.toml
+// that builds from it
+var cargoEcosystem = &Ecosystem{
+	Name:     "cargo",
+	Tool:     "cargo",
+	Runtime:  "rustc",
+	Registry: "https://index.crates.io/",
+	Image:    "rust:1.85-slim-bookworm",
+	Files: []ManifestFile{
+		{Name: "Cargo.toml", Required: true},
+		{Name: "Cargo.lock"},
+	},
+	// Versioned directories let the vendor directory hold two versions of
+	// a crate, and keep its layout stable as a lock file changes
+	Args: func(files map[string]string) []string {
+		args := []string{"vendor", "--versioned-dirs"}
+		if files["Cargo.lock"] != "" {
+			args = append(args, "--locked")
+		}
+		return append(args, "vendor")
+	},
+	FileRegistries: cargoRegistries,
+	WorkspaceFiles: cargoTargetFiles,
+	Env:            []string{"CARGO_TERM_COLOR=never", "CARGO_TERM_PROGRESS_WHEN=never"},
+	CacheEnv:       func(dir string) []string { return []string{"CARGO_HOME=" + dir} },
+	CacheEntry:     cargoCacheEntry,
+	Packages:       cargoPackages,
+	LockedPackages: cargoLockedPackages,
+	FromPackages:   cargoFromPackages,
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "vendor"), nil
+	},
+	// cargo vendor prints the source replacement pointing builds at vendor
+	StdoutFile:  ".cargo/config.toml",
+	ArchiveRoot: "vendor",
+	ArchiveName: "vendor",
+}
+
+// cargoCacheEntry groups CARGO_HOME into the registry indexes and git
+// databases, under registry/index and git/db, and the crates unpacked in
+// registry/src and the checkouts in git/checkouts, a directory each
+func cargoCacheEntry(rel string) string {
+	if strings.HasPrefix(rel, "registry/index/") || strings.HasPrefix(rel, "git/db/") {
+		return leadingDirs(3)(rel)
+	}
+	return leadingDirs(4)(rel)
+}
+
+// cargoTargetFiles adds an empty src/lib.rs, as cargo refuses to load a
+// package without a target and the request carries no sources
+func cargoTargetFiles(files map[string]string) error {
+	if _, ok := files["src/lib.rs"]; !ok {
+		files["src/lib.rs"] = ""
+	}
+	return nil
+}
+
+// cargoSourceKeyPattern matches a dependency key naming where a crate comes
+// from, in a dependency table of its own, an inline one or as a dotted key
+// such as foo.git, bare or quoted
+var cargoSourceKeyPattern = regexp.MustCompile(`(^|[{,.])\s*["']?(git|registry|registry-index)["']?\s*=\s*["']([^"']*)["']`)
+
+// cargoEscapedKeyPattern matches a quoted key with escapes, which could
+// spell git or registry in a way cargoSourceKeyPattern can't see
+var cargoEscapedKeyPattern = regexp.MustCompile(`["'][^"'=]*\\[^"'=]*["']\s*=`)
+
+// cargoDefaultSources are the crates.io index as Cargo.lock names it
+var cargoDefaultSources = []string{"registry+https://github.com/rust-lang/crates.io-index", "sparse+https://index.crates.io/"}
+
+// cargoRegistries lists the git repositories and registries other than
+// crates.io that Cargo.toml's dependencies and the crates Cargo.lock pins
+// come from. Registries named in Cargo.toml are defined in cargo's own
+// configuration, where they can't be checked, so they are refused.
+func cargoRegistries(files map[string]string) ([]fileRegistry, error) {
+	var sources []fileRegistry
+	section := ""
+	for _, line := range strings.Split(files["Cargo.toml"], "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.ReplaceAll(line, " ", "")
+			continue
+		}
+		// Metadata tables hold settings for other tools
+		if strings.Contains(section, ".metadata") {
+			continue
+		}
+		if cargoEscapedKeyPattern.MatchString(line) {
+			return nil, badRequest("Cargo.toml has a quoted key with escapes, which can't be checked against the server's list of allowed registries: %s", line)
+		}
+		for _, m := range cargoSourceKeyPattern.FindAllStringSubmatch(line, -1) {
+			// A key starting a line of a [dependencies] table names a crate
+			if m[1] == "" && strings.HasSuffix(section, "dependencies]") {
+				continue
+			}
+			if m[2] == "registry" {
+				return nil, badRequest("Cargo.toml uses registry %q: only sources named by URL can be checked against the server's list of allowed registries", m[3])
+			}
+			sources = append(sources, fileRegistry{file: "Cargo.toml", url: m[3]})
+		}
+	}
+	for _, line := range strings.Split(files["Cargo.lock"], "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.TrimSpace(key) != "source" {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if slices.Contains(cargoDefaultSources, value) {
+			continue
+		}
+		// git+https://host/repo?rev=...#commit or registry+ and sparse+ URLs
+		_, source, _ := strings.Cut(value, "+")
+		source, _, _ = strings.Cut(source, "#")
+		source, _, _ = strings.Cut(source, "?")
+		sources = append(sources, fileRegistry{file: "Cargo.lock", url: source})
+	}
+	return sources, nil
+}
+
+// cargoPackages lists the crates in a vendor directory from the name,
+// version and license in each one's Cargo.toml
+func cargoPackages(outputDir string) ([]Package, error) {
+	manifests, err := filepath.Glob(filepath.Join(outputDir, "*", "Cargo.toml"))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, manifest := range manifests {
+		b, err := os.ReadFile(manifest)
+		if err != nil {
+			return nil, err
+		}
+		pkg := cargoPackage(string(b))
+		if pkg.Name == "" {
+			continue
+		}
+		pkg.PURL = "pkg:cargo/" + pkg.Name + "@" + url.PathEscape(pkg.Version)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// cargoPackage reads the [package] table of a Cargo.toml as cargo vendor
+// writes it, one key per line
+func cargoPackage(manifest string) Package {
+	var pkg Package
+	inPackage := false
+	for _, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inPackage = line == "[package]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inPackage || !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			pkg.Name = value
+		case "version":
+			pkg.Version = value
+		case "license":
+			pkg.License = value
+		}
+	}
+	return pkg
+}
+
+// cargoLockedPackages lists the crates a Cargo.lock pins. Packages without
+// a source are the project's own and aren't vendored, so they are left out.
+func cargoLockedPackages(files map[string]string) ([]Package, error) {
+	var pkgs []Package
+	var pkg Package
+	source := ""
+	flush := func() {
+		if pkg.Name != "" && source != "" {
+			pkgs = append(pkgs, pkg)
+		}
+		pkg, source = Package{}, ""
+	}
+	for _, line := range strings.Split(files["Cargo.lock"], "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			pkg.Name = value
+		case "version":
+			pkg.Version = value
+		case "source":
+			source = value
+		}
+	}
+	flush()
+	return pkgs, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCargoRegistries(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		lock     string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "crates.io", manifest: "[dependencies]\nserde = \"1\"\nregex = { version = \"1\" }\n"},
+		{name: "crate named git", manifest: "[dependencies]\ngit = \"0.1\"\nregistry = { version = \"1\" }\n"},
+		{name: "inline git", manifest: "[dependencies]\nfoo = { git = \"https://evil/x\" }\n", want: []string{"https://evil/x"}},
+		{name: "dependency table", manifest: "[dependencies.foo]\ngit = \"https://evil/x\"\n", want: []string{"https://evil/x"}},
+		{name: "dotted key", manifest: "[dependencies]\nfoo.git = \"https://evil/x\"\n", want: []string{"https://evil/x"}},
+		{name: "spaced dotted key", manifest: "[dependencies]\nfoo . git = 'https://evil/x'\n", want: []string{"https://evil/x"}},
+		{name: "quoted key", manifest: "[dependencies]\nfoo = { version = \"1\", \"git\" = \"https://evil/x\" }\n", want: []string{"https://evil/x"}},
+		{name: "quoted dotted key", manifest: "[dependencies]\nfoo.'registry-index' = \"https://evil/index\"\n", want: []string{"https://evil/index"}},
+		{name: "target dependencies", manifest: "[target.'cfg(unix)'.dependencies]\nfoo = { git = \"https://evil/x\" }\n", want: []string{"https://evil/x"}},
+		{name: "metadata", manifest: "[package.metadata.foo]\ngit = \"https://example.com/x\"\n"},
+		{name: "named registry", manifest: "[dependencies]\nfoo = { version = \"1\", registry = \"corp\" }\n", wantErr: true},
+		{name: "dotted named registry", manifest: "[dependencies]\nfoo.registry = \"corp\"\n", wantErr: true},
+		{name: "escaped key", manifest: "[dependencies]\nfoo = { version = \"1\", \"gi\\u0074\" = \"https://evil/x\" }\n", wantErr: true},
+		{
+			name:     "lock sources",
+			manifest: "[dependencies]\nserde = \"1\"\n",
+			lock:     "[[package]]\nname = \"serde\"\nsource = \"registry+https://github.com/rust-lang/crates.io-index\"\n\n[[package]]\nname = \"foo\"\nsource = \"git+https://evil/x?rev=1#abc\"\n",
+			want:     []string{"https://evil/x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := cargoRegistries(map[string]string{"Cargo.toml": tt.manifest, "Cargo.lock": tt.lock})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("cargoRegistries() = %v, want an error", sources)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cargoRegistries() failed: %v", err)
+			}
+			var got []string
+			for _, s := range sources {
+				got = append(got, s.url)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("cargoRegistries() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Resource limits for each install, set from the install_memory_mb and
+// install_cpu_weight settings; zero means unlimited. The host and sandbox
+// executors apply them through a cgroup v2 group per install created under
+// cgroupParent, and the docker executor through the container's own limits.
+var (
+	installMemoryMax int64
+	installCPUWeight int
+	cgroupParent     string
+)
+
+// setupCgroupParent enables the controllers the configured limits need for
+// the groups created under cgroupParent
+func setupCgroupParent() error {
+	if _, err := os.Stat(filepath.Join(cgroupParent, "cgroup.subtree_control")); err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %v", cgroupParent, err)
+	}
+	var controllers []string
+	if installMemoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if installCPUWeight > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	for _, controller := range controllers {
+		if err := os.WriteFile(filepath.Join(cgroupParent, "cgroup.subtree_control"), []byte("+"+controller), 0); err != nil {
+			return fmt.Errorf("enabling the %s controller in %s: %v", controller, cgroupParent, err)
+		}
+	}
+	return nil
+}
+
+// An installCgroup is the cgroup one install's processes run in
+type installCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newInstallCgroup creates a group with the configured limits and places cmd
+// in it when it starts
+func newInstallCgroup(cmd *exec.Cmd) (*installCgroup, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cgroupParent, "install-"+hex.EncodeToString(id))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cgroup: %v", err)
+	}
+	cg := &installCgroup{dir: dir}
+	settings := map[string]string{}
+	if installMemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(installMemoryMax, 10)
+		// Without this the limit only pushes the install into swap
+		settings["memory.swap.max"] = "0"
+	}
+	if installCPUWeight > 0 {
+		settings["cpu.weight"] = strconv.Itoa(installCPUWeight)
+	}
+	for name, value := range settings {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0)
+		if err != nil && !(name == "memory.swap.max" && os.IsNotExist(err)) {
+			cg.remove()
+			return nil, fmt.Errorf("setting %s: %v", name, err)
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	cg.fd = fd
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+	return cg, nil
+}
+
+// oomKilled reports whether the kernel killed a process in the group for
+// exceeding its memory limit
+func (cg *installCgroup) oomKilled() bool {
+	events, err := os.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if n, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			return n != "0"
+		}
+	}
+	return false
+}
+
+// remove kills anything still running in the group and deletes it
+func (cg *installCgroup) remove() {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0)
+	// The group can only be removed once its killed processes have exited
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(cg.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// breakerMinRuns is how many runs a registry needs in the window before its
+// failure rate can open the circuit
+const breakerMinRuns = 5
+
+// registryBreaker fails installs fast while their registry is down. It is
+// set up from the circuit_breaker settings; nil when off.
+var registryBreaker *circuitBreaker
+
+var (
+	circuitRejected = newCounterVec("pip_install_circuit_rejected_total",
+		"Installs failed fast because their registry's circuit was open, by registry.", "registry")
+	circuitOpened = newCounterVec("pip_install_circuit_opened_total",
+		"Times a registry's circuit opened, by registry.", "registry")
+)
+
+// A circuitBreaker tracks how often package manager runs fail to reach each
+// registry. Once at least failureRate of the runs in the last window have
+// failed, the registry's circuit opens and installs from it fail straight
+// away for cooldown. Then one install is let through to probe it: success
+// closes the circuit and failure keeps it open for another cooldown.
+type circuitBreaker struct {
+	failureRate float64
+	window      time.Duration
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// A circuit is the state of one registry
+type circuit struct {
+	runs []registryRun
+	open bool
+	// retryAt is when the next probe may run while the circuit is open
+	retryAt time.Time
+}
+
+type registryRun struct {
+	at     time.Time
+	failed bool
+}
+
+func newCircuitBreaker(failureRate float64, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{failureRate: failureRate, window: window, cooldown: cooldown, circuits: make(map[string]*circuit)}
+}
+
+// A circuitOpenError fails an install whose registry's circuit is open
+type circuitOpenError struct {
+	registry   string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("The registry %s is failing; not installing until it recovers", e.registry)
+}
+
+// retryAfterSeconds is the Retry-After hint for the error's response
+func (e *circuitOpenError) retryAfterSeconds() string {
+	return strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds())))
+}
+
+// registryName names the registry an install uses, for the breaker: the
+// host of the request's registry option or, without one, of the ecosystem's
+// default registry, or the upstream of the registry proxy fronting it
+func registryName(eco *Ecosystem, req *InstallRequest) string {
+	registry := eco.Registry
+	switch {
+	case req.Options.Registry != "":
+		registry = req.Options.Registry
+	case registryProxy != nil && eco.Runtime == "node":
+		registry = registryProxy.upstream.String()
+	}
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return registry
+}
+
+// otherRegistries reports whether an install may fetch from registries the
+// caller picked besides the one registryName names: those its own files
+// point at, or the scoped registries of the npm_scopes it depends on. The
+// breaker leaves such installs alone, as their failures may say nothing of
+// the registry it tracks.
+func otherRegistries(eco *Ecosystem, req *InstallRequest) bool {
+	if eco.FileRegistries != nil {
+		files := make(map[string]string, len(req.Files))
+		for name, content := range req.Files {
+			if !eco.secretFile(name) {
+				files[name] = content
+			}
+		}
+		maps.Copy(files, req.clientSecrets)
+		if sources, err := eco.FileRegistries(files); err != nil || len(sources) > 0 {
+			return true
+		}
+	}
+	if eco.Runtime == "node" {
+		for _, c := range scopeCredentials {
+			if strings.Contains(req.Files["package.json"], `"`+c.Scope+`/`) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check fails with a 503 if the registry behind an install is down. Once
+// the cooldown is over, probe lets the install through as the registry's
+// probe; it is set where the package manager is about to run, and installs
+// checked before then are only turned away during the cooldown. Nil
+// breakers let everything through.
+func (b *circuitBreaker) check(ctx context.Context, eco *Ecosystem, req *InstallRequest, probe bool) error {
+	if b == nil || otherRegistries(eco, req) {
+		return nil
+	}
+	name := registryName(eco, req)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[name]
+	if c == nil || !c.open {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(c.retryAt) {
+		circuitRejected.inc(name)
+		return &statusError{status: http.StatusServiceUnavailable, errCode: "REGISTRY_CIRCUIT_OPEN",
+			err: &circuitOpenError{registry: name, retryAfter: c.retryAt.Sub(now)}}
+	}
+	if !probe {
+		return nil
+	}
+	// Let this install probe the registry, holding the rest back meanwhile
+	c.retryAt = now.Add(b.cooldown)
+	loggerFrom(ctx).Info("probing failing registry", "registry", name)
+	return nil
+}
+
+// record notes whether a run of the package manager failed to reach its
+// registry. Runs that were killed, rather than exiting, say nothing of the
+// registry and aren't recorded.
+func (b *circuitBreaker) record(eco *Ecosystem, req *InstallRequest, err error) {
+	if b == nil || otherRegistries(eco, req) {
+		return
+	}
+	var te *toolError
+	if err != nil && (!errors.As(err, &te) || te.exitCode < 0) {
+		return
+	}
+	failed := transient(err)
+	name := registryName(eco, req)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[name]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[name] = c
+	}
+	now := time.Now()
+	if c.open {
+		if !failed {
+			slog.Info("registry recovered, closing its circuit", "registry", name)
+			*c = circuit{}
+		}
+		return
+	}
+	c.runs = append(c.runs, registryRun{at: now, failed: failed})
+	for len(c.runs) > 0 && now.Sub(c.runs[0].at) > b.window {
+		c.runs = c.runs[1:]
+	}
+	failures := 0
+	for _, run := range c.runs {
+		if run.failed {
+			failures++
+		}
+	}
+	if len(c.runs) >= breakerMinRuns && float64(failures) >= b.failureRate*float64(len(c.runs)) {
+		slog.Warn("registry is failing, opening its circuit", "registry", name, "failures", failures, "runs", len(c.runs), "cooldown", b.cooldown)
+		circuitOpened.inc(name)
+		c.open, c.retryAt, c.runs = true, now.Add(b.cooldown), nil
+	}
+}
@@ -0,0 +1,206 @@
+// Package client is a Go client for the pip-install HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Client calls a pip-install server. Its zero value is not usable; create
+// one with New.
+type Client struct {
+	// BaseURL is the server's address, such as https://pip-install.internal
+	BaseURL string
+	// Token is sent as a bearer token: an API key or, with OIDC configured, a JWT
+	Token string
+	// HTTPClient sends the requests (default http.DefaultClient)
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is retried after a network
+	// error or a 429, 502 or 503 response
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the wait between retries, which doubles
+	// each time unless the server sends Retry-After
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PollInterval is how often WaitForJob checks a job
+	PollInterval time.Duration
+}
+
+// New returns a Client for the server at baseURL, retrying 4 times
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		Token:        token,
+		HTTPClient:   http.DefaultClient,
+		MaxRetries:   4,
+		MinBackoff:   500 * time.Millisecond,
+		MaxBackoff:   30 * time.Second,
+		PollInterval: 2 * time.Second,
+	}
+}
+
+// An Error is a response the server rejected a request with
+type Error struct {
+	StatusCode int
+	// Code is the kind of failure, such as TIMEOUT or SCRIPT_FAILED, for
+	// the server's JSON errors
+	Code    string
+	Message string
+	// ExitCode is the package manager's for failed installs, or -1
+	ExitCode int
+	// Log is the end of a failed package manager's output
+	Log string
+	// Field and Reason describe a request body that doesn't match the API's
+	// schema
+	Field  string
+	Reason string
+	// Details is the whole body of a JSON error, such as the advisories that
+	// failed an audit gate
+	Details map[string]any
+	// RetryAfter is how long the server asked the client to wait
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pip-install: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404, such as for an expired job
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// readError turns a failed response into an *Error, closing its body
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body)), ExitCode: -1, RetryAfter: retryAfter(resp)}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		if json.Unmarshal(body, &e.Details) == nil {
+			e.Message, _ = e.Details["error"].(string)
+			e.Field, _ = e.Details["field"].(string)
+			e.Reason, _ = e.Details["reason"].(string)
+			e.Code, _ = e.Details["code"].(string)
+			e.Log, _ = e.Details["log"].(string)
+			if code, ok := e.Details["exit_code"].(float64); ok {
+				e.ExitCode = int(code)
+			}
+		}
+	}
+	return e
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// retryable reports whether a response with this status was rejected before
+// the server did any work, so that sending the request again is safe
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// do sends a request, retrying network errors and retryable statuses. Any
+// status other than 2xx and 304 is returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := httpClient.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !isTemporary(err) || attempt >= c.MaxRetries {
+				return nil, err
+			}
+		case resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified:
+			return resp, nil
+		default:
+			e := readError(resp)
+			if !retryable(resp.StatusCode) || attempt >= c.MaxRetries {
+				return nil, e
+			}
+			wait = e.RetryAfter
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// isTemporary reports whether a request failed in a way worth retrying:
+// anything but a malformed URL or a TLS certificate the client rejects
+func isTemporary(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		var opErr *net.OpError
+		var dnsErr *net.DNSError
+		if errors.As(err, &opErr) || errors.As(err, &dnsErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return true
+		}
+		return urlErr.Timeout()
+	}
+	return false
+}
+
+// backoff returns the wait before the retry after attempt: MinBackoff
+// doubled each attempt up to MaxBackoff, with up to half taken off at random
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.MinBackoff
+	if d <= 0 {
+		d = 500 * time.Millisecond
+	}
+	for i := 0; i < attempt && (c.MaxBackoff <= 0 || d < c.MaxBackoff); i++ {
+		d *= 2
+	}
+	if c.MaxBackoff > 0 && d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d - rand.N(d/2+1)
+}
+
+// getJSON GETs path and decodes the JSON response into v
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
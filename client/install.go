@@ -0,0 +1,553 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An InstallRequest is what to install: manifest files, package specs or
+// both, with the install options
+type InstallRequest struct {
+	// Ecosystem is pip, poetry, yarn, pnpm, bun, deno, composer, bundler or cargo (default pip)
+	Ecosystem string
+	// Files maps manifest names such as requirements.txt, and for workspaces
+	// paths such as packages/a/package.json, to their contents. Binary
+	// files such as bun.lockb are encoded for the server.
+	Files map[string]string
+	// Packages are package specs such as "express@4" to install without a
+	// manifest
+	Packages []string
+	// Format is the archive format: zip (the default), tar.gz or tar.zst
+	Format  string
+	Options Options
+	// NoCache runs the install even if its result is cached
+	NoCache bool
+	// IdempotencyKey makes InstallAsync return the job first submitted with
+	// it rather than start another. Without one, InstallAsync picks one for
+	// its own retries.
+	IdempotencyKey string
+}
+
+// Options are the install options, named as in the HTTP API
+type Options struct {
+	CallbackURL string `json:"callback_url,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	Registry    string `json:"registry,omitempty"`
+	// IgnoreScripts nil means the server's policy decides
+	IgnoreScripts    *bool         `json:"ignore_scripts,omitempty"`
+	NodeVersion      string        `json:"node_version,omitempty"`
+	RubyVersion      string        `json:"ruby_version,omitempty"`
+	Omit             []string      `json:"omit,omitempty"`
+	PeerDepsMode     string        `json:"peer_deps_mode,omitempty"`
+	EngineStrict     bool          `json:"engine_strict,omitempty"`
+	NpmArgs          []string      `json:"npm_args,omitempty"`
+	AuditFailOn      string        `json:"audit_fail_on,omitempty"`
+	VerifyProvenance string        `json:"verify_provenance,omitempty"`
+	RequireIntegrity bool          `json:"require_integrity,omitempty"`
+	SBOM             string        `json:"sbom,omitempty"`
+	DenyLicenses     []string      `json:"deny_licenses,omitempty"`
+	Workspaces       []string      `json:"workspaces,omitempty"`
+	Include          []string      `json:"include,omitempty"`
+	Compression      string        `json:"compression,omitempty"`
+	CompressionLevel int           `json:"compression_level,omitempty"`
+	Output           *OutputTarget `json:"output,omitempty"`
+	LicenseReport    bool          `json:"license_report,omitempty"`
+	Report           bool          `json:"report,omitempty"`
+	Prune            bool          `json:"prune,omitempty"`
+	Target           *Target       `json:"target,omitempty"`
+	// Targets installs for each platform into one archive with a
+	// <platform>-<arch>[-<libc>] directory per target
+	Targets []*Target `json:"targets,omitempty"`
+	// DryRun is set by Client.DryRun
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Target is the platform native modules are installed for, such as
+// {Platform: "linux", Arch: "arm64", Libc: "musl"}; empty fields are the
+// server's
+type Target struct {
+	Platform string `json:"platform,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	Libc     string `json:"libc,omitempty"`
+}
+
+// OutputTarget uploads the archive to an object store or registry instead
+// of returning it
+type OutputTarget struct {
+	Type       string `json:"type,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	BaseImage  string `json:"base_image,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+}
+
+// A Package is a resolved or installed package
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	License string `json:"license,omitempty"`
+	PURL    string `json:"purl"`
+}
+
+// A DryRunResult is what an install would install
+type DryRunResult struct {
+	Ecosystem string    `json:"ecosystem"`
+	Packages  []Package `json:"packages"`
+	// Lockfile is the lock file the resolution wrote; pip writes none
+	Lockfile *struct {
+		Name    string `json:"name"`
+		Content string `json:"content"`
+	} `json:"lockfile,omitempty"`
+	// Added and Removed compare Packages with the submitted lock file's
+	Added      []Package `json:"added,omitempty"`
+	Removed    []Package `json:"removed,omitempty"`
+	Warnings   []Warning `json:"warnings,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// UploadedArtifact is where an install with the output option put its archive
+type UploadedArtifact struct {
+	Type   string `json:"type"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// URL downloads the archive without credentials until ExpiresAt
+	URL            string     `json:"url,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Reference      string     `json:"reference,omitempty"`
+	ManifestDigest string     `json:"manifest_digest,omitempty"`
+	SHA256         string     `json:"sha256"`
+	Size           int64      `json:"size"`
+}
+
+// JobStatus is queued, running, succeeded or failed
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Done reports whether a job with this status has finished
+func (s JobStatus) Done() bool { return s == JobSucceeded || s == JobFailed }
+
+// A Warning is a warning the package manager printed during a job
+type Warning struct {
+	// Kind is deprecated, peer, unpinned or warning
+	Kind string `json:"kind"`
+	// Package is the deprecated package, as name@version
+	Package string `json:"package,omitempty"`
+	Message string `json:"message"`
+}
+
+// A Job is an install run in the background
+type Job struct {
+	ID        string    `json:"id"`
+	Ecosystem string    `json:"ecosystem"`
+	Status    JobStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// ErrorCode is the kind of failure, such as LOCKFILE_MISMATCH
+	ErrorCode string `json:"error_code,omitempty"`
+	// ExitCode is the failed package manager's, if it exited
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ArtifactDigest is the SHA-256 of the archive once the job has succeeded
+	ArtifactDigest string `json:"artifact_sha256,omitempty"`
+	ArtifactURL    string `json:"artifact_url,omitempty"`
+	// Cached is set when the archive came from the result cache
+	Cached bool `json:"cached,omitempty"`
+	// QueuePosition is the job's 1-based place in the queue while it waits
+	QueuePosition  int      `json:"queue_position,omitempty"`
+	SkippedScripts []string `json:"skipped_scripts,omitempty"`
+	// PrunedBytes is how much the prune option removed
+	PrunedBytes int64             `json:"pruned_bytes,omitempty"`
+	Output      *UploadedArtifact `json:"output,omitempty"`
+	// Warnings are what the package manager warned of, such as deprecated
+	// packages and unmet peer dependencies
+	Warnings []Warning `json:"warnings,omitempty"`
+	// Retries is how many times the install was run again after failing to
+	// reach the registry
+	Retries int `json:"retries,omitempty"`
+	// Details is the whole job as the server sent it, including why a
+	// policy failed it
+	Details map[string]any `json:"-"`
+}
+
+func (j *Job) UnmarshalJSON(data []byte) error {
+	type plain Job
+	if err := json.Unmarshal(data, (*plain)(j)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &j.Details)
+}
+
+// A JobError is returned by WaitForJob for a job that failed
+type JobError struct {
+	Job *Job
+}
+
+func (e *JobError) Error() string {
+	if e.Job.ErrorCode != "" {
+		return fmt.Sprintf("pip-install: job %s failed (%s): %s", e.Job.ID, e.Job.ErrorCode, e.Job.Error)
+	}
+	return fmt.Sprintf("pip-install: job %s failed: %s", e.Job.ID, e.Job.Error)
+}
+
+// An Event is a "status" change or a "log" line of a job's package manager
+// output
+type Event struct {
+	ID     int       `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Phase  string    `json:"phase,omitempty"`
+	Status JobStatus `json:"status,omitempty"`
+	Stream string    `json:"stream,omitempty"`
+	Line   string    `json:"line,omitempty"`
+}
+
+// An InstallResult describes the archive an install wrote
+type InstallResult struct {
+	// Digest is the archive's SHA-256
+	Digest   string
+	Filename string
+	// Cached is set when the archive came from the result cache
+	Cached         bool
+	SkippedScripts []string
+	// PrunedBytes is how much the prune option removed
+	PrunedBytes int64
+	// Uploaded is where the archive went, for installs with the output
+	// option, which write nothing
+	Uploaded *UploadedArtifact
+}
+
+func (r *InstallRequest) ecosystem() string {
+	if r.Ecosystem == "" {
+		return "pip"
+	}
+	return r.Ecosystem
+}
+
+// binaryFiles are the manifests JSON bodies carry base64-encoded
+var binaryFiles = []string{"bun.lockb"}
+
+// body encodes the request as the JSON body of an install
+func (r *InstallRequest) body() ([]byte, error) {
+	opts, err := json.Marshal(r.Options)
+	if err != nil {
+		return nil, err
+	}
+	body := make(map[string]any)
+	if err := json.Unmarshal(opts, &body); err != nil {
+		return nil, err
+	}
+	for name, content := range r.Files {
+		if slices.Contains(binaryFiles, name) {
+			content = base64.StdEncoding.EncodeToString([]byte(content))
+		}
+		body[name] = content
+	}
+	if len(r.Packages) > 0 {
+		body["packages"] = r.Packages
+	}
+	return json.Marshal(body)
+}
+
+func (r *InstallRequest) header() http.Header {
+	h := http.Header{"Content-Type": {"application/json"}}
+	if r.NoCache {
+		h.Set("Cache-Control", "no-cache")
+	}
+	return h
+}
+
+func (r *InstallRequest) query(params url.Values) string {
+	if r.Format != "" {
+		params.Set("format", r.Format)
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return "?" + params.Encode()
+}
+
+// Install runs an install and writes its archive to w, checking it against
+// the digest the server sends. Requests rejected because the server is busy
+// are retried, but once the archive has started to arrive a failure is
+// returned as is, since part of it may have been written.
+func (c *Client) Install(ctx context.Context, req *InstallRequest, w io.Writer) (*InstallResult, error) {
+	body, err := req.body()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/install/"+url.PathEscape(req.ecosystem())+req.query(url.Values{}), req.header(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &InstallResult{Cached: resp.Header.Get("X-Cache") == "HIT"}
+	if skipped := resp.Header.Get("X-Skipped-Scripts"); skipped != "" {
+		result.SkippedScripts = strings.Split(skipped, ",")
+	}
+	result.PrunedBytes, _ = strconv.ParseInt(resp.Header.Get("X-Pruned-Bytes"), 10, 64)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		result.Filename = params["filename"]
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		result.Uploaded = new(UploadedArtifact)
+		if err := json.NewDecoder(resp.Body).Decode(result.Uploaded); err != nil {
+			return nil, err
+		}
+		result.Digest = result.Uploaded.SHA256
+		return result, nil
+	}
+	if result.Digest, err = copyVerified(w, resp, digestHeader); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DryRun resolves an install without running it and returns what it would
+// install, with the lock file for the ecosystems that write one
+func (c *Client) DryRun(ctx context.Context, req *InstallRequest) (*DryRunResult, error) {
+	dry := *req
+	dry.Options.DryRun = true
+	body, err := dry.body()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/install/"+url.PathEscape(req.ecosystem()), req.header(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := new(DryRunResult)
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// digestHeader carries an archive's SHA-256, as a trailer when the archive
+// is streamed while it is built
+const digestHeader = "X-Artifact-Digest"
+
+// copyVerified copies a response body to w, checking its SHA-256 against
+// the header or trailer the server sent, and returns it
+func copyVerified(w io.Writer, resp *http.Response, header string) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	want := resp.Header.Get(header)
+	if want == "" {
+		want = resp.Trailer.Get(header)
+	}
+	if want != "" && want != digest {
+		return "", fmt.Errorf("pip-install: archive digest %s doesn't match %s sent by the server", digest, want)
+	}
+	return digest, nil
+}
+
+// InstallAsync submits an install as a job and returns it straight away.
+// A job whose result was cached has already succeeded. Retried submissions
+// send the same Idempotency-Key, so they don't start a second job.
+func (c *Client) InstallAsync(ctx context.Context, req *InstallRequest) (*Job, error) {
+	body, err := req.body()
+	if err != nil {
+		return nil, err
+	}
+	header := req.header()
+	key := req.IdempotencyKey
+	if key == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		key = hex.EncodeToString(b)
+	}
+	header.Set("Idempotency-Key", key)
+	resp, err := c.do(ctx, http.MethodPost, "/jobs"+req.query(url.Values{"ecosystem": {req.ecosystem()}}), header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	job := new(Job)
+	if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJob returns a job's current state
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	job := new(Job)
+	if err := c.getJSON(ctx, "/jobs/"+url.PathEscape(id), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CancelJob cancels a queued or running job, which then fails with
+// JOB_CANCELLED, and returns it. It may still be stopping when returned.
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	resp, err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	job := new(Job)
+	if err := json.NewDecoder(resp.Body).Decode(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// WaitForJob polls a job every PollInterval until it finishes. A failed
+// job is returned with a *JobError.
+func (c *Client) WaitForJob(ctx context.Context, id string) (*Job, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == JobFailed {
+			return job, &JobError{Job: job}
+		}
+		if job.Status.Done() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// DownloadArtifact writes a succeeded job's archive to w, checking its
+// digest, and returns the digest
+func (c *Client) DownloadArtifact(ctx context.Context, id string, w io.Writer) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/artifact", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return copyVerified(w, resp, digestHeader)
+}
+
+// StreamLogs calls fn with a job's events, past ones first, until the job
+// has finished or fn returns an error. A dropped connection is resumed
+// after the last event received.
+func (c *Client) StreamLogs(ctx context.Context, id string, fn func(Event) error) error {
+	last := 0
+	for attempt := 0; ; attempt++ {
+		header := http.Header{"Accept": {"text/event-stream"}}
+		if last > 0 {
+			header.Set("Last-Event-ID", fmt.Sprint(last))
+		}
+		resp, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id)+"/events", header, nil)
+		if err != nil {
+			return err
+		}
+		before := last
+		done, err := readEvents(resp.Body, func(ev Event) error {
+			last = ev.ID
+			return fn(ev)
+		})
+		resp.Body.Close()
+		var fnErr callbackError
+		switch {
+		case errors.As(err, &fnErr):
+			return fnErr.err
+		case done:
+			return nil
+		case ctx.Err() != nil:
+			return ctx.Err()
+		}
+		// Progress since the last attempt means the connection was dropped
+		// rather than refused, so the retries start again
+		if last > before {
+			attempt = 0
+		}
+		if attempt >= c.MaxRetries {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("pip-install: event stream for job %s ended early: %w", id, err)
+		}
+		t := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// callbackError is an error returned by a StreamLogs callback
+type callbackError struct{ err error }
+
+func (e callbackError) Error() string { return e.err.Error() }
+
+// readEvents parses a Server-Sent Events stream of job events, reporting
+// whether it reached the job's final status
+func readEvents(r io.Reader, fn func(Event) error) (bool, error) {
+	var data strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(data.String()), &ev); err != nil {
+				return false, fmt.Errorf("pip-install: malformed event: %v", err)
+			}
+			data.Reset()
+			if err := fn(ev); err != nil {
+				return false, callbackError{err}
+			}
+			if ev.Type == "status" && ev.Status.Done() {
+				return true, nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return false, scanner.Err()
+}
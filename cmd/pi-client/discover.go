@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifests are the files each ecosystem's installs accept, as the server
+// names them
+var manifests = map[string][]string{
+	"pip":      {"requirements.txt", "constraints.txt", "pip.conf"},
+	"poetry":   {"pyproject.toml", "poetry.lock"},
+	"yarn":     {"package.json", "yarn.lock", ".npmrc"},
+	"pnpm":     {"package.json", "pnpm-lock.yaml", "pnpm-workspace.yaml", ".npmrc"},
+	"bun":      {"package.json", "bun.lockb", "bun.lock", ".npmrc"},
+	"deno":     {"deno.json", "import_map.json", "deno.lock"},
+	"composer": {"composer.json", "composer.lock", "auth.json"},
+	"bundler":  {"Gemfile", "Gemfile.lock"},
+	"cargo":    {"Cargo.toml", "Cargo.lock"},
+}
+
+// A project is the manifests read from a directory
+type project struct {
+	ecosystem string
+	files     map[string]string
+}
+
+// discover reads a project's manifests, detecting its ecosystem from them
+// unless one is given
+func discover(dir, ecosystem string) (*project, error) {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	if ecosystem == "" {
+		ecosystem = detectEcosystem(dir, exists)
+		if ecosystem == "" {
+			return nil, fmt.Errorf("no requirements.txt, pyproject.toml, package.json, deno.json, composer.json, Gemfile or Cargo.toml in %s", dir)
+		}
+	}
+	names, ok := manifests[ecosystem]
+	if !ok {
+		return nil, fmt.Errorf("unknown ecosystem %q", ecosystem)
+	}
+	p := &project{ecosystem: ecosystem, files: make(map[string]string)}
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.files[name] = string(b)
+	}
+	// deno.json can be left out for an import map, which the server
+	// points one at
+	if _, ok := p.files[names[0]]; !ok && (ecosystem != "deno" || p.files["import_map.json"] == "") {
+		return nil, fmt.Errorf("%s installs need a %s, which %s doesn't have", ecosystem, names[0], dir)
+	}
+	if ecosystem == "yarn" || ecosystem == "pnpm" || ecosystem == "bun" {
+		if err := p.addWorkspaces(dir); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// detectEcosystem picks the ecosystem a directory's files are for, going by
+// its lock files first
+func detectEcosystem(dir string, exists func(string) bool) string {
+	switch {
+	case exists("pnpm-lock.yaml"), exists("pnpm-workspace.yaml"):
+		return "pnpm"
+	case exists("deno.json"), exists("deno.lock"):
+		return "deno"
+	case exists("bun.lockb"), exists("bun.lock"):
+		return "bun"
+	case exists("yarn.lock"):
+		return "yarn"
+	case exists("package.json"):
+		var pkg struct {
+			PackageManager string `json:"packageManager"`
+		}
+		b, _ := os.ReadFile(filepath.Join(dir, "package.json"))
+		if json.Unmarshal(b, &pkg) == nil {
+			for _, eco := range []string{"pnpm", "bun"} {
+				if strings.HasPrefix(pkg.PackageManager, eco+"@") {
+					return eco
+				}
+			}
+		}
+		return "yarn"
+	case exists("composer.json"):
+		return "composer"
+	case exists("Gemfile"), exists("Gemfile.lock"):
+		return "bundler"
+	case exists("Cargo.toml"):
+		return "cargo"
+	case exists("poetry.lock"), exists("pyproject.toml"):
+		return "poetry"
+	case exists("requirements.txt"):
+		return "pip"
+	}
+	return ""
+}
+
+// addWorkspaces adds the package.json of every package below a workspace
+// root, keyed by its path. The server works out which belong to the
+// workspace.
+func (p *project) addWorkspaces(dir string) error {
+	var root struct {
+		Workspaces json.RawMessage `json:"workspaces"`
+	}
+	json.Unmarshal([]byte(p.files["package.json"]), &root)
+	if root.Workspaces == nil && p.files["pnpm-workspace.yaml"] == "" {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && (d.Name() == "node_modules" || strings.HasPrefix(d.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || d.Name() != "package.json" || path == filepath.Join(dir, "package.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		p.files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+}
+
+func sortedNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarOf builds a tar of entries given as name and either a symlink target
+// ending in "@" or a regular file's content
+func tarOf(t *testing.T, entries ...[2]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e[0], Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e[1]))}
+		content := e[1]
+		if n := len(content); n > 0 && content[n-1] == '@' {
+			hdr.Typeflag, hdr.Linkname, hdr.Size, content = tar.TypeSymlink, content[:n-1], 0, ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	archive := tarOf(t,
+		[2]string{"node_modules/.pnpm/a@1/node_modules/a/index.js", "a"},
+		[2]string{"node_modules/a", ".pnpm/a@1/node_modules/a@"},
+	)
+	if err := extractTar(archive, dir); err != nil {
+		t.Fatalf("extractTar() failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "node_modules", "a", "index.js"))
+	if err != nil || string(b) != "a" {
+		t.Errorf("reading through the link gave %q, %v", b, err)
+	}
+}
+
+func TestExtractTarRefuses(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries [][2]string
+	}{
+		{name: "parent directory", entries: [][2]string{{"../evil", "x"}}},
+		{name: "absolute link", entries: [][2]string{{"evil", "/etc@"}}},
+		{name: "link outside", entries: [][2]string{{"evil", "../../etc@"}}},
+		{name: "link chain", entries: [][2]string{{"a", ".@"}, {"a/a/x", "../../y@"}, {"a/a/x/f", "evil"}}},
+		{name: "file beneath a link", entries: [][2]string{{"a", ".@"}, {"a/f", "evil"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "out")
+			if err := extractTar(tarOf(t, tt.entries...), dir); err == nil {
+				t.Error("extractTar() succeeded, want an error")
+			}
+			for _, name := range []string{"evil", "y", "f"} {
+				if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+					t.Errorf("extractTar() wrote %s outside the directory", name)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTarReplacesLink(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "out")
+	outside := filepath.Join(root, "outside")
+	if err := os.WriteFile(outside, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractTar(tarOf(t, [2]string{"f", "new"}), dir); err != nil {
+		t.Fatalf("extractTar() failed: %v", err)
+	}
+	if b, _ := os.ReadFile(outside); string(b) != "keep" {
+		t.Errorf("extractTar() wrote through the symlink: outside holds %q", b)
+	}
+}
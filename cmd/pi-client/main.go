@@ -0,0 +1,322 @@
+// Command pi-client installs a project's dependencies with a pip-install
+// server and saves or extracts the archive:
+//
+//	pi-client install ./my-project -o node_modules.zip --node 20
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"pip-install/client"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "install" {
+		fmt.Fprintln(os.Stderr, "usage: pi-client install [flags] [dir]")
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := install(ctx, os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "pi-client:", err)
+		var jobErr *client.JobError
+		if errors.As(err, &jobErr) {
+			os.Exit(1)
+		}
+		os.Exit(2)
+	}
+}
+
+type installFlags struct {
+	server        string
+	token         string
+	output        string
+	extract       string
+	ecosystem     string
+	format        string
+	node          string
+	ruby          string
+	omit          string
+	target        string
+	ignoreScripts bool
+	prune         bool
+	dryRun        bool
+	noCache       bool
+	verbose       bool
+}
+
+// parseInterspersed parses flags given before or after the positional
+// arguments, which the flag package alone stops at
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func install(ctx context.Context, args []string) error {
+	var f installFlags
+	fs := flag.NewFlagSet("pi-client install", flag.ContinueOnError)
+	fs.StringVar(&f.server, "server", envOr("PIP_INSTALL_URL", "http://localhost:8080"), "The pip-install server's URL (env PIP_INSTALL_URL)")
+	fs.StringVar(&f.token, "token", os.Getenv("PIP_INSTALL_TOKEN"), "The API key or JWT to send (env PIP_INSTALL_TOKEN)")
+	fs.StringVar(&f.output, "o", "", "Where to save the archive (default named as the server's download, such as node_modules.<ext>)")
+	fs.StringVar(&f.extract, "x", "", "Extract the archive into this directory instead of saving it, unless -o is also given")
+	fs.StringVar(&f.ecosystem, "ecosystem", "", "pip, poetry, yarn, pnpm, bun, deno, composer, bundler or cargo (default detected from the project's files)")
+	fs.StringVar(&f.format, "format", "", "The archive format: zip, tar.gz or tar.zst (default zip)")
+	fs.StringVar(&f.node, "node", "", `The Node.js version to install with, such as "20"`)
+	fs.StringVar(&f.ruby, "ruby", "", `The Ruby version to install with, such as "3.3"`)
+	fs.StringVar(&f.omit, "omit", "", `Comma-separated kinds of dependencies to leave out, such as "dev"`)
+	fs.StringVar(&f.target, "target", "", `The platform to install native modules for, as platform/arch[/libc] such as "linux/arm64/musl"; several, comma-separated, go in a directory each`)
+	fs.BoolVar(&f.ignoreScripts, "ignore-scripts", false, "Skip package lifecycle scripts")
+	fs.BoolVar(&f.prune, "prune", false, "Remove tests, docs and other files packages don't need at run time")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Resolve the install without running it and print what it would install; -o saves the lock file")
+	fs.BoolVar(&f.noCache, "no-cache", false, "Run the install even if its result is cached")
+	fs.BoolVar(&f.verbose, "v", false, "Print the package manager's output")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("expected one project directory, got %d", len(positional))
+	}
+	dir := "."
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+
+	project, err := discover(dir, f.ecosystem)
+	if err != nil {
+		return err
+	}
+	req := &client.InstallRequest{
+		Ecosystem: project.ecosystem,
+		Files:     project.files,
+		Format:    f.format,
+		NoCache:   f.noCache,
+		Options:   client.Options{NodeVersion: f.node, RubyVersion: f.ruby, Prune: f.prune},
+	}
+	if f.omit != "" {
+		req.Options.Omit = strings.Split(f.omit, ",")
+	}
+	for _, spec := range strings.Split(f.target, ",") {
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, "/")
+		if len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("invalid -target %q: must be platform/arch[/libc]", spec)
+		}
+		t := &client.Target{Platform: parts[0], Arch: parts[1]}
+		if len(parts) == 3 {
+			t.Libc = parts[2]
+		}
+		req.Options.Targets = append(req.Options.Targets, t)
+	}
+	// A single target is installed without a directory of its own
+	if len(req.Options.Targets) == 1 {
+		req.Options.Target, req.Options.Targets = req.Options.Targets[0], nil
+	}
+	if f.ignoreScripts {
+		req.Options.IgnoreScripts = &f.ignoreScripts
+	}
+	c := client.New(f.server, f.token)
+	if f.dryRun {
+		return dryRun(ctx, c, req, f.output)
+	}
+	fmt.Fprintf(os.Stderr, "Installing %s with %s (%s)\n", dir, project.ecosystem, strings.Join(sortedNames(project.files), ", "))
+
+	start := time.Now()
+	job, err := c.InstallAsync(ctx, req)
+	if err != nil {
+		return err
+	}
+	id := job.ID
+	if !job.Status.Done() {
+		if err := showProgress(ctx, c, job, f.verbose); err != nil {
+			return abandon(ctx, c, id, err)
+		}
+	}
+	if job, err = c.WaitForJob(ctx, id); err != nil {
+		return abandon(ctx, c, id, err)
+	}
+	if job.PrunedBytes > 0 {
+		fmt.Fprintf(os.Stderr, "Pruned %.1f MiB\n", float64(job.PrunedBytes)/(1<<20))
+	}
+	if len(job.SkippedScripts) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped install scripts of %s\n", strings.Join(job.SkippedScripts, ", "))
+	}
+	if job.Retries > 0 {
+		fmt.Fprintf(os.Stderr, "Retried the install %d times after registry failures\n", job.Retries)
+	}
+	printWarnings(job.Warnings)
+
+	output := f.output
+	if output == "" && f.extract == "" {
+		output = archiveName(project.ecosystem, f.format)
+	}
+	var archive *os.File
+	if output != "" {
+		archive, err = os.Create(output)
+	} else {
+		archive, err = os.CreateTemp("", "pi-client-*")
+		if err == nil {
+			defer os.Remove(archive.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	digest, err := c.DownloadArtifact(ctx, job.ID, archive)
+	if err != nil {
+		return err
+	}
+	cached := ""
+	if job.Cached {
+		cached = ", cached"
+	}
+	if output != "" {
+		fmt.Fprintf(os.Stderr, "Saved %s (sha256 %s%s) in %s\n", output, digest, cached, time.Since(start).Round(100*time.Millisecond))
+	}
+	if f.extract != "" {
+		if err := extract(archive, f.extract); err != nil {
+			return fmt.Errorf("extracting the archive: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Extracted into %s (sha256 %s%s) in %s\n", f.extract, digest, cached, time.Since(start).Round(100*time.Millisecond))
+	}
+	return nil
+}
+
+// printWarnings prints what the package manager warned of
+func printWarnings(warnings []client.Warning) {
+	for _, w := range warnings {
+		if w.Kind == "deprecated" {
+			fmt.Fprintf(os.Stderr, "Warning: %s is deprecated: %s\n", w.Package, w.Message)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", w.Message)
+		}
+	}
+}
+
+// abandon cancels the job when waiting for it failed because pi-client was
+// interrupted, so it stops taking up a worker, and returns err
+func abandon(ctx context.Context, c *client.Client, id string, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	cancelCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, cerr := c.CancelJob(cancelCtx, id); cerr == nil {
+		fmt.Fprintf(os.Stderr, "Cancelled job %s\n", id)
+	}
+	return err
+}
+
+// dryRun prints what req would install, saving the lock file the server
+// resolved to lockPath when it is set
+func dryRun(ctx context.Context, c *client.Client, req *client.InstallRequest, lockPath string) error {
+	result, err := c.DryRun(ctx, req)
+	if err != nil {
+		return err
+	}
+	printWarnings(result.Warnings)
+	for _, p := range result.Added {
+		fmt.Printf("+ %s@%s\n", p.Name, p.Version)
+	}
+	for _, p := range result.Removed {
+		fmt.Printf("- %s@%s\n", p.Name, p.Version)
+	}
+	fmt.Fprintf(os.Stderr, "Would install %d packages (resolved in %.1fs)\n", len(result.Packages), float64(result.DurationMs)/1000)
+	if lockPath == "" {
+		return nil
+	}
+	if result.Lockfile == nil {
+		return fmt.Errorf("%s writes no lock file", result.Ecosystem)
+	}
+	return os.WriteFile(lockPath, []byte(result.Lockfile.Content), 0644)
+}
+
+// showProgress prints a job's phases, and with verbose its output, until it
+// finishes. If the event stream can't be read, WaitForJob polls instead.
+func showProgress(ctx context.Context, c *client.Client, job *client.Job, verbose bool) error {
+	if job.QueuePosition > 0 {
+		fmt.Fprintf(os.Stderr, "Queued at position %d\n", job.QueuePosition)
+	}
+	phase := ""
+	start := time.Now()
+	err := c.StreamLogs(ctx, job.ID, func(ev client.Event) error {
+		switch {
+		case ev.Type == "log" && verbose:
+			fmt.Fprintln(os.Stderr, "  "+ev.Line)
+		case ev.Type == "status" && ev.Phase != phase:
+			phase = ev.Phase
+			if phase != "queued" && phase != "done" {
+				fmt.Fprintf(os.Stderr, "%s... (%s)\n", strings.ToUpper(phase[:1])+phase[1:], time.Since(start).Round(100*time.Millisecond))
+			}
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "Can't follow the job's progress (%v); waiting for it to finish\n", err)
+		return nil
+	}
+	return err
+}
+
+// archiveName is the file an archive is saved as, named like the server's
+// downloads
+func archiveName(ecosystem, format string) string {
+	name := "node_modules"
+	switch ecosystem {
+	case "pip", "poetry":
+		name = "python_packages"
+	case "deno", "composer", "cargo":
+		name = "vendor"
+	case "bundler":
+		name = "bundle"
+	}
+	if format == "" {
+		format = "zip"
+	}
+	return name + "." + format
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// copyFile writes r to a new file at path with the given mode
+func copyFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
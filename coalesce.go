@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var coalescedInstalls = newCounterVec("pip_install_coalesced_installs_total",
+	"Installs and jobs that waited for an identical install already running rather than running the package manager, by ecosystem.", "ecosystem")
+
+// A build is an install queued or running on this server, which identical
+// requests arriving meanwhile wait for
+type build struct {
+	// jobID and events are the job's, for builds that are jobs
+	jobID  string
+	events *jobEvents
+	done   chan struct{}
+}
+
+// building records that the install with the given cache key is queued or
+// running here until the returned function is called, once its archive has
+// been cached or it has failed. An install already recorded under the key
+// keeps it.
+func (in *Installer) building(key, jobID string, events *jobEvents) (finish func()) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if _, ok := in.builds[key]; ok {
+		return func() {}
+	}
+	b := &build{jobID: jobID, events: events, done: make(chan struct{})}
+	in.builds[key] = b
+	return func() {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		if in.builds[key] == b {
+			delete(in.builds, key)
+			close(b.done)
+		}
+	}
+}
+
+// inflight returns the install recorded under a cache key, or nil
+func (in *Installer) inflight(key string) *build {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.builds[key]
+}
+
+// awaitBuild waits for the install recorded under a cache key, if there is
+// one, and reports whether there was and it finished while ctx lasted
+func (in *Installer) awaitBuild(ctx context.Context, eco *Ecosystem, key string) bool {
+	b := in.inflight(key)
+	if b == nil {
+		return false
+	}
+	coalescedInstalls.inc(eco.Name)
+	loggerFrom(ctx).Info("waiting for identical install in flight", "job_id", b.jobID)
+	select {
+	case <-b.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// follow runs a job that arrived while an identical install was queued or
+// running here. It mirrors that install's progress and, once its archive is
+// cached, succeeds with it like a cache hit. If the install failed or was
+// cancelled, the job runs on its own instead, since its failure may not be
+// this job's.
+func (m *JobManager) follow(job *Job, b *build) {
+	ctx := withLogger(trace.ContextWithSpanContext(job.ctx, job.span), job.logger)
+	if job.Owner != nil {
+		ctx = withPrincipal(ctx, *job.Owner)
+	}
+	coalescedInstalls.inc(job.Ecosystem)
+	job.logger.Info("job coalesced with identical install in flight", "coalesced_with", b.jobID)
+	// Builds that are jobs have events to mirror; others are only waited for
+	var changed <-chan struct{}
+	for seen, finished := 0, false; !finished; {
+		if b.events != nil {
+			var events []JobEvent
+			events, _, changed = b.events.since(seen)
+			seen += len(events)
+			for _, ev := range events {
+				m.mirror(job, ev)
+			}
+		}
+		select {
+		case <-changed:
+		case <-b.done:
+			finished = true
+		case <-job.ctx.Done():
+			defer m.active.Done()
+			err := jobCancellation(job.ctx)
+			if err == nil {
+				err = errShuttingDown
+			}
+			m.complete(ctx, job, "", nil, err)
+			return
+		}
+	}
+
+	artifact, ok := m.installer.cache.lookup(m.installer.store, job.cacheKey)
+	if ok {
+		artifact.Close()
+	}
+	if ok && checkInstallPolicies(ctx, job.eco, job.req, artifact.Packages) == nil {
+		defer m.active.Done()
+		m.mu.Lock()
+		job.PrunedBytes = artifact.PrunedBytes
+		job.Warnings = artifact.Report.installWarnings()
+		if artifact.Report != nil {
+			job.Provenance = artifact.Report.Provenance
+		}
+		job.Cached = true
+		m.mu.Unlock()
+		accounting.add(ctx, UsageCounts{CacheHits: 1})
+		m.complete(ctx, job, artifact.Digest, artifact.SkippedScripts, nil)
+		return
+	}
+
+	job.logger.Info("identical install failed, running job on its own", "coalesced_with", b.jobID)
+	slot, err := m.installer.pool.enqueue()
+	m.mu.Lock()
+	job.Status, job.StartedAt, job.CoalescedWith, job.slot = JobQueued, nil, "", slot
+	m.mu.Unlock()
+	if err != nil {
+		defer m.active.Done()
+		m.complete(ctx, job, "", nil, err)
+		return
+	}
+	job.events.status(PhaseQueued, JobQueued)
+	m.run(job)
+}
+
+// mirror copies an event of the install a job follows to the job's own,
+// but for the first and last, and starts the job when the install starts
+func (m *JobManager) mirror(job *Job, ev JobEvent) {
+	if ev.Phase == PhaseQueued || ev.Phase == PhaseDone {
+		return
+	}
+	if ev.Status == JobRunning {
+		m.mu.Lock()
+		if job.Status == JobQueued {
+			job.Status, job.StartedAt = JobRunning, timePtr(time.Now().UTC())
+		}
+		m.mu.Unlock()
+	}
+	job.events.append(JobEvent{Type: ev.Type, Phase: ev.Phase, Status: ev.Status, Stream: ev.Stream, Line: ev.Line}, false)
+}
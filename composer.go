@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Accept composer.json and optional composer.lock
+// When composer.lock is present the install is the versions it pins
+// The output is a zip of the installed vendor directory
+var composerEcosystem = &Ecosystem{
+	Name:     "composer",
+	Tool:     "composer",
+	Runtime:  "php",
+	Registry: "https://repo.packagist.org/",
+	Image:    "composer:2.8.4",
+	Files: []ManifestFile{
+		{Name: "composer.json", Required: true},
+		{Name: "composer.lock"},
+		// Composer reads credentials for private repositories from an
+		// auth.json next to composer.json
+		{Name: "auth.json", Secret: true},
+	},
+	Args: func(files map[string]string) []string {
+		return []string{"install", "--no-interaction", "--no-progress", "--optimize-autoloader"}
+	},
+	OmitArgs: map[string][]string{
+		"dev": {"--no-dev"},
+	},
+	// Plugins run code from the packages as well as scripts
+	NoScriptsArgs:  []string{"--no-scripts", "--no-plugins"},
+	FileRegistries: composerRegistries,
+	CacheEnv:       func(dir string) []string { return []string{"COMPOSER_CACHE_DIR=" + dir} },
+	Packages:       composerPackages,
+	LockedPackages: composerLockedPackages,
+	FromPackages:   composerFromPackages,
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "vendor"), nil
+	},
+	ArchiveRoot: "vendor",
+	ArchiveName: "vendor",
+}
+
+// A composerRepository is an entry of composer.json's repositories
+type composerRepository struct {
+	Type    string          `json:"type"`
+	URL     string          `json:"url"`
+	Package json.RawMessage `json:"package"`
+}
+
+// A composerInlinePackage is a package a package repository defines, with
+// where it is downloaded from
+type composerInlinePackage struct {
+	Dist struct {
+		URL string `json:"url"`
+	} `json:"dist"`
+	Source struct {
+		URL string `json:"url"`
+	} `json:"source"`
+}
+
+// composerRegistries lists the URLs of the repositories composer.json
+// adds, and those the packages it defines inline are fetched from. path
+// and artifact repositories read directories of the server's, so they are
+// refused.
+func composerRegistries(files map[string]string) ([]fileRegistry, error) {
+	var manifest struct {
+		Repositories json.RawMessage `json:"repositories"`
+	}
+	if json.Unmarshal([]byte(files["composer.json"]), &manifest) != nil || manifest.Repositories == nil {
+		return nil, nil
+	}
+	// repositories is a list, or an object keyed by name
+	var entries []json.RawMessage
+	if json.Unmarshal(manifest.Repositories, &entries) != nil {
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(manifest.Repositories, &named); err != nil {
+			return nil, badRequest("composer.json: repositories must be a list or an object")
+		}
+		for _, entry := range named {
+			entries = append(entries, entry)
+		}
+	}
+	var sources []fileRegistry
+	for _, entry := range entries {
+		var repo composerRepository
+		// Entries such as {"packagist.org": false} turn a repository off
+		if json.Unmarshal(entry, &repo) != nil {
+			continue
+		}
+		switch strings.ToLower(repo.Type) {
+		case "path", "artifact":
+			return nil, badRequest("composer.json adds a %s repository: only repositories named by URL can be checked against the server's list of allowed registries", repo.Type)
+		case "package":
+			// package is one package, or a list of its versions
+			var pkgs []composerInlinePackage
+			if json.Unmarshal(repo.Package, &pkgs) != nil {
+				var pkg composerInlinePackage
+				json.Unmarshal(repo.Package, &pkg)
+				pkgs = []composerInlinePackage{pkg}
+			}
+			for _, pkg := range pkgs {
+				for _, u := range []string{pkg.Dist.URL, pkg.Source.URL} {
+					if u != "" {
+						sources = append(sources, fileRegistry{file: "composer.json", url: u})
+					}
+				}
+			}
+		default:
+			if repo.URL != "" {
+				sources = append(sources, fileRegistry{file: "composer.json", url: repo.URL})
+			}
+		}
+	}
+	return sources, nil
+}
+
+// A composerPackage is a package as composer.lock and installed.json
+// describe it
+type composerPackage struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	License []string `json:"license"`
+}
+
+func (p composerPackage) pkg() Package {
+	return Package{
+		Name:    p.Name,
+		Version: p.Version,
+		License: strings.Join(p.License, " OR "),
+		PURL:    "pkg:composer/" + p.Name + "@" + url.PathEscape(p.Version),
+	}
+}
+
+// composerPackages lists the packages in a vendor directory from
+// composer/installed.json, an object holding a packages list since
+// Composer 2 and the bare list before
+func composerPackages(outputDir string) ([]Package, error) {
+	b, err := os.ReadFile(filepath.Join(outputDir, "composer", "installed.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var installed struct {
+		Packages []composerPackage `json:"packages"`
+	}
+	if err := json.Unmarshal(b, &installed); err != nil {
+		if err := json.Unmarshal(b, &installed.Packages); err != nil {
+			return nil, err
+		}
+	}
+	pkgs := make([]Package, len(installed.Packages))
+	for i, p := range installed.Packages {
+		pkgs[i] = p.pkg()
+	}
+	return pkgs, nil
+}
+
+// composerLockedPackages lists the packages a composer.lock pins, dev
+// dependencies included
+func composerLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["composer.lock"]
+	if lock == "" {
+		return nil, nil
+	}
+	var doc struct {
+		Packages    []composerPackage `json:"packages"`
+		PackagesDev []composerPackage `json:"packages-dev"`
+	}
+	if err := json.Unmarshal([]byte(lock), &doc); err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, p := range append(doc.Packages, doc.PackagesDev...) {
+		pkgs = append(pkgs, Package{Name: p.Name, Version: p.Version})
+	}
+	return pkgs, nil
+}
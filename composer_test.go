@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestComposerRegistries(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "no repositories", manifest: `{"require": {"monolog/monolog": "^3"}}`},
+		{name: "packagist off", manifest: `{"repositories": [{"packagist.org": false}]}`},
+		{name: "composer", manifest: `{"repositories": [{"type": "composer", "url": "https://evil/"}]}`, want: []string{"https://evil/"}},
+		{name: "vcs", manifest: `{"repositories": [{"type": "vcs", "url": "git@evil:x/y.git"}]}`, want: []string{"git@evil:x/y.git"}},
+		{name: "named", manifest: `{"repositories": {"corp": {"type": "composer", "url": "https://evil/"}}}`, want: []string{"https://evil/"}},
+		{
+			name:     "inline package",
+			manifest: `{"repositories": [{"type": "package", "package": {"name": "a/b", "dist": {"url": "https://evil/b.zip"}, "source": {"url": "https://evil/b.git"}}}]}`,
+			want:     []string{"https://evil/b.zip", "https://evil/b.git"},
+		},
+		{
+			name:     "inline package versions",
+			manifest: `{"repositories": [{"type": "package", "package": [{"dist": {"url": "https://evil/1.zip"}}, {"dist": {"url": "https://evil/2.zip"}}]}]}`,
+			want:     []string{"https://evil/1.zip", "https://evil/2.zip"},
+		},
+		{name: "path", manifest: `{"repositories": [{"type": "path", "url": "/tmp/pip_work_*"}]}`, wantErr: true},
+		{name: "artifact", manifest: `{"repositories": [{"type": "artifact", "url": "../"}]}`, wantErr: true},
+		{name: "path in capitals", manifest: `{"repositories": [{"type": "PATH", "url": "/"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := composerRegistries(map[string]string{"composer.json": tt.manifest})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("composerRegistries() = %v, want an error", sources)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("composerRegistries() failed: %v", err)
+			}
+			var got []string
+			for _, s := range sources {
+				got = append(got, s.url)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("composerRegistries() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
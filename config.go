@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Config holds the server settings. Each one can be given as a command-line
+// flag (-install-timeout), an environment variable (INSTALL_TIMEOUT) or a key
+// in the YAML config file (install_timeout), in that order of precedence.
+type Config struct {
+	// Role is serve or worker when the first argument names one, and all
+	// otherwise
+	Role string
+
+	Port     int
+	GRPCPort int
+	WorkDir  string
+
+	ArtifactDir      string
+	ArtifactTTL      time.Duration
+	CacheMaxEntries  int
+	ZstdLevel        int
+	Compression      string
+	CompressionLevel int
+
+	InstallTimeout         time.Duration
+	InstallMaxTimeout      time.Duration
+	InstallRetries         int
+	InstallRetryBackoff    time.Duration
+	CircuitFailureRate     float64
+	CircuitWindow          time.Duration
+	CircuitCooldown        time.Duration
+	ShutdownTimeout        time.Duration
+	WorkspaceQuotaMB       int
+	TmpfsDir               string
+	TmpfsWorkspaceMaxMB    int
+	ProjectMaxMB           int
+	BodyMaxMB              int
+	PackageCacheDir        string
+	PackageCacheMaxMB      int
+	PackageCacheGCInterval time.Duration
+	RegistryProxyDir       string
+	RegistryProxyListen    string
+	RegistryProxyURL       string
+	RegistryProxyUpstream  string
+	RegistryProxyTTL       time.Duration
+	CacheWarmWindow        string
+	InstallMemoryMB        int
+	InstallCPUWeight       int
+	CgroupParent           string
+	Executor               string
+	ToolchainDir           string
+	NodeDistURL            string
+	RubiesDir              string
+	ScriptsPolicy          string
+	AuditFailOn            string
+	VerifyProvenance       string
+	RequireIntegrity       bool
+	LicenseDenylist        string
+	PolicyFile             string
+	PolicyReloadInterval   time.Duration
+	OPAURL                 string
+	OPAPolicy              string
+	OPAQuery               string
+	SigningKeyFile         string
+	S3Buckets              string
+	S3Endpoint             string
+	S3Region               string
+	S3PathStyle            bool
+	S3AccessKeyID          string
+	S3SecretAccessKey      string
+	S3SessionToken         string
+	GCSBuckets             string
+	GCSCredentialsFile     string
+	GCSEndpoint            string
+	AzureContainers        string
+	AzureAccount           string
+	AzureAccountKey        string
+	AzureEndpoint          string
+	OCIRepositories        string
+	OCIAuthFile            string
+	OCIInsecureRegistries  string
+	ImageBaseImages        string
+	ImageDefaultBase       string
+	OutputDefaultType      string
+	OutputURLTTL           time.Duration
+	DockerImages           string
+	DockerNetwork          string
+	MaxConcurrentInstalls  int
+	MaxQueuedInstalls      int
+
+	RateLimitRPM        float64
+	RateLimitBurst      float64
+	RateLimitConcurrent int
+	TrustedProxies      string
+
+	APIKeys      string
+	APIKeysFile  string
+	OIDCIssuer   string
+	OIDCJWKSURL  string
+	OIDCAudience string
+	OIDCOrgClaim string
+	TenantsFile  string
+	Admins       string
+
+	UsageFile      string
+	UsageRetention time.Duration
+
+	IdempotencyWindow time.Duration
+
+	AuditLog string
+
+	WebhookSecret string
+
+	JobQueue                string
+	RedisURL                string
+	RedisKeyPrefix          string
+	JobSecretsKey           string
+	WorkerHeartbeatInterval time.Duration
+
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+
+	AllowedRegistries string
+	AllowedNpmArgs    string
+	DefaultNpmrc      string
+	DefaultPipConf    string
+	NpmScopes         string
+	PrunePatterns     string
+
+	ReadyEcosystems    string
+	ReadyMinFreeMB     int
+	ReadyCheckRegistry bool
+
+	// settings records where each value came from, for /config
+	settings *settings
+}
+
+// settings describes the registered options
+type settings struct {
+	fs *flag.FlagSet
+	// secret settings are redacted by /config
+	secret map[string]bool
+	// source is "flag", "env" or "file" for settings that were given
+	source map[string]string
+}
+
+// loadConfig reads the configuration from args, the environment and the file
+// named by -config or CONFIG_FILE. The first argument may be the role.
+func loadConfig(args []string) (*Config, error) {
+	c := &Config{Role: "all"}
+	if len(args) > 0 && (args[0] == "serve" || args[0] == "worker") {
+		c.Role, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("pip-install", flag.ContinueOnError)
+	s := &settings{fs: fs, secret: make(map[string]bool), source: make(map[string]string)}
+	c.settings = s
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config `file` (env CONFIG_FILE)")
+	fs.IntVar(&c.Port, "port", 8080, "Port to listen on")
+	fs.IntVar(&c.GRPCPort, "grpc-port", 0, "Port to serve the gRPC API on (default none)")
+	fs.StringVar(&c.WorkDir, "work-dir", "", "Directory for install workspaces (default the system temp directory)")
+
+	fs.StringVar(&c.ArtifactDir, "artifact-dir", "", "Where artifacts are stored (default a new temporary directory)")
+	fs.DurationVar(&c.ArtifactTTL, "artifact-ttl", time.Hour, "How long artifacts and finished jobs are kept")
+	fs.IntVar(&c.CacheMaxEntries, "cache-max-entries", defaultCacheEntries, "Inputs remembered by the result cache")
+	fs.IntVar(&c.ZstdLevel, "zstd-level", zstdLevel, "Compression level for tar.zst archives, 1 to 22")
+	fs.StringVar(&c.Compression, "compression", compression, "How zip and tar.gz archives are compressed unless a request asks otherwise: store or deflate")
+	fs.IntVar(&c.CompressionLevel, "compression-level", compressionLevel, "Deflate level for zip and tar.gz archives, 1 to 9")
+
+	fs.DurationVar(&c.InstallTimeout, "install-timeout", installTimeout, "Default limit for a package manager run")
+	fs.DurationVar(&c.InstallMaxTimeout, "install-max-timeout", maxInstallTimeout, "Largest install timeout a request may ask for")
+	fs.IntVar(&c.InstallRetries, "install-retries", installRetries, "Times an install that failed to reach the registry is run again")
+	fs.DurationVar(&c.InstallRetryBackoff, "install-retry-backoff", installRetryBackoff, "Wait before the first retry of an install, doubled for each one after")
+	fs.Float64Var(&c.CircuitFailureRate, "circuit-failure-rate", 0.5, "Share of recent installs failing to reach a registry that stops installs from it (0 to never stop)")
+	fs.DurationVar(&c.CircuitWindow, "circuit-window", time.Minute, "How far back the circuit breaker counts installs")
+	fs.DurationVar(&c.CircuitCooldown, "circuit-cooldown", 30*time.Second, "How long installs from a failing registry fail fast before one probes it")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "How long running installs may take to finish on shutdown")
+	fs.IntVar(&c.WorkspaceQuotaMB, "workspace-quota-mb", 0, "Disk space in MiB each install may use (0 for unlimited)")
+	fs.StringVar(&c.TmpfsDir, "tmpfs-dir", "", "tmpfs mount install workspaces are created on while it has room (default none)")
+	fs.IntVar(&c.TmpfsWorkspaceMaxMB, "tmpfs-workspace-max-mb", int(tmpfsWorkspaceMax>>20), "Size in MiB past which an install on tmpfs is moved to work_dir")
+	fs.IntVar(&c.ProjectMaxMB, "project-max-mb", int(maxProjectSize>>20), "Largest unpacked size in MiB of a posted project archive")
+	fs.IntVar(&c.BodyMaxMB, "body-max-mb", int(maxBodySize>>20), "Largest JSON request body in MiB")
+	fs.StringVar(&c.PackageCacheDir, "package-cache-dir", "", "Directory package managers share downloaded packages in between installs (default no shared cache)")
+	fs.IntVar(&c.PackageCacheMaxMB, "package-cache-max-mb", 0, "Size in MiB the shared package cache is trimmed to (0 for unlimited)")
+	fs.DurationVar(&c.PackageCacheGCInterval, "package-cache-gc-interval", 10*time.Minute, "How often the shared package cache is measured and trimmed")
+	fs.StringVar(&c.RegistryProxyDir, "registry-proxy-dir", "", "Directory the npm registry proxy caches package documents and tarballs in (default no proxy)")
+	fs.StringVar(&c.RegistryProxyListen, "registry-proxy-listen", "127.0.0.1:0", "Address the registry proxy listens on; port 0 picks a free one")
+	fs.StringVar(&c.RegistryProxyURL, "registry-proxy-url", "", "URL installs reach the registry proxy at (default its listen address)")
+	fs.StringVar(&c.RegistryProxyUpstream, "registry-proxy-upstream", "https://registry.npmjs.org/", "Registry the proxy caches")
+	fs.DurationVar(&c.RegistryProxyTTL, "registry-proxy-ttl", 5*time.Minute, "How long the proxy serves a cached package document before asking the registry again")
+	fs.StringVar(&c.CacheWarmWindow, "cache-warm-window", "", "Hours of the day, such as 01:00-06:00 in the server's time zone, when cache warm-ups may run (default any time)")
+	fs.IntVar(&c.InstallMemoryMB, "install-memory-mb", 0, "Memory in MiB each install may use (0 for unlimited)")
+	fs.IntVar(&c.InstallCPUWeight, "install-cpu-weight", 0, "cgroup cpu.weight of each install, 1 to 10000 (0 for the default)")
+	fs.StringVar(&c.CgroupParent, "cgroup-parent", "", "cgroup v2 directory install groups are created in, such as /sys/fs/cgroup/pip-install")
+	fs.StringVar(&c.Executor, "executor", "host", "Where package managers run: host, docker, bwrap or nsjail")
+	fs.StringVar(&c.ScriptsPolicy, "scripts-policy", scriptsPolicy, "Whether package scripts run: ignore (unless a request allows them), force (never) or allow (unless a request skips them)")
+	fs.StringVar(&c.ToolchainDir, "toolchain-dir", defaultToolchainDir(), "Where Node.js releases for node_version are kept")
+	fs.StringVar(&c.NodeDistURL, "node-dist-url", "https://nodejs.org/dist", "Where Node.js releases are downloaded from")
+	fs.StringVar(&c.RubiesDir, "rubies-dir", "/opt/rubies", "Where the Ruby releases for ruby_version are installed, one directory per release")
+	fs.StringVar(&c.AuditFailOn, "audit-fail-on", "", "Fail installs with advisories of this severity or worse: critical, high, moderate, low or info")
+	fs.BoolVar(&c.RequireIntegrity, "require-integrity", false, "Fail pnpm and yarn installs unless their lock file pins every package with an integrity hash")
+	fs.StringVar(&c.VerifyProvenance, "verify-provenance", "", "Fail Node.js installs whose packages lack valid registry signatures (signatures) or also provenance attestations (attestations)")
+	fs.StringVar(&c.LicenseDenylist, "license-denylist", "", "Comma-separated SPDX licenses installs may not contain; AGPL-* matches a prefix and UNKNOWN packages without one")
+	fs.StringVar(&c.PolicyFile, "policy-file", "", "YAML `file` of package deny and allow rules")
+	fs.DurationVar(&c.PolicyReloadInterval, "policy-reload-interval", 30*time.Second, "How often to check the policy file for changes (0 to never)")
+	fs.StringVar(&c.OPAURL, "opa-url", "", "OPA Data API URL installs are checked against, such as http://opa:8181/v1/data/pip_install/decision")
+	fs.StringVar(&c.OPAPolicy, "opa-policy", "", "Rego `file` installs are checked against with the opa binary")
+	fs.StringVar(&c.OPAQuery, "opa-query", defaultOPAQuery, "Rule of opa_policy that decides installs")
+	fs.StringVar(&c.SigningKeyFile, "signing-key-file", "", "PEM ECDSA or RSA private key `file` artifacts are signed with")
+	fs.StringVar(&c.S3Buckets, "s3-buckets", "", "Comma-separated S3 buckets the output option may upload to")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", "", "S3 endpoint URL, such as http://minio:9000 (default AWS S3 in s3_region)")
+	fs.StringVar(&c.S3Region, "s3-region", "us-east-1", "Region S3 requests are signed for")
+	fs.BoolVar(&c.S3PathStyle, "s3-path-style", false, "Address buckets as endpoint/bucket rather than bucket.endpoint, as MinIO needs")
+	fs.StringVar(&c.S3AccessKeyID, "s3-access-key-id", "", "Access key ID for S3 uploads")
+	fs.StringVar(&c.S3SecretAccessKey, "s3-secret-access-key", "", "Secret access key for S3 uploads")
+	fs.StringVar(&c.S3SessionToken, "s3-session-token", "", "Session token for temporary S3 credentials")
+	fs.StringVar(&c.GCSBuckets, "gcs-buckets", "", "Comma-separated Google Cloud Storage buckets the output option may upload to")
+	fs.StringVar(&c.GCSCredentialsFile, "gcs-credentials-file", "", "Service account JSON key `file` for GCS uploads")
+	fs.StringVar(&c.GCSEndpoint, "gcs-endpoint", "https://storage.googleapis.com", "GCS XML API endpoint URL")
+	fs.StringVar(&c.AzureContainers, "azure-containers", "", "Comma-separated Azure Blob Storage containers the output option may upload to")
+	fs.StringVar(&c.AzureAccount, "azure-account", "", "Azure storage account for uploads")
+	fs.StringVar(&c.AzureAccountKey, "azure-account-key", "", "Base64 shared key of azure_account")
+	fs.StringVar(&c.AzureEndpoint, "azure-endpoint", "", "Blob endpoint URL, such as http://azurite:10000/devstoreaccount1 (default https://<azure_account>.blob.core.windows.net)")
+	fs.StringVar(&c.OCIRepositories, "oci-repositories", "", "Comma-separated repository prefixes, such as ghcr.io/acme/, the output option may push to")
+	fs.StringVar(&c.OCIAuthFile, "oci-auth-file", "", "Docker config.json `file` holding registry credentials for pushes")
+	fs.StringVar(&c.OCIInsecureRegistries, "oci-insecure-registries", "", "Comma-separated registry hosts pushed to over plain HTTP")
+	fs.StringVar(&c.ImageBaseImages, "image-base-images", "", "Comma-separated repository prefixes, such as docker.io/library/node, image outputs may build on")
+	fs.StringVar(&c.ImageDefaultBase, "image-default-base", "", "Base image of image outputs that name none (default none, as with scratch)")
+	fs.StringVar(&c.OutputDefaultType, "output-default-type", "", "Store the output option uploads to when a request names none: s3, gcs, azure or oci")
+	fs.DurationVar(&c.OutputURLTTL, "output-url-ttl", time.Hour, "How long the download URLs returned for uploads work, up to 168h")
+	fs.StringVar(&c.DockerImages, "docker-images", "", "Comma-separated ecosystem=image overrides for the docker executor")
+	fs.StringVar(&c.DockerNetwork, "docker-network", "", "Docker network install containers join (default docker's bridge)")
+	fs.IntVar(&c.MaxConcurrentInstalls, "max-concurrent-installs", defaultMaxInstalls, "Installs run at once")
+	fs.IntVar(&c.MaxQueuedInstalls, "max-queued-installs", defaultMaxQueued, "Installs that may wait for a slot")
+
+	fs.Float64Var(&c.RateLimitRPM, "rate-limit-rpm", 0, "Install requests per client per minute (0 for unlimited)")
+	fs.Float64Var(&c.RateLimitBurst, "rate-limit-burst", 0, "Install requests a client may make at once (default rate-limit-rpm)")
+	fs.IntVar(&c.RateLimitConcurrent, "rate-limit-concurrent", 0, "Installs each client may have in flight (0 for unlimited)")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", "", "Comma-separated addresses and CIDR ranges of proxies whose X-Forwarded-For gives the client's address")
+
+	fs.StringVar(&c.APIKeys, "api-keys", "", "Comma-separated label:key pairs")
+	fs.StringVar(&c.APIKeysFile, "api-keys-file", "", "File of label:key pairs, one per line")
+	fs.StringVar(&c.OIDCIssuer, "oidc-issuer", "", "Issuer URL of accepted JWTs")
+	fs.StringVar(&c.OIDCJWKSURL, "oidc-jwks-url", "", "JWKS URL (default discovered from the issuer)")
+	fs.StringVar(&c.OIDCAudience, "oidc-audience", "", "Required aud claim of JWTs")
+	fs.StringVar(&c.OIDCOrgClaim, "oidc-org-claim", "org", "JWT claim holding the caller's organisation")
+	fs.StringVar(&c.Admins, "admins", "", "Comma-separated callers allowed the admin routes, as key:<label>, org:<org> or sub:<subject>")
+	fs.StringVar(&c.UsageFile, "usage-file", "", "JSON `file` usage is kept in across restarts (default kept in memory)")
+	fs.DurationVar(&c.UsageRetention, "usage-retention", 90*24*time.Hour, "How long hourly usage is kept for GET /usage")
+	fs.StringVar(&c.AuditLog, "audit-log", "", "Append-only `file` every install is recorded in, one JSON object per line, for GET /admin/audit")
+	fs.DurationVar(&c.IdempotencyWindow, "idempotency-window", time.Hour, "How long an Idempotency-Key keeps naming the job it was sent with; at most artifact_ttl")
+	fs.StringVar(&c.TenantsFile, "tenants-file", "", "YAML `file` of tenants, grouping callers by API key or organisation, with their quotas")
+
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", "", "Key for signing webhook callbacks")
+
+	fs.StringVar(&c.JobQueue, "job-queue", "memory", "Where jobs are queued: memory, or redis to share them between replicas")
+	fs.StringVar(&c.RedisURL, "redis-url", "", "Redis server for the redis job queue, such as redis://:password@host:6379/0")
+	fs.StringVar(&c.RedisKeyPrefix, "redis-key-prefix", "pip-install:", "Prefix of the Redis keys the job queue uses")
+	fs.StringVar(&c.JobSecretsKey, "job-secrets-key", "", "Key sealing the secret files of jobs in the redis job queue; without one such jobs are refused")
+	fs.DurationVar(&c.WorkerHeartbeatInterval, "worker-heartbeat-interval", 10*time.Second, "How often replicas report to the shared job queue; the jobs of one silent for three intervals are requeued")
+
+	fs.StringVar(&c.TLSCertFile, "tls-cert-file", "", "PEM certificate for serving HTTPS")
+	fs.StringVar(&c.TLSKeyFile, "tls-key-file", "", "PEM key for serving HTTPS")
+	fs.DurationVar(&c.TLSReloadInterval, "tls-reload-interval", 0, "How often to check the certificate for rotation (0 to never)")
+
+	fs.StringVar(&c.AllowedRegistries, "allowed-registries", "", "Comma-separated registry URLs requests may install from")
+	fs.StringVar(&c.AllowedNpmArgs, "allowed-npm-args", "", "Comma-separated flags requests may pass to yarn and pnpm in npm_args; --flag=* allows any value")
+	fs.StringVar(&c.DefaultNpmrc, "default-npmrc", "", "`File` used as .npmrc by yarn and pnpm installs that don't send one")
+	fs.StringVar(&c.DefaultPipConf, "default-pip-conf", "", "`File` used as pip.conf by pip installs that don't send one")
+	fs.StringVar(&c.NpmScopes, "npm-scopes", "", "Comma-separated @scope=registry=env:VAR or @scope=registry=file:PATH entries for yarn and pnpm")
+	fs.StringVar(&c.PrunePatterns, "prune-patterns", "", "Comma-separated file name globs the prune option removes, replacing the defaults; dir/ matches directories")
+
+	fs.StringVar(&c.ReadyEcosystems, "ready-ecosystems", strings.Join(ecosystemNames(), ","), "Comma-separated ecosystems /readyz requires")
+	fs.IntVar(&c.ReadyMinFreeMB, "ready-min-free-mb", 1024, "Free space in MiB /readyz requires for workspaces")
+	fs.BoolVar(&c.ReadyCheckRegistry, "ready-check-registry", true, "Whether /readyz requires the ecosystems' registries to answer")
+
+	s.secret["api-keys"] = true
+	s.secret["webhook-secret"] = true
+	// It may hold a password
+	s.secret["redis-url"] = true
+	s.secret["job-secrets-key"] = true
+	s.secret["s3-secret-access-key"] = true
+	s.secret["s3-session-token"] = true
+	s.secret["azure-account-key"] = true
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: pip-install [serve | worker] [flags]\n\n"+
+			"serve answers the API and leaves installs to worker processes sharing its job\n"+
+			"queue; with neither the process does both.\n\n"+
+			"Every flag can also be set with an environment variable such as INSTALL_TIMEOUT,\n"+
+			"or a key such as install_timeout in the YAML config file.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) { s.source[f.Name] = "flag" })
+	if s.source["config"] == "" && os.Getenv("CONFIG_FILE") != "" {
+		s.source["config"] = "env"
+	}
+
+	if *configFile != "" {
+		if err := s.applyFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || s.source[f.Name] == "flag" {
+			return
+		}
+		env := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v := os.Getenv(env); v != "" {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %v", env, v, err))
+			}
+			s.source[f.Name] = "env"
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+// applyFile sets the options given in a YAML file. Flags given explicitly
+// are left alone; environment variables are applied afterwards.
+func (s *settings) applyFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	for key, v := range values {
+		flagName := strings.ReplaceAll(key, "_", "-")
+		f := s.fs.Lookup(flagName)
+		if f == nil || flagName == "config" {
+			return fmt.Errorf("%s: unknown setting %q", name, key)
+		}
+		if s.source[flagName] == "flag" {
+			continue
+		}
+		value := fmt.Sprint(v)
+		if list, ok := v.([]any); ok {
+			parts := make([]string, len(list))
+			for i, item := range list {
+				parts[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(parts, ",")
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %v", name, key, value, err)
+		}
+		s.source[flagName] = "file"
+	}
+	return nil
+}
+
+// validate checks values that parse but make no sense, and fills in defaults
+// that depend on other settings
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535")
+	check(c.GRPCPort >= 0 && c.GRPCPort < 65536, "grpc_port must be between 1 and 65535, or 0 for none")
+	check(c.GRPCPort != c.Port, "grpc_port must differ from port")
+	check(c.ArtifactTTL > 0, "artifact_ttl must be positive")
+	check(c.UsageRetention > 0, "usage_retention must be positive")
+	check(c.IdempotencyWindow > 0 && c.IdempotencyWindow <= c.ArtifactTTL, "idempotency_window must be positive and no longer than artifact_ttl")
+	check(c.CacheMaxEntries >= 1, "cache_max_entries must be at least 1")
+	check(c.ZstdLevel >= 1 && c.ZstdLevel <= 22, "zstd_level must be between 1 and 22")
+	check(slices.Contains(compressionMethods, c.Compression), "compression must be one of %s", strings.Join(compressionMethods, ", "))
+	check(c.CompressionLevel >= 1 && c.CompressionLevel <= 9, "compression_level must be between 1 and 9")
+	check(c.InstallTimeout > 0, "install_timeout must be positive")
+	check(c.InstallMaxTimeout > 0, "install_max_timeout must be positive")
+	check(c.InstallRetries >= 0, "install_retries must not be negative")
+	check(c.InstallRetryBackoff >= 0, "install_retry_backoff must not be negative")
+	check(c.CircuitFailureRate >= 0 && c.CircuitFailureRate <= 1, "circuit_failure_rate must be between 0 and 1")
+	check(c.CircuitWindow > 0, "circuit_window must be positive")
+	check(c.CircuitCooldown > 0, "circuit_cooldown must be positive")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+	check(c.MaxConcurrentInstalls >= 1, "max_concurrent_installs must be at least 1")
+	check(c.MaxQueuedInstalls >= 1, "max_queued_installs must be at least 1")
+	check(c.RateLimitRPM >= 0 && c.RateLimitBurst >= 0 && c.RateLimitConcurrent >= 0, "rate limits must not be negative")
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "tls_cert_file and tls_key_file must be set together")
+	check(c.TLSReloadInterval >= 0, "tls_reload_interval must not be negative")
+	check(c.WorkspaceQuotaMB >= 0, "workspace_quota_mb must not be negative")
+	check(c.TmpfsWorkspaceMaxMB >= 1, "tmpfs_workspace_max_mb must be at least 1")
+	check(c.ProjectMaxMB >= 1, "project_max_mb must be at least 1")
+	check(c.BodyMaxMB >= 1, "body_max_mb must be at least 1")
+	check(c.PackageCacheMaxMB >= 0, "package_cache_max_mb must not be negative")
+	check(c.PackageCacheGCInterval > 0, "package_cache_gc_interval must be positive")
+	check(c.RegistryProxyTTL >= 0, "registry_proxy_ttl must not be negative")
+	if c.RegistryProxyURL != "" {
+		u, err := url.Parse(c.RegistryProxyURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "registry_proxy_url must be an absolute http or https URL")
+	}
+	if c.CacheWarmWindow != "" {
+		_, err := parseWarmWindow(c.CacheWarmWindow)
+		check(err == nil, "cache_warm_window must be two times of day such as 01:00-06:00")
+	}
+	check(c.InstallMemoryMB >= 0, "install_memory_mb must not be negative")
+	check(c.InstallCPUWeight >= 0 && c.InstallCPUWeight <= 10000, "install_cpu_weight must be between 1 and 10000")
+	check(c.InstallMemoryMB == 0 && c.InstallCPUWeight == 0 || c.Executor == "docker" || c.CgroupParent != "",
+		"install_memory_mb and install_cpu_weight need cgroup_parent unless executor is docker")
+	switch c.JobQueue {
+	case "memory":
+	case "redis":
+		_, err := newRedisClient(c.RedisURL)
+		check(err == nil, "job_queue redis needs redis_url to be a redis:// or rediss:// URL")
+	default:
+		check(false, "job_queue must be memory or redis")
+	}
+	check(c.WorkerHeartbeatInterval > 0, "worker_heartbeat_interval must be positive")
+	check(c.Role == "all" || c.JobQueue == "redis", "the %s role needs job_queue redis", c.Role)
+	check(c.ReadyMinFreeMB >= 0, "ready_min_free_mb must not be negative")
+	for _, admin := range splitList(c.Admins) {
+		kind, name, _ := strings.Cut(admin, ":")
+		check((kind == "key" || kind == "org" || kind == "sub") && name != "", "admins: %q must be key:<label>, org:<org> or sub:<subject>", admin)
+	}
+	for _, raw := range splitList(c.AllowedRegistries) {
+		u, err := url.Parse(raw)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "allowed_registries: %q is not an absolute http or https URL", raw)
+	}
+	if len(splitList(c.S3Buckets)) > 0 {
+		check(c.S3AccessKeyID != "" && c.S3SecretAccessKey != "", "s3_buckets needs s3_access_key_id and s3_secret_access_key")
+		u, err := url.Parse(c.s3Endpoint())
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "s3_endpoint must be an absolute http or https URL")
+	}
+	if len(splitList(c.GCSBuckets)) > 0 {
+		check(c.GCSCredentialsFile != "", "gcs_buckets needs gcs_credentials_file")
+		u, err := url.Parse(c.GCSEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "gcs_endpoint must be an absolute http or https URL")
+	}
+	if len(splitList(c.AzureContainers)) > 0 {
+		_, err := base64.StdEncoding.DecodeString(c.AzureAccountKey)
+		check(c.AzureAccount != "" && c.AzureAccountKey != "" && err == nil, "azure_containers needs azure_account and a base64 azure_account_key")
+		u, err := url.Parse(c.azureEndpoint())
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "azure_endpoint must be an absolute http or https URL")
+	}
+	for _, prefix := range splitList(c.OCIRepositories) {
+		host, path, _ := strings.Cut(strings.TrimSuffix(prefix, "/"), "/")
+		check((strings.ContainsAny(host, ".:") || host == "localhost") && (path == "" || ociRepositoryPattern.MatchString(path)),
+			"oci_repositories: %q is not a registry host and optional repository path", prefix)
+	}
+	if c.ImageDefaultBase != "" && c.ImageDefaultBase != "scratch" {
+		repository, _, ok := parseImageReference(c.ImageDefaultBase)
+		check(ok && baseImageAllowed(splitList(c.ImageBaseImages), repository), "image_default_base must be an image reference in image_base_images")
+	}
+	check(c.OutputURLTTL >= time.Second && c.OutputURLTTL <= maxSignedURLTTL, "output_url_ttl must be between 1s and 168h")
+	switch c.OutputDefaultType {
+	case "":
+	case "s3":
+		check(c.S3Buckets != "", "output_default_type s3 needs s3_buckets")
+	case "gcs":
+		check(c.GCSBuckets != "", "output_default_type gcs needs gcs_buckets")
+	case "azure":
+		check(c.AzureContainers != "", "output_default_type azure needs azure_containers")
+	case "oci", "image":
+		check(c.OCIRepositories != "", "output_default_type %s needs oci_repositories", c.OutputDefaultType)
+	default:
+		check(false, "output_default_type must be one of %s", strings.Join(outputTypes, ", "))
+	}
+	for _, arg := range splitList(c.AllowedNpmArgs) {
+		check(strings.HasPrefix(arg, "-"), "allowed_npm_args: %q is not a flag", arg)
+	}
+	_, err := parseTrustedProxies(splitList(c.TrustedProxies))
+	check(err == nil, "trusted_proxies: %v", err)
+	_, err = parseScopeCredentials(splitList(c.NpmScopes))
+	check(err == nil, "npm_scopes: %v", err)
+	for _, pattern := range splitList(c.PrunePatterns) {
+		name := strings.TrimSuffix(pattern, "/")
+		_, err := path.Match(name, "")
+		check(err == nil && name != "" && !strings.Contains(name, "/"),
+			"prune_patterns: %q must be a file name glob, with a trailing / for directories", pattern)
+	}
+	_, err = newExecutor(c.Executor, nil, "")
+	check(err == nil, "executor must be host, docker, bwrap or nsjail")
+	check(slices.Contains(scriptsPolicies, c.ScriptsPolicy), "scripts_policy must be one of %s", strings.Join(scriptsPolicies, ", "))
+	check(c.PolicyReloadInterval >= 0, "policy_reload_interval must not be negative")
+	check(c.OPAURL == "" || c.OPAPolicy == "", "opa_url and opa_policy are mutually exclusive")
+	check(c.AuditFailOn == "" || slices.Contains(gateSeverities, c.AuditFailOn), "audit_fail_on must be one of %s", strings.Join(gateSeverities, ", "))
+	check(c.VerifyProvenance == "" || slices.Contains(provenanceLevels, c.VerifyProvenance), "verify_provenance must be one of %s", strings.Join(provenanceLevels, ", "))
+	for name := range c.dockerImages() {
+		check(findEcosystem(name) != nil, "docker_images: unknown ecosystem %q", name)
+	}
+	for _, name := range c.readyEcosystems() {
+		check(findEcosystem(name) != nil, "ready_ecosystems: unknown ecosystem %q", name)
+	}
+	if c.InstallTimeout > c.InstallMaxTimeout {
+		// A lower cap on its own lowers the default too
+		if c.settings.source["install-timeout"] != "" {
+			check(false, "install_timeout must not exceed install_max_timeout")
+		} else {
+			c.InstallTimeout = c.InstallMaxTimeout
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readyEcosystems returns the names listed in ReadyEcosystems
+func (c *Config) readyEcosystems() []string {
+	return splitList(c.ReadyEcosystems)
+}
+
+// defaultToolchainDir is under the user's cache directory
+func defaultToolchainDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pip-install", "node")
+}
+
+// dockerImages returns the images given in DockerImages by ecosystem name
+func (c *Config) dockerImages() map[string]string {
+	images := make(map[string]string)
+	for _, entry := range splitList(c.DockerImages) {
+		name, image, _ := strings.Cut(entry, "=")
+		images[name] = image
+	}
+	return images
+}
+
+// s3Endpoint returns the S3 endpoint, defaulting to AWS in the region
+func (c *Config) s3Endpoint() string {
+	if c.S3Endpoint != "" {
+		return c.S3Endpoint
+	}
+	return s3Endpoint(c.S3Region)
+}
+
+// azureEndpoint returns the blob endpoint, defaulting to the account's
+func (c *Config) azureEndpoint() string {
+	if c.AzureEndpoint != "" {
+		return c.AzureEndpoint
+	}
+	return azureEndpoint(c.AzureAccount)
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// A configValue is one entry of the /config report
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// handleConfig serves GET /config, reporting the effective settings and where
+// each came from. Secrets are redacted.
+func (c *Config) handleConfig(w http.ResponseWriter, r *http.Request) {
+	report := make(map[string]configValue)
+	s := c.settings
+	s.fs.VisitAll(func(f *flag.Flag) {
+		v := configValue{Value: f.Value.String(), Source: s.source[f.Name]}
+		if v.Source == "" {
+			v.Source = "default"
+		}
+		if s.secret[f.Name] && v.Value != "" {
+			v.Value = "[redacted]"
+		}
+		report[strings.ReplaceAll(f.Name, "-", "_")] = v
+	})
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Accept deno.json, or an import_map.json, and optional deno.lock
+// The modules they import are vendored with deno cache --vendor, frozen to
+// deno.lock when it is present
+// The output is a zip of the vendor directory
+var denoEcosystem = &Ecosystem{
+	Name:     "deno",
+	Tool:     "deno",
+	Runtime:  "deno",
+	Registry: "https://jsr.io/",
+	Image:    "denoland/deno:debian-2.1.4",
+	Files: []ManifestFile{
+		{Name: "deno.json"},
+		{Name: "import_map.json"},
+		{Name: "deno.lock"},
+	},
+	Args: func(files map[string]string) []string {
+		args := []string{"cache", "--vendor=true", "--config=deno.json"}
+		if files["deno.lock"] != "" {
+			args = append(args, "--frozen")
+		}
+		return append(append(args, "--"), denoImports(files)...)
+	},
+	FileRegistries: denoRegistries,
+	// deno.json can name an import map rather than hold the imports
+	WorkspaceFiles: denoConfigFiles,
+	Env:            []string{"DENO_NO_UPDATE_CHECK=1", "NO_COLOR=1"},
+	CacheEnv:       func(dir string) []string { return []string{"DENO_DIR=" + dir} },
+	CacheEntry:     denoCacheEntry,
+	Packages:       denoPackages,
+	LockedPackages: denoLockedPackages,
+	Output: func(workDir string) (string, error) {
+		dir := filepath.Join(workDir, "vendor")
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("deno did not write a vendor directory: %v", err)
+		}
+		return dir, nil
+	},
+	ArchiveRoot: "vendor",
+	ArchiveName: "vendor",
+}
+
+// A denoConfig is the part of deno.json or an import map naming the
+// modules a project imports
+type denoConfig struct {
+	Imports   map[string]string `json:"imports"`
+	ImportMap string            `json:"importMap"`
+}
+
+// denoConfigFiles writes a deno.json pointing at the import map when only
+// the import map was submitted, and checks there is something to vendor
+func denoConfigFiles(files map[string]string) error {
+	if files["deno.json"] == "" {
+		if files["import_map.json"] == "" {
+			return badRequest("Missing deno.json or import_map.json in request")
+		}
+		files["deno.json"] = `{"importMap": "./import_map.json"}`
+	}
+	for _, name := range []string{"deno.json", "import_map.json"} {
+		if files[name] != "" && !json.Valid([]byte(files[name])) {
+			return badRequest("Failed to read %s: not valid JSON", name)
+		}
+	}
+	if len(denoImports(files)) == 0 {
+		return badRequest("deno.json and import_map.json import no modules to vendor")
+	}
+	return nil
+}
+
+// denoImports lists the modules deno.json and its import map map specifiers
+// to, such as "jsr:@std/path@^1" or a URL. Prefix mappings ending in "/"
+// name no module themselves and are left out.
+func denoImports(files map[string]string) []string {
+	var config denoConfig
+	json.Unmarshal([]byte(files["deno.json"]), &config)
+	imports := config.Imports
+	if strings.TrimPrefix(config.ImportMap, "./") == "import_map.json" {
+		var importMap denoConfig
+		json.Unmarshal([]byte(files["import_map.json"]), &importMap)
+		imports = importMap.Imports
+	}
+	var modules []string
+	for _, target := range imports {
+		if target != "" && !strings.HasSuffix(target, "/") && !slices.Contains(modules, target) {
+			modules = append(modules, target)
+		}
+	}
+	slices.Sort(modules)
+	return modules
+}
+
+// denoModuleSchemes are the import targets deno cache may be given
+var denoModuleSchemes = []string{"jsr:", "npm:", "https://"}
+
+// denoRegistries lists the URLs deno.json and import_map.json import
+// from, refusing targets other than jsr:, npm: and https: modules. Prefix
+// mappings into the project's own directory, such as "./src/", are left
+// alone, as deno cache is given no module through them.
+func denoRegistries(files map[string]string) ([]fileRegistry, error) {
+	var sources []fileRegistry
+	for _, name := range []string{"deno.json", "import_map.json"} {
+		var config denoConfig
+		json.Unmarshal([]byte(files[name]), &config)
+		// Other import maps would be read from outside the workspace
+		if config.ImportMap != "" && strings.TrimPrefix(config.ImportMap, "./") != "import_map.json" {
+			return nil, badRequest("%s names importMap %q: only ./import_map.json is supported", name, config.ImportMap)
+		}
+		specifiers := make([]string, 0, len(config.Imports))
+		for specifier := range config.Imports {
+			specifiers = append(specifiers, specifier)
+		}
+		sort.Strings(specifiers)
+		for _, specifier := range specifiers {
+			target := config.Imports[specifier]
+			switch {
+			case strings.HasSuffix(target, "/") && (strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../")):
+			case strings.HasPrefix(target, "https://"):
+				sources = append(sources, fileRegistry{file: name, url: target})
+			case !slices.ContainsFunc(denoModuleSchemes, func(scheme string) bool { return strings.HasPrefix(target, scheme) }):
+				return nil, badRequest("%s maps %q to %q: only jsr:, npm: and https: modules can be vendored", name, specifier, target)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// denoPackages lists the packages in a vendor directory: JSR packages,
+// under jsr.io/@scope/name/version, and deno.land/x modules and the
+// standard library, under deno.land/x/name@version and deno.land/std@version.
+// Other URLs aren't packages.
+func denoPackages(outputDir string) ([]Package, error) {
+	var pkgs []Package
+	jsr, err := filepath.Glob(filepath.Join(outputDir, "jsr.io", "@*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range jsr {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(filepath.Join(outputDir, "jsr.io"), dir)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		pkgs = append(pkgs, Package{Name: parts[0] + "/" + parts[1], Version: parts[2]})
+	}
+	land, err := filepath.Glob(filepath.Join(outputDir, "deno.land", "x", "*@*"))
+	if err != nil {
+		return nil, err
+	}
+	std, err := filepath.Glob(filepath.Join(outputDir, "deno.land", "std@*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range append(land, std...) {
+		name, version, _ := strings.Cut(filepath.Base(dir), "@")
+		pkgs = append(pkgs, Package{Name: name, Version: version})
+	}
+	return pkgs, nil
+}
+
+// denoLockedPackages lists the JSR packages a deno.lock pins, keyed as
+// "@std/path@1.0.8": at the top level in version 4, and under packages in
+// version 3. npm packages aren't vendored, so they are left out.
+func denoLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["deno.lock"]
+	if lock == "" {
+		return nil, nil
+	}
+	var doc struct {
+		JSR      map[string]json.RawMessage `json:"jsr"`
+		Packages struct {
+			JSR map[string]json.RawMessage `json:"jsr"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(lock), &doc); err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, jsr := range []map[string]json.RawMessage{doc.JSR, doc.Packages.JSR} {
+		for key := range jsr {
+			name, version := splitNpmSpec(key)
+			pkgs = append(pkgs, Package{Name: name, Version: version})
+		}
+	}
+	return pkgs, nil
+}
+
+// denoCacheEntry groups the npm packages DENO_DIR unpacks, each version in a
+// directory such as npm/registry.npmjs.org/@std/path/1.0.8; remote modules
+// are a file each
+func denoCacheEntry(rel string) string {
+	parts := strings.Split(rel, "/")
+	switch {
+	case parts[0] != "npm" || len(parts) < 3:
+		return rel
+	case strings.HasPrefix(parts[2], "@"):
+		return leadingDirs(5)(rel)
+	}
+	return leadingDirs(4)(rel)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A DryRun resolves an ecosystem's files without installing them, for the
+// dry_run option
+type DryRun struct {
+	// Args run the tool to resolve the submitted files
+	Args func(files map[string]string) []string
+	// Lockfile is the lock file the resolution writes, if it writes one
+	Lockfile string
+	// Packages lists the resolved packages from the workspace, with the
+	// lock file written, and the tool's standard output
+	Packages func(workDir string, stdout []byte) ([]Package, error)
+}
+
+// A DryRunResult is the response to an install with the dry_run option
+type DryRunResult struct {
+	Ecosystem string `json:"ecosystem"`
+	// Packages lists what the install would install
+	Packages []Package `json:"packages"`
+	// Lockfile is the lock file the resolution wrote, for the ecosystems
+	// that have one
+	Lockfile *LockfileContent `json:"lockfile,omitempty"`
+	// Added and Removed compare Packages with the submitted lock file's,
+	// when there was one
+	Added   []Package `json:"added,omitempty"`
+	Removed []Package `json:"removed,omitempty"`
+	// Warnings are what the package manager warned of while resolving
+	Warnings   []InstallWarning `json:"warnings,omitempty"`
+	DurationMs int64            `json:"duration_ms"`
+}
+
+// LockfileContent is a lock file by name
+type LockfileContent struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// lockedPackagesAt lists the packages of the lock file a dry run wrote with
+// parse, the ecosystem's LockedPackages
+func lockedPackagesAt(name string, parse func(files map[string]string) ([]Package, error)) func(workDir string, stdout []byte) ([]Package, error) {
+	return func(workDir string, _ []byte) ([]Package, error) {
+		b, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return nil, err
+		}
+		return parse(map[string]string{name: string(b)})
+	}
+}
+
+// pipReportPackages lists the packages of the installation report pip
+// install --dry-run --report - writes
+func pipReportPackages(_ string, stdout []byte) ([]Package, error) {
+	var report struct {
+		Install []struct {
+			Metadata struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"metadata"`
+		} `json:"install"`
+	}
+	if err := json.Unmarshal(stdout, &report); err != nil {
+		return nil, fmt.Errorf("failed to read pip's installation report: %v", err)
+	}
+	pkgs := make([]Package, 0, len(report.Install))
+	for _, item := range report.Install {
+		pkg := Package{Name: item.Metadata.Name, Version: item.Metadata.Version}
+		name := strings.ToLower(pythonNameSeparators.ReplaceAllString(pkg.Name, "-"))
+		pkg.PURL = "pkg:pypi/" + name + "@" + url.PathEscape(pkg.Version)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// validateDryRun checks the dry_run option, which can't be combined with the
+// options that shape the archive it doesn't build
+func validateDryRun(eco *Ecosystem, o InstallOptions) error {
+	if eco.DryRun == nil {
+		return badRequest("dry_run is not supported for %s installs", eco.Name)
+	}
+	if o.Output != nil || len(o.Include) > 0 || o.SBOM != "" || o.LicenseReport || o.Report || o.Prune || o.Target != nil || len(o.Targets) > 0 {
+		return badRequest("output, include, sbom, license_report, report, prune, target and targets can't be combined with dry_run")
+	}
+	return nil
+}
+
+// dryRun serves an install with the dry_run option: the request's files are
+// resolved without installing anything, and what would be installed is
+// returned with the lock file the resolution wrote. The package policy
+// applies to the resolved packages; nothing is cached.
+func (in *Installer) dryRun(ctx context.Context, w http.ResponseWriter, r *http.Request, eco *Ecosystem, req *InstallRequest) {
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	done, ok := in.admit(ctx, w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	ctx = withNotes(ctx)
+	start := time.Now()
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	defer removeWorkspace(tmpDir)
+
+	result, err := resolveDryRun(ctx, eco, req, tmpDir)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	loggerFrom(ctx).Info("resolved dry run", "packages", len(result.Packages))
+	writeJSON(w, http.StatusOK, result)
+}
+
+// resolveDryRun runs the ecosystem's dry run in workDir
+func resolveDryRun(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string) (*DryRunResult, error) {
+	if err := checkLockedPolicy(eco, req); err != nil {
+		return nil, err
+	}
+	notes := notesFrom(ctx)
+	args := append(eco.DryRun.Args(req.Files), registryArgs(eco, req)...)
+	for _, name := range req.Options.Workspaces {
+		args = append(args, eco.WorkspaceArgs(name)...)
+	}
+	if req.Options.EngineStrict {
+		args = append(args, eco.Engines.Args...)
+	}
+	args = append(args, req.Options.NpmArgs...)
+	var stdout bytes.Buffer
+	run := toolRun{step: "dry run", tool: eco.Tool, args: args, env: eco.Env, stdout: &stdout,
+		onLine: func(stream, line string) { notes.line(line) }}
+	if _, err := runPeerDeps(ctx, eco, req, run, func(run toolRun) error { return runTool(ctx, eco, req, workDir, run) }); err != nil {
+		return nil, checkEngines(eco, err)
+	}
+	pkgs, err := eco.DryRun.Packages(workDir, stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list resolved packages: %v", err)
+	}
+	if err := checkInstallPolicies(ctx, eco, req, pkgs); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(pkgs, func(a, b Package) int {
+		return strings.Compare(a.Name+"@"+a.Version, b.Name+"@"+b.Version)
+	})
+	result := &DryRunResult{Ecosystem: eco.Name, Packages: pkgs, Warnings: notes.installWarnings()}
+	if name := eco.DryRun.Lockfile; name != "" {
+		b, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s did not write %s: %v", eco.Tool, name, err)
+		}
+		result.Lockfile = &LockfileContent{Name: name, Content: string(b)}
+	}
+	if eco.LockedPackages != nil {
+		if locked, err := eco.LockedPackages(req.Files); err == nil && len(locked) > 0 {
+			result.Added, result.Removed = diffPackages(locked, pkgs)
+		}
+	}
+	return result, nil
+}
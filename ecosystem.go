@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+)
+
+// An Ecosystem describes how one package manager turns a set of manifest
+// files into an installed dependency directory.
+type Ecosystem struct {
+	// Name is used in the /install/<name> route and in log messages
+	Name string
+	// Tool is the executable that performs the install
+	Tool string
+	// Runtime is the interpreter Tool runs on
+	Runtime string
+	// Registry is the package index installs fetch from, checked by /readyz
+	Registry string
+	// Files lists the manifest files accepted in a request
+	Files []ManifestFile
+	// Args builds the command line for Tool from the submitted files
+	Args func(files map[string]string) []string
+	// RegistryArgs returns the extra arguments that point Tool at another
+	// registry; nil if the ecosystem doesn't support overriding it
+	RegistryArgs func(registry string) []string
+	// OmitArgs maps each kind of dependency the omit option can leave out,
+	// such as "dev", to the arguments that do so; nil if none can be
+	OmitArgs map[string][]string
+	// PeerDepsArgs maps each peer_deps_mode but auto to the flags selecting
+	// it; nil if unsupported
+	PeerDepsArgs map[string][]string
+	// Engines holds installs to the engines their packages require; nil if
+	// unsupported
+	Engines *EngineCheck
+	// NoScriptsArgs and NoScriptsEnv stop Tool from running code from the
+	// packages it installs, such as lifecycle scripts or source builds
+	NoScriptsArgs []string
+	NoScriptsEnv  []string
+	// ScriptsAlwaysRun is set when Tool runs code from the request or its
+	// packages whatever its arguments, so installs that must skip scripts
+	// are only accepted by executors that isolate them from the server
+	ScriptsAlwaysRun bool
+	// ScriptPackages lists the installed packages that declare install
+	// scripts, to report which were skipped; nil if the ecosystem can't tell
+	ScriptPackages func(outputDir string) ([]string, error)
+	// Packages lists the installed packages; nil if the ecosystem can't tell
+	Packages func(outputDir string) ([]Package, error)
+	// LockedPackages lists the packages the submitted files pin, to check
+	// them against the package policy before installing; nil if unsupported
+	LockedPackages func(files map[string]string) ([]Package, error)
+	// Overrides reads the versions the manifest forces on dependencies
+	// anywhere in the tree; nil if unsupported
+	Overrides func(files map[string]string) []Override
+	// LockIntegrity finds the lock file entries no integrity hash pins; nil
+	// if unsupported
+	LockIntegrity *LockIntegrity
+	// DryRun resolves the files without installing them; nil if unsupported
+	DryRun *DryRun
+	// Audit scans installs for known vulnerabilities; nil if unsupported
+	Audit *Auditor
+	// FromPackages generates the manifests installing a list of package
+	// specs, for the packages field; nil if unsupported
+	FromPackages func(specs []string) (map[string]string, error)
+	// FileRegistries lists the registries and other sources the request's
+	// files fetch from besides Registry, which must be allowed like the
+	// registry option; nil if the files can't name any
+	FileRegistries func(files map[string]string) ([]fileRegistry, error)
+	// WorkspaceFiles adds any files the tool needs that the request may
+	// leave out, such as those to install the workspaces declared in
+	// package.json; nil if none are needed
+	WorkspaceFiles func(files map[string]string) error
+	// WorkspaceArgs returns the arguments that limit the install to one
+	// workspace and its dependencies; nil if unsupported
+	WorkspaceArgs func(name string) []string
+	// TargetArgs returns the arguments that install the optional packages
+	// for another platform, as the target option asks; nil if unsupported
+	TargetArgs func(t *InstallTarget) []string
+	// CacheEnv returns the environment that points Tool at dir for the
+	// packages it downloads, to share them between installs; nil if the
+	// ecosystem has no cache
+	CacheEnv func(dir string) []string
+	// CacheEntry returns the entry of the cache a file belongs to, both as
+	// paths relative to the ecosystem's cache directory, for entries such
+	// as an unpacked package that are evicted whole; nil if each file
+	// stands alone
+	CacheEntry func(rel string) string
+	// WorkEnv returns the environment that keeps Tool's own state, such as
+	// the gems it installs for itself, in the workspace, which the command
+	// sees at workPath; nil if it needs none
+	WorkEnv func(workPath string) []string
+	// CacheUsage reads a line of Tool's output into the count of packages
+	// taken from the cache and downloaded; nil if its output doesn't tell
+	CacheUsage func(line string, u *cacheUsage)
+	// Image is the pinned container image the docker executor runs Tool in;
+	// empty if there is no default
+	Image string
+	// Env is appended to the server environment when running Tool
+	Env []string
+	// Output locates the installed directory to archive inside workDir
+	Output func(workDir string) (string, error)
+	// StdoutFile, if set, is where Tool's standard output is saved in the
+	// workspace, to be archived next to ArchiveRoot, for tools that print
+	// the configuration using what they installed
+	StdoutFile string
+	// ArchiveRoot is the top-level directory name used inside the archive
+	ArchiveRoot string
+	// ArchiveName is the download filename, without the format extension
+	ArchiveName string
+}
+
+// A ManifestFile is one input file accepted by an ecosystem.
+type ManifestFile struct {
+	Name     string
+	Required bool
+	// Secret files may hold registry credentials. They are scrubbed from
+	// package manager output and can default to a file on the server.
+	Secret bool
+	// Env, if set, is pointed at the file's path when it is present
+	Env string
+	// Base64 files are binary, so JSON bodies and gRPC requests carry them
+	// base64-encoded
+	Base64 bool
+}
+
+// decode returns a file's contents as a JSON body or gRPC request carries it
+func (mf ManifestFile) decode(content string) (string, error) {
+	if !mf.Base64 {
+		return content, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", badRequest("Error decoding %s: must be base64", mf.Name)
+	}
+	return string(b), nil
+}
+
+// binaryFile reports whether the named file is a binary one
+func (e *Ecosystem) binaryFile(name string) bool {
+	return slices.ContainsFunc(e.Files, func(mf ManifestFile) bool { return mf.Name == name && mf.Base64 })
+}
+
+// manifestFile reports whether the named file is one of the ecosystem's
+// text manifests, or a workspace package's package.json
+func (e *Ecosystem) manifestFile(name string) bool {
+	if isWorkspaceManifest(e, name) {
+		return true
+	}
+	return slices.ContainsFunc(e.Files, func(mf ManifestFile) bool { return mf.Name == name && !mf.Base64 })
+}
+
+// secretFile reports whether the named file may hold credentials
+func (e *Ecosystem) secretFile(name string) bool {
+	return slices.ContainsFunc(e.Files, func(mf ManifestFile) bool { return mf.Name == name && mf.Secret })
+}
+
+// ecosystems is the list of supported ecosystems, in routing order
+var ecosystems = []*Ecosystem{
+	pipEcosystem,
+	poetryEcosystem,
+	yarnEcosystem,
+	pnpmEcosystem,
+	bunEcosystem,
+	denoEcosystem,
+	composerEcosystem,
+	bundlerEcosystem,
+	cargoEcosystem,
+}
+
+// checkToolchain reports whether the ecosystem's tool and runtime are
+// available on PATH
+func (e *Ecosystem) checkToolchain() error {
+	for _, bin := range []string{e.Runtime, e.Tool} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return &statusError{
+				status: http.StatusNotImplemented,
+				err:    fmt.Errorf("%s is not installed on this server", bin),
+			}
+		}
+	}
+	return nil
+}
+
+// findEcosystem returns the ecosystem with the given name, or nil
+func findEcosystem(name string) *Ecosystem {
+	for _, eco := range ecosystems {
+		if eco.Name == name {
+			return eco
+		}
+	}
+	return nil
+}
+
+// ecosystemNames lists the supported ecosystems in routing order
+func ecosystemNames() []string {
+	names := make([]string, len(ecosystems))
+	for i, eco := range ecosystems {
+		names[i] = eco.Name
+	}
+	return names
+}
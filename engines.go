@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An EngineCheck is how a Node.js package manager holds the packages it
+// installs to the engines field of their package.json
+type EngineCheck struct {
+	// Args make Tool fail on a package whose engines the toolchain doesn't
+	// satisfy; empty if it always does
+	Args []string
+	// Mismatches reads the packages it failed on from its stderr
+	Mismatches func(stderr string) []EngineMismatch
+}
+
+// An EngineMismatch is a package whose engines range the install's
+// toolchain doesn't satisfy
+type EngineMismatch struct {
+	// Package is the package as name@version
+	Package string `json:"package"`
+	// Engine is the engine it constrains, such as node or npm
+	Engine string `json:"engine"`
+	// Wanted is the range it requires and Current the version used
+	Wanted  string `json:"wanted"`
+	Current string `json:"current,omitempty"`
+}
+
+// An engineError fails an install whose packages require other engines
+// than the toolchain it ran on, explaining the package manager's failure
+type engineError struct {
+	mismatches []EngineMismatch
+	err        error
+}
+
+func (e *engineError) Error() string {
+	specs := make([]string, len(e.mismatches))
+	for i, m := range e.mismatches {
+		specs[i] = fmt.Sprintf("%s wants %s %s", m.Package, m.Engine, m.Wanted)
+		if m.Current != "" {
+			specs[i] += " but got " + m.Current
+		}
+	}
+	return fmt.Sprintf("Packages are incompatible with the install's engines: %s", strings.Join(specs, "; "))
+}
+
+func (e *engineError) Unwrap() error { return e.err }
+
+func (e *engineError) code() string { return "ENGINE_INCOMPATIBLE" }
+
+func (e *engineError) details() map[string]any {
+	return map[string]any{"engines": e.mismatches}
+}
+
+// validateEngineStrict checks the engine_strict option
+func validateEngineStrict(eco *Ecosystem) error {
+	if eco.Engines == nil {
+		return badRequest("engine_strict is not supported for %s installs", eco.Name)
+	}
+	return nil
+}
+
+// checkEngines looks into a failed install. If the package manager failed
+// on packages' engines it is explained with an engineError; other failures
+// return installErr as is.
+func checkEngines(eco *Ecosystem, installErr error) error {
+	var te *toolError
+	if eco.Engines == nil || !errors.As(installErr, &te) {
+		return installErr
+	}
+	mismatches := eco.Engines.Mismatches(te.stderr)
+	if len(mismatches) == 0 {
+		return installErr
+	}
+	return &engineError{mismatches: mismatches, err: installErr}
+}
+
+// engineRanges turns the engines objects npm and pnpm print, such as
+// {"node":">=22"}, into mismatches. They print every engine the package
+// declares, so only the ranges the current version fails are kept; one
+// that can't be checked is kept too.
+func engineRanges(pkg, wanted, current string) []EngineMismatch {
+	var want, have map[string]string
+	if json.Unmarshal([]byte(wanted), &want) != nil {
+		return nil
+	}
+	json.Unmarshal([]byte(current), &have)
+	var mismatches []EngineMismatch
+	for engine, r := range want {
+		version := strings.TrimPrefix(have[engine], "v")
+		if ok, known := satisfiesRange(version, r); ok && known {
+			continue
+		}
+		mismatches = append(mismatches, EngineMismatch{Package: pkg, Engine: engine, Wanted: r, Current: version})
+	}
+	return mismatches
+}
+
+// rangeOperatorSpace matches the space npm allows after a comparator's
+// operator, as in ">= 18"
+var rangeOperatorSpace = regexp.MustCompile(`([<>=~^]+)\s+`)
+
+// satisfiesRange reports whether version satisfies the npm semver range r,
+// such as ">=18 <21 || ^22.1", and whether the two could be read.
+// Prerelease tags are ignored.
+func satisfiesRange(version, r string) (ok, known bool) {
+	v, n, parsed := parsePartialVersion(version)
+	if !parsed || n < 3 {
+		return false, false
+	}
+	for _, set := range strings.Split(r, "||") {
+		fields := strings.Fields(rangeOperatorSpace.ReplaceAllString(strings.TrimSpace(set), "$1"))
+		// A hyphen range, "1.2.3 - 2.3"
+		if len(fields) == 3 && fields[1] == "-" {
+			fields = []string{">=" + fields[0], "<=" + fields[2]}
+		}
+		match := true
+		for _, c := range fields {
+			cmp, parsed := satisfiesComparator(v, c)
+			if !parsed {
+				return false, false
+			}
+			match = match && cmp
+		}
+		if match {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// satisfiesComparator reports whether v satisfies one comparator of a
+// range, such as ">=18", "^1.2" or "1.x", and whether it could be read
+func satisfiesComparator(v [3]int, c string) (ok, known bool) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(c, prefix) {
+			op, c = prefix, c[len(prefix):]
+			break
+		}
+	}
+	lo, n, parsed := parsePartialVersion(c)
+	if !parsed {
+		return false, false
+	}
+	// hi is the first version past a partial one: 1.2 covers 1.2.x
+	hi := lo
+	if n > 0 {
+		hi[n-1]++
+	}
+	cmp := compareVersions(v, lo)
+	switch op {
+	case "", "=":
+		return n == 0 || cmp >= 0 && (n == 3 && cmp == 0 || n < 3 && compareVersions(v, hi) < 0), true
+	case ">":
+		if n < 3 {
+			return n > 0 && compareVersions(v, hi) >= 0, true
+		}
+		return cmp > 0, true
+	case ">=":
+		return cmp >= 0, true
+	case "<":
+		return n > 0 && cmp < 0, true
+	case "<=":
+		if n < 3 {
+			return n == 0 || compareVersions(v, hi) < 0, true
+		}
+		return cmp <= 0, true
+	case "~":
+		// ~1.2.3 and ~1.2 allow patches, ~1 any 1.x
+		hi = [3]int{lo[0] + 1, 0, 0}
+		if n >= 2 {
+			hi = [3]int{lo[0], lo[1] + 1, 0}
+		}
+		return n == 0 || cmp >= 0 && compareVersions(v, hi) < 0, true
+	default:
+		// ^ allows changes that keep the first non-zero part
+		switch {
+		case lo[0] > 0 || n == 1:
+			hi = [3]int{lo[0] + 1, 0, 0}
+		case lo[1] > 0 || n == 2:
+			hi = [3]int{0, lo[1] + 1, 0}
+		default:
+			hi = [3]int{0, 0, lo[2] + 1}
+		}
+		return n == 0 || cmp >= 0 && compareVersions(v, hi) < 0, true
+	}
+}
+
+// parsePartialVersion reads a version such as 22.3.1, 22.3, 22, 22.x or *,
+// returning its parts and how many were given. A prerelease or build
+// suffix is dropped.
+func parsePartialVersion(s string) (v [3]int, n int, ok bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, _, _ = strings.Cut(s, "-")
+	if s == "" {
+		return v, 0, false
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, false
+	}
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			return v, 0, false
+		}
+		v[n] = i
+		n++
+	}
+	return v, n, true
+}
+
+func compareVersions(a, b [3]int) int {
+	return slices.Compare(a[:], b[:])
+}
+
+func sortMismatches(mismatches []EngineMismatch) []EngineMismatch {
+	slices.SortFunc(mismatches, func(a, b EngineMismatch) int {
+		return strings.Compare(a.Package+" "+a.Engine, b.Package+" "+b.Engine)
+	})
+	return slices.Compact(mismatches)
+}
+
+// npmEngineError matches npm's EBADENGINE report, over three lines
+var npmEngineError = regexp.MustCompile(`(?m)notsup Not compatible with your version of node/npm: (\S+)\s*\n.*notsup Required: (\{.*\})\s*\n.*notsup Actual: +(\{.*\})`)
+
+// npmEngineMismatches reads npm's EBADENGINE errors
+func npmEngineMismatches(stderr string) []EngineMismatch {
+	var mismatches []EngineMismatch
+	for _, m := range npmEngineError.FindAllStringSubmatch(stderr, -1) {
+		mismatches = append(mismatches, engineRanges(m[1], m[2], m[3])...)
+	}
+	return sortMismatches(mismatches)
+}
+
+// pnpmEngineError matches pnpm's ERR_PNPM_UNSUPPORTED_ENGINE
+var pnpmEngineError = regexp.MustCompile(`Unsupported engine for (\S+?): wanted: (\{.*?\}) \(current: (\{.*?\})\)`)
+
+// pnpmEngineMismatches reads pnpm's ERR_PNPM_UNSUPPORTED_ENGINE errors
+func pnpmEngineMismatches(stderr string) []EngineMismatch {
+	var mismatches []EngineMismatch
+	for _, m := range pnpmEngineError.FindAllStringSubmatch(stderr, -1) {
+		mismatches = append(mismatches, engineRanges(m[1], m[2], m[3])...)
+	}
+	return sortMismatches(mismatches)
+}
+
+// yarnEngineError matches yarn 1's report of a package it won't install
+var yarnEngineError = regexp.MustCompile(`error (\S+?): The engine "([^"]+)" is incompatible with this module\. Expected version "([^"]*)"\. Got "([^"]*)"`)
+
+// yarnEngineMismatches reads the packages yarn found incompatible
+func yarnEngineMismatches(stderr string) []EngineMismatch {
+	var mismatches []EngineMismatch
+	for _, m := range yarnEngineError.FindAllStringSubmatch(stderr, -1) {
+		mismatches = append(mismatches, EngineMismatch{Package: m[1], Engine: m[2], Wanted: m[3], Current: m[4]})
+	}
+	return sortMismatches(mismatches)
+}
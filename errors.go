@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Error responses are JSON with a machine-readable code alongside the
+// message in "error", so clients can branch on the kind of failure. The
+// codes of failures that aren't more specific come from their status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "BAD_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHORIZED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusMethodNotAllowed:      "METHOD_NOT_ALLOWED",
+	http.StatusNotAcceptable:         "NOT_ACCEPTABLE",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusGone:                  "GONE",
+	http.StatusRequestEntityTooLarge: "TOO_LARGE",
+	http.StatusUnsupportedMediaType:  "UNSUPPORTED_MEDIA_TYPE",
+	http.StatusUnprocessableEntity:   "POLICY_VIOLATION",
+	http.StatusTooManyRequests:       "RATE_LIMITED",
+	http.StatusInternalServerError:   "INTERNAL_ERROR",
+	http.StatusNotImplemented:        "NOT_SUPPORTED",
+	http.StatusBadGateway:            "UPSTREAM_FAILED",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+	http.StatusGatewayTimeout:        "TIMEOUT",
+}
+
+// A codedError knows the code it is reported with
+type codedError interface {
+	error
+	code() string
+}
+
+// errorCode returns the code err is reported with at the given status
+func errorCode(err error, status int) string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if ce, ok := err.(codedError); ok && ce.code() != "" {
+			return ce.code()
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// writeError responds like http.Error, with a JSON body whose code comes
+// from the status
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeJSON(w, status, map[string]any{"code": errorCode(nil, status), "error": message})
+}
+
+// errorBody is the JSON body describing err: its code and message, and for
+// the failures that have them, their details, the tool's exit code and the
+// end of its output
+func errorBody(err error, status int) map[string]any {
+	body := map[string]any{}
+	var pe policyError
+	if errors.As(err, &pe) {
+		body = pe.details()
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		body["field"], body["reason"] = fe.field, fe.reason
+	}
+	body["code"], body["error"] = errorCode(err, status), err.Error()
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		body["error"] = strings.TrimSuffix(err.Error(), ": "+mbe.Error())
+		body["max_bytes"] = mbe.Limit
+	}
+	var te *toolError
+	if errors.As(err, &te) {
+		// Without the output, which goes in log, but with anything
+		// wrapping it, such as the target of a matrix install
+		body["error"] = strings.Replace(err.Error(), "\nStderr: "+te.stderr, "", 1)
+		if te.exitCode >= 0 {
+			body["exit_code"] = te.exitCode
+		}
+		if log := logExcerpt(te.stderr); log != "" {
+			body["log"] = log
+		}
+	}
+	return body
+}
+
+// A toolError is a run of a package manager or other tool that failed, with
+// the end of its standard error
+type toolError struct {
+	// msg says what failed, such as "pnpm install failed: exit status 1"
+	msg  string
+	step string
+	// kind is the code when the failure isn't left to classify, such as
+	// TIMEOUT
+	kind string
+	// exitCode is the tool's, or -1 if it was killed
+	exitCode int
+	stderr   string
+	err      error
+}
+
+func (e *toolError) Error() string { return e.msg + "\nStderr: " + e.stderr }
+
+func (e *toolError) Unwrap() error { return e.err }
+
+// toolFailures classify a failed install by its stderr, lowercased, in
+// order: native builds also fail their package's install script, for one
+var toolFailures = []struct {
+	code     string
+	patterns []string
+}{
+	{"LOCKFILE_MISMATCH", []string{"err_pnpm_outdated_lockfile", "err_pnpm_lockfile_config_mismatch", "lockfile needs to be updated",
+		"changed significantly since poetry.lock", "poetry.lock is not consistent", "pyproject.toml changed",
+		"deployment mode after changing your gemfile", "frozen mode is set", "but --locked was passed"}},
+	{"PACKAGE_NOT_FOUND", []string{"e404", "err_pnpm_fetch_404", "err_pnpm_no_matching_version", "couldn't find package",
+		"no matching version", "no matching distribution found", "could not find a version that satisfies",
+		"could not find gem", "no matching package named", "failed to select a version for the requirement"}},
+	{"REGISTRY_UNREACHABLE", []string{"enotfound", "econnrefused", "econnreset", "etimedout", "eai_again", "getaddrinfo",
+		"err_pnpm_meta_fetch_fail", "failed to establish a new connection", "max retries exceeded",
+		"temporary failure in name resolution", "network connection", "there appears to be trouble with your network"}},
+	{"REGISTRY_ERROR", []string{"err_pnpm_fetch_5", "code e500", "code e502", "code e503", "code e504",
+		"500 internal server error", "502 bad gateway", "503 service unavailable", "504 gateway timeout", "http error 50"}},
+	{"PEER_CONFLICT", []string{"eresolve", "err_pnpm_peer_dep_issues", "conflicting peer dependency"}},
+	{"NATIVE_BUILD_FAILED", []string{"gyp err!", "failed to build gem native extension"}},
+	{"SCRIPT_FAILED", []string{"elifecycle", "err_pnpm_lifecycle", "command failed.", "lifecycle script"}},
+}
+
+func (e *toolError) code() string {
+	if e.kind != "" {
+		return e.kind
+	}
+	stderr := strings.ToLower(e.stderr)
+	for _, f := range toolFailures {
+		for _, p := range f.patterns {
+			if strings.Contains(stderr, p) {
+				return f.code
+			}
+		}
+	}
+	if e.step == "install" {
+		return "INSTALL_FAILED"
+	}
+	return "TOOL_FAILED"
+}
+
+// logExcerptLines is how much of a failed tool's stderr error responses
+// carry; jobs stream the rest
+const logExcerptLines = 20
+
+// logExcerpt returns the last lines of a tool's output
+func logExcerpt(output string) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > logExcerptLines {
+		lines = lines[len(lines)-logExcerptLines:]
+	}
+	excerpt := strings.Join(lines, "\n")
+	if len(excerpt) > 4096 {
+		excerpt = excerpt[len(excerpt)-4096:]
+	}
+	return excerpt
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxJobEvents caps how many events are kept per job; output beyond it is dropped
+const maxJobEvents = 10000
+
+// Job lifecycle phases reported in status events
+const (
+	PhaseQueued     = "queued"
+	PhaseInstalling = "installing"
+	PhaseAuditing   = "auditing"
+	PhaseArchiving  = "archiving"
+	PhaseUploading  = "uploading"
+	PhaseDone       = "done"
+)
+
+// A JobEvent is one entry in a job's event log: either a lifecycle "status"
+// change or a "log" line written by the package manager
+type JobEvent struct {
+	ID     int       `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Phase  string    `json:"phase,omitempty"`
+	Status JobStatus `json:"status,omitempty"`
+	Stream string    `json:"stream,omitempty"`
+	Line   string    `json:"line,omitempty"`
+}
+
+// A jobEvents log is appended to by the worker running a job and read
+// concurrently by any number of subscribers. Readers track their own position
+// and wait on the channel returned by since, which is closed on every append.
+type jobEvents struct {
+	mu        sync.Mutex
+	events    []JobEvent
+	closed    bool
+	truncated bool
+	changed   chan struct{}
+}
+
+func newJobEvents() *jobEvents {
+	return &jobEvents{changed: make(chan struct{})}
+}
+
+// restoreJobEvents continues a log that already has events, for a job
+// taken from the shared queue
+func restoreJobEvents(events []JobEvent) *jobEvents {
+	return &jobEvents{events: events, changed: make(chan struct{})}
+}
+
+// An eventLog is read by the streaming handlers. Readers resume from the
+// last ID they saw and wait on the returned channel for more.
+type eventLog interface {
+	since(id int) ([]JobEvent, bool, <-chan struct{})
+}
+
+// status records a lifecycle phase change
+func (e *jobEvents) status(phase string, status JobStatus) {
+	e.append(JobEvent{Type: "status", Phase: phase, Status: status}, false)
+}
+
+// line records one line of package manager output
+func (e *jobEvents) line(stream, line string) {
+	e.append(JobEvent{Type: "log", Stream: stream, Line: line}, false)
+}
+
+// close records the final status; no events are accepted afterwards
+func (e *jobEvents) close(status JobStatus) {
+	e.append(JobEvent{Type: "status", Phase: PhaseDone, Status: status}, true)
+}
+
+func (e *jobEvents) append(ev JobEvent, final bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	// Status changes are always kept so readers see the job finish
+	if len(e.events) >= maxJobEvents && ev.Type == "log" {
+		if e.truncated {
+			return
+		}
+		e.truncated = true
+		ev = JobEvent{Type: "log", Stream: "server", Line: "output truncated"}
+	}
+	ev.ID = len(e.events) + 1
+	ev.Time = time.Now().UTC()
+	e.events = append(e.events, ev)
+	e.closed = final
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// since returns the events after the given ID, whether the log is complete, and
+// a channel that is closed when more events arrive
+func (e *jobEvents) since(id int) ([]JobEvent, bool, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if id < 0 {
+		id = 0
+	}
+	var events []JobEvent
+	if id < len(e.events) {
+		events = e.events[id:len(e.events):len(e.events)]
+	}
+	return events, e.closed, e.changed
+}
+
+// A tailBuffer keeps only the last max bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
+
+// lineWriter is an io.Writer that calls fn with every complete line written to it
+type lineWriter struct {
+	fn  func(string)
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(string(bytes.TrimRight(w.buf[:i], "\r")))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush emits any trailing partial line
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.fn(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// handleEvents serves GET /jobs/{id}/events as a Server-Sent Events stream.
+// Past events are replayed first, resuming after Last-Event-ID when a client
+// reconnects, and the stream ends once the job has finished.
+func (m *JobManager) handleEvents(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	next, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		events, done, changed := m.eventLog(job).since(next)
+		for _, ev := range events {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				loggerFrom(r.Context()).Error("failed to encode job event", "job_id", job.ID, "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+			next = ev.ID
+		}
+		flusher.Flush()
+		if done && len(events) == 0 {
+			return
+		}
+		if done {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// An executor starts package manager commands for installs
+type executor interface {
+	// checkToolchain reports whether installs for eco can run
+	checkToolchain(eco *Ecosystem) error
+	// workPath returns where workDir appears to the command
+	workPath(workDir string) string
+	// command runs tool, eco's package manager or another program for it,
+	// with args in workDir, adding env to its environment and letting it
+	// write to the package cache at cacheDir unless that is empty, on the given
+	// release of eco's runtime unless version is empty. Executors that can run
+	// it on another machine do so for target, which may be nil.
+	// The command runs in its own process group and is killed along with
+	// everything it started when ctx is done.
+	command(ctx context.Context, eco *Ecosystem, workDir, cacheDir, tool string, args, env []string, version string, target *InstallTarget) (*exec.Cmd, error)
+}
+
+// installExecutor runs every install, set from the executor setting
+var installExecutor executor = hostExecutor{}
+
+// newExecutor returns the executor with the given name
+func newExecutor(name string, images map[string]string, network string) (executor, error) {
+	switch name {
+	case "host":
+		return hostExecutor{}, nil
+	case "docker":
+		return &dockerExecutor{images: images, network: network}, nil
+	case "bwrap", "nsjail":
+		return sandboxExecutor{tool: name}, nil
+	}
+	return nil, fmt.Errorf("unknown executor %q", name)
+}
+
+// lookPath finds an executable in the directories of path. An absolute
+// file, such as a tool the install put in the workspace, is used as is.
+func lookPath(file, path string) (string, error) {
+	if filepath.IsAbs(file) {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		p := filepath.Join(dir, file)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH", file)
+}
+
+// killGroup kills the process group cmd leads
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// hostExecutor runs the package manager directly on the server
+type hostExecutor struct{}
+
+func (hostExecutor) checkToolchain(eco *Ecosystem) error { return eco.checkToolchain() }
+
+func (hostExecutor) workPath(workDir string) string { return workDir }
+
+func (hostExecutor) command(ctx context.Context, eco *Ecosystem, workDir, cacheDir, tool string, args, env []string, version string, target *InstallTarget) (*exec.Cmd, error) {
+	path, err := toolchainPath(ctx, eco, version)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Dir = workDir
+	if version != "" {
+		// The last PATH wins, and it must also be used to find the tool
+		env = append(env, "PATH="+path)
+		if cmd.Path, err = lookPath(tool, path); err != nil {
+			return nil, err
+		}
+		cmd.Err = nil
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Run in its own process group so that build scripts and other children
+	// are killed along with the package manager
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return killGroup(cmd) }
+	return cmd, nil
+}
+
+// sandboxHidden are directories replaced by empty tmpfs mounts in sandboxes,
+// so installs can't read the server's home directories or temporary files
+var sandboxHidden = []string{"/tmp", "/home", "/root", "/run", "/var/tmp"}
+
+// sandboxExecutor runs the host's package manager inside bubblewrap or nsjail.
+// The host filesystem is mounted read-only with only the workspace writable,
+// and the sandbox has its own mount, PID and IPC namespaces but shares the
+// network so registries stay reachable. The server's environment, which may
+// hold its own secrets, is not passed in.
+type sandboxExecutor struct {
+	// tool is "bwrap" or "nsjail"
+	tool string
+}
+
+func (s sandboxExecutor) checkToolchain(eco *Ecosystem) error {
+	if _, err := exec.LookPath(s.tool); err != nil {
+		return &statusError{status: http.StatusNotImplemented, err: fmt.Errorf("%s is not installed on this server", s.tool)}
+	}
+	return eco.checkToolchain()
+}
+
+func (sandboxExecutor) workPath(workDir string) string { return workDir }
+
+func (s sandboxExecutor) command(ctx context.Context, eco *Ecosystem, workDir, cacheDir, tool string, args, env []string, version string, target *InstallTarget) (*exec.Cmd, error) {
+	path, err := toolchainPath(ctx, eco, version)
+	if err != nil {
+		return nil, err
+	}
+	toolPath, err := lookPath(tool, path)
+	if err != nil {
+		return nil, err
+	}
+	env = append([]string{"PATH=" + path, "HOME=/tmp"}, env...)
+	var sandbox []string
+	if s.tool == "bwrap" {
+		sandbox = []string{"--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc"}
+		for _, dir := range sandboxHidden {
+			sandbox = append(sandbox, "--tmpfs", dir)
+		}
+		// Downloaded toolchains may live in a hidden directory
+		if nodes != nil {
+			sandbox = append(sandbox, "--ro-bind", nodes.dir, nodes.dir)
+		}
+		if rubiesDir != "" {
+			sandbox = append(sandbox, "--ro-bind-try", rubiesDir, rubiesDir)
+		}
+		if cacheDir != "" {
+			sandbox = append(sandbox, "--bind", cacheDir, cacheDir)
+		}
+		sandbox = append(sandbox, "--bind", workDir, workDir, "--chdir", workDir,
+			"--unshare-all", "--share-net", "--die-with-parent", "--new-session", "--clearenv")
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			sandbox = append(sandbox, "--setenv", k, v)
+		}
+		sandbox = append(sandbox, "--")
+	} else {
+		// nsjail's default limits are far too small for an install, and
+		// the install timeout is enforced by the server
+		sandbox = []string{"--mode", "o", "--quiet", "--time_limit", "0",
+			"--rlimit_as", "max", "--rlimit_fsize", "max", "--rlimit_nofile", "max", "--rlimit_nproc", "max",
+			"--disable_clone_newnet", "--user", fmt.Sprint(os.Getuid()), "--group", fmt.Sprint(os.Getgid()),
+			"--bindmount_ro", "/"}
+		for _, dir := range sandboxHidden {
+			sandbox = append(sandbox, "--tmpfsmount", dir)
+		}
+		if nodes != nil {
+			sandbox = append(sandbox, "--bindmount_ro", nodes.dir)
+		}
+		if _, err := os.Stat(rubiesDir); rubiesDir != "" && err == nil {
+			sandbox = append(sandbox, "--bindmount_ro", rubiesDir)
+		}
+		if cacheDir != "" {
+			sandbox = append(sandbox, "--bindmount", cacheDir)
+		}
+		sandbox = append(sandbox, "--bindmount", workDir, "--cwd", workDir)
+		for _, kv := range env {
+			sandbox = append(sandbox, "--env", kv)
+		}
+		sandbox = append(sandbox, "--")
+	}
+	cmd := exec.CommandContext(ctx, s.tool, append(append(sandbox, toolPath), args...)...)
+	cmd.Dir = workDir
+	cmd.Env = []string{}
+	// The sandboxed processes are in their own PID namespace, which dies
+	// with the sandbox tool
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return killGroup(cmd) }
+	return cmd, nil
+}
+
+// containerWorkDir is where the workspace is mounted inside containers
+const containerWorkDir = "/work"
+
+// dockerExecutor runs each install in a short-lived container from the
+// ecosystem's pinned image. The container's root filesystem is read-only,
+// it has no capabilities and runs as the server's user, and only the
+// workspace and a scratch /tmp are writable.
+type dockerExecutor struct {
+	// images overrides Ecosystem.Image by ecosystem name
+	images map[string]string
+	// network is passed to --network when set
+	network string
+	// build runs the official node images' full variant, which has the
+	// toolchain native modules are compiled with, in place of the slim one
+	build bool
+}
+
+// builder returns the executor that compiles eco's native modules, or nil
+// if there's no image with the toolchain for it: only the official node
+// images have a full variant, and their Alpine one has none
+func (d *dockerExecutor) builder(eco *Ecosystem, target *InstallTarget) *dockerExecutor {
+	if d.build || d.images[eco.Name] != "" || !strings.HasPrefix(eco.Image, "node:") || target != nil && target.Libc == "musl" {
+		return nil
+	}
+	return &dockerExecutor{images: d.images, network: d.network, build: true}
+}
+
+func (d *dockerExecutor) image(eco *Ecosystem) string {
+	if image := d.images[eco.Name]; image != "" {
+		return image
+	}
+	return eco.Image
+}
+
+// runtimeImage returns the image for eco on the given release of its runtime
+// and, for musl targets, on Alpine. The official node images, which yarn's
+// default is, and ruby images come in a tag per release and variant; ruby's
+// default is the full variant, as gems compile native extensions.
+func (d *dockerExecutor) runtimeImage(eco *Ecosystem, version string, target *InstallTarget) (string, error) {
+	musl := target != nil && target.Libc == "musl"
+	if version == "" && !musl && !d.build {
+		return d.image(eco), nil
+	}
+	repo, tag, _ := strings.Cut(eco.Image, ":")
+	if d.images[eco.Name] != "" || repo != "node" && repo != "ruby" {
+		if version == "" {
+			return "", badRequest("musl targets are not supported for %s installs on this server", eco.Name)
+		}
+		return "", badRequest("%s_version is not supported for %s installs on this server", eco.Runtime, eco.Name)
+	}
+	release, _, _ := strings.Cut(tag, "-")
+	if version != "" {
+		release = strings.TrimPrefix(version, "v")
+	}
+	switch {
+	case musl:
+		return repo + ":" + release + "-alpine", nil
+	case d.build || repo == "ruby":
+		return repo + ":" + release + "-bookworm", nil
+	}
+	return repo + ":" + release + "-bookworm-slim", nil
+}
+
+func (d *dockerExecutor) checkToolchain(eco *Ecosystem) error {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return &statusError{status: http.StatusNotImplemented, err: fmt.Errorf("docker is not installed on this server")}
+	}
+	if d.image(eco) == "" {
+		return &statusError{status: http.StatusNotImplemented, err: fmt.Errorf("no container image is configured for %s", eco.Name)}
+	}
+	return nil
+}
+
+func (d *dockerExecutor) workPath(string) string { return containerWorkDir }
+
+func (d *dockerExecutor) command(ctx context.Context, eco *Ecosystem, workDir, cacheDir, tool string, args, env []string, version string, target *InstallTarget) (*exec.Cmd, error) {
+	image, err := d.runtimeImage(eco, version, target)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	name := "pip-install-" + hex.EncodeToString(id)
+	run := []string{"run", "--rm", "--name", name,
+		"--read-only", "--tmpfs", "/tmp:rw,exec",
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"--volume", workDir + ":" + containerWorkDir, "--workdir", containerWorkDir,
+		// Caches go to the scratch /tmp, as nothing else is writable
+		"--env", "HOME=/tmp",
+	}
+	if d.network != "" {
+		run = append(run, "--network", d.network)
+	}
+	// Emulated by the host's binfmt handlers when the arch isn't its own,
+	// so install scripts build native modules for the target too
+	if platform := target.dockerPlatform(); platform != "" {
+		run = append(run, "--platform", platform)
+	}
+	// The shared cache is mounted at the same path, so its environment
+	// variables hold inside the container too
+	if cacheDir != "" {
+		run = append(run, "--volume", cacheDir+":"+cacheDir)
+	}
+	if installMemoryMax > 0 {
+		mem := strconv.FormatInt(installMemoryMax, 10)
+		run = append(run, "--memory", mem, "--memory-swap", mem)
+	}
+	if installCPUWeight > 0 {
+		// cpu.weight defaults to 100 where docker's CPU shares default to 1024
+		run = append(run, "--cpu-shares", strconv.Itoa(max(2, installCPUWeight*1024/100)))
+	}
+	for _, kv := range env {
+		run = append(run, "--env", kv)
+	}
+	run = append(run, image, tool)
+	cmd := exec.CommandContext(ctx, "docker", append(run, args...)...)
+	cmd.Dir = workDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Killing the client leaves the container running, so stop it first
+	cmd.Cancel = func() error {
+		if out, err := exec.Command("docker", "kill", name).CombinedOutput(); err != nil {
+			loggerFrom(ctx).Warn("failed to kill install container", "container", name,
+				"error", err, "output", strings.TrimSpace(string(out)))
+		}
+		return killGroup(cmd)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// npmNamePattern matches valid npm package names, scoped or not
+var npmNamePattern = regexp.MustCompile(`^(@[a-z0-9-~][a-z0-9-._~]*/)?[a-z0-9-~][a-z0-9-._~]*$`)
+
+// composerNamePattern matches valid Composer package names, vendor/name
+var composerNamePattern = regexp.MustCompile(`^[a-z0-9]([_.-]?[a-z0-9]+)*/[a-z0-9](([_.]|-{1,2})?[a-z0-9]+)*$`)
+
+// gemNamePattern matches valid gem names
+var gemNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// gemRequirementPattern matches one gem version requirement, such as "~> 7.1"
+var gemRequirementPattern = regexp.MustCompile(`^(~>|>=|<=|!=|[<>=])?\s*\d[0-9A-Za-z.]*$`)
+
+// crateNamePattern matches valid crate names
+var crateNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,63}$`)
+
+// crateRequirementPattern matches a Cargo version requirement, such as "1",
+// "^1.0.200" or ">=0.4, <0.6"
+var crateRequirementPattern = regexp.MustCompile(`^[0-9A-Za-z.*^~<>=, +-]+$`)
+
+// packagesEcosystem is the ecosystem POST /install/packages uses unless the
+// ecosystem query parameter names another
+var packagesEcosystem = yarnEcosystem
+
+// npmFromPackages writes a package.json depending on specs such as
+// "express@4" or "@types/node@^20". A spec without a version installs the
+// latest release.
+func npmFromPackages(specs []string) (map[string]string, error) {
+	deps := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, version := splitNpmSpec(strings.TrimSpace(spec))
+		if !npmNamePattern.MatchString(name) {
+			return nil, badRequest("Invalid package %q: must be a name with an optional @version", spec)
+		}
+		if version == "" {
+			version = "latest"
+		}
+		deps[name] = version
+	}
+	b, err := json.MarshalIndent(map[string]any{
+		"name":         "pip-install-packages",
+		"version":      "0.0.0",
+		"private":      true,
+		"dependencies": deps,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"package.json": string(b) + "\n"}, nil
+}
+
+// pipFromPackages writes a requirements.txt with one requirement per spec,
+// such as "requests==2.31.0" or "django>=4,<5"
+func pipFromPackages(specs []string) (map[string]string, error) {
+	var requirements strings.Builder
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		// Options such as -r or --index-url would change how pip runs
+		if spec == "" || strings.HasPrefix(spec, "-") || strings.ContainsAny(spec, "\r\n") {
+			return nil, badRequest("Invalid package %q: must be a requirement such as \"requests==2.31.0\"", spec)
+		}
+		requirements.WriteString(spec + "\n")
+	}
+	return map[string]string{"requirements.txt": requirements.String()}, nil
+}
+
+// composerFromPackages writes a composer.json requiring specs such as
+// "monolog/monolog:^3", as composer require takes them. A spec without a
+// constraint installs the latest stable release.
+func composerFromPackages(specs []string) (map[string]string, error) {
+	require := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, constraint, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		if !composerNamePattern.MatchString(name) || strings.ContainsAny(constraint, "\r\n") {
+			return nil, badRequest("Invalid package %q: must be a vendor/name with an optional :constraint", spec)
+		}
+		if constraint == "" {
+			constraint = "*"
+		}
+		require[name] = constraint
+	}
+	b, err := json.MarshalIndent(map[string]any{"require": require}, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"composer.json": string(b) + "\n"}, nil
+}
+
+// bundlerFromPackages writes a Gemfile depending on specs such as "rails" or
+// "rails:~> 7.1, >= 7.1.2", a gem name with optional comma-separated
+// requirements. A spec without requirements installs the latest release.
+func bundlerFromPackages(specs []string) (map[string]string, error) {
+	var gemfile strings.Builder
+	gemfile.WriteString("source \"https://rubygems.org\"\n\n")
+	for _, spec := range specs {
+		name, requirements, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		if !gemNamePattern.MatchString(name) {
+			return nil, badRequest("Invalid package %q: must be a gem name with optional :requirements", spec)
+		}
+		fmt.Fprintf(&gemfile, "gem %q", name)
+		if requirements == "" {
+			gemfile.WriteString("\n")
+			continue
+		}
+		for _, r := range strings.Split(requirements, ",") {
+			if r = strings.TrimSpace(r); !gemRequirementPattern.MatchString(r) {
+				return nil, badRequest("Invalid package %q: %q is not a version requirement such as \"~> 7.1\"", spec, r)
+			}
+			fmt.Fprintf(&gemfile, ", %q", r)
+		}
+		gemfile.WriteString("\n")
+	}
+	return map[string]string{"Gemfile": gemfile.String()}, nil
+}
+
+// cargoFromPackages writes a Cargo.toml depending on specs such as "serde@1"
+// or "tokio@^1.40", as cargo add takes them. A spec without a version
+// requirement vendors the latest release.
+func cargoFromPackages(specs []string) (map[string]string, error) {
+	var manifest strings.Builder
+	manifest.WriteString("[package]\nname = \"pip-install-packages\"\nversion = \"0.0.0\"\nedition = \"2021\"\npublish = false\n\n[dependencies]\n")
+	for _, spec := range specs {
+		name, requirement, _ := strings.Cut(strings.TrimSpace(spec), "@")
+		if requirement == "" {
+			requirement = "*"
+		}
+		if !crateNamePattern.MatchString(name) || !crateRequirementPattern.MatchString(requirement) {
+			return nil, badRequest("Invalid package %q: must be a crate name with an optional @version", spec)
+		}
+		manifest.WriteString(name + " = \"" + requirement + "\"\n")
+	}
+	return map[string]string{"Cargo.toml": manifest.String()}, nil
+}
+
+// addPackageManifests adds the manifests the ecosystem generates for a list
+// of package specs to a request's files
+func addPackageManifests(eco *Ecosystem, files map[string]string, specs []string) error {
+	if eco.FromPackages == nil {
+		return badRequest("packages is not supported for %s installs", eco.Name)
+	}
+	if len(specs) == 0 {
+		return badRequest("packages must list at least one package")
+	}
+	generated, err := eco.FromPackages(specs)
+	if err != nil {
+		return err
+	}
+	for name, content := range generated {
+		if files[name] != "" {
+			return badRequest("packages can't be combined with %s", name)
+		}
+		files[name] = content
+	}
+	return nil
+}
+
+// decodePackages reads the packages field of a request, a list of specs
+func decodePackages(eco *Ecosystem, files map[string]string, raw []byte) error {
+	var specs []string
+	if err := json.Unmarshal(raw, &specs); err != nil {
+		return badRequest("packages must be a list of package specs such as \"express@4\"")
+	}
+	return addPackageManifests(eco, files, specs)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// auditFailOn is the server's vulnerability gate, set from the audit_fail_on
+// setting: installs with advisories of this severity or worse fail. Empty
+// turns the gate off unless a request asks for it.
+var auditFailOn string
+
+// gateSeverities are the valid thresholds, from most to least severe
+var gateSeverities = []string{"critical", "high", "moderate", "low", "info"}
+
+// failOn returns the gate threshold for the request: the stricter of the
+// server's and the request's
+func (o InstallOptions) failOn() string {
+	if o.AuditFailOn == "" || auditFailOn != "" && severityRank(auditFailOn) > severityRank(o.AuditFailOn) {
+		return auditFailOn
+	}
+	return o.AuditFailOn
+}
+
+// validateFailOn checks the audit_fail_on option, which may only tighten the
+// server's gate
+func validateFailOn(eco *Ecosystem, failOn string) error {
+	if !slices.Contains(gateSeverities, failOn) {
+		return badRequest("Invalid audit_fail_on %q: must be one of %s", failOn, strings.Join(gateSeverities, ", "))
+	}
+	if eco.Audit == nil {
+		return badRequest("audit_fail_on is not supported for %s", eco.Name)
+	}
+	if auditFailOn != "" && severityRank(failOn) < severityRank(auditFailOn) {
+		return badRequest("audit_fail_on %q is looser than the server's policy of %q", failOn, auditFailOn)
+	}
+	return nil
+}
+
+// An auditGateError fails an install whose packages have advisories at or
+// above the gate's threshold
+type auditGateError struct {
+	threshold  string
+	advisories []Advisory
+}
+
+func (e *auditGateError) Error() string {
+	return fmt.Sprintf("Install has %d advisories of %s severity or worse", len(e.advisories), e.threshold)
+}
+
+func (e *auditGateError) code() string { return "AUDIT_GATE_FAILED" }
+
+func (e *auditGateError) details() map[string]any {
+	return map[string]any{"threshold": e.threshold, "advisories": e.advisories}
+}
+
+// A policyError fails an install that breaks one of the server's or the
+// request's policies, with details of what broke it
+type policyError interface {
+	error
+	details() map[string]any
+}
+
+// writePolicyError responds with a policy failure's details
+func writePolicyError(w http.ResponseWriter, err policyError) {
+	writeJSON(w, http.StatusUnprocessableEntity, errorBody(err, http.StatusUnprocessableEntity))
+}
+
+// gateInstall verifies the provenance of an install's packages when the
+// request has a provenance policy, and audits it when the request's gate is
+// on. Advisories without a severity, as pip-audit reports them, always fail
+// it.
+func gateInstall(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir, outputDir string) error {
+	if err := checkProvenance(ctx, eco, req, workDir, outputDir); err != nil {
+		return err
+	}
+	threshold := req.Options.failOn()
+	if threshold == "" {
+		return nil
+	}
+	// The gate fails closed: a missing scanner fails the install
+	if err := checkAuditTool(eco); err != nil {
+		return err
+	}
+	defer notesFrom(ctx).phase("audit", time.Now())
+	report, err := runAudit(ctx, eco, req, workDir, outputDir)
+	if err != nil {
+		return err
+	}
+	var failing []Advisory
+	for _, adv := range report.Advisories {
+		if adv.Severity == "unknown" || severityRank(adv.Severity) <= severityRank(threshold) {
+			failing = append(failing, adv)
+		}
+	}
+	if len(failing) > 0 {
+		loggerFrom(ctx).Warn("install failed the vulnerability gate", "threshold", threshold, "advisories", len(failing))
+		return &auditGateError{threshold: threshold, advisories: failing}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// gcsScope is the OAuth scope uploads are made with
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// A gcsClient uploads artifacts to Google Cloud Storage through its XML API,
+// authenticating as a service account
+type gcsClient struct {
+	endpoint *url.URL
+	// email and key are the service account's, from its JSON key file
+	email    string
+	key      *rsa.PrivateKey
+	tokenURL string
+	buckets  []string
+	// signedURLTTL is how long the download URLs returned for uploads work
+	signedURLTTL time.Duration
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newGCSClient reads a service account JSON key file
+func newGCSClient(credentialsFile, endpoint string, buckets []string, ttl time.Duration, client *http.Client) (*gcsClient, error) {
+	b, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %v", credentialsFile, err)
+	}
+	if creds.Type != "service_account" {
+		return nil, fmt.Errorf("%s is not a service account key", credentialsFile)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM private key", credentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the private key in %s: %v", credentialsFile, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, not an RSA key", credentialsFile, parsed)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &gcsClient{
+		endpoint:     u,
+		email:        creds.ClientEmail,
+		key:          key,
+		tokenURL:     creds.TokenURI,
+		buckets:      buckets,
+		signedURLTTL: ttl,
+		client:       client,
+	}, nil
+}
+
+func (c *gcsClient) Buckets() []string { return c.buckets }
+
+// objectURL returns the URL of an object, addressed by path
+func (c *gcsClient) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+// Put uploads body as an object. GCS can't check a SHA-256, so it is kept in
+// the object's metadata instead.
+func (c *gcsClient) Put(ctx context.Context, bucket, key, contentType string, body io.Reader, size int64, sum string) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(bucket, key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Goog-Meta-Sha256", sum)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("PUT gs://%s/%s: %s: %s", bucket, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// accessToken returns an OAuth access token for the service account,
+// exchanging a signed JWT for a new one shortly before the last expires
+func (c *gcsClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expires) > time.Minute {
+		return c.token, nil
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   c.email,
+		"scope": gcsScope,
+		"aud":   c.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(c.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", fmt.Errorf("fetching a GCS access token: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("fetching a GCS access token: %v", err)
+	}
+	c.token, c.expires = token.AccessToken, now.Add(time.Duration(token.ExpiresIn)*time.Second)
+	return c.token, nil
+}
+
+// SignedURL returns a V4 signed URL that downloads the object without
+// credentials until the returned time
+func (c *gcsClient) SignedURL(ctx context.Context, bucket, key string, now time.Time) (string, time.Time, error) {
+	u := c.objectURL(bucket, key)
+	date := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	query := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {c.email + "/" + scope},
+		"X-Goog-Date":          {date},
+		"X-Goog-Expires":       {strconv.Itoa(int(c.signedURLTTL.Seconds()))},
+		"X-Goog-SignedHeaders": {"host"},
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "GOOG4-RSA-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	digest := sha256.Sum256([]byte(stringToSign))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	u.RawQuery = canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(sig)
+	return u.String(), now.Add(c.signedURLTTL), nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"pip-install/pipinstallpb"
+)
+
+// artifactChunkSize is how much of an archive each FetchArtifact message carries
+const artifactChunkSize = 64 << 10
+
+var grpcRequests = newCounterVec("pip_install_grpc_requests_total",
+	"gRPC calls handled, by method and status code.", "method", "code")
+
+// A grpcServer serves the pipinstallpb API on top of the JobManager, with
+// the same authentication, limits, logs and traces as the HTTP routes
+type grpcServer struct {
+	pipinstallpb.UnimplementedPipInstallServer
+	jobs   *JobManager
+	server *grpc.Server
+	health *grpchealth.Server
+}
+
+// newGRPCServer registers the API and the standard health service, serving
+// TLS when tlsConfig is set
+func newGRPCServer(jobs *JobManager, tlsConfig *tls.Config) *grpcServer {
+	s := &grpcServer{jobs: jobs, health: grpchealth.NewServer()}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			var resp any
+			err := grpcCall(ctx, info.FullMethod, func(ctx context.Context) error {
+				var err error
+				resp, err = handler(ctx, req)
+				return err
+			})
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return grpcCall(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+				return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+			})
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s.server = grpc.NewServer(opts...)
+	pipinstallpb.RegisterPipInstallServer(s.server, s)
+	healthpb.RegisterHealthServer(s.server, s.health)
+	return s
+}
+
+// serve accepts connections on lis until shutdown
+func (s *grpcServer) serve(lis net.Listener) error {
+	return s.server.Serve(lis)
+}
+
+// shutdown reports NOT_SERVING to health checks and waits for open calls to
+// finish, closing them once ctx is done
+func (s *grpcServer) shutdown(ctx context.Context) {
+	s.health.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.Warn("drain timeout expired, closing open gRPC calls")
+		s.server.Stop()
+	}
+}
+
+// A contextStream is a server stream whose handler sees ctx
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// grpcCall runs one call the way withRequestLogging, traced, auth.require and
+// limits.rate wrap an HTTP request: with a request ID, a server span, the
+// caller's credentials checked and a "request completed" log line
+func grpcCall(ctx context.Context, method string, call func(context.Context) error) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := firstMetadata(md, strings.ToLower(requestIDHeader))
+	if !requestIDPattern.MatchString(id) {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	ip := grpcClientIP(ctx)
+	logger := slog.Default().With("request_id", id, "client_ip", ip)
+	ra := &requestAttrs{}
+	ctx = context.WithValue(withLogger(ctx, logger), requestAttrsKey{}, ra)
+
+	service, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(name)))
+	defer span.End()
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = withLogger(ctx, loggerFrom(ctx).With("trace_id", sc.TraceID().String()))
+	}
+
+	start := time.Now()
+	err := admitCall(ctx, method, md, ip, call)
+	code := status.Code(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	switch code {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.Unimplemented:
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+	grpcRequests.inc(method, code.String())
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	logger.Info("request completed", append([]any{
+		"method", method,
+		"code", code.String(),
+		"duration_ms", time.Since(start).Milliseconds(),
+	}, ra.attrs...)...)
+	return err
+}
+
+// admitCall checks the caller's bearer token, except for health checks, and
+// the request rate of SubmitInstall, before running call
+func admitCall(ctx context.Context, method string, md metadata.MD, ip string, call func(context.Context) error) error {
+	if strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return call(ctx)
+	}
+	if auth.enabled() {
+		token, _ := parseBearer(firstMetadata(md, "authorization"))
+		admitted, err := auth.admit(ctx, token)
+		if err != nil {
+			authFailures.inc()
+			loggerFrom(ctx).Warn("rejected unauthenticated request", "method", method, "reason", err.Error())
+			return status.Error(codes.Unauthenticated, "Missing or invalid credentials")
+		}
+		ctx = admitted
+	}
+	if method == pipinstallpb.PipInstall_SubmitInstall_FullMethodName && limits.perMinute > 0 {
+		client := callerID(ctx, ip)
+		if wait, ok := limits.take(client, time.Now()); !ok {
+			rateLimited.inc("rate")
+			loggerFrom(ctx).Warn("rate limit exceeded", "client", client)
+			return status.Errorf(codes.ResourceExhausted, "Rate limit exceeded, try again in %ds", int(math.Ceil(wait.Seconds())))
+		}
+	}
+	accounting.add(ctx, UsageCounts{Requests: 1})
+	return call(ctx)
+}
+
+// grpcClientIP returns the caller's address, read from x-forwarded-for
+// when the peer is a trusted proxy as for HTTP requests
+func grpcClientIP(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return forwardedClientIP(host, md.Get("x-forwarded-for"))
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// metadataCarrier reads propagated trace context from incoming metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string { return firstMetadata(metadata.MD(c), key) }
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// grpcError converts an error carrying an HTTP status to a gRPC status
+func grpcError(err error) error {
+	code := codes.Internal
+	switch errorStatus(err) {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict, http.StatusUnprocessableEntity:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+// SubmitInstall queues an install like POST /jobs
+func (s *grpcServer) SubmitInstall(ctx context.Context, in *pipinstallpb.SubmitInstallRequest) (*pipinstallpb.Job, error) {
+	name := in.Ecosystem
+	if name == "" {
+		name = pipEcosystem.Name
+	}
+	eco := findEcosystem(name)
+	if eco == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Unknown ecosystem %q", name)
+	}
+	req, err := installRequestFromProto(eco, in)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	req.cacheNamespace = cacheNamespaceOf(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if req.idempotencyKey, err = idempotencyKeyOf(ctx, firstMetadata(md, "idempotency-key")); err != nil {
+		return nil, grpcError(err)
+	}
+	if req.Options.CallbackURL != "" {
+		if err := validateCallbackURL(req.Options.CallbackURL); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+	release, err := limits.reserve(ctx, callerID(ctx, grpcClientIP(ctx)))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	// There is no HTTP host to make webhook artifact URLs absolute with
+	job, err := s.jobs.submit(ctx, eco, req, "", !in.NoCache, release)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if job.replayed {
+		return jobToProto(newJobResponse(*job)), nil
+	}
+	snapshot, _, err := s.jobs.get(ctx, job.ID)
+	if err != nil {
+		snapshot = *job
+	}
+	if snapshot.Cached {
+		job.logger.Info("job served from cache", "digest", snapshot.ArtifactDigest)
+	} else {
+		job.logger.Info("job queued")
+	}
+	return jobToProto(newJobResponse(snapshot)), nil
+}
+
+// installRequestFromProto builds the install a JSON body with the same
+// files, packages and options would describe
+func installRequestFromProto(eco *Ecosystem, in *pipinstallpb.SubmitInstallRequest) (*InstallRequest, error) {
+	req := &InstallRequest{Files: make(map[string]string), Format: archiveFormats[0]}
+	if in.Format != "" {
+		i := slices.IndexFunc(archiveFormats, func(f *archiveFormat) bool { return f.Name == in.Format })
+		if i < 0 {
+			return nil, badRequest("Unsupported format %q", in.Format)
+		}
+		req.Format = archiveFormats[i]
+	}
+	accepted := make([]string, len(eco.Files))
+	for i, mf := range eco.Files {
+		accepted[i] = mf.Name
+	}
+	for name, content := range in.Files {
+		if !slices.Contains(accepted, name) && !isWorkspaceManifest(eco, name) {
+			return nil, badRequest("Unexpected file %q: %s installs accept %s", name, eco.Name, strings.Join(accepted, ", "))
+		}
+		if i := slices.IndexFunc(eco.Files, func(mf ManifestFile) bool { return mf.Name == name }); i >= 0 {
+			var err error
+			if content, err = eco.Files[i].decode(content); err != nil {
+				return nil, err
+			}
+		}
+		req.Files[name] = content
+	}
+	if len(in.Packages) > 0 {
+		if err := addPackageManifests(eco, req.Files, in.Packages); err != nil {
+			return nil, err
+		}
+	}
+	if o := in.Options; o != nil {
+		req.Options = InstallOptions{
+			CallbackURL:      o.CallbackUrl,
+			Timeout:          o.Timeout,
+			Registry:         o.Registry,
+			IgnoreScripts:    o.IgnoreScripts,
+			NodeVersion:      o.NodeVersion,
+			RubyVersion:      o.RubyVersion,
+			Omit:             o.Omit,
+			PeerDepsMode:     o.PeerDepsMode,
+			EngineStrict:     o.EngineStrict,
+			NpmArgs:          o.NpmArgs,
+			AuditFailOn:      o.AuditFailOn,
+			VerifyProvenance: o.VerifyProvenance,
+			RequireIntegrity: o.RequireIntegrity,
+			SBOM:             o.Sbom,
+			DenyLicenses:     o.DenyLicenses,
+			Workspaces:       o.Workspaces,
+			Include:          o.Include,
+			Compression:      o.Compression,
+			CompressionLevel: int(o.CompressionLevel),
+			LicenseReport:    o.LicenseReport,
+			Report:           o.Report,
+			Prune:            o.Prune,
+		}
+		if t := o.Target; t != nil {
+			req.Options.Target = &InstallTarget{Platform: t.Platform, Arch: t.Arch, Libc: t.Libc}
+		}
+		for _, t := range o.Targets {
+			req.Options.Targets = append(req.Options.Targets, &InstallTarget{Platform: t.Platform, Arch: t.Arch, Libc: t.Libc})
+		}
+		if t := o.Output; t != nil {
+			req.Options.Output = &OutputTarget{
+				Type:       t.Type,
+				Bucket:     t.Bucket,
+				Key:        t.Key,
+				Repository: t.Repository,
+				Tag:        t.Tag,
+				BaseImage:  t.BaseImage,
+				Path:       t.Path,
+				Platform:   t.Platform,
+			}
+		}
+	}
+	if err := completeRequest(eco, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// GetJob returns a job like GET /jobs/{id}
+func (s *grpcServer) GetJob(ctx context.Context, in *pipinstallpb.GetJobRequest) (*pipinstallpb.Job, error) {
+	job, err := s.find(ctx, in.Id)
+	if err != nil {
+		return nil, err
+	}
+	return jobToProto(newJobResponse(job)), nil
+}
+
+// CancelJob cancels a job like DELETE /jobs/{id}, returning it once it has
+// stopped or after a while if it is still stopping
+func (s *grpcServer) CancelJob(ctx context.Context, in *pipinstallpb.CancelJobRequest) (*pipinstallpb.Job, error) {
+	job, err := s.find(ctx, in.Id)
+	if err != nil {
+		return nil, err
+	}
+	by, err := cancellerOf(ctx, job)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	job, _, err = s.jobs.cancel(ctx, in.Id, by)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	loggerFrom(ctx).Info("job cancelled", "job_id", job.ID, "by", by)
+	return jobToProto(newJobResponse(job)), nil
+}
+
+// find returns the job with the given ID, or a NotFound status
+func (s *grpcServer) find(ctx context.Context, id string) (Job, error) {
+	job, ok, err := s.jobs.get(ctx, id)
+	if err != nil {
+		return Job{}, status.Errorf(codes.Unavailable, "Failed to read job: %v", err)
+	}
+	if !ok {
+		return Job{}, status.Error(codes.NotFound, "Job not found")
+	}
+	return job, nil
+}
+
+// StreamLogs sends a job's events like GET /jobs/{id}/events, resuming
+// after after_id
+func (s *grpcServer) StreamLogs(in *pipinstallpb.StreamLogsRequest, stream grpc.ServerStreamingServer[pipinstallpb.JobEvent]) error {
+	ctx := stream.Context()
+	job, err := s.find(ctx, in.Id)
+	if err != nil {
+		return err
+	}
+	next := int(in.AfterId)
+	for {
+		events, done, changed := s.jobs.eventLog(job).since(next)
+		for _, ev := range events {
+			if err := stream.Send(&pipinstallpb.JobEvent{
+				Id:     int32(ev.ID),
+				Type:   ev.Type,
+				Time:   timestamppb.New(ev.Time),
+				Phase:  ev.Phase,
+				Status: jobStatusToProto(ev.Status),
+				Stream: ev.Stream,
+				Line:   ev.Line,
+			}); err != nil {
+				return err
+			}
+			next = ev.ID
+		}
+		if done && len(events) == 0 {
+			return nil
+		}
+		if done {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// FetchArtifact streams a succeeded job's archive like GET
+// /jobs/{id}/artifact
+func (s *grpcServer) FetchArtifact(in *pipinstallpb.FetchArtifactRequest, stream grpc.ServerStreamingServer[pipinstallpb.ArtifactChunk]) error {
+	ctx := stream.Context()
+	job, err := s.find(ctx, in.Id)
+	if err != nil {
+		return err
+	}
+	if job.Status != JobSucceeded {
+		return status.Errorf(codes.FailedPrecondition, "Artifact not available: job is %s", job.Status)
+	}
+	artifact, err := s.jobs.installer.store.Open(job.ArtifactDigest)
+	if errors.Is(err, errArtifactNotFound) {
+		return status.Error(codes.NotFound, "Artifact not found or expired")
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("failed to open artifact", "digest", job.ArtifactDigest, "error", err)
+		return status.Error(codes.Internal, "Failed to open artifact")
+	}
+	defer artifact.Close()
+
+	chunk := &pipinstallpb.ArtifactChunk{Info: &pipinstallpb.ArtifactInfo{
+		Sha256:      artifact.Digest,
+		Filename:    artifact.Filename,
+		ContentType: artifact.ContentType,
+		Size:        artifact.Size,
+	}}
+	var served int64
+	defer func() { accounting.add(ctx, UsageCounts{BytesServed: served}) }()
+	buf := make([]byte, artifactChunkSize)
+	for {
+		n, err := io.ReadFull(artifact, buf)
+		if n > 0 || chunk.Info != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			served += int64(n)
+			chunk = &pipinstallpb.ArtifactChunk{}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			loggerFrom(ctx).Warn("failed to stream artifact", "digest", artifact.Digest, "error", err)
+			return status.Error(codes.Internal, fmt.Sprintf("Failed to read artifact: %v", err))
+		}
+	}
+}
+
+// jobToProto converts a job as GET /jobs/{id} would describe it
+func jobToProto(resp jobResponse) *pipinstallpb.Job {
+	job := &pipinstallpb.Job{
+		Id:             resp.ID,
+		Ecosystem:      resp.Ecosystem,
+		Status:         jobStatusToProto(resp.Status),
+		Error:          resp.Error,
+		CreatedAt:      timestamppb.New(resp.CreatedAt),
+		StartedAt:      timestampOrNil(resp.StartedAt),
+		FinishedAt:     timestampOrNil(resp.FinishedAt),
+		ArtifactSha256: resp.ArtifactDigest,
+		Cached:         resp.Cached,
+		QueuePosition:  int32(resp.QueuePosition),
+		SkippedScripts: resp.SkippedScripts,
+		PrunedBytes:    resp.PrunedBytes,
+		ErrorCode:      resp.ErrorCode,
+		Retries:        int32(resp.Retries),
+	}
+	if resp.ExitCode != nil {
+		code := int32(*resp.ExitCode)
+		job.ExitCode = &code
+	}
+	for _, w := range resp.Warnings {
+		job.Warnings = append(job.Warnings, &pipinstallpb.InstallWarning{Kind: w.Kind, Package: w.Package, Message: w.Message})
+	}
+	if out := resp.Output; out != nil {
+		job.Output = &pipinstallpb.UploadedArtifact{
+			Type:           out.Type,
+			Bucket:         out.Bucket,
+			Key:            out.Key,
+			Url:            out.URL,
+			ExpiresAt:      timestampOrNil(out.ExpiresAt),
+			Reference:      out.Reference,
+			ManifestDigest: out.ManifestDigest,
+			Sha256:         out.SHA256,
+			Size:           out.Size,
+		}
+	}
+	return job
+}
+
+func jobStatusToProto(s JobStatus) pipinstallpb.JobStatus {
+	switch s {
+	case JobQueued:
+		return pipinstallpb.JobStatus_JOB_STATUS_QUEUED
+	case JobRunning:
+		return pipinstallpb.JobStatus_JOB_STATUS_RUNNING
+	case JobSucceeded:
+		return pipinstallpb.JobStatus_JOB_STATUS_SUCCEEDED
+	case JobFailed:
+		return pipinstallpb.JobStatus_JOB_STATUS_FAILED
+	}
+	return pipinstallpb.JobStatus_JOB_STATUS_UNSPECIFIED
+}
+
+func timestampOrNil(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// readyCacheTTL is how long readiness results are reused, so frequent
+	// probes don't hammer the registries
+	readyCacheTTL = 10 * time.Second
+	// registryTimeout bounds each registry reachability check
+	registryTimeout = 5 * time.Second
+)
+
+// A healthChecker answers liveness and readiness probes. The server is ready
+// when every configured ecosystem's toolchain is installed and its registry
+// answers, and the workspace filesystem is writable with enough free space.
+type healthChecker struct {
+	ecosystems []*Ecosystem
+	minFree    uint64
+	// client is nil when registries aren't checked
+	client *http.Client
+	// draining is set once shutdown starts
+	draining atomic.Bool
+
+	mu        sync.Mutex
+	last      readiness
+	checkedAt time.Time
+}
+
+// A readiness report lists the result of every check
+type readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []checkResult `json:"checks"`
+}
+
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newHealthChecker(ecosystems []*Ecosystem, minFree uint64, checkRegistries bool) *healthChecker {
+	h := &healthChecker{ecosystems: ecosystems, minFree: minFree}
+	if checkRegistries {
+		h.client = &http.Client{Timeout: registryTimeout}
+	}
+	return h
+}
+
+// handleHealthz serves GET /healthz, which succeeds while the process is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz serves GET /readyz with 200 when the server can take installs
+// and 503 otherwise, listing each check in the body
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var report readiness
+	if h.draining.Load() {
+		report = readiness{Checks: []checkResult{{Name: "shutdown", Error: "server is shutting down"}}}
+	} else {
+		report = h.check(r.Context())
+	}
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// check runs the readiness checks, reusing a recent result
+func (h *healthChecker) check(ctx context.Context) readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < readyCacheTTL {
+		return h.last
+	}
+
+	checks := []func(context.Context) checkResult{h.checkWorkspace}
+	for _, eco := range h.ecosystems {
+		checks = append(checks, toolchainCheck(eco))
+		if h.client != nil {
+			checks = append(checks, h.registryCheck(eco))
+		}
+	}
+	// Results are shared between probes, so one probe giving up mustn't
+	// cut the checks short
+	checkCtx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	results := make([]checkResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func(context.Context) checkResult) {
+			defer wg.Done()
+			results[i] = check(checkCtx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := readiness{Ready: true, Checks: results}
+	for _, res := range results {
+		if !res.OK {
+			report.Ready = false
+			loggerFrom(ctx).Warn("readiness check failed", "check", res.Name, "error", res.Error)
+		}
+	}
+	h.last, h.checkedAt = report, time.Now()
+	return report
+}
+
+// checkWorkspace verifies that workspaces can be created and that their
+// filesystem has at least minFree bytes available
+func (h *healthChecker) checkWorkspace(context.Context) checkResult {
+	res := checkResult{Name: "workspace"}
+	dir, err := os.MkdirTemp(workRoot, workDirPrefix+"probe_")
+	if err != nil {
+		res.Error = fmt.Sprintf("workspace directory is not writable: %v", err)
+		return res
+	}
+	defer os.Remove(dir)
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if free := fs.Bavail * uint64(fs.Bsize); free < h.minFree {
+		res.Error = fmt.Sprintf("only %d MiB free, need %d MiB", free>>20, h.minFree>>20)
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+func toolchainCheck(eco *Ecosystem) func(context.Context) checkResult {
+	return func(context.Context) checkResult {
+		res := checkResult{Name: eco.Name + " toolchain"}
+		if err := installExecutor.checkToolchain(eco); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.OK = true
+		return res
+	}
+}
+
+// registryCheck verifies that the ecosystem's registry answers. Any response
+// below 500 counts, since some registries reject bare requests.
+func (h *healthChecker) registryCheck(eco *Ecosystem) func(context.Context) checkResult {
+	return func(ctx context.Context) checkResult {
+		res := checkResult{Name: eco.Name + " registry"}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, eco.Registry, nil)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			res.Error = fmt.Sprintf("%s answered %s", eco.Registry, resp.Status)
+			return res
+		}
+		res.OK = true
+		return res
+	}
+}
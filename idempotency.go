@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// idempotencyWindow is how long an Idempotency-Key keeps naming the job it
+// was first sent with, set from the idempotency_window setting. It is no
+// longer than artifact_ttl, so the job is still known.
+var idempotencyWindow = time.Hour
+
+// maxIdempotencyKey caps the length of an Idempotency-Key
+const maxIdempotencyKey = 255
+
+var idempotentReplays = newCounterVec("pip_install_idempotent_replays_total",
+	"Job submissions answered with the job first submitted with their Idempotency-Key, by ecosystem.", "ecosystem")
+
+// An idempotencyClaim is the job a caller's Idempotency-Key names, with the
+// cache key of its install so reusing the key for another is caught
+type idempotencyClaim struct {
+	jobID    string
+	cacheKey string
+	at       time.Time
+}
+
+// idempotencyKeyOf checks an Idempotency-Key and scopes it to the caller in
+// ctx, so callers can't see each other's jobs through it. Empty keys are
+// returned as they are.
+func idempotencyKeyOf(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > maxIdempotencyKey {
+		return "", badRequest("Idempotency-Key is longer than %d characters", maxIdempotencyKey)
+	}
+	p, _ := principalFrom(ctx)
+	sum := sha256.Sum256([]byte(usageCaller(p) + "\x00" + p.Tenant + "\x00" + key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// keyReusedError fails a submission whose Idempotency-Key was sent before
+// with a different install
+func keyReusedError() error {
+	return &statusError{status: http.StatusUnprocessableEntity, errCode: "IDEMPOTENCY_KEY_REUSED",
+		err: errors.New("Idempotency-Key was already used for a different install")}
+}
+
+// claimIdempotencyKey makes a job's Idempotency-Key name it for the
+// idempotency window. If the key names an earlier job that is still known,
+// that job is returned instead, marked as replayed, unless it was for a
+// different install.
+func (m *JobManager) claimIdempotencyKey(ctx context.Context, job *Job) (*Job, error) {
+	claim := idempotencyClaim{jobID: job.ID, cacheKey: job.cacheKey, at: time.Now()}
+	existing, claimed, err := m.storeClaim(ctx, job.req.idempotencyKey, claim)
+	if err != nil || claimed {
+		return nil, err
+	}
+	if existing.cacheKey != job.cacheKey {
+		return nil, keyReusedError()
+	}
+	original, ok, err := m.get(ctx, existing.jobID)
+	if err != nil {
+		return nil, &statusError{status: http.StatusServiceUnavailable, err: fmt.Errorf("Failed to read job: %v", err)}
+	}
+	if !ok {
+		// Jobs outlive their keys, so this one hasn't been recorded yet
+		return nil, &statusError{status: http.StatusConflict, err: errors.New("A job with this Idempotency-Key is still being submitted")}
+	}
+	original.replayed = true
+	idempotentReplays.inc(job.Ecosystem)
+	job.logger.Info("job submission replayed", "original_job_id", original.ID)
+	return &original, nil
+}
+
+// storeClaim records claim under key unless the key has a claim already,
+// which it returns instead
+func (m *JobManager) storeClaim(ctx context.Context, key string, claim idempotencyClaim) (idempotencyClaim, bool, error) {
+	if m.queue != nil {
+		existing, claimed, err := m.queue.claimIdempotencyKey(ctx, key, claim.jobID+" "+claim.cacheKey, idempotencyWindow)
+		if err != nil {
+			return idempotencyClaim{}, false, &statusError{status: http.StatusServiceUnavailable, err: fmt.Errorf("Failed to record Idempotency-Key: %v", err)}
+		}
+		jobID, cacheKey, _ := strings.Cut(existing, " ")
+		return idempotencyClaim{jobID: jobID, cacheKey: cacheKey}, claimed, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.idempotencyKeys[key]; ok && time.Since(existing.at) < idempotencyWindow {
+		return existing, false, nil
+	}
+	m.idempotencyKeys[key] = claim
+	return claim, true, nil
+}
+
+// forgetIdempotencyKey frees a key whose job was never submitted, so a
+// retry of the submission isn't answered with a job that doesn't exist
+func (m *JobManager) forgetIdempotencyKey(ctx context.Context, key string) {
+	if m.queue != nil {
+		m.queue.forgetIdempotencyKey(ctx, key)
+		return
+	}
+	m.mu.Lock()
+	delete(m.idempotencyKeys, key)
+	m.mu.Unlock()
+}
+
+// expireIdempotencyKeys drops the keys older than the idempotency window.
+// m.mu must be held.
+func (m *JobManager) expireIdempotencyKeys() {
+	for key, claim := range m.idempotencyKeys {
+		if time.Since(claim.at) >= idempotencyWindow {
+			delete(m.idempotencyKeys, key)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// imageCreatedBy is the history entry of the layers image outputs add
+const imageCreatedBy = "pip-install"
+
+// An ociPlatform is the system an image runs on
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// An ociIndex lists the manifests of a multi-platform image
+type ociIndex struct {
+	Manifests []ociIndexEntry `json:"manifests"`
+}
+
+// An ociIndexEntry points at the manifest for one platform
+type ociIndexEntry struct {
+	ociDescriptor
+	Platform ociPlatform `json:"platform"`
+}
+
+// defaultImagePlatform is the platform image outputs are built for unless a
+// request names another. Native modules are built on this server, so that is
+// where they run.
+var defaultImagePlatform = "linux/" + runtime.GOARCH
+
+// parsePlatform parses a platform such as linux/arm64/v8
+func parsePlatform(s string) (ociPlatform, bool) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ociPlatform{}, false
+	}
+	p := ociPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, true
+}
+
+// parseImageReference splits an image reference such as node:20-slim or
+// ghcr.io/acme/base@sha256:... into its repository and its tag or digest.
+// Docker Hub names are expanded as docker pull does.
+func parseImageReference(ref string) (repository, reference string, ok bool) {
+	repository, reference, found := strings.Cut(ref, "@")
+	if !found {
+		reference = "latest"
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			repository, reference = ref[:i], ref[i+1:]
+		}
+		if !ociTagPattern.MatchString(reference) {
+			return "", "", false
+		}
+	} else if !strings.HasPrefix(reference, "sha256:") || !digestPattern.MatchString(strings.TrimPrefix(reference, "sha256:")) {
+		return "", "", false
+	}
+	host, _, hasSlash := strings.Cut(repository, "/")
+	if !hasSlash || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		// A Docker Hub name, such as node or bitnami/node
+		if !hasSlash {
+			repository = "library/" + repository
+		}
+		repository = "docker.io/" + repository
+	}
+	_, _, ok = splitRepository(repository)
+	return repository, reference, ok
+}
+
+// validateImageOutput checks the fields only image outputs take
+func validateImageOutput(target *OutputTarget) error {
+	if target.BaseImage == "" {
+		target.BaseImage = ociOutput.defaultBase
+	}
+	if target.BaseImage != "" && target.BaseImage != "scratch" {
+		repository, _, ok := parseImageReference(target.BaseImage)
+		if !ok {
+			return badRequest("Invalid output base_image %q", target.BaseImage)
+		}
+		if !baseImageAllowed(ociOutput.baseImages, repository) {
+			return badRequest("Invalid output base_image %q: must be in %s", target.BaseImage, strings.Join(ociOutput.baseImages, ", "))
+		}
+	}
+	if target.Path == "" {
+		target.Path = "/app"
+	}
+	if !path.IsAbs(target.Path) || path.Clean(target.Path) != target.Path {
+		return badRequest("Invalid output path %q: must be a clean absolute path", target.Path)
+	}
+	if target.Platform == "" {
+		target.Platform = defaultImagePlatform
+	}
+	if _, ok := parsePlatform(target.Platform); !ok {
+		return badRequest("Invalid output platform %q: must be os/architecture[/variant]", target.Platform)
+	}
+	return nil
+}
+
+// baseImageAllowed reports whether repository is under one of prefixes
+func baseImageAllowed(prefixes []string, repository string) bool {
+	return slices.ContainsFunc(prefixes, func(prefix string) bool {
+		return strings.HasPrefix(repository+"/", strings.TrimSuffix(prefix, "/")+"/")
+	})
+}
+
+// imageTag is an image output's default tag: the hash of the install's
+// inputs and of how the image is built from them
+func imageTag(inputKey string, target *OutputTarget) string {
+	sum := sha256.Sum256([]byte(inputKey + "\x00" + target.BaseImage + "\x00" + target.Path + "\x00" + target.Platform))
+	return hex.EncodeToString(sum[:])
+}
+
+// An imageLayer is an archive rewritten as an image layer, in a temporary file
+type imageLayer struct {
+	file *os.File
+	size int64
+	// digest is the SHA-256 of the compressed layer and diffID that of the
+	// tar inside it
+	digest string
+	diffID string
+}
+
+// Close removes the layer's file
+func (l *imageLayer) Close() error {
+	l.file.Close()
+	return os.Remove(l.file.Name())
+}
+
+// buildImageLayer rewrites a tar.gz or tar.zst artifact as a gzipped layer
+// with its entries under dir
+func buildImageLayer(artifact *Artifact, dir string) (*imageLayer, error) {
+	var src io.Reader
+	switch artifact.ContentType {
+	case tarGzFormat.ContentType:
+		gz, err := gzip.NewReader(artifact)
+		if err != nil {
+			return nil, err
+		}
+		src = gz
+	case tarZstFormat.ContentType:
+		zr, err := zstd.NewReader(artifact)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		src = zr
+	default:
+		return nil, fmt.Errorf("%s artifacts can't be image layers", artifact.ContentType)
+	}
+
+	f, err := os.CreateTemp(workRoot, workDirPrefix+"layer_")
+	if err != nil {
+		return nil, err
+	}
+	layer := &imageLayer{file: f}
+	compressed, uncompressed := sha256.New(), sha256.New()
+	gz, err := gzip.NewWriterLevel(io.MultiWriter(f, compressed), compressionLevel)
+	if err != nil {
+		layer.Close()
+		return nil, err
+	}
+	tw := tar.NewWriter(io.MultiWriter(gz, uncompressed))
+	if err := rerootTar(tw, tar.NewReader(src), strings.TrimPrefix(dir, "/")); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	if layer.size, err = f.Seek(0, io.SeekCurrent); err != nil {
+		layer.Close()
+		return nil, err
+	}
+	layer.digest = "sha256:" + hex.EncodeToString(compressed.Sum(nil))
+	layer.diffID = "sha256:" + hex.EncodeToString(uncompressed.Sum(nil))
+	return layer, nil
+}
+
+// rerootTar copies the entries of tr to tw under dir, after entries for dir
+// and its parents
+func rerootTar(tw *tar.Writer, tr *tar.Reader, dir string) error {
+	if dir != "" {
+		parts := strings.Split(dir, "/")
+		for i := range parts {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     strings.Join(parts[:i+1], "/") + "/",
+				Mode:     0755,
+				ModTime:  archiveModTime,
+				Format:   tar.FormatPAX,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		dir += "/"
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hdr.Name = dir + hdr.Name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = dir + hdr.Linkname
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// baseImage is a base image's manifest and config, resolved for a platform
+type baseImage struct {
+	session   *ociSession
+	mediaType string
+	manifest  ociManifest
+	config    map[string]any
+}
+
+// pullBaseImage fetches a base image's manifest and config, picking the
+// platform's manifest from a multi-platform image
+func (c *ociClient) pullBaseImage(ctx context.Context, ref string, platform ociPlatform) (*baseImage, error) {
+	repository, reference, _ := parseImageReference(ref)
+	base := &baseImage{session: c.session(repository, "pull")}
+	mediaType, body, err := base.session.pullManifest(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == ociIndexType || mediaType == dockerManifestListType {
+		var index ociIndex
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("parsing the index of %s: %v", ref, err)
+		}
+		i := slices.IndexFunc(index.Manifests, func(m ociIndexEntry) bool {
+			p := m.Platform
+			return p.OS == platform.OS && p.Architecture == platform.Architecture && (platform.Variant == "" || p.Variant == platform.Variant)
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("%s has no %s/%s image", ref, platform.OS, platform.Architecture)
+		}
+		if mediaType, body, err = base.session.pullManifest(ctx, index.Manifests[i].Digest); err != nil {
+			return nil, err
+		}
+	}
+	if mediaType != ociManifestType && mediaType != dockerManifestType {
+		return nil, fmt.Errorf("%s has an unsupported manifest type %q", ref, mediaType)
+	}
+	base.mediaType = mediaType
+	if err := json.Unmarshal(body, &base.manifest); err != nil {
+		return nil, fmt.Errorf("parsing the manifest of %s: %v", ref, err)
+	}
+	config, err := base.session.pullBlob(ctx, base.manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer config.Close()
+	dec := json.NewDecoder(io.LimitReader(config, 4<<20))
+	dec.UseNumber()
+	if err := dec.Decode(&base.config); err != nil {
+		return nil, fmt.Errorf("parsing the config of %s: %v", ref, err)
+	}
+	return base, nil
+}
+
+// pushImage pushes an image made of the base image's layers, if there is
+// one, and the given layer. It returns the manifest's digest.
+func (c *ociClient) pushImage(ctx context.Context, repository, tag, baseRef string, platform ociPlatform, layer *imageLayer) (string, error) {
+	dst := c.session(repository, "pull,push")
+	manifestType, configType, layerType := ociManifestType, ociConfigType, ociLayerType
+	config := map[string]any{
+		"architecture": platform.Architecture,
+		"os":           platform.OS,
+		"config":       map[string]any{},
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []any{}},
+	}
+	if platform.Variant != "" {
+		config["variant"] = platform.Variant
+	}
+	var layers []ociDescriptor
+	if baseRef != "" && baseRef != "scratch" {
+		base, err := c.pullBaseImage(ctx, baseRef, platform)
+		if err != nil {
+			return "", err
+		}
+		if base.mediaType == dockerManifestType {
+			manifestType, configType, layerType = dockerManifestType, dockerConfigType, dockerLayerType
+		}
+		// Layers on the same registry are mounted rather than copied
+		from := ""
+		if base.session.host == dst.host {
+			from = base.session.path
+		}
+		for _, d := range base.manifest.Layers {
+			open := func() (io.Reader, error) { return base.session.pullBlob(ctx, d.Digest) }
+			if err := dst.pushBlob(ctx, open, d.Size, d.Digest, from); err != nil {
+				return "", err
+			}
+		}
+		layers = base.manifest.Layers
+		config = base.config
+	}
+
+	rootfs, _ := config["rootfs"].(map[string]any)
+	if rootfs == nil {
+		return "", fmt.Errorf("%s has no rootfs in its config", baseRef)
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]any)
+	rootfs["diff_ids"] = append(diffIDs, layer.diffID)
+	if history, ok := config["history"].([]any); ok {
+		config["history"] = append(history, map[string]any{"created_by": imageCreatedBy})
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	if err := dst.pushBlob(ctx, seekBody(layer.file), layer.size, layer.digest, ""); err != nil {
+		return "", err
+	}
+	if err := dst.pushBlob(ctx, bytesBody(configJSON), int64(len(configJSON)), ociDigest(configJSON), ""); err != nil {
+		return "", err
+	}
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+		Config:        ociDescriptor{MediaType: configType, Digest: ociDigest(configJSON), Size: int64(len(configJSON))},
+		Layers:        append(slices.Clip(layers), ociDescriptor{MediaType: layerType, Digest: layer.digest, Size: layer.size}),
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst.pushManifest(ctx, manifestType, manifest, tag)
+}
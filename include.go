@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// includable lists what the include option may name for an ecosystem: its
+// installed directory, the output it saves and the manifests it accepts,
+// except secret ones
+func includable(eco *Ecosystem) []string {
+	names := defaultInclude(eco)
+	for _, mf := range eco.Files {
+		if !mf.Secret {
+			names = append(names, mf.Name)
+		}
+	}
+	return names
+}
+
+// validateInclude checks the include option
+func validateInclude(eco *Ecosystem, include []string) error {
+	names := includable(eco)
+	for _, name := range include {
+		if !slices.Contains(names, name) {
+			return badRequest("Invalid include %q: %s archives can include %s", name, eco.Name, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// defaultInclude is what an archive holds unless the include option says
+// otherwise: the installed directory and the output the ecosystem saves
+func defaultInclude(eco *Ecosystem) []string {
+	if eco.StdoutFile != "" {
+		return []string{eco.ArchiveRoot, eco.StdoutFile}
+	}
+	return []string{eco.ArchiveRoot}
+}
+
+// stageArchive returns the directory to archive and the root its entries go
+// under. That is normally the installed directory alone. When the archive
+// needs more, such as the lock file the install wrote or each workspace's
+// node_modules, everything in it is moved into a staging directory inside
+// workDir at its path relative to workDir, so symlinks between them resolve.
+func stageArchive(eco *Ecosystem, include []string, workDir, outputDir string) (srcDir, root string, err error) {
+	if len(include) == 0 {
+		include = defaultInclude(eco)
+	}
+	withOutput := slices.Contains(include, eco.ArchiveRoot)
+	var nested []string
+	if withOutput && eco.Runtime == "node" {
+		if nested, err = workspaceModules(workDir); err != nil {
+			return "", "", err
+		}
+	}
+	if withOutput && len(include) == 1 && len(nested) == 0 {
+		return outputDir, eco.ArchiveRoot, nil
+	}
+
+	staging, err := os.MkdirTemp(workDir, ".archive-")
+	if err != nil {
+		return "", "", err
+	}
+	moves := map[string]string{}
+	if withOutput {
+		moves[outputDir] = filepath.Join(staging, eco.ArchiveRoot)
+	}
+	for _, rel := range nested {
+		moves[filepath.Join(workDir, rel)] = filepath.Join(staging, rel)
+	}
+	for src, dst := range moves {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", "", err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return "", "", fmt.Errorf("failed to stage %s: %v", src, err)
+		}
+	}
+	for _, name := range include {
+		if name == eco.ArchiveRoot {
+			continue
+		}
+		// Manifests the install didn't write, such as an optional lock
+		// file pip never creates, are left out
+		b, err := os.ReadFile(filepath.Join(workDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		dst := filepath.Join(staging, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(dst, b, 0644); err != nil {
+			return "", "", err
+		}
+	}
+	return staging, "", nil
+}
@@ -0,0 +1,1281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A statusError is an error that knows which HTTP status it should be reported with
+type statusError struct {
+	status int
+	err    error
+	// errCode, if set, is the error response's code in place of the status's
+	errCode string
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func (e *statusError) code() string { return e.errCode }
+
+func (e *statusError) Unwrap() error { return e.err }
+
+// errorStatus returns the HTTP status for err, defaulting to 500
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	var pe policyError
+	if errors.As(err, &pe) {
+		return http.StatusUnprocessableEntity
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// writeInstallError responds with an install's error in JSON, with its
+// code and whatever else errorBody knows of it, and when to retry if its
+// registry's circuit is open
+func writeInstallError(w http.ResponseWriter, err error) {
+	var ce *circuitOpenError
+	if errors.As(err, &ce) {
+		w.Header().Set("Retry-After", ce.retryAfterSeconds())
+	}
+	status := errorStatus(err)
+	writeJSON(w, status, errorBody(err, status))
+}
+
+// stderrTailBytes is how much of the package manager's stderr is kept for error messages
+const stderrTailBytes = 64 << 10
+
+// killGrace is how long the package manager's output pipes are drained after
+// its process group has been killed
+const killGrace = 5 * time.Second
+
+// installTimeout is the wall-clock limit for a package manager run unless a
+// request asks for another, which may not exceed maxInstallTimeout. Both are
+// set from INSTALL_TIMEOUT and INSTALL_MAX_TIMEOUT.
+var (
+	installTimeout    = 10 * time.Minute
+	maxInstallTimeout = 30 * time.Minute
+)
+
+// An Installer runs installs for the HTTP handlers and the job manager. Every
+// archive it builds is kept in the artifact store and recorded in the result
+// cache, so repeat requests can skip the package manager entirely. All
+// installs take a slot from the pool first.
+type Installer struct {
+	store ArtifactStore
+	cache *resultCache
+	pool  *installPool
+	// jobs, when set, runs installs as jobs on workers instead of here
+	jobs *JobManager
+
+	mu sync.Mutex
+	// builds are the installs queued or running here, by cache key
+	builds map[string]*build
+}
+
+func newInstaller(store ArtifactStore, cache *resultCache, pool *installPool) *Installer {
+	return &Installer{store: store, cache: cache, pool: pool, builds: make(map[string]*build)}
+}
+
+// packagesHandler serves POST /install/packages, which installs a list of
+// package specs with the ecosystem named by the ecosystem query parameter
+func (in *Installer) packagesHandler(w http.ResponseWriter, r *http.Request) {
+	eco := packagesEcosystem
+	if name := r.URL.Query().Get("ecosystem"); name != "" {
+		if eco = findEcosystem(name); eco == nil {
+			writeError(w, fmt.Sprintf("Unknown ecosystem %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	in.handleInstall(w, r, eco)
+}
+
+// handler returns the /install/<name> handler for an ecosystem
+func (in *Installer) handler(eco *Ecosystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		in.handleInstall(w, r, eco)
+	}
+}
+
+func (in *Installer) handleInstall(w http.ResponseWriter, r *http.Request, eco *Ecosystem) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeRequest(r, eco)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if req.Options.CallbackURL != "" {
+		writeError(w, "callback_url is only supported for asynchronous jobs", http.StatusBadRequest)
+		return
+	}
+	if req.Options.AuditFix {
+		writeError(w, "audit_fix is only supported by /audit/"+eco.Name, http.StatusBadRequest)
+		return
+	}
+	if req.Options.Bundle != nil {
+		writeError(w, "bundle is only supported by /bundle", http.StatusBadRequest)
+		return
+	}
+
+	logger := loggerFrom(r.Context()).With("ecosystem", eco.Name)
+	ctx := withLogger(r.Context(), logger)
+	if req.Options.DryRun {
+		in.dryRun(ctx, w, r, eco, req)
+		return
+	}
+	key := cacheKey(eco, req)
+	// Installs run as jobs are recorded by the worker that runs them
+	queued := false
+	if auditLog != nil {
+		p, _ := principalFrom(ctx)
+		rec, start := newAuditRecord(eco.Name, req, key, p), time.Now()
+		rec.ClientIP = clientIP(r)
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = sr
+		defer func() {
+			if !queued {
+				auditLog.recordInstall(rec, sr, start, in.store)
+			}
+		}()
+	}
+	if !cacheBypassed(r) {
+		if in.serveCached(ctx, w, r, eco, req, key) {
+			return
+		}
+		// An identical install already running here is waited for and
+		// its archive served, rather than running the package manager twice
+		if in.jobs == nil && in.awaitBuild(ctx, eco, key) && in.serveCached(ctx, w, r, eco, req, key) {
+			return
+		}
+	}
+
+	if in.jobs != nil {
+		queued = true
+		in.jobs.installQueued(ctx, w, r, eco, req, key)
+		return
+	}
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if err := registryBreaker.check(ctx, eco, req, false); err != nil {
+		poolError(w, err)
+		return
+	}
+	defer in.building(key, "", nil)()
+	done, ok := in.admit(ctx, w, r)
+	if !ok {
+		return
+	}
+	defer done()
+
+	ctx = withNotes(ctx)
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	defer removeWorkspace(tmpDir) // Clean up afterwards
+
+	var outputDir string
+	var meta ArtifactMeta
+	if len(req.Options.Targets) > 0 {
+		outputDir, meta, err = installTargets(ctx, in.pool, eco, req, tmpDir, key, nil)
+	} else {
+		outputDir, err = runInstall(ctx, eco, req, tmpDir, nil)
+		if err == nil {
+			err = gateInstall(ctx, eco, req, tmpDir, outputDir)
+		}
+		if err == nil {
+			meta, err = artifactMeta(ctx, eco, req, outputDir, key)
+		}
+	}
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	w.Header().Set("ETag", inputETag(key))
+	w.Header().Set("X-Cache", "MISS")
+	setSkippedScripts(w, meta.SkippedScripts)
+	setPrunedBytes(w, meta.PrunedBytes)
+	if req.Options.Output != nil {
+		digest, err := in.archive(ctx, eco, req, tmpDir, outputDir, key, meta, nil)
+		var uploaded *UploadedArtifact
+		if err == nil {
+			uploaded, err = uploadArtifact(ctx, in.store, digest, key, req.Options.Output)
+		}
+		writeUploaded(w, uploaded, err)
+		return
+	}
+	w.Header().Set("Content-Type", req.Format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", req.Format.filename(eco)))
+	w.Header().Set("Trailer", digestHeader)
+
+	digest, err := in.archive(ctx, eco, req, tmpDir, outputDir, key, meta, w)
+	if err != nil {
+		logger.Error("failed to archive installed packages", "path", outputDir, "error", err)
+		if w.Header().Get("Content-Type") == "" {
+			writeError(w, fmt.Sprintf("Error archiving files: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set(digestHeader, digest)
+	logger.Info("streamed archive", "format", req.Format.Name, "digest", digest)
+}
+
+// serveCached answers an install from the result cache, if it has the
+// install's archive, and reports whether it did
+func (in *Installer) serveCached(ctx context.Context, w http.ResponseWriter, r *http.Request, eco *Ecosystem, req *InstallRequest, key string) bool {
+	artifact, ok := in.cache.lookup(in.store, key)
+	if !ok {
+		return false
+	}
+	defer artifact.Close()
+	// The policies may have changed since the artifact was built, and may
+	// decide differently for another caller
+	if err := checkInstallPolicies(ctx, eco, req, artifact.Packages); err != nil {
+		writeInstallError(w, err)
+		return true
+	}
+	w.Header().Set("ETag", inputETag(key))
+	w.Header().Set("Content-Location", artifactURL(artifact.Digest))
+	w.Header().Set("X-Cache", "HIT")
+	accounting.add(ctx, UsageCounts{CacheHits: 1})
+	if req.Options.Output != nil {
+		setSkippedScripts(w, artifact.SkippedScripts)
+		setPrunedBytes(w, artifact.PrunedBytes)
+		uploaded, err := uploadArtifact(ctx, in.store, artifact.Digest, key, req.Options.Output)
+		writeUploaded(w, uploaded, err)
+		return true
+	}
+	// The client already has an archive built from these inputs
+	if etagMatches(r.Header.Get("If-None-Match"), inputETag(key)) {
+		loggerFrom(ctx).Info("cached install not modified", "digest", artifact.Digest)
+		w.Header().Set(digestHeader, artifact.Digest)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	loggerFrom(ctx).Info("serving cached install", "digest", artifact.Digest)
+	writeArtifact(w, r, artifact)
+	return true
+}
+
+// admit takes one of the caller's concurrent install slots and waits for a
+// place in the install pool. If the request can't proceed it writes the error
+// response and returns false; otherwise done must be called afterwards.
+func (in *Installer) admit(ctx context.Context, w http.ResponseWriter, r *http.Request) (done func(), ok bool) {
+	release, err := limits.acquire(w, r)
+	if err != nil {
+		writeInstallError(w, err)
+		return nil, false
+	}
+	tenantRelease, err := tenants.reserve(ctx)
+	if err != nil {
+		release()
+		writeInstallError(w, err)
+		return nil, false
+	}
+	slot, err := in.pool.enqueue()
+	if err != nil {
+		release()
+		tenantRelease()
+		poolError(w, err)
+		return nil, false
+	}
+	done = func() {
+		slot.release()
+		release()
+		tenantRelease()
+	}
+	if pos := slot.position(); pos > 0 {
+		loggerFrom(ctx).Info("waiting for install slot", "queue_position", pos)
+	}
+	if err := slot.wait(ctx); err != nil {
+		loggerFrom(ctx).Info("client went away while waiting for install slot")
+		done()
+		return nil, false
+	}
+	return done, true
+}
+
+// archive writes outputDir, and anything else the request includes from
+// workDir, into the artifact store in the request's format, also streaming
+// it to tee when it is non-nil, and caches the result under key. meta is
+// recorded with the artifact, along with its content type and name.
+func (in *Installer) archive(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir, outputDir, key string, meta ArtifactMeta, tee io.Writer) (digest string, err error) {
+	format := req.Format
+	_, span := tracer.Start(ctx, "archive", trace.WithAttributes(ecosystemAttr(eco), attribute.String("pip_install.format", format.Name)))
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+
+	aw, err := in.store.Create()
+	if err != nil {
+		return "", err
+	}
+	counter := &countingWriter{w: aw}
+	var out io.Writer = counter
+	if tee != nil {
+		out = io.MultiWriter(tee, counter)
+	}
+	out = contextWriter{ctx: ctx, w: out}
+	// A targets install was staged by installTargets, a directory per target
+	srcDir, root := outputDir, ""
+	if len(req.Options.Targets) == 0 {
+		srcDir, root, err = stageArchive(eco, req.Options.Include, workDir, outputDir)
+	}
+	if err != nil {
+		aw.Abort()
+		return "", fmt.Errorf("Error archiving files: %v", err)
+	}
+	if err := format.Write(out, srcDir, root, req.Options.deflateLevel()); err != nil {
+		aw.Abort()
+		return "", fmt.Errorf("Error archiving files: %v", err)
+	}
+	archiveSize.observe(float64(counter.n), format.Name)
+	span.SetAttributes(attribute.Int64("pip_install.archive_bytes", counter.n))
+	if meta.Report != nil {
+		meta.Report.PhasesMillis["archive"] = time.Since(start).Milliseconds()
+	}
+	meta.ContentType, meta.Filename = format.ContentType, format.filename(eco)
+	digest, err = aw.Commit(meta)
+	if err != nil {
+		return "", err
+	}
+	tenants.addArtifact(ctx, digest, counter.n)
+	in.cache.add(key, digest)
+	return digest, nil
+}
+
+// workRoot is the directory workspaces are created in; empty means the
+// system temp directory
+var workRoot string
+
+// workspaces tracks the working directories in use so any left behind by
+// installs interrupted during shutdown can be removed
+var workspaces sync.Map
+
+// prepareWorkspace creates a temporary working directory holding the request's
+// files, which are keyed by slash-separated path. The caller must remove it with removeWorkspace.
+func prepareWorkspace(ctx context.Context, eco *Ecosystem, req *InstallRequest) (dir string, err error) {
+	_, span := tracer.Start(ctx, "setup workspace", trace.WithAttributes(ecosystemAttr(eco)))
+	defer func() { endSpan(span, err) }()
+	defer notesFrom(ctx).phase("workspace", time.Now())
+
+	root, tmpfs := workspaceRoot()
+	tmpDir, err := os.MkdirTemp(root, workDirPrefix)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temp directory: %v", err)
+	}
+	workspaces.Store(tmpDir, workspace{tmpfs: tmpfs})
+	if err := writeWorkspaceFiles(eco, tmpDir, req.Files, req.modes); err != nil {
+		removeWorkspace(tmpDir)
+		return "", err
+	}
+	return tmpDir, nil
+}
+
+// writeWorkspaceFiles writes the request's files into a workspace with
+// the modes the project archive gave them, the secret ones readable only
+// by their owner
+func writeWorkspaceFiles(eco *Ecosystem, dir string, files map[string]string, modes map[string]os.FileMode) error {
+	secret := make(map[string]bool)
+	for _, mf := range eco.Files {
+		secret[mf.Name] = mf.Secret
+	}
+	for name, content := range files {
+		perm := os.FileMode(0644)
+		if mode, ok := modes[name]; ok {
+			perm = mode
+		}
+		if secret[name] {
+			perm = 0600
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		// Files from a project archive may be in subdirectories
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// removeWorkspace deletes a directory created by prepareWorkspace, and the
+// one it was moved to if it spilled from tmpfs
+func removeWorkspace(dir string) {
+	if spilled := workspaceOf(dir).spilled; spilled != "" {
+		os.RemoveAll(spilled)
+	}
+	os.RemoveAll(dir)
+	workspaces.Delete(dir)
+}
+
+// removeAllWorkspaces deletes every working directory still in use
+func removeAllWorkspaces() {
+	workspaces.Range(func(dir, _ any) bool {
+		removeWorkspace(dir.(string))
+		return true
+	})
+}
+
+// runInstall runs the ecosystem's package manager in workDir and returns the
+// directory holding the installed packages. When onLine is non-nil it
+// receives each line the package manager writes to stdout and stderr. The
+// package manager and everything it spawned are killed when the request's
+// timeout expires or ctx is cancelled.
+func runInstall(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string, onLine func(stream, line string)) (outputDir string, err error) {
+	ctx, span := tracer.Start(ctx, eco.Name+" install", trace.WithAttributes(ecosystemAttr(eco)))
+	defer func() { endSpan(span, err) }()
+
+	if err := checkLockedPolicy(eco, req); err != nil {
+		return "", err
+	}
+	if err := checkLockIntegrity(ctx, eco, req); err != nil {
+		return "", err
+	}
+	if err := registryBreaker.check(ctx, eco, req, true); err != nil {
+		return "", err
+	}
+	installsStarted.inc(eco.Name)
+	activeInstalls.inc()
+	defer activeInstalls.dec()
+	start := time.Now()
+	args := append(eco.Args(req.Files), registryArgs(eco, req)...)
+	env := eco.Env
+	for _, kind := range req.Options.Omit {
+		args = append(args, eco.OmitArgs[kind]...)
+	}
+	if req.Options.ignoreScripts() {
+		args = append(args, eco.NoScriptsArgs...)
+		env = append(env[:len(env):len(env)], eco.NoScriptsEnv...)
+	}
+	for _, name := range req.Options.Workspaces {
+		args = append(args, eco.WorkspaceArgs(name)...)
+	}
+	if t := req.Options.Target; t != nil {
+		args = append(args, eco.TargetArgs(t)...)
+		env = append(env[:len(env):len(env)], t.env()...)
+	}
+	if req.Options.EngineStrict {
+		args = append(args, eco.Engines.Args...)
+	}
+	args = append(args, req.Options.NpmArgs...)
+	var usage cacheUsage
+	notes := notesFrom(ctx)
+	lines := func(stream, line string) {
+		notes.line(line)
+		if packageCacheDir != "" && eco.CacheUsage != nil {
+			eco.CacheUsage(line, &usage)
+		}
+		if onLine != nil {
+			onLine(stream, line)
+		}
+	}
+	install := toolRun{step: "install", tool: eco.Tool, args: args, env: env, onLine: lines}
+	var stdout *bytes.Buffer
+	if eco.StdoutFile != "" {
+		stdout = &bytes.Buffer{}
+		install.stdout = stdout
+	}
+	run, err := runPeerDeps(ctx, eco, req, install, func(run toolRun) error {
+		return runToolRetrying(ctx, eco, req, workDir, run)
+	})
+	if err != nil && eco.Runtime == "node" && !req.Options.ignoreScripts() {
+		err = checkNativeBuild(ctx, eco, req, workDir, run, err)
+	}
+	if err != nil {
+		err = checkOverrides(eco, req, checkEngines(eco, err))
+	}
+	installDuration.observe(time.Since(start).Seconds(), eco.Name)
+	tenants.addInstallTime(ctx, time.Since(start))
+	accounting.add(ctx, UsageCounts{Installs: 1, InstallSeconds: time.Since(start).Seconds()})
+	workspaceInstallDuration.observe(time.Since(start).Seconds(), eco.Name, workspaceStorage(workDir))
+	notes.phase("install", start)
+	if err != nil {
+		installsFailed.inc(eco.Name)
+		return "", err
+	}
+	installsSucceeded.inc(eco.Name)
+	if packageCacheDir != "" && eco.CacheUsage != nil {
+		packageCachePackages.add(float64(usage.hits), eco.Name, "hit")
+		packageCachePackages.add(float64(usage.misses), eco.Name, "miss")
+		loggerFrom(ctx).Info("package cache usage", "hits", usage.hits, "misses", usage.misses)
+	}
+
+	if stdout != nil {
+		if err := writeWorkspaceFiles(eco, workDir, map[string]string{eco.StdoutFile: stdout.String()}, nil); err != nil {
+			return "", err
+		}
+	}
+	outputDir, err = eco.Output(workDir)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to locate installed packages", "error", err)
+		return "", fmt.Errorf("Failed to locate installed packages: %v", err)
+	}
+	if packagePolicies != nil || opa != nil {
+		pkgs, err := installedPackages(eco, outputDir)
+		if err != nil {
+			return "", fmt.Errorf("Failed to list installed packages: %v", err)
+		}
+		if err := checkInstallPolicies(ctx, eco, req, pkgs); err != nil {
+			return "", err
+		}
+	}
+	return outputDir, nil
+}
+
+// A toolRun is one run of a package manager or scanner in a workspace
+type toolRun struct {
+	// step names the run in logs and errors, such as "install"
+	step      string
+	tool      string
+	args, env []string
+	// stdout, if non-nil, receives the tool's standard output
+	stdout io.Writer
+	// onLine, if non-nil, receives each line of output
+	onLine func(stream, line string)
+	// executor, if non-nil, runs the tool instead of installExecutor
+	executor executor
+}
+
+// runTool runs a tool in workDir under the request's limits: its timeout, the
+// workspace quota and the memory and CPU limits. Paths to the request's
+// configuration files are added to the environment, and credentials from
+// them are scrubbed from the output. A tool that exits with an error returns
+// an error wrapping its *exec.ExitError.
+func runTool(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string, run toolRun) error {
+	outer := ctx
+	timeout := req.Options.timeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ctx, cancelQuota := context.WithCancelCause(ctx)
+	defer cancelQuota(nil)
+
+	ex := installExecutor
+	if run.executor != nil {
+		ex = run.executor
+	}
+	start := time.Now()
+	env := run.env[:len(run.env):len(run.env)]
+	cacheDir := installCacheDir(eco, req)
+	switch {
+	case cacheDir != "":
+		env = append(env, eco.CacheEnv(cacheDir)...)
+	case packageCacheDir != "" && eco.CacheEnv != nil:
+		env = append(env, eco.CacheEnv(filepath.Join(ex.workPath(workDir), workspaceCacheDir))...)
+	}
+	for _, mf := range eco.Files {
+		if mf.Env != "" && req.Files[mf.Name] != "" {
+			env = append(env[:len(env):len(env)], mf.Env+"="+filepath.Join(ex.workPath(workDir), mf.Name))
+		}
+	}
+	if eco.WorkEnv != nil {
+		env = append(env[:len(env):len(env)], eco.WorkEnv(ex.workPath(workDir))...)
+	}
+	cmd, err := ex.command(ctx, eco, workDir, cacheDir, run.tool, run.args, env, req.Options.runtimeVersion(eco), req.Options.Target)
+	if err != nil {
+		if errorStatus(err) != http.StatusInternalServerError {
+			return err
+		}
+		return fmt.Errorf("Failed to start %s: %v", run.tool, err)
+	}
+	cmd.WaitDelay = killGrace
+	logger := loggerFrom(ctx).With("command", strings.Join(cmd.Args, " "), "work_dir", workDir)
+	var cg *installCgroup
+	// Containers get their limits from docker instead
+	if _, isDocker := ex.(*dockerExecutor); cgroupParent != "" && !isDocker {
+		if cg, err = newInstallCgroup(cmd); err != nil {
+			logger.Error("failed to create cgroup", "error", err)
+			return fmt.Errorf("Failed to limit %s %s: %v", eco.Name, run.step, err)
+		}
+		defer cg.remove()
+	}
+	// Output is streamed to onLine; only the end of stderr is kept for the
+	// error message. Both have credentials from secret files removed.
+	scrub := newScrubber(eco, req.Files)
+	stderrTail := &tailBuffer{max: stderrTailBytes}
+	stderr := func() string { return scrub.scrub(stderrTail.String()) }
+	cmd.Stdout = run.stdout
+	cmd.Stderr = stderrTail
+	if run.onLine != nil {
+		stdoutLines := &lineWriter{fn: func(line string) { run.onLine("stdout", scrub.scrub(line)) }}
+		stderrLines := &lineWriter{fn: func(line string) { run.onLine("stderr", scrub.scrub(line)) }}
+		defer stdoutLines.flush()
+		defer stderrLines.flush()
+		cmd.Stdout = stdoutLines
+		if run.stdout != nil {
+			cmd.Stdout = io.MultiWriter(run.stdout, stdoutLines)
+		}
+		cmd.Stderr = io.MultiWriter(stderrTail, stderrLines)
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("process.command", cmd.Path), attribute.StringSlice("process.command_args", cmd.Args))
+	tmpfs := onTmpfs(workDir)
+	if workspaceQuota > 0 || tmpfs {
+		go watchQuota(ctx, workDir, tmpfs, cancelQuota)
+	}
+	if err = cmd.Start(); err == nil {
+		cgroupDir := ""
+		if cg != nil {
+			cgroupDir = cg.dir
+		}
+		notesFrom(ctx).toolStarted(run.step, cmd.Process.Pid, cgroupDir)
+		err = cmd.Wait()
+		notesFrom(ctx).toolExited()
+	}
+	if cmd.Process != nil {
+		// Kill anything the tool left running in its group
+		killGroup(cmd)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// It exited successfully but a leftover child held its output open
+		err = nil
+	}
+	elapsed := time.Since(start)
+	span.SetAttributes(
+		attribute.Int("process.exit_code", cmd.ProcessState.ExitCode()),
+		attribute.Float64("process.duration_seconds", elapsed.Seconds()))
+	// An install that outgrew tmpfs, or filled it up, is run again on disk.
+	// Later steps work on what the install left, which spilling drops.
+	if errors.Is(context.Cause(ctx), errTmpfsFull) || tmpfs && err != nil && strings.Contains(strings.ToLower(stderr()), "no space left on device") {
+		if run.step != "install" {
+			logger.Error(run.step+" outgrew tmpfs", "tmpfs_workspace_max_bytes", tmpfsWorkspaceMax)
+			return &statusError{status: http.StatusInsufficientStorage,
+				err: fmt.Errorf("%s %s outgrew the workspace's %d MiB of tmpfs", eco.Name, run.step, tmpfsWorkspaceMax>>20)}
+		}
+		if err := spillWorkspace(outer, eco, req, workDir); err != nil {
+			return err
+		}
+		if out, ok := run.stdout.(*bytes.Buffer); ok {
+			out.Reset()
+		}
+		return runTool(outer, eco, req, workDir, run)
+	}
+	// A fast install may outgrow the quota between checks
+	if errors.Is(context.Cause(ctx), errQuotaExceeded) || err == nil && workspaceQuota > 0 && overQuota(ctx, workDir) {
+		logger.Error(run.step+" exceeded disk quota", "quota_bytes", workspaceQuota)
+		return &statusError{status: http.StatusRequestEntityTooLarge, errCode: "DISK_QUOTA_EXCEEDED",
+			err: fmt.Errorf("%s %s exceeded the disk quota of %d MiB", eco.Name, run.step, workspaceQuota>>20)}
+	}
+	failed := &toolError{step: run.step, exitCode: cmd.ProcessState.ExitCode(), stderr: stderr(), err: err}
+	if err != nil && cg != nil && cg.oomKilled() {
+		logger.Error(run.step+" ran out of memory", "memory_max_bytes", installMemoryMax, "stderr", failed.stderr)
+		failed.msg = fmt.Sprintf("%s %s was killed for exceeding its memory limit of %d MiB", eco.Name, run.step, installMemoryMax>>20)
+		failed.kind = "OUT_OF_MEMORY"
+		return failed
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Error(run.step+" timed out", "timeout", timeout.String(), "stderr", failed.stderr)
+		failed.msg = fmt.Sprintf("%s %s timed out after %s", eco.Name, run.step, timeout)
+		failed.kind = "TIMEOUT"
+		return &statusError{status: http.StatusGatewayTimeout, err: failed}
+	}
+	if err != nil {
+		logger.Error(run.step+" failed", "error", err, "stderr", failed.stderr)
+		failed.msg = fmt.Sprintf("%s %s failed: %v", eco.Name, run.step, err)
+		return failed
+	}
+	logger.Info(run.step+" completed", "duration_ms", elapsed.Milliseconds())
+	return nil
+}
+
+// An InstallRequest is a decoded install submission
+type InstallRequest struct {
+	Files   map[string]string
+	Options InstallOptions
+	// Format is the archive format negotiated from the query string or Accept header
+	Format *archiveFormat
+	// cacheNamespace keeps the caller's tenant's results apart in the cache
+	cacheNamespace string
+	// idempotencyKey is the caller's Idempotency-Key, scoped to them
+	idempotencyKey string
+	// clientSecrets are the secret files as the caller sent them, before
+	// the server's credentials were added
+	clientSecrets map[string]string
+	// sealedSecrets is clientSecrets as the shared job queue stores them
+	sealedSecrets string
+	// modes are the permissions of a project archive's files that aren't
+	// written 0644
+	modes map[string]os.FileMode
+}
+
+// InstallOptions are the settings accepted alongside the manifest files. In a
+// JSON body they sit next to the file names; in a multipart upload they are
+// sent as a JSON object in the "options" field.
+type InstallOptions struct {
+	// CallbackURL receives a POST when an asynchronous job finishes
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Timeout overrides the server's install timeout, as a Go duration such as "5m"
+	Timeout string `json:"timeout,omitempty"`
+	// Registry replaces the ecosystem's default registry or index; it must be
+	// in the server's allowlist
+	Registry string `json:"registry,omitempty"`
+	// IgnoreScripts skips package lifecycle scripts and source builds. Unset
+	// means the server's policy decides; it is filled in once decoded.
+	IgnoreScripts *bool `json:"ignore_scripts,omitempty"`
+	// NodeVersion runs a Node.js ecosystem's install on the newest release
+	// matching a version such as "20" or "20.11.1"
+	NodeVersion string `json:"node_version,omitempty"`
+	// RubyVersion runs a Bundler install on the newest Ruby release matching
+	// a version such as "3.3" or "3.3.6"
+	RubyVersion string `json:"ruby_version,omitempty"`
+	// Omit leaves kinds of dependencies out of the install, such as "dev"
+	Omit []string `json:"omit,omitempty"`
+	// PeerDepsMode is how a Node.js install treats peer dependencies:
+	// strict, legacy or auto. Unset leaves it to the package manager.
+	PeerDepsMode string `json:"peer_deps_mode,omitempty"`
+	// EngineStrict fails a Node.js install on any package whose engines
+	// field the toolchain doesn't satisfy, rather than warning of it
+	EngineStrict bool `json:"engine_strict,omitempty"`
+	// NpmArgs are extra flags for yarn and pnpm; each must be in the server's
+	// allowlist
+	NpmArgs []string `json:"npm_args,omitempty"`
+	// AuditFix makes /audit/<name> upgrade vulnerable dependencies and
+	// return the changed manifests
+	AuditFix bool `json:"audit_fix,omitempty"`
+	// AuditFailOn fails the install if its packages have advisories of this
+	// severity or worse. It may tighten the server's gate but not loosen it,
+	// and is filled in once decoded.
+	AuditFailOn string `json:"audit_fail_on,omitempty"`
+	// VerifyProvenance fails a Node.js install whose packages' registry
+	// signatures or provenance attestations fail the policy it names. It
+	// may tighten the server's policy but not loosen it, and is filled in
+	// once decoded.
+	VerifyProvenance string `json:"verify_provenance,omitempty"`
+	// RequireIntegrity fails the install unless its lock file pins every
+	// package with an integrity hash. The server's policy turns it on once
+	// decoded.
+	RequireIntegrity bool `json:"require_integrity,omitempty"`
+	// SBOM adds a software bill of materials in this format to the archive
+	SBOM string `json:"sbom,omitempty"`
+	// DenyLicenses adds to the server's license denylist. It is filled in
+	// with the whole list once decoded.
+	DenyLicenses []string `json:"deny_licenses,omitempty"`
+	// Workspaces limits a workspace install to these packages and the
+	// workspaces they depend on
+	Workspaces []string `json:"workspaces,omitempty"`
+	// Include lists what the archive holds: the installed directory, such
+	// as "node_modules", and manifests such as the lock file the install
+	// wrote. Unset means the installed directory alone.
+	Include []string `json:"include,omitempty"`
+	// Compression is how zip and tar.gz archives are compressed, "store" or
+	// "deflate", at CompressionLevel from 1 to 9. Both are filled in from
+	// the server's defaults once decoded.
+	Compression      string `json:"compression,omitempty"`
+	CompressionLevel int    `json:"compression_level,omitempty"`
+	// Output uploads the archive to an object store and responds with
+	// where it is instead of the archive itself
+	Output *OutputTarget `json:"output,omitempty"`
+	// LicenseReport adds a report of the installed packages' licenses to
+	// the archive
+	LicenseReport bool `json:"license_report,omitempty"`
+	// Report adds the install report to the archive as install-report.json
+	Report bool `json:"report,omitempty"`
+	// DryRun resolves the files and responds with what would be installed
+	// and the lock file, without installing or archiving anything
+	DryRun bool `json:"dry_run,omitempty"`
+	// Prune removes tests, docs, source maps and other files packages don't
+	// need at run time from node_modules
+	Prune bool `json:"prune,omitempty"`
+	// Bundle is what POST /bundle builds with esbuild
+	Bundle *BundleOptions `json:"bundle,omitempty"`
+	// Target installs native modules for another platform than the server's
+	Target *InstallTarget `json:"target,omitempty"`
+	// Targets installs for each of several platforms in parallel, into one
+	// archive with a directory per target
+	Targets []*InstallTarget `json:"targets,omitempty"`
+}
+
+// validate checks the options that can be rejected before installing
+func (o InstallOptions) validate(eco *Ecosystem) error {
+	if o.Registry != "" {
+		if err := validateRegistry(eco, o.Registry); err != nil {
+			return err
+		}
+	}
+	if o.AuditFix && (eco.Audit == nil || eco.Audit.Fix == nil) {
+		return badRequest("audit_fix is not supported for %s", eco.Name)
+	}
+	if o.AuditFailOn != "" {
+		if err := validateFailOn(eco, o.AuditFailOn); err != nil {
+			return err
+		}
+	}
+	if o.VerifyProvenance != "" {
+		if err := validateProvenance(eco, o.VerifyProvenance); err != nil {
+			return err
+		}
+	}
+	if o.SBOM != "" && findSBOMFormat(o.SBOM) == nil {
+		return badRequest("Invalid sbom %q: must be one of %s", o.SBOM, sbomFormatNames())
+	}
+	for _, license := range o.DenyLicenses {
+		if license == "" || strings.ContainsAny(license, " ()") {
+			return badRequest("Invalid deny_licenses entry %q: must be an SPDX license identifier", license)
+		}
+	}
+	if o.Output != nil {
+		if err := validateOutput(o.Output); err != nil {
+			return err
+		}
+	}
+	if len(o.Include) > 0 {
+		if err := validateInclude(eco, o.Include); err != nil {
+			return err
+		}
+	}
+	if len(o.Workspaces) > 0 {
+		if err := validateWorkspaces(eco, o.Workspaces); err != nil {
+			return err
+		}
+	}
+	if len(o.NpmArgs) > 0 {
+		if err := validateNpmArgs(eco, o.NpmArgs); err != nil {
+			return err
+		}
+	}
+	if o.PeerDepsMode != "" {
+		if err := validatePeerDeps(eco, o.PeerDepsMode); err != nil {
+			return err
+		}
+	}
+	if o.EngineStrict {
+		if err := validateEngineStrict(eco); err != nil {
+			return err
+		}
+	}
+	for _, kind := range o.Omit {
+		if _, ok := eco.OmitArgs[kind]; !ok {
+			var kinds []string
+			for k := range eco.OmitArgs {
+				kinds = append(kinds, k)
+			}
+			slices.Sort(kinds)
+			if len(kinds) == 0 {
+				return badRequest("omit is not supported for %s installs", eco.Name)
+			}
+			return badRequest("Invalid omit %q: %s installs can omit %s", kind, eco.Name, strings.Join(kinds, ", "))
+		}
+	}
+	if o.Prune && eco.Runtime != "node" {
+		return badRequest("prune is not supported for %s installs", eco.Name)
+	}
+	if o.Target != nil {
+		if err := o.Target.validate(eco); err != nil {
+			return err
+		}
+	}
+	if len(o.Targets) > 0 {
+		if err := validateTargets(eco, o); err != nil {
+			return err
+		}
+	}
+	if o.DryRun {
+		if err := validateDryRun(eco, o); err != nil {
+			return err
+		}
+	}
+	if o.NodeVersion != "" {
+		if eco.Runtime != "node" {
+			return badRequest("node_version is not supported for %s installs", eco.Name)
+		}
+		if !nodeVersionPattern.MatchString(o.NodeVersion) {
+			return badRequest("Invalid node_version %q: must be a version such as \"20\" or \"20.11.1\"", o.NodeVersion)
+		}
+	}
+	if o.RubyVersion != "" {
+		if eco.Runtime != "ruby" {
+			return badRequest("ruby_version is not supported for %s installs", eco.Name)
+		}
+		if !rubyVersionPattern.MatchString(o.RubyVersion) {
+			return badRequest("Invalid ruby_version %q: must be a version such as \"3.3\" or \"3.3.6\"", o.RubyVersion)
+		}
+	}
+	if scriptsPolicy == "force" && o.IgnoreScripts != nil && !*o.IgnoreScripts {
+		return badRequest("Package scripts are disabled on this server")
+	}
+	if _, onHost := installExecutor.(hostExecutor); onHost && eco.ScriptsAlwaysRun && o.ignoreScripts() {
+		return badRequest("%s installs run code from the request and its packages, which this server only allows with a sandbox or docker executor", eco.Name)
+	}
+	if o.Timeout == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(o.Timeout)
+	if err != nil || d <= 0 {
+		return badRequest("Invalid timeout %q: must be a positive duration such as \"5m\"", o.Timeout)
+	}
+	if d > maxInstallTimeout {
+		return badRequest("Invalid timeout %q: must not exceed %s", o.Timeout, maxInstallTimeout)
+	}
+	return nil
+}
+
+// timeout returns the install timeout the options ask for, or the server default
+func (o InstallOptions) timeout() time.Duration {
+	if d, err := time.ParseDuration(o.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return installTimeout
+}
+
+// runtimeVersion returns the release of eco's runtime the options ask for,
+// or "" for the server's own
+func (o InstallOptions) runtimeVersion(eco *Ecosystem) string {
+	if eco.Runtime == "ruby" {
+		return o.RubyVersion
+	}
+	return o.NodeVersion
+}
+
+// decodeRequest reads the ecosystem's manifest files and the install options
+// from a multipart upload, a JSON body keyed by file name or a project
+// archive
+func decodeRequest(r *http.Request, eco *Ecosystem) (_ *InstallRequest, err error) {
+	_, span := tracer.Start(r.Context(), "decode request", trace.WithAttributes(ecosystemAttr(eco)))
+	defer func() { endSpan(span, err) }()
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &InstallRequest{Files: make(map[string]string), Format: format, cacheNamespace: cacheNamespaceOf(r.Context())}
+	files := req.Files
+
+	contentType := r.Header.Get("Content-Type")
+	if isProjectArchive(contentType) {
+		// A whole project directory; its options are the defaults
+		defer r.Body.Close()
+		if req.Files, req.modes, err = readProject(eco, r.Body); err != nil {
+			return nil, err
+		}
+		files = req.Files
+	} else if strings.HasPrefix(contentType, "multipart/form-data") {
+		// Handle multipart form upload
+		err := r.ParseMultipartForm(20 << 20) // 20MB max memory
+		if err != nil {
+			return nil, badRequest("Error parsing multipart form: %v", err)
+		}
+		// Larger parts are spooled to temporary files
+		defer r.MultipartForm.RemoveAll()
+		accepted := make([]string, len(eco.Files))
+		for i, mf := range eco.Files {
+			accepted[i] = mf.Name
+		}
+		// A misnamed manifest would otherwise be silently left out
+		for name := range r.MultipartForm.File {
+			if name != "project" && !slices.Contains(accepted, name) && !isWorkspaceManifest(eco, name) {
+				return nil, badRequest("Unexpected file %q in form-data: %s installs accept %s and project", name, eco.Name, strings.Join(accepted, ", "))
+			}
+		}
+		if headers := r.MultipartForm.File["project"]; len(headers) > 0 {
+			f, err := headers[0].Open()
+			if err != nil {
+				return nil, badRequest("Error reading project: %v", err)
+			}
+			req.Files, req.modes, err = readProject(eco, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			files = req.Files
+		}
+		// Manifests sent as their own parts replace the project's
+		for name := range r.MultipartForm.File {
+			if isWorkspaceManifest(eco, name) {
+				if files[name], _, err = multipartFile(r.MultipartForm, name); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for name, values := range r.MultipartForm.Value {
+			if isWorkspaceManifest(eco, name) && len(values) > 0 {
+				files[name] = values[0]
+			}
+		}
+		for _, mf := range eco.Files {
+			content, ok, err := multipartFile(r.MultipartForm, mf.Name)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				if mf.Required && files[mf.Name] == "" && r.FormValue("packages") == "" {
+					return nil, badRequest("Missing %s file in form-data", mf.Name)
+				}
+				continue
+			}
+			files[mf.Name] = content
+		}
+		if opts := r.FormValue("options"); opts != "" {
+			if err := validateOptions([]byte(opts)); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal([]byte(opts), &req.Options); err != nil {
+				return nil, badRequest("Error decoding options: %v", err)
+			}
+		}
+		if specs := r.FormValue("packages"); specs != "" {
+			if err := decodePackages(eco, files, []byte(specs)); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// Fallback: JSON body
+		raw, err := readBody(r)
+		if err != nil {
+			return nil, err
+		}
+		// A bare list is shorthand for {"packages": [...]}
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			raw = []byte(`{"packages":` + string(trimmed) + `}`)
+		}
+		if err := decodeJSONBody(eco, req, raw); err != nil {
+			return nil, err
+		}
+	}
+	if err := completeRequest(eco, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeJSONBody reads the manifest files, package specs and options from a
+// JSON object keyed by file name
+func decodeJSONBody(eco *Ecosystem, req *InstallRequest, raw []byte) error {
+	if err := validateInstallBody(eco, raw); err != nil {
+		return err
+	}
+	files := req.Files
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return badRequest("Error decoding request body: %v", err)
+	}
+	for _, mf := range eco.Files {
+		content, ok := body[mf.Name]
+		if !ok {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(content, &s); err != nil {
+			return badRequest("Error decoding %s: must be a string", mf.Name)
+		}
+		s, err := mf.decode(s)
+		if err != nil {
+			return err
+		}
+		files[mf.Name] = s
+	}
+	for name, content := range body {
+		if !isWorkspaceManifest(eco, name) {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(content, &s); err != nil {
+			return badRequest("Error decoding %s: must be a string", name)
+		}
+		files[name] = s
+	}
+	if err := json.Unmarshal(raw, &req.Options); err != nil {
+		return badRequest("Error decoding request body: %v", err)
+	}
+	if specs, ok := body["packages"]; ok {
+		return decodePackages(eco, files, specs)
+	}
+	return nil
+}
+
+// addServerFiles adds the server's credentials to a request's secret files:
+// its default files for those the caller didn't send, and the configured
+// scopes' registries to .npmrc
+func addServerFiles(eco *Ecosystem, files map[string]string) error {
+	for _, mf := range eco.Files {
+		if files[mf.Name] == "" && mf.Secret && defaultFiles[mf.Name] != "" {
+			b, err := os.ReadFile(defaultFiles[mf.Name])
+			if err != nil {
+				return fmt.Errorf("Failed to read default %s: %v", mf.Name, err)
+			}
+			files[mf.Name] = string(b)
+		}
+		if mf.Name == ".npmrc" && len(scopeCredentials) > 0 {
+			scoped, err := scopedNpmrc()
+			if err != nil {
+				return err
+			}
+			if npmrc := files[mf.Name]; npmrc != "" && !strings.HasSuffix(npmrc, "\n") {
+				files[mf.Name] += "\n"
+			}
+			files[mf.Name] += scoped
+		}
+	}
+	return nil
+}
+
+// completeRequest adds the server's default files to a decoded request,
+// validates it and fills in the options the server decides
+func completeRequest(eco *Ecosystem, req *InstallRequest) error {
+	files := req.Files
+	for _, mf := range eco.Files {
+		if mf.Secret && files[mf.Name] != "" {
+			if req.clientSecrets == nil {
+				req.clientSecrets = make(map[string]string)
+			}
+			req.clientSecrets[mf.Name] = files[mf.Name]
+		}
+	}
+	if err := validateFileRegistries(eco, files); err != nil {
+		return err
+	}
+	if err := addServerFiles(eco, files); err != nil {
+		return err
+	}
+	for _, mf := range eco.Files {
+		if files[mf.Name] == "" {
+			if mf.Required {
+				return badRequest("Missing %s in request", mf.Name)
+			}
+			delete(files, mf.Name)
+		}
+	}
+	if eco.WorkspaceFiles != nil {
+		if err := eco.WorkspaceFiles(files); err != nil {
+			return err
+		}
+	}
+	if err := req.Options.validate(eco); err != nil {
+		return err
+	}
+	if err := req.Options.resolveCompression(req.Format); err != nil {
+		return err
+	}
+	if req.Options.Output != nil && req.Options.Output.Type == "image" && req.Format == zipFormat {
+		return badRequest("Image outputs need format tar.gz or tar.zst")
+	}
+	ignore := req.Options.ignoreScripts()
+	req.Options.IgnoreScripts = &ignore
+	if eco.Audit != nil {
+		req.Options.AuditFailOn = req.Options.failOn()
+	}
+	if eco.Runtime == "node" {
+		req.Options.VerifyProvenance = req.Options.provenance()
+	}
+	if eco.LockIntegrity != nil {
+		req.Options.RequireIntegrity = req.Options.RequireIntegrity || requireIntegrity
+	}
+	if req.Options.RequireIntegrity {
+		if err := validateIntegrity(eco, req.Files); err != nil {
+			return err
+		}
+	}
+	req.Options.DenyLicenses = req.Options.deniedLicenses()
+	// The order of omit doesn't change the result, so it mustn't change the cache key
+	slices.Sort(req.Options.Omit)
+	req.Options.Omit = slices.Compact(req.Options.Omit)
+	slices.Sort(req.Options.Include)
+	req.Options.Include = slices.Compact(req.Options.Include)
+	if len(req.Options.Include) == 1 && req.Options.Include[0] == eco.ArchiveRoot {
+		req.Options.Include = nil
+	}
+	slices.Sort(req.Options.Workspaces)
+	req.Options.Workspaces = slices.Compact(req.Options.Workspaces)
+	return nil
+}
+
+// multipartFile returns the contents of the form part with the given name,
+// which may be a file upload (curl -F name=@path) or a plain field
+// (curl -F name=<path)
+func multipartFile(form *multipart.Form, name string) (string, bool, error) {
+	if headers := form.File[name]; len(headers) > 0 {
+		f, err := headers[0].Open()
+		if err != nil {
+			return "", false, badRequest("Error reading %s: %v", name, err)
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return "", false, badRequest("Error reading %s: %v", name, err)
+		}
+		return string(b), true, nil
+	}
+	if values := form.Value[name]; len(values) > 0 {
+		return values[0], true, nil
+	}
+	return "", false, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// contextWriter stops writing once its context is done, so a cancelled
+// install stops archiving
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c contextWriter) Write(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	return c.w.Write(p)
+}
+
+// maxBodySize caps the JSON request bodies read into memory, set from the
+// body_max_mb setting. Project archives are limited by maxProjectSize instead.
+var maxBodySize int64 = 10 << 20
+
+// readBody reads a JSON request body, failing with a 413 that gives the
+// limit if it is larger than maxBodySize
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	raw, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, &statusError{status: http.StatusRequestEntityTooLarge,
+			err: fmt.Errorf("Request body is larger than the limit of %d MiB: %w", tooLarge.Limit>>20, tooLarge)}
+	}
+	if err != nil {
+		return nil, badRequest("Error reading request body: %v", err)
+	}
+	return raw, nil
+}
+
+// badRequest formats a 400 statusError
+func badRequest(format string, args ...any) error {
+	return &statusError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// requireIntegrity is the server's lock file policy, set from the
+// require_integrity setting: installs of ecosystems that can check it must
+// submit a lock file pinning every package with an integrity hash
+var requireIntegrity bool
+
+// A LockIntegrity finds the entries of an ecosystem's lock file that no
+// integrity hash pins, which the package manager fetches without verifying
+// what it got, such as git and file dependencies
+type LockIntegrity struct {
+	// File is the lock file
+	File string
+	// Unpinned lists its unpinned entries
+	Unpinned func(lock string) ([]UnpinnedPackage, error)
+}
+
+// An UnpinnedPackage is a lock file entry without an integrity hash
+type UnpinnedPackage struct {
+	// Package is the entry, usually as name@version
+	Package string `json:"package"`
+	// Source is git, local for file: and link: dependencies, or tarball
+	// for a package fetched from a URL or registry
+	Source string `json:"source"`
+}
+
+// An unpinnedError fails an install requiring integrity whose lock file
+// leaves packages unpinned
+type unpinnedError struct {
+	lockfile string
+	packages []UnpinnedPackage
+}
+
+func (e *unpinnedError) Error() string {
+	return fmt.Sprintf("%s has %d packages without an integrity hash", e.lockfile, len(e.packages))
+}
+
+func (e *unpinnedError) code() string { return "LOCKFILE_UNPINNED" }
+
+func (e *unpinnedError) details() map[string]any {
+	return map[string]any{"unpinned": e.packages}
+}
+
+// validateIntegrity checks that an install requiring integrity has a lock
+// file to check
+func validateIntegrity(eco *Ecosystem, files map[string]string) error {
+	if eco.LockIntegrity == nil {
+		return badRequest("require_integrity is not supported for %s installs", eco.Name)
+	}
+	if files[eco.LockIntegrity.File] == "" {
+		return badRequest("require_integrity needs a %s pinning every package", eco.LockIntegrity.File)
+	}
+	return nil
+}
+
+// checkLockIntegrity checks the request's lock file before anything is
+// installed. Unpinned entries fail installs requiring integrity and are
+// flagged as warnings of others. The package managers verify the hashes of
+// the packages they download against the lock files they are frozen to.
+func checkLockIntegrity(ctx context.Context, eco *Ecosystem, req *InstallRequest) error {
+	li := eco.LockIntegrity
+	if li == nil || req.Files[li.File] == "" {
+		return nil
+	}
+	unpinned, err := li.Unpinned(req.Files[li.File])
+	if err != nil {
+		return badRequest("Failed to read %s: %v", li.File, err)
+	}
+	if len(unpinned) == 0 {
+		return nil
+	}
+	if req.Options.RequireIntegrity {
+		loggerFrom(ctx).Warn("lock file leaves packages unpinned", "lockfile", li.File, "packages", len(unpinned))
+		return &unpinnedError{lockfile: li.File, packages: unpinned}
+	}
+	notes := notesFrom(ctx)
+	for _, p := range unpinned {
+		notes.warn(InstallWarning{Kind: "unpinned", Package: p.Package,
+			Message: fmt.Sprintf("%s has no integrity hash in %s, so what is fetched from its %s source isn't verified", p.Package, li.File, p.Source)})
+	}
+	return nil
+}
+
+// pnpmUnpinned lists the packages of a pnpm-lock.yaml whose resolution has
+// no integrity: those from git, directories and tarball URLs without one.
+// Workspace packages are linked from importers and never listed.
+func pnpmUnpinned(lock string) ([]UnpinnedPackage, error) {
+	var doc struct {
+		Packages map[string]struct {
+			Resolution struct {
+				Integrity string `yaml:"integrity"`
+				Tarball   string `yaml:"tarball"`
+				Type      string `yaml:"type"`
+				Repo      string `yaml:"repo"`
+				Directory string `yaml:"directory"`
+			} `yaml:"resolution"`
+		} `yaml:"packages"`
+	}
+	if err := yaml.Unmarshal([]byte(lock), &doc); err != nil {
+		return nil, err
+	}
+	var unpinned []UnpinnedPackage
+	for key, entry := range doc.Packages {
+		r := entry.Resolution
+		if r.Integrity != "" {
+			continue
+		}
+		// GitHub dependencies resolve to codeload tarballs
+		source := lockSource(key + " " + r.Tarball)
+		switch {
+		case r.Type == "git" || r.Repo != "":
+			source = "git"
+		case r.Type == "directory" || r.Directory != "":
+			source = "local"
+		}
+		key, _, _ = strings.Cut(strings.TrimPrefix(key, "/"), "(")
+		unpinned = append(unpinned, UnpinnedPackage{Package: key, Source: source})
+	}
+	slices.SortFunc(unpinned, func(a, b UnpinnedPackage) int { return strings.Compare(a.Package, b.Package) })
+	return unpinned, nil
+}
+
+// yarnUnpinned lists the entries of a yarn.lock without an integrity field,
+// or in later releases a checksum, leaving out the project's workspaces
+func yarnUnpinned(lock string) ([]UnpinnedPackage, error) {
+	var unpinned []UnpinnedPackage
+	var spec, version, resolved string
+	var pinned bool
+	flush := func() {
+		if spec != "" && spec != "__metadata" && !pinned && !strings.Contains(resolved, "@workspace:") {
+			name, _ := splitNpmSpec(spec)
+			unpinned = append(unpinned, UnpinnedPackage{Package: name + "@" + version, Source: lockSource(spec + " " + resolved)})
+		}
+		spec, version, resolved, pinned = "", "", "", false
+	}
+	sc := bufio.NewScanner(strings.NewReader(lock))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			flush()
+			first, _, _ := strings.Cut(strings.TrimSuffix(line, ":"), ",")
+			spec = strings.Trim(first, `"`)
+			continue
+		}
+		// Fields are indented once; deeper lines are their dependencies
+		if strings.HasPrefix(line, "   ") {
+			continue
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		key = strings.TrimSuffix(key, ":")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "version":
+			version = value
+		case "resolved", "resolution":
+			resolved = value
+		case "integrity", "checksum":
+			pinned = value != ""
+		}
+	}
+	flush()
+	return unpinned, sc.Err()
+}
+
+// lockSource tells where a lock file entry comes from by its spec and
+// resolution
+func lockSource(s string) string {
+	for _, marker := range []string{"git+", "git://", "github:", "#commit=", "codeload.github.com"} {
+		if strings.Contains(s, marker) {
+			return "git"
+		}
+	}
+	for _, marker := range []string{"file:", "link:", "portal:"} {
+		if strings.Contains(s, marker) {
+			return "local"
+		}
+	}
+	return "tarball"
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// eventPollInterval is how often job events are copied to Redis and read
+// back by replicas streaming them
+const eventPollInterval = 500 * time.Millisecond
+
+var jobsRequeued = newCounterVec("pip_install_jobs_requeued_total",
+	"Jobs put back on the shared queue because the replica running them stopped.")
+
+// A redisQueue keeps jobs, their state and their events in Redis, so every
+// replica can take queued jobs and report on any of them. A replica moves
+// each job it takes into its own processing list and refreshes a heartbeat
+// key while it runs; the jobs of a replica whose heartbeat expires are put
+// back on the queue by the others.
+type redisQueue struct {
+	redis  *redisClient
+	prefix string
+	// worker identifies this replica
+	worker    string
+	heartbeat time.Duration
+	retention time.Duration
+	// secrets seals the secret files clients send with jobs; nil if the
+	// server has no job_secrets_key, and such jobs are refused
+	secrets cipher.AEAD
+}
+
+// A jobRecord is a job as stored in Redis, with what a replica needs to run it
+type jobRecord struct {
+	Job
+	// Request is kept until the job finishes, so another replica can run it
+	Request     *storedRequest `json:"request,omitempty"`
+	CacheKey    string         `json:"cache_key"`
+	BaseURL     string         `json:"base_url"`
+	Traceparent string         `json:"traceparent,omitempty"`
+	// ErrorStatus and ErrorDetails let a frontend answer a synchronous
+	// install that failed on a worker
+	ErrorStatus  int            `json:"error_status,omitempty"`
+	ErrorDetails map[string]any `json:"error_details,omitempty"`
+}
+
+// A storedRequest is an InstallRequest as stored in a jobRecord. Secret
+// files are left out of Files: those the client sent are kept sealed in
+// Secrets, and the server's own credentials are added back by the replica
+// that runs the job.
+type storedRequest struct {
+	Files   map[string]string      `json:"files"`
+	Secrets string                 `json:"secrets,omitempty"`
+	Modes   map[string]os.FileMode `json:"modes,omitempty"`
+	Options InstallOptions         `json:"options"`
+	Format  string                 `json:"format"`
+}
+
+func newRedisQueue(client *redisClient, prefix string, heartbeat, retention time.Duration, secretsKey string) (*redisQueue, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	q := &redisQueue{
+		redis:     client,
+		prefix:    prefix,
+		worker:    host + "-" + id[:8],
+		heartbeat: heartbeat,
+		retention: retention,
+	}
+	if secretsKey != "" {
+		key := sha256.Sum256([]byte(secretsKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		if q.secrets, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// sealSecrets encrypts the secret files a client sent with a job, so that
+// reading Redis doesn't reveal them. Without a key such jobs are refused.
+func (q *redisQueue) sealSecrets(files map[string]string) (string, error) {
+	if len(files) == 0 {
+		return "", nil
+	}
+	if q.secrets == nil {
+		return "", badRequest("Jobs with secret files such as .npmrc can't be queued on this server, which has no job_secrets_key")
+	}
+	plain, err := json.Marshal(files)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, q.secrets.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(q.secrets.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// openSecrets decrypts what sealSecrets returned
+func (q *redisQueue) openSecrets(sealed string) (map[string]string, error) {
+	if sealed == "" {
+		return nil, nil
+	}
+	if q.secrets == nil {
+		return nil, errors.New("the job has secret files but this replica has no job_secrets_key")
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < q.secrets.NonceSize() {
+		return nil, errors.New("malformed secret files")
+	}
+	nonce, box := b[:q.secrets.NonceSize()], b[q.secrets.NonceSize():]
+	plain, err := q.secrets.Open(nil, nonce, box, nil)
+	if err != nil {
+		return nil, errors.New("secret files don't open with this replica's job_secrets_key")
+	}
+	var files map[string]string
+	return files, json.Unmarshal(plain, &files)
+}
+
+func (q *redisQueue) key(parts ...string) string {
+	key := q.prefix
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+	return key
+}
+
+func millis(d time.Duration) string { return strconv.FormatInt(d.Milliseconds(), 10) }
+
+// newJobRecord returns the stored form of a job
+func newJobRecord(job *Job) jobRecord {
+	rec := jobRecord{Job: *job, CacheKey: job.cacheKey, BaseURL: job.baseURL, ErrorStatus: job.errorStatus, ErrorDetails: job.errorDetails}
+	if job.req != nil {
+		files := make(map[string]string, len(job.req.Files))
+		for name, content := range job.req.Files {
+			if !job.eco.secretFile(name) {
+				files[name] = content
+			}
+		}
+		rec.Request = &storedRequest{Files: files, Secrets: job.req.sealedSecrets, Modes: job.req.modes, Options: job.req.Options, Format: job.req.Format.Name}
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), job.span), carrier)
+	rec.Traceparent = carrier["traceparent"]
+	return rec
+}
+
+// job rebuilds a Job from its record. Its request, if it still has one, is
+// returned separately.
+func (rec jobRecord) job() (*Job, *InstallRequest) {
+	job := rec.Job
+	job.eco = findEcosystem(rec.Ecosystem)
+	job.cacheKey = rec.CacheKey
+	job.baseURL = rec.BaseURL
+	job.errorStatus, job.errorDetails = rec.ErrorStatus, rec.ErrorDetails
+	job.logger = slog.Default().With("job_id", rec.ID, "ecosystem", rec.Ecosystem)
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": rec.Traceparent})
+	job.span = trace.SpanContextFromContext(ctx)
+	if rec.Request == nil {
+		return &job, nil
+	}
+	req := &InstallRequest{Files: rec.Request.Files, Options: rec.Request.Options, Format: archiveFormats[0], sealedSecrets: rec.Request.Secrets, modes: rec.Request.Modes}
+	for _, f := range archiveFormats {
+		if f.Name == rec.Request.Format {
+			req.Format = f
+		}
+	}
+	return &job, req
+}
+
+// save writes a job's record. Finished jobs expire after the retention period.
+func (q *redisQueue) save(ctx context.Context, rec jobRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", q.key("job", rec.ID), string(b)}
+	if rec.FinishedAt != nil {
+		args = append(args, "PX", millis(q.retention))
+	}
+	_, err = q.redis.do(ctx, args...)
+	return err
+}
+
+// load reads a job's record
+func (q *redisQueue) load(ctx context.Context, id string) (jobRecord, bool, error) {
+	s, err := q.redis.str(ctx, "GET", q.key("job", id))
+	if err != nil || s == "" {
+		return jobRecord{}, false, err
+	}
+	var rec jobRecord
+	if err := json.Unmarshal([]byte(s), &rec); err != nil {
+		return jobRecord{}, false, fmt.Errorf("decoding job %s: %v", id, err)
+	}
+	return rec, true, nil
+}
+
+// push saves a new job with its first events and adds it to the queue
+func (q *redisQueue) push(ctx context.Context, rec jobRecord, events []JobEvent) error {
+	if err := q.save(ctx, rec); err != nil {
+		return err
+	}
+	if err := q.appendEvents(ctx, rec.ID, events, false); err != nil {
+		return err
+	}
+	_, err := q.redis.do(ctx, "LPUSH", q.key("queue"), rec.ID)
+	return err
+}
+
+// appendEvents adds events to a job's event log. Once the log is final it
+// expires with the job.
+func (q *redisQueue) appendEvents(ctx context.Context, id string, events []JobEvent, final bool) error {
+	key := q.key("events", id)
+	if len(events) > 0 {
+		args := []string{"RPUSH", key}
+		for _, ev := range events {
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			args = append(args, string(b))
+		}
+		if _, err := q.redis.do(ctx, args...); err != nil {
+			return err
+		}
+	}
+	if final {
+		_, err := q.redis.do(ctx, "PEXPIRE", key, millis(q.retention))
+		return err
+	}
+	return nil
+}
+
+// loadEvents reads a job's events after the given ID
+func (q *redisQueue) loadEvents(ctx context.Context, id string, after int) ([]JobEvent, error) {
+	items, err := q.redis.strings(ctx, "LRANGE", q.key("events", id), strconv.Itoa(after), "-1")
+	if err != nil {
+		return nil, err
+	}
+	events := make([]JobEvent, 0, len(items))
+	for _, item := range items {
+		var ev JobEvent
+		if err := json.Unmarshal([]byte(item), &ev); err != nil {
+			return nil, fmt.Errorf("decoding event of job %s: %v", id, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// claim moves the oldest queued job to this replica's processing list,
+// waiting up to a second for one. It returns "" if there was none.
+func (q *redisQueue) claim(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second+redisTimeout)
+	defer cancel()
+	return q.redis.str(ctx, "BLMOVE", q.key("queue"), q.key("processing", q.worker), "RIGHT", "LEFT", "1")
+}
+
+// done removes a finished job from this replica's processing list
+func (q *redisQueue) done(ctx context.Context, id string) error {
+	_, err := q.redis.do(ctx, "LREM", q.key("processing", q.worker), "0", id)
+	return err
+}
+
+// requeue puts a job this replica was running back at the front of the queue
+func (q *redisQueue) requeue(ctx context.Context, id, reason string) error {
+	if err := q.requeued(ctx, id, reason); err != nil {
+		return err
+	}
+	if err := q.done(ctx, id); err != nil {
+		return err
+	}
+	_, err := q.redis.do(ctx, "RPUSH", q.key("queue"), id)
+	return err
+}
+
+// putBack returns a job this replica took but can't start yet to the back
+// of the queue, behind the jobs waiting
+func (q *redisQueue) putBack(ctx context.Context, id string) error {
+	if err := q.done(ctx, id); err != nil {
+		return err
+	}
+	_, err := q.redis.do(ctx, "LPUSH", q.key("queue"), id)
+	return err
+}
+
+// requeued marks a job that has gone back on the queue as queued again,
+// noting why in its events
+func (q *redisQueue) requeued(ctx context.Context, id, reason string) error {
+	rec, ok, err := q.load(ctx, id)
+	if err != nil || !ok {
+		return err
+	}
+	rec.Status = JobQueued
+	rec.StartedAt = nil
+	if err := q.save(ctx, rec); err != nil {
+		return err
+	}
+	n, err := q.redis.int(ctx, "LLEN", q.key("events", id))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	jobsRequeued.inc()
+	slog.Warn("job requeued", "job_id", id, "ecosystem", rec.Ecosystem, "reason", reason)
+	return q.appendEvents(ctx, id, []JobEvent{
+		{ID: int(n) + 1, Type: "log", Time: now, Stream: "server", Line: "requeued: " + reason},
+		{ID: int(n) + 2, Type: "status", Time: now, Phase: PhaseQueued, Status: JobQueued},
+	}, false)
+}
+
+// position returns a queued job's 1-based place in the queue, or 0 if it
+// isn't waiting
+func (q *redisQueue) position(ctx context.Context, id string) int {
+	reply, err := q.redis.do(ctx, "LPOS", q.key("queue"), id)
+	index, ok := reply.(int64)
+	if err != nil || !ok {
+		return 0
+	}
+	n, err := q.depth(ctx)
+	if err != nil {
+		return 0
+	}
+	// Jobs are pushed on the left and taken from the right
+	return n - int(index)
+}
+
+// depth returns how many jobs are waiting in the queue
+func (q *redisQueue) depth(ctx context.Context) (int, error) {
+	n, err := q.redis.int(ctx, "LLEN", q.key("queue"))
+	return int(n), err
+}
+
+// beat refreshes this replica's heartbeat every heartbeat interval and puts
+// the jobs of replicas whose heartbeat has expired back on the queue, until
+// ctx is cancelled
+func (q *redisQueue) beat(ctx context.Context) {
+	for {
+		if err := q.alive(ctx); err != nil {
+			slog.Error("failed to record worker heartbeat", "worker", q.worker, "error", err)
+		}
+		if err := q.reap(ctx); err != nil {
+			slog.Error("failed to requeue orphaned jobs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.heartbeat):
+		}
+	}
+}
+
+// alive records that this replica is running. The key outlives three missed
+// heartbeats.
+func (q *redisQueue) alive(ctx context.Context) error {
+	if _, err := q.redis.do(ctx, "SET", q.key("worker", q.worker), time.Now().UTC().Format(time.RFC3339), "PX", millis(3*q.heartbeat)); err != nil {
+		return err
+	}
+	_, err := q.redis.do(ctx, "SADD", q.key("workers"), q.worker)
+	return err
+}
+
+// reap requeues the jobs of every replica whose heartbeat has expired
+func (q *redisQueue) reap(ctx context.Context) error {
+	workers, err := q.redis.strings(ctx, "SMEMBERS", q.key("workers"))
+	if err != nil {
+		return err
+	}
+	for _, worker := range workers {
+		if worker == q.worker {
+			continue
+		}
+		n, err := q.redis.int(ctx, "EXISTS", q.key("worker", worker))
+		if err != nil || n > 0 {
+			continue
+		}
+		// Only one replica wins the rename, so each job is requeued once. Its
+		// events are written before it can be taken again.
+		orphans := q.key("orphans", worker)
+		if _, err := q.redis.do(ctx, "RENAME", q.key("processing", worker), orphans); err == nil {
+			for {
+				id, err := q.redis.str(ctx, "LINDEX", orphans, "-1")
+				if err != nil {
+					return err
+				}
+				if id == "" {
+					break
+				}
+				if err := q.requeued(ctx, id, "worker "+worker+" stopped"); err != nil {
+					return err
+				}
+				if _, err := q.redis.do(ctx, "LMOVE", orphans, q.key("queue"), "RIGHT", "RIGHT"); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := q.redis.do(ctx, "SREM", q.key("workers"), worker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leave removes this replica's heartbeat once it has stopped running jobs
+func (q *redisQueue) leave(ctx context.Context) error {
+	if _, err := q.redis.do(ctx, "DEL", q.key("worker", q.worker)); err != nil {
+		return err
+	}
+	_, err := q.redis.do(ctx, "SREM", q.key("workers"), q.worker)
+	return err
+}
+
+// forward copies the events of a job this replica is running to Redis every
+// eventPollInterval, starting after the first sent, until stop is closed.
+// The returned channel is closed once the last events have been copied.
+func (q *redisQueue) forward(job *Job, sent int, stop <-chan struct{}) <-chan struct{} {
+	finished := make(chan struct{})
+	flush := func() {
+		events, closed, _ := job.events.since(sent)
+		if err := q.appendEvents(context.Background(), job.ID, events, closed); err != nil {
+			job.logger.Error("failed to copy job events to redis", "error", err)
+			return
+		}
+		sent += len(events)
+	}
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(eventPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				flush()
+				return
+			case <-ticker.C:
+				flush()
+				// Cancelling a job another replica runs is asked of it here
+				if by, ok := q.cancelRequested(context.Background(), job.ID); ok {
+					job.cancel(cancelledBy(by))
+				}
+			}
+		}
+	}()
+	return finished
+}
+
+// withdraw takes a queued job off the queue, reporting whether it was there
+func (q *redisQueue) withdraw(ctx context.Context, id string) (bool, error) {
+	n, err := q.redis.int(ctx, "LREM", q.key("queue"), "0", id)
+	return n > 0, err
+}
+
+// promote moves a queued job to the front of the queue, reporting whether it
+// was waiting
+func (q *redisQueue) promote(ctx context.Context, id string) (bool, error) {
+	ok, err := q.withdraw(ctx, id)
+	if err != nil || !ok {
+		return false, err
+	}
+	_, err = q.redis.do(ctx, "RPUSH", q.key("queue"), id)
+	return true, err
+}
+
+// requestCancel asks the replica running a job to cancel it, noting who by
+func (q *redisQueue) requestCancel(ctx context.Context, id, by string) error {
+	_, err := q.redis.do(ctx, "SET", q.key("cancel", id), by, "PX", millis(q.retention))
+	return err
+}
+
+// claimIdempotencyKey sets an Idempotency-Key to value for ttl unless it is
+// set already, returning what it is set to instead
+func (q *redisQueue) claimIdempotencyKey(ctx context.Context, key, value string, ttl time.Duration) (string, bool, error) {
+	ok, err := q.redis.str(ctx, "SET", q.key("idempotency", key), value, "NX", "PX", millis(ttl))
+	if err != nil || ok == "OK" {
+		return "", err == nil, err
+	}
+	existing, err := q.redis.str(ctx, "GET", q.key("idempotency", key))
+	return existing, false, err
+}
+
+// forgetIdempotencyKey frees an Idempotency-Key
+func (q *redisQueue) forgetIdempotencyKey(ctx context.Context, key string) {
+	q.redis.do(ctx, "DEL", q.key("idempotency", key))
+}
+
+// cancelRequested reports whether a job's cancellation has been asked for,
+// and who by
+func (q *redisQueue) cancelRequested(ctx context.Context, id string) (string, bool) {
+	by, err := q.redis.str(ctx, "GET", q.key("cancel", id))
+	return by, err == nil && by != ""
+}
+
+// queued returns the IDs of the queued jobs, next first
+func (q *redisQueue) queued(ctx context.Context) ([]string, error) {
+	ids, err := q.redis.strings(ctx, "LRANGE", q.key("queue"), "0", "-1")
+	slices.Reverse(ids)
+	return ids, err
+}
+
+// processing returns the IDs of the jobs each replica is running
+func (q *redisQueue) processing(ctx context.Context) (map[string][]string, error) {
+	workers, err := q.redis.strings(ctx, "SMEMBERS", q.key("workers"))
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string][]string)
+	for _, worker := range workers {
+		ids, err := q.redis.strings(ctx, "LRANGE", q.key("processing", worker), "0", "-1")
+		if err != nil {
+			return nil, err
+		}
+		running[worker] = ids
+	}
+	return running, nil
+}
+
+// redisEvents reads the event log of a job from Redis, for jobs this replica
+// isn't running
+type redisEvents struct {
+	q  *redisQueue
+	id string
+}
+
+// since is like jobEvents.since, except that the returned channel is closed
+// after eventPollInterval whether or not there are new events
+func (e redisEvents) since(id int) ([]JobEvent, bool, <-chan struct{}) {
+	changed := make(chan struct{})
+	time.AfterFunc(eventPollInterval, func() { close(changed) })
+	if id < 0 {
+		id = 0
+	}
+	// The last event seen is read again to tell whether the log has ended
+	events, err := e.q.loadEvents(context.Background(), e.id, max(id-1, 0))
+	if err != nil {
+		slog.Error("failed to read job events", "job_id", e.id, "error", err)
+		return nil, true, changed
+	}
+	if len(events) == 0 {
+		return nil, false, changed
+	}
+	last := events[len(events)-1]
+	done := last.Type == "status" && last.Phase == PhaseDone
+	for len(events) > 0 && events[0].ID <= id {
+		events = events[1:]
+	}
+	return events, done, changed
+}
+
+// waitJob polls the shared queue until a job has finished
+func (m *JobManager) waitJob(ctx context.Context, id string) (Job, error) {
+	for {
+		job, ok, err := m.get(ctx, id)
+		if err != nil {
+			return Job{}, err
+		}
+		if !ok {
+			return Job{}, errors.New("job expired before it finished")
+		}
+		if job.FinishedAt != nil {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-time.After(eventPollInterval):
+		}
+	}
+}
+
+// installQueued answers a synchronous install on a frontend by running it as
+// a job on a worker and serving the archive it stores, holding the caller's
+// concurrent install slot meanwhile
+func (m *JobManager) installQueued(ctx context.Context, w http.ResponseWriter, r *http.Request, eco *Ecosystem, req *InstallRequest, key string) {
+	release, err := limits.acquire(w, r)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	defer release()
+	job, err := m.submit(ctx, eco, req, requestBaseURL(r), false, func() {})
+	if err != nil {
+		poolError(w, err)
+		return
+	}
+	loggerFrom(ctx).Info("waiting for install on a worker", "job_id", job.ID)
+	done, err := m.waitJob(ctx, job.ID)
+	if err != nil {
+		if ctx.Err() == nil {
+			writeError(w, fmt.Sprintf("Failed to follow job %s: %v", job.ID, err), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if done.Status == JobFailed {
+		status := done.errorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		if done.errorDetails != nil {
+			writeJSON(w, status, done.errorDetails)
+			return
+		}
+		writeError(w, done.Error, status)
+		return
+	}
+	m.installer.cache.add(key, done.ArtifactDigest)
+	w.Header().Set("ETag", inputETag(key))
+	w.Header().Set("X-Cache", "MISS")
+	if done.Output != nil {
+		setSkippedScripts(w, done.SkippedScripts)
+		setPrunedBytes(w, done.PrunedBytes)
+		writeUploaded(w, done.Output, nil)
+		return
+	}
+	serveArtifact(w, r, m.installer.store, done.ArtifactDigest)
+}
@@ -0,0 +1,1050 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// JobStatus is the lifecycle state of an asynchronous install
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// A Job is one asynchronous install. Its fields are guarded by the
+// JobManager's mutex once the job has been submitted.
+type Job struct {
+	ID        string    `json:"id"`
+	Ecosystem string    `json:"ecosystem"`
+	Status    JobStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// ErrorCode is the code of the error response the failure would have
+	// been, such as LOCKFILE_MISMATCH
+	ErrorCode string `json:"error_code,omitempty"`
+	// ExitCode is the failed tool's, if it exited
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// ArtifactDigest is the SHA-256 of the archive once the job has succeeded
+	ArtifactDigest string `json:"artifact_sha256,omitempty"`
+	// Cached is set when the artifact came from the result cache
+	Cached bool `json:"cached,omitempty"`
+	// CoalescedWith is the job whose identical install this one waited for
+	// instead of running its own
+	CoalescedWith string `json:"coalesced_with,omitempty"`
+	// Owner is the authenticated caller who submitted the job
+	Owner *Principal `json:"owner,omitempty"`
+	// SkippedScripts lists the packages whose install scripts were skipped
+	SkippedScripts []string `json:"skipped_scripts,omitempty"`
+	// PrunedBytes is how much the prune option removed
+	PrunedBytes int64 `json:"pruned_bytes,omitempty"`
+	// Warnings are what the package manager warned of, such as deprecated
+	// packages and unmet peer dependencies, whether or not the job failed
+	Warnings []InstallWarning `json:"warnings,omitempty"`
+	// Retries is how many times the install was run again after failing to
+	// reach the registry
+	Retries int `json:"retries,omitempty"`
+	// Provenance is what verifying the packages' registry signatures and
+	// attestations found, for jobs with a provenance policy
+	Provenance *ProvenanceReport `json:"provenance,omitempty"`
+	// Advisories lists the vulnerabilities that failed the job's audit gate
+	Advisories []Advisory `json:"advisories,omitempty"`
+	// DeniedPackages lists the packages whose licenses failed the job
+	DeniedPackages []Package `json:"denied_packages,omitempty"`
+	// PolicyViolations lists the packages the package policy blocked
+	PolicyViolations []PolicyViolation `json:"policy_violations,omitempty"`
+	// IncompatibleEngines lists the packages that failed the job by
+	// requiring other engines than it ran on
+	IncompatibleEngines []EngineMismatch `json:"incompatible_engines,omitempty"`
+	// UnsatisfiableOverrides lists the overrides that failed the job by
+	// forcing versions that don't exist
+	UnsatisfiableOverrides []Override `json:"unsatisfiable_overrides,omitempty"`
+	// PolicyReasons explains why the OPA policy denied the job
+	PolicyReasons []string `json:"policy_reasons,omitempty"`
+	// Output is where the archive was uploaded, for jobs with the output option
+	Output *UploadedArtifact `json:"output,omitempty"`
+
+	eco    *Ecosystem
+	logger *slog.Logger
+	// span is the submitting request's span; the job's own span is its child
+	span     trace.SpanContext
+	events   *jobEvents
+	req      *InstallRequest
+	cacheKey string
+	baseURL  string
+	// release frees the submitter's concurrent install slot
+	release func()
+	// slot is the job's place in the install pool
+	slot *ticket
+	// position is the job's place in the shared queue, when it was read from one
+	position int
+	// errorStatus and errorDetails are the status and JSON body of the
+	// response an install failing like the job would have
+	errorStatus  int
+	errorDetails map[string]any
+	// stopEvents stops copying the job's events to the shared queue, once
+	// the last have been copied
+	stopEvents func()
+	// ctx is the context the job runs in, from when it is queued on this
+	// replica; cancel stops it with the reason
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// workDir and notes are the running job's workspace and install notes
+	workDir string
+	notes   *installNotes
+	// replayed is set on the job a repeated Idempotency-Key is answered with
+	replayed bool
+	// buildDone ends the job's record as an install in flight, which
+	// identical ones wait for
+	buildDone func()
+}
+
+// A JobManager runs asynchronous installs once the Installer's pool has a
+// slot for them and stores their archives through the Installer. Finished
+// jobs are forgotten after retention, matching the artifact TTL.
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	installer *Installer
+	retention time.Duration
+	notifier  *webhookNotifier
+	// queue, when set, holds the jobs instead of the jobs map, which then
+	// has only those this replica is running
+	queue *redisQueue
+
+	// closing is set once shutdown starts; no new jobs are accepted
+	closing bool
+	// active counts job goroutines, queued or running
+	active sync.WaitGroup
+	// queueCtx is cancelled when shutdown starts, failing jobs still waiting
+	// for a slot, and runCtx when the drain timeout expires, killing the rest
+	queueCtx, runCtx    context.Context
+	stopQueue, stopRuns context.CancelFunc
+	// stopBeat ends the heartbeat this replica reports to the shared queue
+	stopBeat context.CancelFunc
+	// idempotencyKeys are the jobs submitted with an Idempotency-Key, by
+	// scoped key, without a shared queue
+	idempotencyKeys map[string]idempotencyClaim
+}
+
+// newJobManager starts the janitor. With a shared queue and runJobs set it
+// also starts a worker for each install slot, taking jobs from the queue;
+// without runJobs jobs are only submitted to it.
+func newJobManager(installer *Installer, retention time.Duration, notifier *webhookNotifier, queue *redisQueue, runJobs bool) *JobManager {
+	m := &JobManager{
+		jobs:            make(map[string]*Job),
+		installer:       installer,
+		retention:       retention,
+		notifier:        notifier,
+		queue:           queue,
+		idempotencyKeys: make(map[string]idempotencyClaim),
+	}
+	m.queueCtx, m.stopQueue = context.WithCancel(context.Background())
+	m.runCtx, m.stopRuns = context.WithCancel(context.Background())
+	newGaugeFunc("pip_install_job_queue_depth", "Jobs waiting for an install slot.", func() float64 {
+		if m.queue != nil {
+			n, _ := m.queue.depth(context.Background())
+			return float64(n)
+		}
+		return float64(m.count(JobQueued))
+	})
+	newGaugeFunc("pip_install_active_jobs", "Jobs currently running.", func() float64 {
+		return float64(m.count(JobRunning))
+	})
+	go m.janitor()
+	if queue != nil && runJobs {
+		var beatCtx context.Context
+		beatCtx, m.stopBeat = context.WithCancel(context.Background())
+		go queue.beat(beatCtx)
+		m.active.Add(installer.pool.slots)
+		for i := 0; i < installer.pool.slots; i++ {
+			go m.work()
+		}
+		slog.Info("taking jobs from the shared queue", "worker", queue.worker, "workers", installer.pool.slots)
+	}
+	return m
+}
+
+// submit registers a new queued job, failing if the queue is full. baseURL is
+// used to build the absolute artifact URL sent to webhooks. Unless useCache is
+// false, a job whose result is already cached succeeds immediately. release is
+// called once the job no longer needs an install slot. A request with an
+// Idempotency-Key its caller sent before gets the job it was sent with.
+func (m *JobManager) submit(ctx context.Context, eco *Ecosystem, req *InstallRequest, baseURL string, useCache bool, release func()) (_ *Job, err error) {
+	id, err := newJobID()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        id,
+		Ecosystem: eco.Name,
+		Status:    JobQueued,
+		CreatedAt: now,
+		eco:       eco,
+		logger:    loggerFrom(ctx).With("job_id", id, "ecosystem", eco.Name),
+		span:      trace.SpanContextFromContext(ctx),
+		events:    newJobEvents(),
+		req:       req,
+		cacheKey:  cacheKey(eco, req),
+		baseURL:   baseURL,
+		release:   release,
+	}
+	if p, ok := principalFrom(ctx); ok {
+		job.Owner = &p
+	}
+	if req.idempotencyKey != "" {
+		original, err := m.claimIdempotencyKey(ctx, job)
+		if err != nil || original != nil {
+			release()
+			return original, err
+		}
+		defer func() {
+			if err != nil {
+				m.forgetIdempotencyKey(ctx, req.idempotencyKey)
+			}
+		}()
+	}
+
+	// Cached results are returned straight away, so jobs that upload their
+	// archive run in the queue like any other
+	if useCache && req.Options.Output == nil {
+		artifact, ok := m.installer.cache.lookup(m.installer.store, job.cacheKey)
+		if ok {
+			artifact.Close()
+		}
+		// Artifacts the policies block, whether since they were built or
+		// for this caller, are rebuilt, failing the job with the reasons
+		if ok && checkInstallPolicies(ctx, eco, req, artifact.Packages) == nil {
+			release()
+			job.Status = JobSucceeded
+			job.StartedAt = &now
+			job.FinishedAt = &now
+			job.ArtifactDigest = artifact.Digest
+			job.SkippedScripts = artifact.SkippedScripts
+			job.PrunedBytes = artifact.PrunedBytes
+			job.Warnings = artifact.Report.installWarnings()
+			if artifact.Report != nil {
+				job.Provenance = artifact.Report.Provenance
+			}
+			job.Cached = true
+			accounting.add(ctx, UsageCounts{CacheHits: 1})
+			job.events.close(JobSucceeded)
+			if m.queue != nil {
+				events, _, _ := job.events.since(0)
+				err := m.queue.save(ctx, newJobRecord(job))
+				if err == nil {
+					err = m.queue.appendEvents(ctx, id, events, true)
+				}
+				if err != nil {
+					return nil, &statusError{status: http.StatusServiceUnavailable, err: fmt.Errorf("Failed to record job: %v", err)}
+				}
+			} else {
+				m.mu.Lock()
+				m.jobs[id] = job
+				m.mu.Unlock()
+			}
+			auditLog.recordJob(*job, req, m.installer.store)
+			m.finished(withLogger(context.Background(), job.logger), *job, req.Options.CallbackURL)
+			return job, nil
+		}
+	}
+
+	// Cached results are served whatever the registry's state
+	if err := registryBreaker.check(ctx, eco, req, false); err != nil {
+		release()
+		return nil, err
+	}
+	tenantRelease, err := tenants.reserve(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	job.release = func() {
+		release()
+		tenantRelease()
+	}
+	if m.queue != nil {
+		return job, m.push(ctx, job)
+	}
+	if b := m.installer.inflight(job.cacheKey); b != nil && useCache && req.Options.Output == nil {
+		return job, m.coalesce(job, b)
+	}
+	job.slot, err = m.installer.pool.enqueue()
+	if err != nil {
+		job.release()
+		return nil, err
+	}
+	job.ctx, job.cancel = context.WithCancelCause(m.runCtx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		job.slot.release()
+		job.release()
+		return nil, &statusError{status: http.StatusServiceUnavailable, err: errShuttingDown}
+	}
+	job.events.status(PhaseQueued, JobQueued)
+	m.jobs[id] = job
+	job.buildDone = m.installer.building(job.cacheKey, id, job.events)
+	m.active.Add(1)
+	go m.run(job)
+	return job, nil
+}
+
+// coalesce attaches a new job to an identical install queued or running
+// here, which it waits for instead of taking a place in the install pool
+func (m *JobManager) coalesce(job *Job, b *build) error {
+	job.ctx, job.cancel = context.WithCancelCause(m.runCtx)
+	job.CoalescedWith = b.jobID
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		job.release()
+		return &statusError{status: http.StatusServiceUnavailable, err: errShuttingDown}
+	}
+	job.events.status(PhaseQueued, JobQueued)
+	m.jobs[job.ID] = job
+	m.active.Add(1)
+	go m.follow(job, b)
+	return nil
+}
+
+// push adds a new job to the shared queue. The submitter's concurrent
+// install slot and its tenant's can't follow it to another replica, so they
+// are freed straight away; the replica that takes the job reserves the
+// tenant's again while it runs.
+func (m *JobManager) push(ctx context.Context, job *Job) error {
+	job.release()
+	m.mu.Lock()
+	closing := m.closing
+	m.mu.Unlock()
+	if closing {
+		return &statusError{status: http.StatusServiceUnavailable, err: errShuttingDown}
+	}
+	sealed, err := m.queue.sealSecrets(job.req.clientSecrets)
+	if err != nil {
+		return err
+	}
+	job.req.sealedSecrets = sealed
+	job.events.status(PhaseQueued, JobQueued)
+	events, _, _ := job.events.since(0)
+	if err := m.queue.push(ctx, newJobRecord(job), events); err != nil {
+		return &statusError{status: http.StatusServiceUnavailable, err: fmt.Errorf("Failed to queue job: %v", err)}
+	}
+	return nil
+}
+
+// get returns a snapshot of the job with the given ID, reading it from the
+// shared queue unless this replica is running it
+func (m *JobManager) get(ctx context.Context, id string) (Job, bool, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if ok {
+		snapshot := *job
+		m.mu.Unlock()
+		return snapshot, true, nil
+	}
+	m.mu.Unlock()
+	if m.queue == nil {
+		return Job{}, false, nil
+	}
+	rec, ok, err := m.queue.load(ctx, id)
+	if err != nil || !ok {
+		return Job{}, false, err
+	}
+	stored, _ := rec.job()
+	if stored.Status == JobQueued {
+		stored.position = m.queue.position(ctx, id)
+	}
+	return *stored, true, nil
+}
+
+// find returns the job named by the request's id path value, answering 404
+// if there is none
+func (m *JobManager) find(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	job, ok, err := m.get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to read job: %v", err), http.StatusServiceUnavailable)
+		return Job{}, false
+	}
+	if !ok {
+		writeError(w, "Job not found", http.StatusNotFound)
+		return Job{}, false
+	}
+	return job, true
+}
+
+// eventLog returns where a job's events are read from: the job itself while
+// this replica runs it, and otherwise the shared queue
+func (m *JobManager) eventLog(job Job) eventLog {
+	if job.events != nil {
+		return job.events
+	}
+	return redisEvents{q: m.queue, id: job.ID}
+}
+
+// count returns how many known jobs are in the given state
+func (m *JobManager) count(status JobStatus) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, job := range m.jobs {
+		if job.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// run waits for the job's install slot, executes it and records its outcome
+func (m *JobManager) run(job *Job) {
+	defer m.active.Done()
+	defer job.cancel(nil)
+	ctx := withLogger(trace.ContextWithSpanContext(job.ctx, job.span), job.logger)
+	if job.Owner != nil {
+		ctx = withPrincipal(ctx, *job.Owner)
+	}
+	// Queued jobs stop waiting when shutdown starts or they are cancelled
+	waitCtx, stopWaiting := context.WithCancel(m.queueCtx)
+	stop := context.AfterFunc(job.ctx, stopWaiting)
+	err := job.slot.wait(waitCtx)
+	stop()
+	stopWaiting()
+	if cancelled := jobCancellation(job.ctx); cancelled != nil {
+		m.complete(ctx, job, "", nil, cancelled)
+		return
+	}
+	if err != nil {
+		m.complete(ctx, job, "", nil, errShuttingDown)
+		return
+	}
+	m.mu.Lock()
+	job.Status = JobRunning
+	job.StartedAt = timePtr(time.Now().UTC())
+	rec := newJobRecord(job)
+	m.mu.Unlock()
+	if m.queue != nil {
+		if err := m.queue.save(context.Background(), rec); err != nil {
+			job.logger.Error("failed to record job status", "error", err)
+		}
+	}
+	job.events.status(PhaseInstalling, JobRunning)
+
+	ctx, span := tracer.Start(ctx, "job", trace.WithAttributes(ecosystemAttr(job.eco), attribute.String("pip_install.job_id", job.ID)))
+	digest, skipped, err := m.build(ctx, job)
+	if cancelled := jobCancellation(job.ctx); err != nil && cancelled != nil {
+		err = cancelled
+	}
+	endSpan(span, err)
+	// Another replica can finish what the drain timeout interrupted
+	if err != nil && m.queue != nil && m.runCtx.Err() != nil && jobCancellation(job.ctx) == nil {
+		m.requeue(job)
+		return
+	}
+	m.complete(ctx, job, digest, skipped, err)
+}
+
+// work runs jobs from the shared queue whenever this replica has a free
+// install slot, until shutdown starts
+func (m *JobManager) work() {
+	defer m.active.Done()
+	for m.queueCtx.Err() == nil {
+		slot, err := m.installer.pool.enqueue()
+		if err != nil {
+			// Other replicas can take the job while this one is full
+			time.Sleep(time.Second)
+			continue
+		}
+		if slot.wait(m.queueCtx) != nil {
+			return
+		}
+		id, err := m.queue.claim(m.queueCtx)
+		if err != nil || id == "" {
+			slot.release()
+			if err != nil && m.queueCtx.Err() == nil {
+				slog.Error("failed to take a job from the queue", "error", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		job, err := m.claimed(id, slot)
+		if err != nil {
+			slot.release()
+			slog.Error("failed to load queued job", "job_id", id, "error", err)
+			m.queue.done(context.Background(), id)
+			continue
+		}
+		// The job counts against its tenant while it runs here, and a
+		// tenant with as many going as it may waits its turn
+		ctx := context.Background()
+		if job.Owner != nil {
+			ctx = withPrincipal(ctx, *job.Owner)
+		}
+		release, err := tenants.reserve(ctx)
+		switch {
+		case errorStatus(err) == http.StatusTooManyRequests:
+			m.putBack(job)
+			time.Sleep(time.Second)
+		case err != nil:
+			m.complete(withLogger(ctx, job.logger), job, "", nil, err)
+		default:
+			job.release = release
+			m.active.Add(1)
+			m.run(job)
+		}
+	}
+}
+
+// putBack returns a job this replica claimed to the shared queue, for it or
+// another replica to start later
+func (m *JobManager) putBack(job *Job) {
+	job.stopEvents()
+	m.mu.Lock()
+	delete(m.jobs, job.ID)
+	m.mu.Unlock()
+	job.slot.release()
+	if err := m.queue.putBack(context.Background(), job.ID); err != nil {
+		job.logger.Error("failed to put job back on the queue", "error", err)
+	}
+}
+
+// claimed loads a job this replica has taken from the shared queue, holding
+// slot, and starts copying its events back
+func (m *JobManager) claimed(id string, slot *ticket) (*Job, error) {
+	ctx := context.Background()
+	rec, ok, err := m.queue.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || rec.Request == nil {
+		return nil, errors.New("job has expired or already finished")
+	}
+	job, req := rec.job()
+	if job.eco == nil {
+		return nil, fmt.Errorf("unknown ecosystem %q", rec.Ecosystem)
+	}
+	if req.clientSecrets, err = m.queue.openSecrets(rec.Request.Secrets); err != nil {
+		return nil, err
+	}
+	maps.Copy(req.Files, req.clientSecrets)
+	if err := addServerFiles(job.eco, req.Files); err != nil {
+		return nil, err
+	}
+	past, err := m.queue.loadEvents(ctx, id, 0)
+	if err != nil {
+		return nil, err
+	}
+	job.req = req
+	job.slot = slot
+	job.release = func() {}
+	job.ctx, job.cancel = context.WithCancelCause(m.runCtx)
+	if by, ok := m.queue.cancelRequested(ctx, id); ok {
+		job.cancel(cancelledBy(by))
+	}
+	job.events = restoreJobEvents(past)
+	stop := make(chan struct{})
+	forwarded := m.queue.forward(job, len(past), stop)
+	job.stopEvents = func() {
+		close(stop)
+		<-forwarded
+	}
+	m.mu.Lock()
+	m.jobs[id] = job
+	m.mu.Unlock()
+	job.logger.Info("job taken from queue", "worker", m.queue.worker)
+	return job, nil
+}
+
+// requeue hands a job this replica couldn't finish back to the shared queue
+func (m *JobManager) requeue(job *Job) {
+	job.stopEvents()
+	if err := m.queue.requeue(context.Background(), job.ID, "worker "+m.queue.worker+" shut down"); err != nil {
+		job.logger.Error("failed to requeue job", "error", err)
+	}
+	m.mu.Lock()
+	delete(m.jobs, job.ID)
+	m.mu.Unlock()
+	job.slot.release()
+	job.release()
+}
+
+// complete records a job's outcome, frees its slots and sends its webhook
+func (m *JobManager) complete(ctx context.Context, job *Job, digest string, skipped []string, err error) {
+	m.mu.Lock()
+	job.FinishedAt = timePtr(time.Now().UTC())
+	callbackURL := job.req.Options.CallbackURL
+	req := job.req
+	job.req = nil
+	job.workDir, job.notes = "", nil
+	if err != nil {
+		job.failed(err)
+		job.logger.Error("job failed", "error", err)
+	} else {
+		job.Status = JobSucceeded
+		job.ArtifactDigest = digest
+		job.SkippedScripts = skipped
+		job.logger.Info("job succeeded", "digest", digest)
+	}
+	snapshot := *job
+	rec := newJobRecord(job)
+	m.mu.Unlock()
+
+	if m.queue != nil {
+		if err := m.queue.save(context.Background(), rec); err != nil {
+			job.logger.Error("failed to record job status", "error", err)
+		}
+		if err := m.queue.done(context.Background(), job.ID); err != nil {
+			job.logger.Error("failed to remove job from processing list", "error", err)
+		}
+	}
+	if job.slot != nil {
+		job.slot.release()
+	}
+	job.release()
+	job.events.close(snapshot.Status)
+	if job.buildDone != nil {
+		job.buildDone()
+	}
+	if job.stopEvents != nil {
+		job.stopEvents()
+		m.mu.Lock()
+		delete(m.jobs, job.ID)
+		m.mu.Unlock()
+	}
+	auditLog.recordJob(snapshot, req, m.installer.store)
+	m.finished(ctx, snapshot, callbackURL)
+}
+
+// failed records the error a job failed with, with the details of the
+// failures that have them
+func (job *Job) failed(err error) {
+	job.Status = JobFailed
+	job.Error = err.Error()
+	job.errorStatus = errorStatus(err)
+	job.errorDetails = errorBody(err, job.errorStatus)
+	job.ErrorCode = errorCode(err, job.errorStatus)
+	var te *toolError
+	if errors.As(err, &te) && te.exitCode >= 0 {
+		job.ExitCode = &te.exitCode
+	}
+	var gateErr *auditGateError
+	if errors.As(err, &gateErr) {
+		job.Advisories = gateErr.advisories
+	}
+	var licenseErr *licenseError
+	if errors.As(err, &licenseErr) {
+		job.DeniedPackages = licenseErr.packages
+	}
+	var policyErr *packagePolicyError
+	if errors.As(err, &policyErr) {
+		job.PolicyViolations = policyErr.violations
+	}
+	var engineErr *engineError
+	if errors.As(err, &engineErr) {
+		job.IncompatibleEngines = engineErr.mismatches
+	}
+	var overrideErr *overrideError
+	if errors.As(err, &overrideErr) {
+		job.UnsatisfiableOverrides = overrideErr.overrides
+	}
+	var denyErr *opaDenyError
+	if errors.As(err, &denyErr) {
+		job.PolicyReasons = denyErr.reasons
+	}
+}
+
+// shutdown stops accepting jobs, fails those still queued and waits for
+// running ones to finish. If ctx expires first they are killed.
+func (m *JobManager) shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+	m.stopQueue()
+
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.stopRuns()
+		<-done
+		err = ctx.Err()
+	}
+	if m.stopBeat != nil {
+		m.stopBeat()
+		if err := m.queue.leave(context.Background()); err != nil {
+			slog.Warn("failed to leave the shared queue", "error", err)
+		}
+	}
+	return err
+}
+
+// finished delivers the webhook for a job that has reached a final state.
+// Delivery outlives the request or job that ctx belongs to, keeping its
+// logger, but is abandoned once the drain timeout kills running jobs.
+func (m *JobManager) finished(ctx context.Context, job Job, callbackURL string) {
+	if callbackURL == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(m.runCtx, cancel)
+	payload := newWebhookPayload(job)
+	go func() {
+		defer cancel()
+		defer stop()
+		m.notifier.notify(ctx, callbackURL, payload)
+	}()
+}
+
+// newWebhookPayload summarises a finished job for its callback
+func newWebhookPayload(job Job) webhookPayload {
+	payload := webhookPayload{
+		JobID:     job.ID,
+		Ecosystem: job.Ecosystem,
+		Status:    job.Status,
+		Error:     job.Error,
+		Warnings:  job.Warnings,
+	}
+	// Jobs failed during shutdown may never have started
+	if job.StartedAt != nil {
+		payload.DurationSeconds = job.FinishedAt.Sub(*job.StartedAt).Seconds()
+	}
+	if job.Status == JobSucceeded {
+		payload.ArtifactURL = job.baseURL + artifactURL(job.ArtifactDigest)
+		payload.ArtifactDigest = job.ArtifactDigest
+		payload.Output = job.Output
+	}
+	return payload
+}
+
+// build installs the job's files, stores the archive and returns its digest
+// and the packages whose scripts were skipped
+func (m *JobManager) build(ctx context.Context, job *Job) (string, []string, error) {
+	if err := installExecutor.checkToolchain(job.eco); err != nil {
+		return "", nil, err
+	}
+	ctx = withNotes(ctx)
+	defer func() {
+		notes := notesFrom(ctx)
+		warnings, retries, provenance := notes.installWarnings(), notes.retryCount(), notes.provenanceReport()
+		m.mu.Lock()
+		job.Warnings, job.Retries, job.Provenance = warnings, retries, provenance
+		m.mu.Unlock()
+	}()
+	tmpDir, err := prepareWorkspace(ctx, job.eco, job.req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer removeWorkspace(tmpDir)
+	m.mu.Lock()
+	job.workDir, job.notes = tmpDir, notesFrom(ctx)
+	m.mu.Unlock()
+
+	var outputDir string
+	var meta ArtifactMeta
+	if len(job.req.Options.Targets) > 0 {
+		if outputDir, meta, err = installTargets(ctx, m.installer.pool, job.eco, job.req, tmpDir, job.cacheKey, job.events.line); err != nil {
+			return "", nil, err
+		}
+	} else {
+		if outputDir, err = runInstall(ctx, job.eco, job.req, tmpDir, job.events.line); err != nil {
+			return "", nil, err
+		}
+		if job.req.Options.failOn() != "" || job.req.Options.VerifyProvenance != "" {
+			job.events.status(PhaseAuditing, JobRunning)
+			if err := gateInstall(ctx, job.eco, job.req, tmpDir, outputDir); err != nil {
+				return "", nil, err
+			}
+		}
+		if meta, err = artifactMeta(ctx, job.eco, job.req, outputDir, job.cacheKey); err != nil {
+			return "", nil, err
+		}
+	}
+	m.mu.Lock()
+	job.PrunedBytes = meta.PrunedBytes
+	m.mu.Unlock()
+	job.events.status(PhaseArchiving, JobRunning)
+	digest, err := m.installer.archive(ctx, job.eco, job.req, tmpDir, outputDir, job.cacheKey, meta, nil)
+	if err != nil || job.req.Options.Output == nil {
+		return digest, meta.SkippedScripts, err
+	}
+	job.events.status(PhaseUploading, JobRunning)
+	uploaded, err := uploadArtifact(ctx, m.installer.store, digest, job.cacheKey, job.req.Options.Output)
+	if err != nil {
+		return "", nil, err
+	}
+	m.mu.Lock()
+	job.Output = uploaded
+	m.mu.Unlock()
+	return digest, meta.SkippedScripts, nil
+}
+
+// janitor periodically drops finished jobs older than the retention period
+func (m *JobManager) janitor() {
+	for range time.Tick(time.Minute) {
+		cutoff := time.Now().Add(-m.retention)
+		m.mu.Lock()
+		for id, job := range m.jobs {
+			if job.FinishedAt == nil || job.FinishedAt.After(cutoff) {
+				continue
+			}
+			delete(m.jobs, id)
+		}
+		m.expireIdempotencyKeys()
+		m.mu.Unlock()
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+// errShuttingDown fails jobs that can't run because the server is stopping
+var errShuttingDown = errors.New("server is shutting down")
+
+// newJobID returns a random 128-bit hex identifier
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jobResponse is the JSON representation of a job returned to clients
+type jobResponse struct {
+	Job
+	// QueuePosition is the job's 1-based place in the install queue while it waits
+	QueuePosition int    `json:"queue_position,omitempty"`
+	ArtifactURL   string `json:"artifact_url,omitempty"`
+}
+
+func newJobResponse(job Job) jobResponse {
+	resp := jobResponse{Job: job}
+	if job.Status == JobQueued {
+		resp.QueuePosition = job.position
+		if job.slot != nil {
+			resp.QueuePosition = job.slot.position()
+		}
+	}
+	if job.Status == JobSucceeded {
+		resp.ArtifactURL = artifactURL(job.ArtifactDigest)
+	}
+	return resp
+}
+
+// handleSubmit serves POST /jobs?ecosystem=<name>. The body is the same as for
+// /install/<name>; the ecosystem defaults to pip.
+func (m *JobManager) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("ecosystem")
+	if name == "" {
+		name = pipEcosystem.Name
+	}
+	eco := findEcosystem(name)
+	if eco == nil {
+		writeError(w, fmt.Sprintf("Unknown ecosystem %q", name), http.StatusBadRequest)
+		return
+	}
+
+	req, err := decodeRequest(r, eco)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	if req.Options.AuditFix {
+		writeError(w, "audit_fix is only supported by /audit/"+eco.Name, http.StatusBadRequest)
+		return
+	}
+	if req.Options.Bundle != nil {
+		writeError(w, "bundle is only supported by /bundle", http.StatusBadRequest)
+		return
+	}
+	if req.Options.DryRun {
+		writeError(w, "dry_run is only supported by /install/"+eco.Name, http.StatusBadRequest)
+		return
+	}
+	if req.Options.CallbackURL != "" {
+		if err := validateCallbackURL(req.Options.CallbackURL); err != nil {
+			writeInstallError(w, err)
+			return
+		}
+	}
+
+	if req.idempotencyKey, err = idempotencyKeyOf(r.Context(), r.Header.Get("Idempotency-Key")); err != nil {
+		writeInstallError(w, err)
+		return
+	}
+
+	release, err := limits.acquire(w, r)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	job, err := m.submit(r.Context(), eco, req, requestBaseURL(r), !cacheBypassed(r), release)
+	if err != nil {
+		poolError(w, err)
+		return
+	}
+	if job.replayed {
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeJSON(w, http.StatusAccepted, newJobResponse(*job))
+		return
+	}
+	snapshot, _, err := m.get(r.Context(), job.ID)
+	if err != nil {
+		snapshot = *job
+	}
+	if snapshot.Cached {
+		job.logger.Info("job served from cache", "digest", snapshot.ArtifactDigest)
+	} else {
+		job.logger.Info("job queued")
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, newJobResponse(snapshot))
+}
+
+// handleStatus serves GET /jobs/{id}
+func (m *JobManager) handleStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newJobResponse(job))
+}
+
+// handleCancel serves DELETE /jobs/{id}, cancelling a queued or running job
+// for its submitter or an admin. It answers 200 once the job has stopped, or
+// 202 if it is still stopping.
+func (m *JobManager) handleCancel(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	by, err := cancellerOf(r.Context(), job)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	m.writeCancelled(w, r, by)
+}
+
+// cancellerOf names the caller in ctx for the error a job they cancel fails
+// with, failing with 403 unless they submitted it or are an admin. Jobs
+// submitted without auth may be cancelled by anyone.
+func cancellerOf(ctx context.Context, job Job) (string, error) {
+	p, ok := principalFrom(ctx)
+	if !ok || job.Owner == nil || usageCaller(*job.Owner) == usageCaller(p) {
+		return "its submitter", nil
+	}
+	if isAdmin(p) {
+		return "an administrator (" + usageCaller(p) + ")", nil
+	}
+	return "", &statusError{status: http.StatusForbidden, err: errors.New("Only the job's submitter can cancel it")}
+}
+
+// handleArtifact serves GET /jobs/{id}/artifact once the job has succeeded
+func (m *JobManager) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != JobSucceeded {
+		writeError(w, fmt.Sprintf("Artifact not available: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	serveArtifact(w, r, m.installer.store, job.ArtifactDigest)
+}
+
+// handleSignature serves GET /jobs/{id}/artifact.sig once the job has succeeded
+func (m *JobManager) handleSignature(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != JobSucceeded {
+		writeError(w, fmt.Sprintf("Signature not available: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	writeSignature(w, r, job.ArtifactDigest)
+}
+
+// handleSBOM serves GET /jobs/{id}/sbom once the job has succeeded
+func (m *JobManager) handleSBOM(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != JobSucceeded {
+		writeError(w, fmt.Sprintf("SBOM not available: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	writeSBOM(w, r, m.installer.store, job.eco, job.ArtifactDigest)
+}
+
+// handleLicenses serves GET /jobs/{id}/licenses once the job has succeeded
+func (m *JobManager) handleLicenses(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != JobSucceeded {
+		writeError(w, fmt.Sprintf("License report not available: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	serveLicenseReport(w, r, m.installer.store, job.ArtifactDigest)
+}
+
+// handleReport serves GET /jobs/{id}/report once the job has succeeded
+func (m *JobManager) handleReport(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != JobSucceeded {
+		writeError(w, fmt.Sprintf("Install report not available: job is %s", job.Status), http.StatusConflict)
+		return
+	}
+	serveInstallReport(w, r, m.installer.store, job.ArtifactDigest)
+}
+
+// requestBaseURL returns the scheme and host the client used to reach the server
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode JSON response", "error", err)
+	}
+}
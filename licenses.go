@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// licenseDenylist fails installs containing packages under these licenses,
+// set from the license_denylist setting. Entries are SPDX identifiers,
+// matched case-insensitively; a trailing * matches any suffix, as in
+// "AGPL-*", and UNKNOWN matches packages that declare no license.
+var licenseDenylist []string
+
+// licenseReportFile is where the license report is written in the archive
+const licenseReportFile = "licenses.json"
+
+// deniedLicenses returns the request's effective denylist: the server's
+// entries plus any the request adds
+func (o InstallOptions) deniedLicenses() []string {
+	denied := append(slices.Clone(licenseDenylist), o.DenyLicenses...)
+	for i, d := range denied {
+		denied[i] = strings.ToLower(d)
+	}
+	slices.Sort(denied)
+	return slices.Compact(denied)
+}
+
+// licenseDenied reports whether a package's declared license is denied.
+// Each alternative of an OR expression must contain a denied identifier for
+// the package to be, since the license can otherwise be chosen.
+func licenseDenied(license string, denied []string) bool {
+	if strings.TrimSpace(license) == "" {
+		return slices.Contains(denied, "unknown")
+	}
+	expr := strings.NewReplacer("(", " ", ")", " ").Replace(license)
+	for _, alt := range strings.Split(expr, " OR ") {
+		if !alternativeDenied(alt, denied) {
+			return false
+		}
+	}
+	return true
+}
+
+// alternativeDenied reports whether any identifier in an AND or WITH
+// expression is denied
+func alternativeDenied(alt string, denied []string) bool {
+	for _, id := range strings.Fields(alt) {
+		if id == "AND" || id == "WITH" {
+			continue
+		}
+		id = strings.ToLower(id)
+		for _, d := range denied {
+			if prefix, ok := strings.CutSuffix(d, "*"); ok && strings.HasPrefix(id, prefix) || id == d {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A licenseError fails an install with packages under denied licenses
+type licenseError struct {
+	denied   []string
+	packages []Package
+}
+
+func (e *licenseError) Error() string {
+	return fmt.Sprintf("Install has %d packages under denied licenses", len(e.packages))
+}
+
+func (e *licenseError) code() string { return "LICENSE_DENIED" }
+
+func (e *licenseError) details() map[string]any {
+	return map[string]any{"denied_licenses": e.denied, "packages": e.packages}
+}
+
+// checkLicenses fails an install with packages whose licenses the request's
+// denylist matches
+func checkLicenses(req *InstallRequest, pkgs []Package) error {
+	denied := req.Options.deniedLicenses()
+	if len(denied) == 0 {
+		return nil
+	}
+	var failing []Package
+	for _, pkg := range pkgs {
+		if licenseDenied(pkg.License, denied) {
+			failing = append(failing, pkg)
+		}
+	}
+	if len(failing) > 0 {
+		return &licenseError{denied: denied, packages: failing}
+	}
+	return nil
+}
+
+// A LicenseReport lists the license of every installed package
+type LicenseReport struct {
+	Packages []Package `json:"packages"`
+	// Counts is the number of packages under each license, with packages
+	// that declare none counted as UNKNOWN
+	Counts map[string]int `json:"counts"`
+}
+
+func newLicenseReport(pkgs []Package) LicenseReport {
+	report := LicenseReport{Packages: pkgs, Counts: make(map[string]int)}
+	if report.Packages == nil {
+		report.Packages = []Package{}
+	}
+	for _, pkg := range pkgs {
+		license := pkg.License
+		if license == "" {
+			license = "UNKNOWN"
+		}
+		report.Counts[license]++
+	}
+	return report
+}
+
+// writeLicenseReport adds the license report to the archived directory
+func writeLicenseReport(outputDir string, pkgs []Package) error {
+	b, err := json.MarshalIndent(newLicenseReport(pkgs), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, licenseReportFile), b, 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", licenseReportFile, err)
+	}
+	return nil
+}
+
+// serveLicenseReport responds with the license report for a stored artifact
+func serveLicenseReport(w http.ResponseWriter, r *http.Request, store ArtifactStore, digest string) {
+	artifact, ok := openArtifactMeta(w, r, store, digest)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newLicenseReport(artifact.Packages))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// npmEcosystem runs npm for the endpoints that report on a package.json
+// rather than archive its install: POST /lock, /tree and /outdated. It has no
+// /install route of its own.
+var npmEcosystem = &Ecosystem{
+	Name:     "npm",
+	Tool:     "npm",
+	Runtime:  "node",
+	Registry: "https://registry.npmjs.org/",
+	Image:    "node:20.18.0-bookworm-slim",
+	Files: []ManifestFile{
+		{Name: "package.json", Required: true},
+		// An existing lock is kept where package.json still allows it
+		{Name: "package-lock.json"},
+		{Name: ".npmrc", Secret: true},
+	},
+	// Args only resolve the lock file. Nothing is installed, so no package
+	// gets to run its scripts.
+	Args: func(files map[string]string) []string {
+		return []string{"install", "--package-lock-only", "--ignore-scripts", "--no-audit", "--no-fund"}
+	},
+	RegistryArgs: func(registry string) []string {
+		return []string{"--registry=" + registry}
+	},
+	FileRegistries: npmRegistries,
+	PeerDepsArgs: map[string][]string{
+		"strict": {"--strict-peer-deps"},
+		"legacy": {"--legacy-peer-deps"},
+	},
+	Engines:  &EngineCheck{Args: []string{"--engine-strict"}, Mismatches: npmEngineMismatches},
+	CacheEnv: func(dir string) []string { return []string{"npm_config_cache=" + dir} },
+}
+
+// handleLock serves POST /lock: npm resolves the submitted package.json and
+// the generated package-lock.json is returned without installing anything
+func (in *Installer) handleLock(w http.ResponseWriter, r *http.Request) {
+	lock, ok := in.generateLock(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(lock)
+}
+
+// generateLock runs npm over the request's package.json and returns the
+// package-lock.json it writes. If the request can't be resolved it writes
+// the error response and returns false.
+func (in *Installer) generateLock(w http.ResponseWriter, r *http.Request) (lock []byte, ok bool) {
+	ok = in.runNpm(w, r, func(ctx context.Context, req *InstallRequest, workDir string) error {
+		if err := runNpmStep(ctx, req, workDir, "lock", npmEcosystem.Args(req.Files), nil); err != nil {
+			return err
+		}
+		var err error
+		if lock, err = os.ReadFile(filepath.Join(workDir, "package-lock.json")); err != nil {
+			return fmt.Errorf("npm did not write package-lock.json: %v", err)
+		}
+		loggerFrom(ctx).Info("generated lock file", "bytes", len(lock))
+		return nil
+	})
+	return lock, ok
+}
+
+// runNpm decodes a request for npmEcosystem and calls fn in a workspace
+// holding its files once the request has an install slot. It returns whether
+// fn succeeded, having written the error response if not.
+func (in *Installer) runNpm(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, req *InstallRequest, workDir string) error) bool {
+	eco := npmEcosystem
+	req, err := decodeRequest(r, eco)
+	if err != nil {
+		writeInstallError(w, err)
+		return false
+	}
+	if req.Options.CallbackURL != "" {
+		writeError(w, "callback_url is only supported for asynchronous jobs", http.StatusBadRequest)
+		return false
+	}
+	logger := loggerFrom(r.Context()).With("ecosystem", eco.Name)
+	ctx := withLogger(r.Context(), logger)
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		writeInstallError(w, err)
+		return false
+	}
+	done, ok := in.admit(ctx, w, r)
+	if !ok {
+		return false
+	}
+	defer done()
+
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		writeInstallError(w, err)
+		return false
+	}
+	defer removeWorkspace(tmpDir)
+	if err := fn(ctx, req, tmpDir); err != nil {
+		writeInstallError(w, err)
+		return false
+	}
+	return true
+}
+
+// runNpmStep runs npm in workDir with the request's registry and extra flags
+func runNpmStep(ctx context.Context, req *InstallRequest, workDir, step string, args []string, stdout io.Writer) error {
+	eco := npmEcosystem
+	args = append(args, registryArgs(eco, req)...)
+	if req.Options.EngineStrict {
+		args = append(args, eco.Engines.Args...)
+	}
+	args = append(args, req.Options.NpmArgs...)
+	_, err := runPeerDeps(ctx, eco, req, toolRun{step: step, tool: eco.Tool, args: args, stdout: stdout}, func(run toolRun) error {
+		return runTool(ctx, eco, req, workDir, run)
+	})
+	if err != nil {
+		return checkEngines(eco, err)
+	}
+	return nil
+}
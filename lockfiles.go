@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// splitNpmSpec splits a package spec such as "@scope/name@^1.0.0" into its
+// name and version or range
+func splitNpmSpec(spec string) (name, version string) {
+	if i := strings.LastIndex(spec, "@"); i > 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// pnpmLockedPackages lists the packages a pnpm-lock.yaml pins. Lock file
+// versions 5 to 9 key packages as "/name/1.0.0", "/name@1.0.0" or
+// "name@1.0.0", with peer dependencies appended in parentheses or after "_".
+func pnpmLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["pnpm-lock.yaml"]
+	if lock == "" {
+		return nil, nil
+	}
+	var doc struct {
+		Packages map[string]yaml.Node `yaml:"packages"`
+	}
+	if err := yaml.Unmarshal([]byte(lock), &doc); err != nil {
+		return nil, err
+	}
+	pkgs := make([]Package, 0, len(doc.Packages))
+	for key := range doc.Packages {
+		key, _, _ = strings.Cut(strings.TrimPrefix(key, "/"), "(")
+		name, version := splitNpmSpec(key)
+		if version == "" {
+			if i := strings.LastIndex(key, "/"); i > 0 {
+				name, version = key[:i], key[i+1:]
+				version, _, _ = strings.Cut(version, "_")
+			}
+		}
+		pkgs = append(pkgs, Package{Name: name, Version: version})
+	}
+	return pkgs, nil
+}
+
+// yarnLockedPackages lists the packages a yarn.lock pins. Entries start with
+// an unindented line of comma-separated specs ending in ":", followed by an
+// indented version field: `version "1.0.0"` in yarn 1 and `version: 1.0.0`
+// in later releases.
+func yarnLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["yarn.lock"]
+	if lock == "" {
+		return nil, nil
+	}
+	var pkgs []Package
+	var name string
+	sc := bufio.NewScanner(strings.NewReader(lock))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			spec, _, _ := strings.Cut(strings.TrimSuffix(line, ":"), ",")
+			name, _ = splitNpmSpec(strings.Trim(spec, `"`))
+			continue
+		}
+		field := strings.TrimSpace(line)
+		if v, ok := strings.CutPrefix(field, "version"); ok && name != "" && name != "__metadata" {
+			v = strings.Trim(strings.TrimSpace(strings.TrimPrefix(v, ":")), `"`)
+			pkgs = append(pkgs, Package{Name: name, Version: v})
+			name = ""
+		}
+	}
+	return pkgs, sc.Err()
+}
+
+// bunLockedPackages lists the packages a bun.lock pins. Its packages map
+// keys by install path, to an array whose first element is the package as
+// "name@1.0.0". Workspaces, and packages from git or the file system, have
+// a protocol such as "workspace:" in place of the version. The binary
+// bun.lockb can't be read.
+func bunLockedPackages(files map[string]string) ([]Package, error) {
+	lock := files["bun.lock"]
+	if lock == "" {
+		return nil, nil
+	}
+	var doc struct {
+		Packages map[string][]json.RawMessage `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(stripTrailingCommas(lock)), &doc); err != nil {
+		return nil, err
+	}
+	var pkgs []Package
+	for _, entry := range doc.Packages {
+		var spec string
+		if len(entry) == 0 || json.Unmarshal(entry[0], &spec) != nil {
+			continue
+		}
+		name, version := splitNpmSpec(spec)
+		if version == "" || strings.Contains(version, ":") {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: name, Version: version})
+	}
+	return pkgs, nil
+}
+
+// stripTrailingCommas removes the commas before closing brackets that
+// bun.lock has and JSON doesn't allow
+func stripTrailingCommas(s string) string {
+	var b strings.Builder
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case inString:
+			inString = escaped || c != '"'
+			escaped = !escaped && c == '\\'
+		case c == '"':
+			inString = true
+		case c == ',':
+			if next := strings.TrimLeft(s[i+1:], " \t\r\n"); next != "" && (next[0] == '}' || next[0] == ']') {
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// pipLockedPackages lists the requirements and constraints pip installs.
+// Only requirements pinned with == have a version.
+func pipLockedPackages(files map[string]string) ([]Package, error) {
+	var pkgs []Package
+	for _, name := range []string{"requirements.txt", "constraints.txt"} {
+		for _, line := range strings.Split(files[name], "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			line, _, _ = strings.Cut(line, ";")
+			line = strings.TrimSpace(line)
+			// Options such as -r and --index-url, and URLs, aren't packages
+			if line == "" || strings.HasPrefix(line, "-") || strings.Contains(line, "://") {
+				continue
+			}
+			line, _, _ = strings.Cut(line, " --")
+			line = strings.ReplaceAll(strings.TrimSuffix(line, "\\"), " ", "")
+			var version string
+			if n, v, ok := strings.Cut(line, "=="); ok {
+				line, version = n, v
+			}
+			if i := strings.IndexAny(line, "[<>=!~"); i >= 0 {
+				line = line[:i]
+			}
+			pkgs = append(pkgs, Package{Name: line, Version: version})
+		}
+	}
+	return pkgs, nil
+}
+
+// poetryLockedPackages lists the packages a poetry.lock pins, reading the
+// name and version of each [[package]] table
+func poetryLockedPackages(files map[string]string) ([]Package, error) {
+	var pkgs []Package
+	var inPackage bool
+	var pkg Package
+	flush := func() {
+		if pkg.Name != "" {
+			pkgs = append(pkgs, pkg)
+		}
+		pkg = Package{}
+	}
+	for _, line := range strings.Split(files["poetry.lock"], "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if inPackage {
+				flush()
+			}
+			inPackage = line == "[[package]]"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inPackage || !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			pkg.Name = value
+		case "version":
+			pkg.Version = value
+		}
+	}
+	if inPackage {
+		flush()
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries the request ID to and from clients
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits which client supplied request IDs are reused
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type loggerKey struct{}
+
+type requestAttrsKey struct{}
+
+// requestAttrs collects attributes added by inner handlers for the
+// "request completed" log line
+type requestAttrs struct {
+	mu    sync.Mutex
+	attrs []any
+}
+
+// annotateRequest adds key/value pairs to the "request completed" log line of
+// the request ctx belongs to
+func annotateRequest(ctx context.Context, args ...any) {
+	if ra, ok := ctx.Value(requestAttrsKey{}).(*requestAttrs); ok {
+		ra.mu.Lock()
+		ra.attrs = append(ra.attrs, args...)
+		ra.mu.Unlock()
+	}
+}
+
+// withLogger returns a context carrying logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger stored in ctx, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// withRequestLogging assigns every request an ID, echoes it in the
+// X-Request-ID response header and attaches a logger carrying it and the
+// client IP to the request context. A valid X-Request-ID sent by the client
+// is reused so IDs can be correlated across services.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("request_id", id, "client_ip", clientIP(r))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		ra := &requestAttrs{}
+		ctx := context.WithValue(withLogger(r.Context(), logger), requestAttrsKey{}, ra)
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		logger.Info("request completed", append([]any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}, ra.attrs...)...)
+	})
+}
+
+// newRequestID returns a random 64-bit hex identifier
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For is believed, set
+// from the trusted_proxies setting
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads trusted_proxies entries, each an address or a
+// CIDR range
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the originating client address: the peer's, unless it
+// is one of trustedProxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return forwardedClientIP(host, r.Header.Values("X-Forwarded-For"))
+}
+
+// forwardedClientIP returns the client a request from peer was made for.
+// Clients can send any X-Forwarded-For, so it is only read when peer is a
+// trusted proxy, and then from the right: the first hop that isn't one of
+// trustedProxies is the client.
+func forwardedClientIP(peer string, forwarded []string) string {
+	if !trustedProxy(peer) {
+		return peer
+	}
+	var hops []string
+	for _, value := range forwarded {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		peer = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return peer
+}
+
+// trustedProxy reports whether ip is in trustedProxies
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder remembers the status code and counts the bytes written
+// through it. It passes Flush and Hijack through so event streams and
+// WebSockets keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		trusted   bool
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "no proxies", remote: "203.0.113.5:4000", want: "203.0.113.5"},
+		{name: "no proxies ignores the header", remote: "203.0.113.5:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "untrusted peer", trusted: true, remote: "203.0.113.5:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "trusted peer", trusted: true, remote: "10.1.2.3:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed first hop", trusted: true, remote: "10.1.2.3:4000", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy chain", trusted: true, remote: "10.1.2.3:4000", forwarded: []string{"1.2.3.4, 198.51.100.1, 192.0.2.1"}, want: "198.51.100.1"},
+		{name: "several headers", trusted: true, remote: "10.1.2.3:4000", forwarded: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only proxies", trusted: true, remote: "10.1.2.3:4000", forwarded: []string{"10.9.9.9"}, want: "10.9.9.9"},
+		{name: "trusted peer without header", trusted: true, remote: "10.1.2.3:4000", want: "10.1.2.3"},
+		{name: "mapped IPv4 peer", trusted: true, remote: "[::ffff:10.1.2.3]:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+	}
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = nil
+			if tt.trusted {
+				trustedProxies = proxies
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entry := range []string{"proxy.internal", "10.0.0.0/33", "10.0.0.1:80"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want an error", entry)
+		}
+	}
+}
@@ -1,189 +1,420 @@
-// Accepts requirements.txt and optional constraints.txt
-// Runs pip install and zips the resulting site-packages directory
+// Accepts dependency manifests for a supported ecosystem
+// Runs the package manager and zips the resulting installed packages
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"syscall"
+	"time"
 )
 
 const workDirPrefix = "pip_work_"
 
-// Accept requirements.txt and optional constraints.txt
-// constraints.txt is optional and used for reproducible installs
-// The output is a zip of the installed site-packages
+// defaultShutdownTimeout is how long running installs get to finish after
+// SIGTERM before they are killed
+const defaultShutdownTimeout = 30 * time.Second
 
-type PythonFiles struct {
-	RequirementsTXT string `json:"requirements.txt"`
-	ConstraintsTXT  string `json:"constraints.txt,omitempty"`
+// auth guards the routes registered with handle. It is loaded in main
+// before any routes are registered.
+var auth = &authenticator{}
+
+// limits holds the per-client rate and concurrency limits, set in main
+var limits = newClientLimits(0, 0, 0)
+
+// handle registers h on the default mux inside a span named after pattern,
+// requiring an API key when any are configured
+func handle(pattern string, h http.HandlerFunc) {
+	http.Handle(pattern, traced(pattern, auth.require(metered(h))))
+}
+
+// handlePublic registers h like handle but without authentication
+func handlePublic(pattern string, h http.HandlerFunc) {
+	http.Handle(pattern, traced(pattern, h))
 }
 
 func main() {
-	http.HandleFunc("/install", handleInstall)
-	log.Println("Server starting on port 8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
 	}
-}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}()
 
-func handleInstall(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
-
-	var pyFiles PythonFiles
-
-	contentType := r.Header.Get("Content-Type")
-	if strings.HasPrefix(contentType, "multipart/form-data") {
-		// Handle multipart form upload
-		err := r.ParseMultipartForm(20 << 20) // 20MB max memory
-		if err != nil {
-			http.Error(w, "Error parsing multipart form: "+err.Error(), http.StatusBadRequest)
-			return
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	workRoot = cfg.WorkDir
+	zstdLevel = cfg.ZstdLevel
+	compression, compressionLevel = cfg.Compression, cfg.CompressionLevel
+	installTimeout, maxInstallTimeout = cfg.InstallTimeout, cfg.InstallMaxTimeout
+	installRetries, installRetryBackoff = cfg.InstallRetries, cfg.InstallRetryBackoff
+	if cfg.CircuitFailureRate > 0 {
+		registryBreaker = newCircuitBreaker(cfg.CircuitFailureRate, cfg.CircuitWindow, cfg.CircuitCooldown)
+	}
+	allowedRegistries = splitList(cfg.AllowedRegistries)
+	allowedNpmArgs = splitList(cfg.AllowedNpmArgs)
+	trustedProxies, _ = parseTrustedProxies(splitList(cfg.TrustedProxies))
+	defaultFiles[".npmrc"] = cfg.DefaultNpmrc
+	defaultFiles["pip.conf"] = cfg.DefaultPipConf
+	scopeCredentials, _ = parseScopeCredentials(splitList(cfg.NpmScopes))
+	if patterns := splitList(cfg.PrunePatterns); len(patterns) > 0 {
+		prunePatterns = patterns
+	}
+	scriptsPolicy = cfg.ScriptsPolicy
+	auditFailOn = cfg.AuditFailOn
+	verifyProvenance = cfg.VerifyProvenance
+	requireIntegrity = cfg.RequireIntegrity
+	licenseDenylist = splitList(cfg.LicenseDenylist)
+	switch {
+	case cfg.OPAURL != "":
+		opa = newRemoteOPAPolicy(cfg.OPAURL)
+	case cfg.OPAPolicy != "":
+		if opa, err = newLocalOPAPolicy(cfg.OPAPolicy, cfg.OPAQuery); err != nil {
+			fatal("failed to set up OPA policy", "error", err)
 		}
-		reqFile, _, err := r.FormFile("requirements.txt")
-		if err != nil {
-			http.Error(w, "Missing requirements.txt file in form-data", http.StatusBadRequest)
-			return
+	}
+	if cfg.PolicyFile != "" {
+		if packagePolicies, err = newPolicyReloader(cfg.PolicyFile); err != nil {
+			fatal("failed to load package policy", "error", err)
+		}
+		if cfg.PolicyReloadInterval > 0 {
+			go packagePolicies.watch(cfg.PolicyReloadInterval)
 		}
-		defer reqFile.Close()
-		reqBytes, err := io.ReadAll(reqFile)
+	}
+	if cfg.SigningKeyFile != "" {
+		if artifactSigner, err = loadSigningKey(cfg.SigningKeyFile); err != nil {
+			fatal("failed to load signing key", "error", err)
+		}
+	}
+	uploads := &http.Client{Timeout: cfg.InstallMaxTimeout}
+	if buckets := splitList(cfg.S3Buckets); len(buckets) > 0 {
+		endpoint, _ := url.Parse(cfg.s3Endpoint())
+		outputStores["s3"] = &s3Client{
+			endpoint:     endpoint,
+			region:       cfg.S3Region,
+			accessKey:    cfg.S3AccessKeyID,
+			secretKey:    cfg.S3SecretAccessKey,
+			sessionToken: cfg.S3SessionToken,
+			pathStyle:    cfg.S3PathStyle,
+			buckets:      buckets,
+			presignTTL:   cfg.OutputURLTTL,
+			client:       uploads,
+		}
+	}
+	if buckets := splitList(cfg.GCSBuckets); len(buckets) > 0 {
+		gcs, err := newGCSClient(cfg.GCSCredentialsFile, cfg.GCSEndpoint, buckets, cfg.OutputURLTTL, uploads)
 		if err != nil {
-			http.Error(w, "Error reading requirements.txt: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-		pyFiles.RequirementsTXT = string(reqBytes)
-
-		conFile, _, err := r.FormFile("constraints.txt")
-		if err == nil {
-			defer conFile.Close()
-			conBytes, err := io.ReadAll(conFile)
-			if err != nil {
-				http.Error(w, "Error reading constraints.txt: "+err.Error(), http.StatusBadRequest)
-				return
+			fatal("failed to load GCS credentials", "error", err)
+		}
+		outputStores["gcs"] = gcs
+	}
+	if containers := splitList(cfg.AzureContainers); len(containers) > 0 {
+		endpoint, _ := url.Parse(cfg.azureEndpoint())
+		key, _ := base64.StdEncoding.DecodeString(cfg.AzureAccountKey)
+		outputStores["azure"] = &azureClient{
+			endpoint:   endpoint,
+			account:    cfg.AzureAccount,
+			key:        key,
+			containers: containers,
+			sasTTL:     cfg.OutputURLTTL,
+			client:     uploads,
+		}
+	}
+	if repositories := splitList(cfg.OCIRepositories); len(repositories) > 0 {
+		ociOutput = &ociClient{
+			repositories: repositories,
+			insecure:     splitList(cfg.OCIInsecureRegistries),
+			baseImages:   splitList(cfg.ImageBaseImages),
+			defaultBase:  cfg.ImageDefaultBase,
+			client:       uploads,
+		}
+		if cfg.OCIAuthFile != "" {
+			if ociOutput.auths, err = loadDockerAuths(cfg.OCIAuthFile); err != nil {
+				fatal("failed to load registry credentials", "error", err)
 			}
-			pyFiles.ConstraintsTXT = string(conBytes)
 		}
-	} else {
-		// Fallback: JSON body
-		err := json.NewDecoder(io.LimitReader(r.Body, 10*1024*1024)).Decode(&pyFiles) // 10MB limit
+	}
+	outputDefaultType = cfg.OutputDefaultType
+	if cfg.PackageCacheDir != "" {
+		// Containers mount it at the same path, which docker needs to be absolute
+		if packageCacheDir, err = filepath.Abs(cfg.PackageCacheDir); err != nil {
+			fatal("invalid configuration", "error", err)
+		}
+		if err := setupPackageCache(); err != nil {
+			fatal("failed to create package cache", "error", err)
+		}
+		go collectPackageCache(int64(cfg.PackageCacheMaxMB)<<20, cfg.PackageCacheGCInterval)
+	}
+	if cfg.RegistryProxyDir != "" {
+		registryProxy, err = startRegistryProxy(cfg.RegistryProxyDir, cfg.RegistryProxyListen, cfg.RegistryProxyURL, cfg.RegistryProxyUpstream, cfg.RegistryProxyTTL)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error decoding request body: %v", err), http.StatusBadRequest)
-			return
+			fatal("failed to start registry proxy", "error", err)
+		}
+		slog.Info("proxying the npm registry", "url", registryProxy.url, "upstream", registryProxy.upstream.String())
+		if cfg.Executor == "docker" && cfg.RegistryProxyURL == "" && cfg.DockerNetwork != "host" {
+			slog.Warn("containers can't reach the registry proxy at its listen address; set registry_proxy_url, or docker_network to host")
 		}
-		defer r.Body.Close()
 	}
-
-	if pyFiles.RequirementsTXT == "" {
-		http.Error(w, "Missing requirements.txt in request", http.StatusBadRequest)
-		return
+	workspaceQuota = int64(cfg.WorkspaceQuotaMB) << 20
+	tmpfsDir, tmpfsWorkspaceMax = cfg.TmpfsDir, int64(cfg.TmpfsWorkspaceMaxMB)<<20
+	if tmpfsDir != "" {
+		if err := checkTmpfs(tmpfsDir); err != nil {
+			fatal("invalid configuration", "error", err)
+		}
 	}
-
-	// Create a temporary working directory
-	tmpDir, err := os.MkdirTemp("", workDirPrefix)
+	maxProjectSize = int64(cfg.ProjectMaxMB) << 20
+	maxBodySize = int64(cfg.BodyMaxMB) << 20
+	idempotencyWindow = cfg.IdempotencyWindow
+	installMemoryMax, installCPUWeight = int64(cfg.InstallMemoryMB)<<20, cfg.InstallCPUWeight
+	if cfg.CgroupParent != "" && cfg.Executor != "docker" {
+		cgroupParent = cfg.CgroupParent
+		if err := setupCgroupParent(); err != nil {
+			fatal("failed to set up cgroups", "error", err)
+		}
+	}
+	installExecutor, err = newExecutor(cfg.Executor, cfg.dockerImages(), cfg.DockerNetwork)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create temp directory: %v", err), http.StatusInternalServerError)
-		return
+		fatal("invalid configuration", "error", err)
 	}
-	defer os.RemoveAll(tmpDir) // Clean up afterwards
-
-	// Write requirements.txt
-	if err := os.WriteFile(filepath.Join(tmpDir, "requirements.txt"), []byte(pyFiles.RequirementsTXT), 0644); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to write requirements.txt: %v", err), http.StatusInternalServerError)
-		return
+	if cfg.Executor != "host" {
+		slog.Info("running installs in containers", "executor", cfg.Executor)
 	}
-
-	pipArgs := []string{"install", "-r", "requirements.txt", "--target", "site-packages"}
-	if pyFiles.ConstraintsTXT != "" {
-		if err := os.WriteFile(filepath.Join(tmpDir, "constraints.txt"), []byte(pyFiles.ConstraintsTXT), 0644); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to write constraints.txt: %v", err), http.StatusInternalServerError)
-			return
+	// Containers use the node image for the requested release instead
+	if cfg.Executor != "docker" {
+		nodes, err = newNodeToolchains(cfg.ToolchainDir, cfg.NodeDistURL)
+		if err != nil {
+			fatal("failed to create toolchain directory", "error", err)
 		}
-		pipArgs = append(pipArgs, "-c", "constraints.txt")
+		rubiesDir = cfg.RubiesDir
 	}
 
-	// Run pip install
-	cmd := exec.Command("pip", pipArgs...)
-	cmd.Dir = tmpDir
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		log.Printf("pip install failed in %s. Stderr: %s", tmpDir, stderr.String())
-		http.Error(w, fmt.Sprintf("pip install failed: %v\nStderr: %s", err, stderr.String()), http.StatusInternalServerError)
-		return
+	auth, err = loadAPIKeys(cfg.APIKeys, cfg.APIKeysFile)
+	if err != nil {
+		fatal("failed to load API keys", "error", err)
 	}
-	log.Printf("pip install completed successfully in %s", tmpDir)
-
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=\"python_packages.zip\"")
-
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
-
-	// Add site-packages to zip
-	sitePackagesPath := filepath.Join(tmpDir, "site-packages")
-	err = filepath.Walk(sitePackagesPath, func(path string, info os.FileInfo, err error) error {
+	if cfg.OIDCIssuer != "" {
+		auth.oidc, err = newOIDCVerifier(context.Background(), cfg.OIDCIssuer, cfg.OIDCJWKSURL, cfg.OIDCAudience, cfg.OIDCOrgClaim)
 		if err != nil {
-			return err
+			fatal("failed to set up OIDC", "error", err)
 		}
-		relPath, err := filepath.Rel(tmpDir, path)
-		if err != nil {
-			return err
+		slog.Info("OIDC authentication enabled", "issuer", cfg.OIDCIssuer, "jwks_url", auth.oidc.jwksURL)
+	}
+	if len(auth.keys) > 0 {
+		slog.Info("API key authentication enabled", "keys", len(auth.keys))
+	}
+	if !auth.enabled() {
+		slog.Warn("no API keys configured, authentication is disabled")
+	}
+	admins = splitList(cfg.Admins)
+	if len(admins) > 0 && !auth.enabled() {
+		fatal("invalid configuration", "error", "admins needs api_keys or oidc_issuer")
+	}
+	if cfg.UsageFile != "" {
+		if accounting, err = loadUsage(cfg.UsageFile, cfg.UsageRetention); err != nil {
+			fatal("failed to load usage", "error", err)
 		}
-		if relPath == "." || relPath == ".." {
-			return nil
+	} else {
+		accounting = newUsageLedger("", cfg.UsageRetention)
+	}
+	go accounting.keepFlushing()
+	if cfg.TenantsFile != "" {
+		if !auth.enabled() {
+			fatal("invalid configuration", "error", "tenants_file needs api_keys or oidc_issuer: tenants are found from who the caller is")
 		}
-		zipPath := filepath.ToSlash(relPath)
-		if info.IsDir() {
-			if !strings.HasSuffix(zipPath, "/") {
-				zipPath += "/"
+		if tenants, err = loadTenants(cfg.TenantsFile, cfg.ArtifactTTL); err != nil {
+			fatal("failed to load tenants", "error", err)
+		}
+		tenants.seedInstallTime(accounting)
+		slog.Info("tenants enabled", "tenants", len(tenants.tenants))
+	}
+	if cfg.AuditLog != "" {
+		if auditLog, err = openAuditLog(cfg.AuditLog); err != nil {
+			fatal("failed to open audit log", "error", err)
+		}
+		slog.Info("audit log enabled", "path", cfg.AuditLog)
+	}
+	limits = newClientLimits(cfg.RateLimitRPM, cfg.RateLimitBurst, cfg.RateLimitConcurrent)
+	store, err := newDiskStore(cfg.ArtifactDir)
+	if err != nil {
+		fatal("failed to open artifact store", "error", err)
+	}
+	go expireArtifacts(store, cfg.ArtifactTTL)
+	pool := newInstallPool(cfg.MaxConcurrentInstalls, cfg.MaxQueuedInstalls)
+	installer := newInstaller(store, newResultCache(cfg.CacheMaxEntries), pool)
+
+	var queue *redisQueue
+	if cfg.JobQueue == "redis" {
+		client, _ := newRedisClient(cfg.RedisURL)
+		if queue, err = newRedisQueue(client, cfg.RedisKeyPrefix, cfg.WorkerHeartbeatInterval, cfg.ArtifactTTL, cfg.JobSecretsKey); err != nil {
+			fatal("failed to set up job queue", "error", err)
+		}
+	}
+	jobs := newJobManager(installer, cfg.ArtifactTTL, newWebhookNotifier(cfg.WebhookSecret), queue, cfg.Role != "serve")
+	if cfg.Role == "serve" {
+		installer.jobs = jobs
+	}
+	slog.Info("starting role", "role", cfg.Role)
+
+	// Workers only run jobs, answering health checks and metrics alone
+	var warmer *cacheWarmer
+	if cfg.Role != "worker" {
+		for _, eco := range ecosystems {
+			handle("/install/"+eco.Name, limits.rate(installer.handler(eco)))
+			if eco.Audit != nil {
+				handle("POST /audit/"+eco.Name, limits.rate(installer.auditHandler(eco)))
 			}
-			_, err = zipWriter.CreateHeader(&zip.FileHeader{
-				Name:   zipPath,
-				Method: zip.Store,
-			})
-			if err != nil {
-				log.Printf("Failed to create directory header in zip for %s: %v", zipPath, err)
-				return err
+		}
+		handle("POST /lock", limits.rate(installer.handleLock))
+		handle("POST /tree", limits.rate(installer.handleTree))
+		handle("POST /outdated", limits.rate(installer.handleOutdated))
+		handle("POST /bundle", limits.rate(installer.handleBundle))
+		handle("POST /install/packages", limits.rate(installer.packagesHandler))
+		// Kept for clients written before per-ecosystem routes existed
+		handle("/install", limits.rate(installer.handler(pipEcosystem)))
+		handle("GET /artifacts/{sha}", artifactHandler(store))
+		handle("GET /artifacts/{sha}/report", installReportHandler(store))
+
+		handle("POST /jobs", limits.rate(jobs.handleSubmit))
+		handle("GET /jobs/{id}", jobs.handleStatus)
+		handle("DELETE /jobs/{id}", jobs.handleCancel)
+		handle("GET /jobs/{id}/artifact", jobs.handleArtifact)
+		handle("GET /jobs/{id}/artifact.sig", jobs.handleSignature)
+		handle("GET /jobs/{id}/sbom", jobs.handleSBOM)
+		handle("GET /jobs/{id}/licenses", jobs.handleLicenses)
+		handle("GET /jobs/{id}/report", jobs.handleReport)
+		handle("GET /jobs/{id}/events", jobs.handleEvents)
+		handle("GET /jobs/{id}/ws", jobs.handleWebSocket)
+		if len(admins) > 0 {
+			handle("GET /admin/jobs", requireAdmin(jobs.handleAdminJobs))
+			handle("GET /admin/jobs/{id}/logs", requireAdmin(jobs.handleAdminLogs))
+			handle("POST /admin/jobs/{id}/cancel", requireAdmin(jobs.handleAdminCancel))
+			handle("POST /admin/jobs/{id}/promote", requireAdmin(jobs.handleAdminPromote))
+			if auditLog != nil {
+				handle("GET /admin/audit", requireAdmin(auditLog.handleQuery))
 			}
-			return nil
+			// Usage covers every key and tenant
+			handle("GET /usage", requireAdmin(accounting.handleUsage))
 		}
-		fileInZip, err := zipWriter.Create(zipPath)
-		if err != nil {
-			log.Printf("Failed to create zip entry for %s: %v", path, err)
-			return err
+
+		// Warm-ups run where they are queued, so frontends don't take them
+		if packageCacheDir != "" && cfg.Role == "all" {
+			var window *warmWindow
+			if cfg.CacheWarmWindow != "" {
+				w, _ := parseWarmWindow(cfg.CacheWarmWindow)
+				window = &w
+			}
+			warmer = newCacheWarmer(pool, window)
+			handle("POST /cache/warm", limits.rate(warmer.handleWarm))
+			handle("GET /cache/warm", warmer.handleList)
 		}
-		fileToZip, err := os.Open(path)
+
+		handle("GET /config", cfg.handleConfig)
+		if tenants != nil {
+			handle("GET /tenant", tenants.handleTenant)
+		}
+		handlePublic("GET /signing-key", handleSigningKey)
+		handlePublic("GET /openapi.json", handleOpenAPI)
+	}
+	handlePublic("GET /metrics", handleMetrics)
+
+	var readyEcosystems []*Ecosystem
+	for _, name := range cfg.readyEcosystems() {
+		readyEcosystems = append(readyEcosystems, findEcosystem(name))
+	}
+	health := newHealthChecker(readyEcosystems, uint64(cfg.ReadyMinFreeMB)<<20, cfg.ReadyCheckRegistry)
+	handlePublic("GET /healthz", handleHealthz)
+	handlePublic("GET /readyz", health.handleReadyz)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: withRequestLogging(http.DefaultServeMux)}
+	if cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
 		if err != nil {
-			log.Printf("Failed to open file %s for zipping: %v", path, err)
-			return err
+			fatal("failed to load TLS certificate", "error", err)
 		}
-		defer fileToZip.Close()
-		_, err = io.Copy(fileInZip, fileToZip)
+		srv.TLSConfig = certs.tlsConfig()
+		if cfg.TLSReloadInterval > 0 {
+			go certs.watch(cfg.TLSReloadInterval)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	slog.Info("server starting", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+	var grpcSrv *grpcServer
+	if cfg.GRPCPort != 0 && cfg.Role != "worker" {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
 		if err != nil {
-			log.Printf("Failed to copy file %s to zip: %v", path, err)
-			return err
+			fatal("failed to listen for gRPC", "error", err)
 		}
-		return nil
-	})
+		grpcSrv = newGRPCServer(jobs, srv.TLSConfig)
+		go func() { errc <- grpcSrv.serve(lis) }()
+		slog.Info("gRPC server starting", "addr", lis.Addr().String(), "tls", srv.TLSConfig != nil)
+	}
+	select {
+	case err := <-errc:
+		fatal("server stopped", "error", err)
+	case <-ctx.Done():
+	}
+	stop()
+	health.draining.Store(true)
+	if warmer != nil {
+		warmer.shutdown()
+	}
 
-	if err != nil {
-		log.Printf("Error walking site-packages path %s: %v", sitePackagesPath, err)
-		if w.Header().Get("Content-Type") == "" {
-			http.Error(w, fmt.Sprintf("Error zipping files: %v", err), http.StatusInternalServerError)
+	// Stop accepting connections and let running installs finish. Jobs still
+	// waiting for a slot are failed so their clients hear about it.
+	slog.Info("shutting down", "drain_timeout", cfg.ShutdownTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	jobsDone := make(chan error, 1)
+	go func() { jobsDone <- jobs.shutdown(drainCtx) }()
+	grpcDone := make(chan struct{})
+	go func() {
+		if grpcSrv != nil {
+			grpcSrv.shutdown(drainCtx)
 		}
-		return
+		close(grpcDone)
+	}()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("drain timeout expired, closing open connections", "error", err)
+		srv.Close()
+	}
+	<-grpcDone
+	if err := <-jobsDone; err != nil {
+		slog.Warn("drain timeout expired, killed running jobs", "error", err)
 	}
-	log.Println("Successfully streamed zip response.")
+	removeAllWorkspaces()
+	if err := accounting.flush(); err != nil {
+		slog.Error("failed to save usage", "path", cfg.UsageFile, "error", err)
+	}
+	slog.Info("server stopped")
 }
-
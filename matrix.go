@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxTargets is how many targets the targets option may list
+const maxTargets = 8
+
+// name is the directory a target's install goes under in a matrix archive,
+// such as linux-arm64-musl
+func (t *InstallTarget) name() string {
+	name := t.platform() + "-" + t.arch()
+	if t.Libc != "" {
+		name += "-" + t.Libc
+	}
+	return name
+}
+
+// validateTargets checks the targets option, whose targets must each be
+// valid and put their installs in different directories
+func validateTargets(eco *Ecosystem, o InstallOptions) error {
+	if o.Target != nil {
+		return badRequest("target and targets can't both be set")
+	}
+	if len(o.Targets) > maxTargets {
+		return badRequest("Invalid targets: at most %d can be built at once", maxTargets)
+	}
+	seen := make(map[string]bool)
+	for _, t := range o.Targets {
+		if err := t.validate(eco); err != nil {
+			return err
+		}
+		if seen[t.name()] {
+			return badRequest("Invalid targets: %s is listed twice", t.name())
+		}
+		seen[t.name()] = true
+	}
+	return nil
+}
+
+// installTargets runs a targets install: the request is installed for each
+// target, each in its own workspace, as if it had set target. The install's
+// own slot runs one target at a time, and targets run in parallel only on
+// the slots pool has free besides, so a matrix never runs more installs
+// than the pool allows. Each target's archive contents are moved into a
+// directory of workDir under the target's name, which is returned to be
+// archived at the root; the meta and report combine the targets'. An
+// install that fails fails them all.
+func installTargets(ctx context.Context, pool *installPool, eco *Ecosystem, req *InstallRequest, workDir, key string, onLine func(stream, line string)) (string, ArtifactMeta, error) {
+	matrixDir, err := os.MkdirTemp(workDir, ".targets-")
+	if err != nil {
+		return "", ArtifactMeta{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	metas := make([]ArtifactMeta, len(req.Options.Targets))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	next := make(chan int, len(req.Options.Targets))
+	for i := range req.Options.Targets {
+		next <- i
+	}
+	close(next)
+	runTargets := func() {
+		defer wg.Done()
+		for i := range next {
+			t := req.Options.Targets[i]
+			meta, err := installTarget(ctx, eco, req, t, filepath.Join(matrixDir, t.name()), key, onLine)
+			mu.Lock()
+			metas[i] = meta
+			// The first failure cancels the rest, whose errors only say so
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", t.name(), err)
+				cancel()
+			}
+			mu.Unlock()
+		}
+	}
+	wg.Add(1)
+	go runTargets()
+	for range len(req.Options.Targets) - 1 {
+		slot, ok := pool.tryAcquire()
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer slot.release()
+			runTargets()
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return "", ArtifactMeta{}, firstErr
+	}
+
+	var meta ArtifactMeta
+	for _, m := range metas {
+		meta.PrunedBytes += m.PrunedBytes
+		meta.SkippedScripts = append(meta.SkippedScripts, m.SkippedScripts...)
+		meta.Packages = append(meta.Packages, m.Packages...)
+	}
+	slices.Sort(meta.SkippedScripts)
+	meta.SkippedScripts = slices.Compact(meta.SkippedScripts)
+	slices.SortFunc(meta.Packages, func(a, b Package) int {
+		return strings.Compare(a.Name+"@"+a.Version, b.Name+"@"+b.Version)
+	})
+	meta.Packages = slices.CompactFunc(meta.Packages, func(a, b Package) bool {
+		return a.Name == b.Name && a.Version == b.Version
+	})
+	meta.Report = buildReport(ctx, eco, req, matrixDir, meta.Packages)
+	if req.Options.Report {
+		if err := writeInstallReport(matrixDir, meta.Report); err != nil {
+			return "", ArtifactMeta{}, fmt.Errorf("Failed to write %s: %v", installReportName, err)
+		}
+	}
+	return matrixDir, meta, nil
+}
+
+// installTarget installs req for one target in a workspace of its own and
+// moves what its archive would hold to dst
+func installTarget(ctx context.Context, eco *Ecosystem, req *InstallRequest, t *InstallTarget, dst, key string, onLine func(stream, line string)) (ArtifactMeta, error) {
+	logger := loggerFrom(ctx).With("target", t.name())
+	ctx = withLogger(ctx, logger)
+	treq := *req
+	treq.Options.Target, treq.Options.Targets = t, nil
+	// installTargets reports on the targets together
+	treq.Options.Report = false
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		return ArtifactMeta{}, err
+	}
+	defer removeWorkspace(tmpDir)
+
+	var lines func(stream, line string)
+	if onLine != nil {
+		lines = func(stream, line string) { onLine(stream, "["+t.name()+"] "+line) }
+	}
+	outputDir, err := runInstall(ctx, eco, &treq, tmpDir, lines)
+	if err == nil {
+		err = gateInstall(ctx, eco, &treq, tmpDir, outputDir)
+	}
+	var meta ArtifactMeta
+	if err == nil {
+		meta, err = artifactMeta(ctx, eco, &treq, outputDir, key)
+	}
+	if err != nil {
+		return meta, err
+	}
+	srcDir, root, err := stageArchive(eco, treq.Options.Include, tmpDir, outputDir)
+	if err != nil {
+		return meta, fmt.Errorf("Error archiving files: %v", err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return meta, err
+	}
+	// Staging puts everything at the archive's root; otherwise srcDir is
+	// the installed directory, archived under root
+	if root != "" {
+		dst = filepath.Join(dst, root)
+	} else if err := os.Remove(dst); err != nil {
+		return meta, err
+	}
+	if err := os.Rename(srcDir, dst); err != nil {
+		return meta, fmt.Errorf("Error archiving files: %v", err)
+	}
+	logger.Info("installed target")
+	return meta, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This file implements the small subset of the Prometheus text exposition
+// format the service needs: labelled counters and histograms, and gauges.
+
+// A collector writes its samples in the Prometheus text format
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+var (
+	installsStarted = newCounterVec("pip_install_installs_started_total",
+		"Installs started, by ecosystem.", "ecosystem")
+	installsSucceeded = newCounterVec("pip_install_installs_succeeded_total",
+		"Installs that completed successfully, by ecosystem.", "ecosystem")
+	installsFailed = newCounterVec("pip_install_installs_failed_total",
+		"Installs that failed, by ecosystem.", "ecosystem")
+	installDuration = newHistogramVec("pip_install_install_duration_seconds",
+		"Time spent running the package manager, by ecosystem.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}, "ecosystem")
+	archiveSize = newHistogramVec("pip_install_archive_size_bytes",
+		"Size of built archives, by format.",
+		[]float64{1 << 20, 10 << 20, 50 << 20, 100 << 20, 250 << 20, 500 << 20, 1 << 30}, "format")
+	cacheRequests = newCounterVec("pip_install_cache_requests_total",
+		"Result cache lookups, by result (hit or miss).", "result")
+	activeInstalls = newGauge("pip_install_active_installs",
+		"Installs currently running.")
+)
+
+// handleMetrics serves GET /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// A counterVec is a set of counters partitioned by label values
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// inc adds one to the counter with the given label values
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	writeMetadata(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+// A gauge is a single value that can go up and down. If fn is set the value
+// is read from it at scrape time instead.
+type gauge struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+	fn         func() float64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	register(g)
+	return g
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gauge {
+	g := &gauge{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *gauge) add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *gauge) inc() { g.add(1) }
+func (g *gauge) dec() { g.add(-1) }
+
+func (g *gauge) writeTo(w io.Writer) {
+	writeMetadata(w, g.name, g.help, "gauge")
+	var v float64
+	if g.fn != nil {
+		v = g.fn()
+	} else {
+		g.mu.Lock()
+		v = g.value
+		g.mu.Unlock()
+	}
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(v))
+}
+
+// A histogramVec is a set of histograms partitioned by label values
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+// observe records v in the histogram with the given label values
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	writeMetadata(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func writeMetadata(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// seriesKey joins label values into a map key
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {name="value",...} for a series key, optionally
+// followed by one extra label such as a histogram's le
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], escapeLabel(v)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel leaves only characters that %q renders the way Prometheus expects
+func escapeLabel(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
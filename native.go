@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// buildTools are what node-gyp compiles native modules with, each satisfied
+// by any of the commands listed
+var buildTools = [][]string{{"python3", "python"}, {"make"}, {"c++", "g++", "clang++"}}
+
+var nativeBuilds = newCounterVec("pip_install_native_builds_total",
+	"Installs that failed building native modules, by ecosystem and outcome: retried (in the builder image), missing_tools or failed.",
+	"ecosystem", "outcome")
+
+// A nativeBuildError fails an install whose native modules must be compiled
+// where the build tools aren't installed
+type nativeBuildError struct {
+	packages []string
+	missing  []string
+}
+
+func (e *nativeBuildError) Error() string {
+	return fmt.Sprintf("Native modules of %s must be compiled, but these build tools are missing where this server runs installs: %s",
+		strings.Join(e.packages, ", "), strings.Join(e.missing, ", "))
+}
+
+func (e *nativeBuildError) code() string { return "BUILD_TOOLS_MISSING" }
+
+func (e *nativeBuildError) details() map[string]any {
+	return map[string]any{"native_packages": e.packages, "missing_tools": e.missing}
+}
+
+// nativePackages lists the packages in workDir's node_modules that build a
+// native addon with node-gyp, as far as a failed install got
+func nativePackages(workDir string) []string {
+	var names []string
+	walkNpmPackages(filepath.Join(workDir, "node_modules"), func(dir string, pkg npmManifest) error {
+		if _, err := os.Stat(filepath.Join(dir, "binding.gyp")); err == nil {
+			names = append(names, pkg.Name)
+		}
+		return nil
+	})
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// checkNativeBuild looks into an install that failed in node-gyp. With the
+// docker executor it's retried in the builder image, which has the build
+// tools. Elsewhere, or without a builder for the ecosystem, the failure is
+// explained with a nativeBuildError if the tools are missing. Other
+// failures return installErr as is.
+func checkNativeBuild(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string, run toolRun, installErr error) error {
+	if errorStatus(installErr) != http.StatusInternalServerError || !strings.Contains(installErr.Error(), "gyp") {
+		return installErr
+	}
+	packages := nativePackages(workDir)
+	if len(packages) == 0 {
+		return installErr
+	}
+	logger := loggerFrom(ctx)
+	if d, ok := installExecutor.(*dockerExecutor); ok {
+		if builder := d.builder(eco, req.Options.Target); builder != nil {
+			logger.Info("retrying install in the builder image", "native_packages", packages)
+			nativeBuilds.inc(eco.Name, "retried")
+			run.executor = builder
+			return runTool(ctx, eco, req, workDir, run)
+		}
+	}
+	missing, err := missingBuildTools(ctx, eco, req, workDir)
+	if err != nil {
+		logger.Warn("failed to check for build tools", "error", err)
+		return installErr
+	}
+	if len(missing) == 0 {
+		nativeBuilds.inc(eco.Name, "failed")
+		return installErr
+	}
+	logger.Warn("native modules can't be built", "native_packages", packages, "missing_tools", missing)
+	nativeBuilds.inc(eco.Name, "missing_tools")
+	return &nativeBuildError{packages: packages, missing: missing}
+}
+
+// missingBuildTools lists the build tools the install executor doesn't
+// have, by their first name, looking for them where installs run
+func missingBuildTools(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string) ([]string, error) {
+	var script strings.Builder
+	for _, names := range buildTools {
+		for _, name := range names {
+			fmt.Fprintf(&script, "command -v %s >/dev/null 2>&1 || ", name)
+		}
+		fmt.Fprintf(&script, "echo %s\n", names[0])
+	}
+	var out bytes.Buffer
+	err := runTool(ctx, eco, req, workDir, toolRun{step: "build tools check", tool: "sh", args: []string{"-c", script.String()}, stdout: &out})
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out.String()), nil
+}
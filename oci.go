@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Media types of the manifests and blobs pushed and pulled
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+	ociEmptyType    = "application/vnd.oci.empty.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// Docker's types, which base images may still use
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerConfigType       = "application/vnd.docker.container.image.v1+json"
+	dockerLayerType        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// ociArtifactType marks manifests holding an install's archive
+	ociArtifactType = "application/vnd.pip-install.dependencies.v1"
+)
+
+// ociEmpty is the empty JSON config artifacts without one point at
+var ociEmpty = []byte("{}")
+
+// ociTagPattern matches a valid tag
+var ociTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// ociRepositoryPattern matches the path of a repository within a registry
+var ociRepositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+// An ociClient pushes artifacts to container registries with the OCI
+// distribution API
+type ociClient struct {
+	// repositories are the repository prefixes, such as ghcr.io/acme/,
+	// requests may push to
+	repositories []string
+	// auths holds the base64 "user:password" for each registry host
+	auths map[string]string
+	// insecure lists the registry hosts spoken to over plain HTTP
+	insecure []string
+	// baseImages are the repository prefixes image outputs may build on,
+	// and defaultBase the base image of those that name none
+	baseImages  []string
+	defaultBase string
+	client      *http.Client
+}
+
+// ociOutput is the client for the oci and image output types, set from the oci_*
+// settings; nil when no repositories are configured
+var ociOutput *ociClient
+
+// loadDockerAuths reads the registry credentials from a Docker config.json,
+// such as a Kubernetes dockerconfigjson secret
+func loadDockerAuths(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	auths := make(map[string]string)
+	for server, a := range config.Auths {
+		// Keys may be bare hosts or URLs such as https://index.docker.io/v1/
+		host := server
+		if u, err := url.Parse(server); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if host == "index.docker.io" {
+			host = "docker.io"
+		}
+		if a.Auth == "" && a.Username != "" {
+			a.Auth = base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + a.Password))
+		}
+		auths[host] = a.Auth
+	}
+	return auths, nil
+}
+
+// splitRepository splits a repository such as ghcr.io/acme/deps into its
+// registry host and path
+func splitRepository(repository string) (host, path string, ok bool) {
+	host, path, ok = strings.Cut(repository, "/")
+	if !ok || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "", "", false
+	}
+	return host, path, ociRepositoryPattern.MatchString(path)
+}
+
+// allowed reports whether requests may push to repository
+func (c *ociClient) allowed(repository string) bool {
+	return slices.ContainsFunc(c.repositories, func(prefix string) bool {
+		return repository == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(repository, strings.TrimSuffix(prefix, "/")+"/")
+	})
+}
+
+// An ociSession talks to one repository, holding the authorization the
+// registry granted to it
+type ociSession struct {
+	c    *ociClient
+	host string
+	path string
+	// actions is the access asked for: "pull" or "pull,push"
+	actions string
+	// base is the repository's API URL
+	base string
+	// authz is the Authorization header requests are sent with, and
+	// authed whether the registry has been asked for one
+	authz  string
+	authed bool
+}
+
+func (c *ociClient) session(repository, actions string) *ociSession {
+	host, path, _ := splitRepository(repository)
+	apiHost := host
+	if host == "docker.io" {
+		apiHost = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if slices.Contains(c.insecure, host) {
+		scheme = "http"
+	}
+	return &ociSession{c: c, host: host, path: path, actions: actions, base: scheme + "://" + apiHost + "/v2/" + path}
+}
+
+// do sends the request newRequest builds. On a 401 it gets authorization as
+// the registry's challenge asks and sends a fresh request once more.
+func (s *ociSession) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if s.authz != "" {
+			req.Header.Set("Authorization", s.authz)
+		}
+		resp, err := s.c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || s.authed {
+			return resp, nil
+		}
+		resp.Body.Close()
+		s.authed = true
+		if err := s.authorize(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authorize answers a WWW-Authenticate challenge, with the registry's
+// credentials from oci_auth_file if there are any
+func (s *ociSession) authorize(ctx context.Context, challenge string) error {
+	basic := s.c.auths[s.host]
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if basic == "" {
+			return fmt.Errorf("%s requires credentials", s.host)
+		}
+		s.authz = "Basic " + basic
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("%s sent an unsupported challenge %q", s.host, challenge)
+	}
+	values := parseChallenge(params)
+	realm, err := url.Parse(values["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("%s sent an invalid token realm %q", s.host, values["realm"])
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", "repository:"+s.path+":"+s.actions)
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if basic != "" {
+		req.Header.Set("Authorization", "Basic "+basic)
+	}
+	resp, err := s.c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching a token for %s: %s", s.host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("fetching a token for %s: %v", s.host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	s.authz = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses the comma-separated key="value" parameters of a
+// WWW-Authenticate challenge
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return values
+}
+
+// hasBlob reports whether the repository has a blob
+func (s *ociSession) hasBlob(ctx context.Context, digest string) (bool, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, s.base+"/blobs/"+digest, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// pushBlob uploads a blob in a single request, unless the repository already
+// has it. If from names another repository on the same registry, the blob is
+// mounted from it rather than uploaded where the registry allows. open is
+// called for the body of every attempt.
+func (s *ociSession) pushBlob(ctx context.Context, open func() (io.Reader, error), size int64, digest, from string) error {
+	if ok, err := s.hasBlob(ctx, digest); err != nil || ok {
+		return err
+	}
+
+	start := s.base + "/blobs/uploads/"
+	if from != "" {
+		start += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	}
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, start, nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated && from != "" {
+		return nil
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting blob upload to %s/%s: %s", s.host, s.path, resp.Status)
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	resp, err = s.do(ctx, func() (*http.Request, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPut, location.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("uploading blob %s to %s/%s: %s: %s", digest, s.host, s.path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// bytesBody opens b as a blob body
+func bytesBody(b []byte) func() (io.Reader, error) {
+	return func() (io.Reader, error) { return bytes.NewReader(b), nil }
+}
+
+// seekBody opens r from the start as a blob body
+func seekBody(r io.ReadSeeker) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		_, err := r.Seek(0, io.SeekStart)
+		return io.NopCloser(r), err
+	}
+}
+
+// pullManifest fetches the manifest or index a tag or digest names,
+// returning its media type
+func (s *ociSession) pullManifest(ctx context.Context, reference string) (string, []byte, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, s.base+"/manifests/"+reference, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join([]string{ociManifestType, ociIndexType, dockerManifestType, dockerManifestListType}, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetching %s/%s:%s: %s", s.host, s.path, reference, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", nil, err
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !slices.Contains([]string{ociManifestType, ociIndexType, dockerManifestType, dockerManifestListType}, mediaType) {
+		// Some registries only give the type in the manifest itself
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(b, &m)
+		mediaType = m.MediaType
+	}
+	return mediaType, b, nil
+}
+
+// pullBlob opens a blob for reading
+func (s *ociSession) pullBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, s.base+"/blobs/"+digest, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching blob %s from %s/%s: %s", digest, s.host, s.path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// pushManifest tags a manifest, returning its digest
+func (s *ociSession) pushManifest(ctx context.Context, mediaType string, manifest []byte, tag string) (string, error) {
+	resp, err := s.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, s.base+"/manifests/"+tag, bytes.NewReader(manifest))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", fmt.Errorf("pushing manifest to %s/%s:%s: %s: %s", s.host, s.path, tag, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return ociDigest(manifest), nil
+}
+
+// An ociDescriptor points at a blob
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// An ociManifest is an OCI image manifest
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociDigest returns the digest of b as OCI writes it
+func ociDigest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// pushArtifact pushes an archive as an OCI artifact: a manifest with an empty
+// config and the archive as its one layer, titled with its filename as
+// oras names pulled files. It returns the manifest's digest.
+func (c *ociClient) pushArtifact(ctx context.Context, repository, tag string, artifact *Artifact, layerType string) (string, error) {
+	s := c.session(repository, "pull,push")
+	if err := s.pushBlob(ctx, bytesBody(ociEmpty), int64(len(ociEmpty)), ociDigest(ociEmpty), ""); err != nil {
+		return "", err
+	}
+	layerDigest := "sha256:" + artifact.Digest
+	if err := s.pushBlob(ctx, seekBody(artifact), artifact.Size, layerDigest, ""); err != nil {
+		return "", err
+	}
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  ociArtifactType,
+		Config:        ociDescriptor{MediaType: ociEmptyType, Digest: ociDigest(ociEmpty), Size: int64(len(ociEmpty))},
+		Layers: []ociDescriptor{{
+			MediaType:   layerType,
+			Digest:      layerDigest,
+			Size:        artifact.Size,
+			Annotations: map[string]string{"org.opencontainers.image.title": artifact.Filename},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.pushManifest(ctx, ociManifestType, manifest, tag)
+}
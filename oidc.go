@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksMaxAge is how long fetched signing keys are trusted before refetching
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits refetches triggered by tokens with unknown key IDs
+	jwksMinRefresh = time.Minute
+	// jwtLeeway allows for clock skew between the issuer and this server
+	jwtLeeway = 30 * time.Second
+)
+
+// jwtMethods are the asymmetric algorithms accepted; HMAC and "none" are never
+// allowed since the keys come from a public JWKS document
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// An oidcVerifier validates JWTs signed by an OIDC issuer, using the signing
+// keys published at its JWKS URL
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	orgClaim string
+	jwksURL  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+// newOIDCVerifier validates tokens from issuer. When jwksURL is empty it is
+// discovered from the issuer's /.well-known/openid-configuration. Tokens must
+// name audience in their aud claim unless it is empty, and the organisation is
+// read from orgClaim.
+func newOIDCVerifier(ctx context.Context, issuer, jwksURL, audience, orgClaim string) (*oidcVerifier, error) {
+	v := &oidcVerifier{
+		issuer:   issuer,
+		audience: audience,
+		orgClaim: orgClaim,
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery document for %s has no jwks_uri", issuer)
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+	return v, nil
+}
+
+// verify checks token's signature, issuer, audience and expiry and returns
+// the caller it identifies
+func (v *oidcVerifier) verify(ctx context.Context, token string) (Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}, opts...)
+	if err != nil {
+		return Principal{}, err
+	}
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return Principal{}, fmt.Errorf("token has no sub claim")
+	}
+	org, _ := claims[v.orgClaim].(string)
+	return Principal{Subject: sub, Org: org}, nil
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when it
+// is stale or the ID is unknown so that issuer key rotation is picked up
+func (v *oidcVerifier) key(ctx context.Context, kid string) (any, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetched)
+	if (ok && age < jwksMaxAge) || (!ok && age < jwksMinRefresh) {
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		if ok {
+			// Keep using the old key rather than locking everyone out
+			loggerFrom(ctx).Warn("failed to refresh JWKS", "url", v.jwksURL, "error", err)
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// A jwk is one entry of a JSON Web Key Set
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys downloads the JWKS and decodes its RSA and EC signing keys by ID.
+// Keys of other types are skipped.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) (map[string]any, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	keys := make(map[string]any)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			loggerFrom(ctx).Warn("skipping JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key, returning nil for unsupported key types
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key parameter: %v", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
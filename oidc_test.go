@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIssuer serves an OIDC discovery document and a JWKS holding one RSA
+// and one EC signing key, and counts the JWKS fetches
+type testIssuer struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches++
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{Kid: "rsa", Kty: "RSA", Use: "sig", N: b64(rsaKey.N), E: b64(big.NewInt(int64(rsaKey.E)))},
+			{Kid: "ec", Kty: "EC", Crv: "P-256", X: b64(ecKey.X), Y: b64(ecKey.Y)},
+			{Kid: "enc", Kty: "RSA", Use: "enc", N: b64(rsaKey.N), E: b64(big.NewInt(int64(rsaKey.E)))},
+		}})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// claims are valid for the issuer, with the audience "pip-install"
+func (iss *testIssuer) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": iss.URL,
+		"aud": "pip-install",
+		"sub": "ci-bot",
+		"org": "acme",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (iss *testIssuer) sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOIDCVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newOIDCVerifier(context.Background(), iss.URL, "", "pip-install", "org")
+	if err != nil {
+		t.Fatalf("newOIDCVerifier() failed: %v", err)
+	}
+	if want := iss.URL + "/jwks"; v.jwksURL != want {
+		t.Errorf("discovered JWKS URL %q, want %q", v.jwksURL, want)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		c := iss.claims()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "RSA", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, iss.claims())},
+		{name: "EC", token: iss.sign(t, jwt.SigningMethodES256, "ec", iss.ecKey, iss.claims())},
+		{name: "audience list", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("aud", []string{"other", "pip-install"}))},
+		{name: "within leeway", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("exp", time.Now().Add(-jwtLeeway/2).Unix()))},
+		{name: "expired", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("exp", time.Now().Add(-time.Hour).Unix())), wantErr: true},
+		{name: "no expiry", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("exp", nil)), wantErr: true},
+		{name: "not yet valid", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("nbf", time.Now().Add(time.Hour).Unix())), wantErr: true},
+		{name: "wrong issuer", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("iss", "https://evil")), wantErr: true},
+		{name: "wrong audience", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("aud", "other")), wantErr: true},
+		{name: "no subject", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, with("sub", nil)), wantErr: true},
+		{name: "other signer", token: iss.sign(t, jwt.SigningMethodRS256, "rsa", otherKey, iss.claims()), wantErr: true},
+		{name: "unknown key", token: iss.sign(t, jwt.SigningMethodRS256, "gone", iss.rsaKey, iss.claims()), wantErr: true},
+		{name: "encryption key", token: iss.sign(t, jwt.SigningMethodRS256, "enc", iss.rsaKey, iss.claims()), wantErr: true},
+		{name: "key of another type", token: iss.sign(t, jwt.SigningMethodRS256, "ec", iss.rsaKey, iss.claims()), wantErr: true},
+		{name: "HMAC with the public key", token: iss.sign(t, jwt.SigningMethodHS256, "rsa", iss.rsaKey.N.Bytes(), iss.claims()), wantErr: true},
+		{name: "none", token: iss.sign(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, iss.claims()), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.verify(context.Background(), tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("verify() = %+v, want an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify() failed: %v", err)
+			}
+			if p.Subject != "ci-bot" || p.Org != "acme" {
+				t.Errorf("verify() = %+v, want sub ci-bot and org acme", p)
+			}
+		})
+	}
+	// Unknown key IDs refetch the JWKS at most once per jwksMinRefresh
+	if iss.fetches != 1 {
+		t.Errorf("fetched the JWKS %d times, want 1", iss.fetches)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	v, err := newOIDCVerifier(context.Background(), iss.URL, iss.URL+"/jwks", "", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := iss.sign(t, jwt.SigningMethodRS256, "rsa", iss.rsaKey, iss.claims())
+	if _, err := v.verify(context.Background(), token); err != nil {
+		t.Fatalf("verify() failed: %v", err)
+	}
+	// Stale keys are refetched, and kept when the issuer can't be reached
+	v.fetched = time.Now().Add(-jwksMaxAge)
+	iss.Close()
+	if _, err := v.verify(context.Background(), token); err != nil {
+		t.Errorf("verify() with the JWKS unreachable failed: %v", err)
+	}
+	if iss.fetches != 1 {
+		t.Errorf("fetched the JWKS %d times, want 1", iss.fetches)
+	}
+}
+
+func TestOIDCDiscoveryFails(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := newOIDCVerifier(context.Background(), srv.URL, "", "", "org"); err == nil {
+		t.Error("newOIDCVerifier() succeeded without a discovery document")
+	}
+}
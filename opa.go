@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultOPAQuery is the Rego rule a local policy is evaluated with
+const defaultOPAQuery = "data.pip_install.decision"
+
+// An opaPolicy asks Open Policy Agent whether an install may proceed, either
+// through a remote OPA server's Data API or by evaluating a local Rego file
+// with the opa binary. Set from the opa_url, or the opa_policy and opa_query,
+// settings; nil if neither is set.
+type opaPolicy struct {
+	url    string
+	client *http.Client
+
+	policyFile, query string
+}
+
+var opa *opaPolicy
+
+func newRemoteOPAPolicy(url string) *opaPolicy {
+	return &opaPolicy{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func newLocalOPAPolicy(policyFile, query string) (*opaPolicy, error) {
+	if _, err := exec.LookPath("opa"); err != nil {
+		return nil, fmt.Errorf("opa_policy needs the opa binary: %v", err)
+	}
+	return &opaPolicy{policyFile: policyFile, query: query}, nil
+}
+
+// opaInput is the document a policy is evaluated against
+type opaInput struct {
+	Ecosystem string         `json:"ecosystem"`
+	Packages  []Package      `json:"packages"`
+	Files     []string       `json:"files"`
+	Options   InstallOptions `json:"options"`
+	// Principal is the authenticated caller; null when auth is off
+	Principal *Principal `json:"principal"`
+}
+
+// An opaDecision is a policy's verdict. Policies may return a bare boolean
+// or an object with allow and reasons.
+type opaDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+func (d *opaDecision) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Allow); err == nil {
+		return nil
+	}
+	type decision opaDecision
+	return json.Unmarshal(b, (*decision)(d))
+}
+
+// An opaDenyError fails an install the OPA policy denied
+type opaDenyError struct {
+	reasons []string
+}
+
+func (e *opaDenyError) Error() string {
+	if len(e.reasons) == 0 {
+		return "Install denied by policy"
+	}
+	return "Install denied by policy: " + strings.Join(e.reasons, "; ")
+}
+
+func (e *opaDenyError) code() string { return "POLICY_DENIED" }
+
+func (e *opaDenyError) details() map[string]any {
+	return map[string]any{"reasons": e.reasons}
+}
+
+// decide evaluates the policy. An undefined result denies the install.
+func (p *opaPolicy) decide(ctx context.Context, input opaInput) (opaDecision, error) {
+	var result *opaDecision
+	var err error
+	if p.url != "" {
+		result, err = p.decideRemote(ctx, input)
+	} else {
+		result, err = p.decideLocal(ctx, input)
+	}
+	if err != nil {
+		return opaDecision{}, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Policy evaluation failed: %v", err)}
+	}
+	if result == nil {
+		return opaDecision{Reasons: []string{"policy decision is undefined"}}, nil
+	}
+	return *result, nil
+}
+
+// decideRemote queries a policy through OPA's Data API
+func (p *opaPolicy) decideRemote(ctx context.Context, input opaInput) (*opaDecision, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded %s", p.url, resp.Status)
+	}
+	var out struct {
+		Result *opaDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Result, nil
+}
+
+// decideLocal evaluates the policy file with opa eval
+func (p *opaPolicy) decideLocal(ctx context.Context, input opaInput) (*opaDecision, error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "opa", "eval", "--format", "json", "--stdin-input", "--data", p.policyFile, p.query)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("opa eval: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var out struct {
+		Result []struct {
+			Expressions []struct {
+				Value *opaDecision `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(stdout, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Result) == 0 || len(out.Result[0].Expressions) == 0 {
+		return nil, nil
+	}
+	return out.Result[0].Expressions[0].Value, nil
+}
+
+// checkOPAPolicy asks the OPA policy whether the caller may install pkgs
+func checkOPAPolicy(ctx context.Context, eco *Ecosystem, req *InstallRequest, pkgs []Package) error {
+	if opa == nil {
+		return nil
+	}
+	input := opaInput{Ecosystem: eco.Name, Packages: pkgs, Files: make([]string, 0, len(req.Files)), Options: req.Options}
+	if input.Packages == nil {
+		input.Packages = []Package{}
+	}
+	for name := range req.Files {
+		input.Files = append(input.Files, name)
+	}
+	slices.Sort(input.Files)
+	if p, ok := principalFrom(ctx); ok {
+		input.Principal = &p
+	}
+	decision, err := opa.decide(ctx, input)
+	if err != nil {
+		return err
+	}
+	if !decision.Allow {
+		loggerFrom(ctx).Warn("install denied by OPA policy", "reasons", decision.Reasons)
+		return &opaDenyError{reasons: decision.Reasons}
+	}
+	return nil
+}
+
+// checkInstallPolicies checks installed packages against the package policy
+// and the OPA policy
+func checkInstallPolicies(ctx context.Context, eco *Ecosystem, req *InstallRequest, pkgs []Package) error {
+	if err := checkPolicy(eco, pkgs); err != nil {
+		return err
+	}
+	return checkOPAPolicy(ctx, eco, req, pkgs)
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// installBodySchemas are the JSON body schemas of each ecosystem's install
+// requests, which incoming bodies are validated against
+var installBodySchemas = sync.OnceValue(func() map[string]*schema {
+	schemas := make(map[string]*schema)
+	for _, eco := range append(ecosystems[:len(ecosystems):len(ecosystems)], npmEcosystem) {
+		schemas[eco.Name] = installBodySchema(eco)
+	}
+	return schemas
+})
+
+// openAPIDocument is the spec served at /openapi.json, built once since the
+// ecosystems and formats it lists don't change
+var openAPIDocument = sync.OnceValue(func() []byte {
+	doc, err := json.MarshalIndent(openAPISpec(), "", "  ")
+	if err != nil {
+		slog.Error("failed to encode OpenAPI spec", "error", err)
+	}
+	return doc
+})
+
+// handleOpenAPI serves GET /openapi.json
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument())
+}
+
+func stringSchema(description string) *schema {
+	return &schema{Type: "string", Description: description}
+}
+
+func enumSchema(description string, values []string) *schema {
+	return &schema{Type: "string", Description: description, Enum: values}
+}
+
+func targetSchema(description string) *schema {
+	return &schema{Type: "object", Closed: true, Description: description, Properties: map[string]*schema{
+		"platform": enumSchema("", targetPlatforms),
+		"arch":     enumSchema("", targetArchs),
+		"libc":     enumSchema("For linux targets.", targetLibcs),
+	}}
+}
+
+func boolSchema(description string) *schema {
+	return &schema{Type: "boolean", Description: description}
+}
+
+func listSchema(description string, items *schema) *schema {
+	return &schema{Type: "array", Description: description, Items: items}
+}
+
+func intSchema(description string, min, max float64) *schema {
+	return &schema{Type: "integer", Description: description, Minimum: &min, Maximum: &max}
+}
+
+func refSchema(name string) *schema {
+	return &schema{Ref: "#/components/schemas/" + name}
+}
+
+// optionsSchema describes InstallOptions. Whether an option applies to the
+// ecosystem is left to the server, which explains why it doesn't.
+func optionsSchema() *schema {
+	sbomNames := make([]string, len(sbomFormats))
+	for i, f := range sbomFormats {
+		sbomNames[i] = f.Name
+	}
+	return &schema{Type: "object", Closed: true, Properties: map[string]*schema{
+		"callback_url":      {Type: "string", Format: "uri", Description: "Receives a POST when an asynchronous job finishes."},
+		"timeout":           stringSchema(`Overrides the install timeout, as a Go duration such as "5m".`),
+		"registry":          {Type: "string", Format: "uri", Description: "Replaces the default registry or index; it must be in the server's allowlist."},
+		"ignore_scripts":    boolSchema("Skips package lifecycle scripts and source builds. Unset means the server's policy decides."),
+		"node_version":      stringSchema(`Runs a Node.js install on the newest release matching a version such as "20".`),
+		"ruby_version":      stringSchema(`Runs a Bundler install on the newest Ruby release matching a version such as "3.3".`),
+		"omit":              listSchema(`Kinds of dependencies to leave out, such as "dev".`, &schema{Type: "string"}),
+		"peer_deps_mode":    enumSchema("How a Node.js install treats peer dependencies: strict fails on conflicts, legacy leaves them out and auto falls back to legacy on a conflict.", peerDepsModes),
+		"engine_strict":     boolSchema("Fails a Node.js install on any package whose engines field the toolchain doesn't satisfy."),
+		"npm_args":          listSchema("Extra flags for yarn and pnpm; each must be in the server's allowlist.", &schema{Type: "string"}),
+		"audit_fix":         boolSchema("Makes /audit/{ecosystem} upgrade vulnerable dependencies."),
+		"audit_fail_on":     enumSchema("Fails the install on advisories of this severity or worse.", gateSeverities),
+		"require_integrity": boolSchema("Fails a pnpm or yarn install unless its lock file pins every package with an integrity hash."),
+		"verify_provenance": enumSchema("Fails a Node.js install whose packages lack valid registry signatures, or with attestations, provenance attestations.", provenanceLevels),
+		"sbom":              enumSchema("Adds a software bill of materials in this format to the archive.", sbomNames),
+		"deny_licenses":     listSchema("SPDX license identifiers to add to the server's denylist.", &schema{Type: "string", Pattern: `^[^ ()]+$`}),
+		"workspaces":        listSchema("Limits a workspace install to these packages and the workspaces they depend on.", &schema{Type: "string"}),
+		"include":           listSchema("What the archive holds: the installed directory and manifests written by the install.", &schema{Type: "string"}),
+		"compression":       enumSchema("How zip and tar.gz archives are compressed.", compressionMethods),
+		"compression_level": intSchema("The deflate level of zip and tar.gz archives.", 1, 9),
+		"license_report":    boolSchema("Adds a report of the installed packages' licenses to the archive."),
+		"report":            boolSchema("Adds the install report to the archive as install-report.json."),
+		"dry_run":           boolSchema("Resolves the install without running it and responds with a DryRunResult: what would be installed and the lock file, for pip, pnpm and poetry."),
+		"prune":             boolSchema("Removes tests, docs, source maps and other files packages don't need at run time from node_modules."),
+		"target":            targetSchema("Installs native modules for another platform than the server's; unset fields are the server's."),
+		"targets":           {Type: "array", MaxItems: maxTargets, Items: targetSchema(""), Description: "Installs for each platform in parallel, into one archive with a <platform>-<arch>[-<libc>] directory per target."},
+		"bundle": {Type: "object", Closed: true, Required: []string{"entry_points"}, Description: "What POST /bundle builds with esbuild.", Properties: map[string]*schema{
+			"entry_points": {Type: "array", MinItems: 1, Items: &schema{Type: "string"}, Description: "Project files bundled, each into its own output."},
+			"platform":     enumSchema("Default node.", bundlePlatforms),
+			"target":       listSchema(`Environments the output must run on, such as "node20" or "es2020".`, &schema{Type: "string", Pattern: bundleTargetPattern.String()}),
+			"format":       enumSchema("", bundleFormats),
+			"minify":       boolSchema(""),
+			"sourcemap":    boolSchema(""),
+			"external":     listSchema("Packages left out of the bundle to be loaded at run time.", &schema{Type: "string"}),
+		}},
+		"output": {Type: "object", Closed: true, Description: "Uploads the archive instead of returning it.", Properties: map[string]*schema{
+			"type":       enumSchema("The kind of store (default the server's output_default_type).", outputTypes),
+			"bucket":     stringSchema("The bucket, or for Azure the container."),
+			"key":        stringSchema("The object name (default <sha256>/<filename>)."),
+			"repository": stringSchema("Where oci and image outputs are pushed, such as ghcr.io/acme/deps."),
+			"tag":        stringSchema("The oci or image output's tag (default the hash of the install's inputs)."),
+			"base_image": stringSchema(`The image an image output's layer goes on top of, or "scratch".`),
+			"path":       stringSchema("The directory an image output puts the installed directory in."),
+			"platform":   stringSchema("The image output's os/architecture."),
+		}},
+	}}
+}
+
+// installBodySchema describes a JSON install body for eco: its manifests by
+// name, or packages, next to the options
+func installBodySchema(eco *Ecosystem) *schema {
+	body := optionsSchema()
+	body.Description = "Manifest files by name, or packages, next to the install options."
+	for _, mf := range eco.Files {
+		body.Properties[mf.Name] = stringSchema("The contents of " + mf.Name + ".")
+		if mf.Base64 {
+			body.Properties[mf.Name] = &schema{Type: "string", Format: "byte", Description: "The contents of " + mf.Name + ", base64-encoded."}
+		}
+	}
+	body.Properties["packages"] = &schema{Type: "array", MinItems: 1, Items: &schema{Type: "string"},
+		Description: `Package specs such as "express@4" to install without a manifest.`}
+	if eco.Runtime == "node" {
+		body.PatternProperties = map[string]*schema{`/package\.json$`: stringSchema("A workspace package's package.json, keyed by its path.")}
+	}
+	return body
+}
+
+// validateInstallBody checks a JSON install body against eco's schema
+func validateInstallBody(eco *Ecosystem, raw []byte) error {
+	return installBodySchemas()[eco.Name].validateJSON(raw, "")
+}
+
+// validateOptions checks the options field of a multipart upload
+func validateOptions(raw []byte) error {
+	return optionsSchema().validateJSON(raw, "options")
+}
+
+// openAPISpec describes the HTTP API as an OpenAPI 3.1 document
+func openAPISpec() map[string]any {
+	paths := map[string]any{}
+	for _, eco := range ecosystems {
+		paths["/install/"+eco.Name] = map[string]any{"post": installOperation(eco,
+			"Install "+eco.Name+" manifests", "Runs the install and responds with the archive.")}
+		if eco.Audit != nil {
+			paths["/audit/"+eco.Name] = map[string]any{"post": map[string]any{
+				"summary":     "Audit " + eco.Name + " dependencies",
+				"description": "Installs the manifests like /install/" + eco.Name + " and responds with the advisories found.",
+				"requestBody": installRequestBody(eco),
+				"responses": withErrors(map[string]any{
+					"200": jsonResponse("The audit report.", refSchema("AuditReport")),
+				}),
+			}}
+		}
+	}
+	packages := installOperation(packagesEcosystem, "Install packages by name",
+		"Installs a list of package specs, or an object with packages and options, with the ecosystem named by the ecosystem query parameter.")
+	packages["parameters"] = append(packages["parameters"].([]any), map[string]any{
+		"name": "ecosystem", "in": "query", "schema": enumSchema("", ecosystemNames()),
+	})
+	paths["/install/packages"] = map[string]any{"post": packages}
+	legacy := installOperation(pipEcosystem, "Install pip requirements", "The same as /install/pip.")
+	legacy["deprecated"] = true
+	paths["/install"] = map[string]any{"post": legacy}
+
+	for path, op := range map[string][2]string{
+		"/lock":     {"Generate a package-lock.json", "Responds with the package-lock.json npm resolves for the package.json."},
+		"/tree":     {"Resolve the dependency tree", "Responds with the dependency tree npm resolves for the package.json."},
+		"/outdated": {"Find outdated dependencies", "Responds with the dependencies that have newer versions in the registry."},
+	} {
+		result := map[string]string{"/lock": "PackageLock", "/tree": "DependencyTree", "/outdated": "OutdatedReport"}[path]
+		paths[path] = map[string]any{"post": map[string]any{
+			"summary":     op[0],
+			"description": op[1],
+			"requestBody": installRequestBody(npmEcosystem),
+			"responses":   withErrors(map[string]any{"200": jsonResponse("The result.", refSchema(result))}),
+		}}
+	}
+
+	bundle := installOperation(yarnEcosystem, "Bundle a project with esbuild",
+		"Installs the project's dependencies, which must include esbuild, then responds with an archive of what esbuild builds from the bundle option's entry points. Send the project as the project part of a multipart upload with the options.")
+	bundle["parameters"] = append(bundle["parameters"].([]any), map[string]any{
+		"name": "ecosystem", "in": "query", "schema": enumSchema("Default yarn.", []string{"yarn", "pnpm", "bun"}),
+	})
+	paths["/bundle"] = map[string]any{"post": bundle}
+
+	jobPath := func(summary, description string, ok map[string]any) map[string]any {
+		return map[string]any{"get": map[string]any{
+			"summary":     summary,
+			"description": description,
+			"parameters":  []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": stringSchema("")}},
+			"responses": withErrors(map[string]any{
+				"200": ok,
+				"404": errorResponse("There is no such job, or it has expired."),
+				"409": errorResponse("The job hasn't succeeded."),
+			}),
+		}}
+	}
+	submit := installOperation(pipEcosystem, "Submit a job", "Queues an install and responds with the job straight away.")
+	submit["parameters"] = append(submit["parameters"].([]any), map[string]any{
+		"name": "ecosystem", "in": "query", "schema": enumSchema("The ecosystem, default pip. The body is that of /install/{ecosystem}.", ecosystemNames()),
+	}, map[string]any{
+		"name": "Idempotency-Key", "in": "header", "schema": stringSchema("Up to 255 characters. Submitting the same install with the same key again within idempotency_window returns the first job, with Idempotent-Replayed: true."),
+	})
+	submit["responses"] = withErrors(map[string]any{
+		"202": jsonResponse("The queued job, or a succeeded one when the result was cached.", refSchema("Job")),
+		"409": errorResponse("The job first submitted with the Idempotency-Key is still being submitted."),
+		"422": errorResponse("The Idempotency-Key was used for a different install."),
+	})
+	paths["/jobs"] = map[string]any{"post": submit}
+	paths["/jobs/{id}"] = jobPath("Get a job", "", jsonResponse("The job.", refSchema("Job")))
+	paths["/jobs/{id}/artifact"] = jobPath("Download a job's archive", "", archiveResponse())
+	paths["/jobs/{id}/artifact.sig"] = jobPath("Download the archive's signature", "", binaryResponse("The signature.", "application/octet-stream"))
+	paths["/jobs/{id}/sbom"] = jobPath("Download the archive's SBOM", "", jsonResponse("The SBOM in the format the job asked for.", &schema{Type: "object"}))
+	paths["/jobs/{id}/licenses"] = jobPath("Get the license report", "", jsonResponse("The licenses of the installed packages.", &schema{Type: "object"}))
+	paths["/jobs/{id}/report"] = jobPath("Get the install report", "", jsonResponse("What the job installed.", refSchema("InstallReport")))
+	paths["/jobs/{id}/events"] = jobPath("Stream a job's events", "A Server-Sent Events stream of JobEvent objects that ends once the job has finished. Send Last-Event-ID to resume.",
+		map[string]any{"description": "The events.", "content": map[string]any{"text/event-stream": map[string]any{"schema": refSchema("JobEvent")}}})
+	paths["/jobs/{id}/ws"] = jobPath("Stream a job's events over a WebSocket", "Each message is a JobEvent.",
+		map[string]any{"description": "Switching to the WebSocket protocol."})
+	idParam := []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": stringSchema("")}}
+	paths["/admin/jobs"] = map[string]any{"get": map[string]any{
+		"summary":     "List queued and running jobs",
+		"description": "Admins only. Running jobs come first, with what they use on the replica answering, then queued ones in the order they will run.",
+		"parameters":  []any{map[string]any{"name": "status", "in": "query", "schema": stringSchema("queued, running or both, comma-separated; both by default.")}},
+		"responses": withErrors(map[string]any{"200": jsonResponse("The jobs.", &schema{Type: "object", Properties: map[string]*schema{
+			"jobs": listSchema("", refSchema("AdminJob")),
+		}})}),
+	}}
+	paths["/admin/jobs/{id}/logs"] = map[string]any{"get": map[string]any{
+		"summary":    "Get a job's output so far",
+		"parameters": idParam,
+		"responses":  withErrors(map[string]any{"200": textResponse("The job's log lines and status changes."), "404": errorResponse("There is no such job, or it has expired.")}),
+	}}
+	paths["/jobs/{id}"].(map[string]any)["delete"] = map[string]any{
+		"summary":     "Cancel a job",
+		"description": "For the job's submitter or an admin. The job fails with JOB_CANCELLED; a running job's package manager is killed with its process group and its workspace removed.",
+		"parameters":  idParam,
+		"responses": withErrors(map[string]any{
+			"200": jsonResponse("The cancelled job.", refSchema("Job")),
+			"202": jsonResponse("The job is stopping.", refSchema("Job")),
+			"404": errorResponse("There is no such job, or it has expired."),
+			"409": errorResponse("The job has already finished."),
+		}),
+	}
+	paths["/admin/jobs/{id}/cancel"] = map[string]any{"post": map[string]any{
+		"summary":     "Cancel a job",
+		"description": "Admins only. The job fails with JOB_CANCELLED; a running job's package manager is killed with its process group and its workspace removed.",
+		"parameters":  idParam,
+		"responses": withErrors(map[string]any{
+			"200": jsonResponse("The cancelled job.", refSchema("Job")),
+			"202": jsonResponse("The job is stopping.", refSchema("Job")),
+			"404": errorResponse("There is no such job, or it has expired."),
+			"409": errorResponse("The job has already finished."),
+		}),
+	}}
+	paths["/admin/jobs/{id}/promote"] = map[string]any{"post": map[string]any{
+		"summary":    "Move a queued job to the front of the queue",
+		"parameters": idParam,
+		"responses": withErrors(map[string]any{
+			"200": jsonResponse("The job.", refSchema("Job")),
+			"404": errorResponse("There is no such job, or it has expired."),
+			"409": errorResponse("The job isn't queued."),
+		}),
+	}}
+	paths["/artifacts/{sha}"] = map[string]any{"get": map[string]any{
+		"summary":    "Download an archive by digest",
+		"parameters": []any{map[string]any{"name": "sha", "in": "path", "required": true, "schema": &schema{Type: "string", Pattern: "^[0-9a-f]{64}$"}}},
+		"responses":  withErrors(map[string]any{"200": archiveResponse(), "404": errorResponse("The artifact doesn't exist or has expired.")}),
+	}}
+	paths["/artifacts/{sha}/report"] = map[string]any{"get": map[string]any{
+		"summary":    "Get an archive's install report",
+		"parameters": []any{map[string]any{"name": "sha", "in": "path", "required": true, "schema": &schema{Type: "string", Pattern: "^[0-9a-f]{64}$"}}},
+		"responses":  withErrors(map[string]any{"200": jsonResponse("What the install put in the archive.", refSchema("InstallReport")), "404": errorResponse("The artifact doesn't exist, has expired or has no report.")}),
+	}}
+
+	paths["/cache/warm"] = map[string]any{
+		"post": map[string]any{
+			"summary":     "Warm the package cache",
+			"description": "Queues installs that only fill the shared package cache, run while the server is idle.",
+			"requestBody": map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": &schema{
+				Type: "object", Required: []string{"installs"}, Properties: map[string]*schema{
+					"installs": listSchema("Install bodies, each with an ecosystem field.", &schema{Type: "object"}),
+				}}}}},
+			"responses": withErrors(map[string]any{"202": jsonResponse("The queued warm-ups.", &schema{Type: "object"})}),
+		},
+		"get": map[string]any{
+			"summary":   "List cache warm-ups",
+			"responses": withErrors(map[string]any{"200": jsonResponse("Warm-ups from the last day.", &schema{Type: "object"})}),
+		},
+	}
+	paths["/config"] = map[string]any{"get": map[string]any{
+		"summary":   "Get the effective configuration",
+		"responses": withErrors(map[string]any{"200": jsonResponse("Each setting's value and source.", &schema{Type: "object"})}),
+	}}
+	paths["/tenant"] = map[string]any{"get": map[string]any{
+		"summary":   "Get the caller's tenant's limits and usage",
+		"responses": withErrors(map[string]any{"200": jsonResponse("The tenant account.", refSchema("TenantAccount")), "404": errorResponse("Tenants aren't enabled.")}),
+	}}
+	paths["/usage"] = map[string]any{"get": map[string]any{
+		"summary":     "Report usage by API key or tenant",
+		"description": "Admins only, when admins is set.",
+		"parameters": []any{
+			map[string]any{"name": "from", "in": "query", "schema": stringSchema("Start of the range, an RFC 3339 time or a date; the start of the month by default.")},
+			map[string]any{"name": "to", "in": "query", "schema": stringSchema("End of the range; now by default.")},
+			map[string]any{"name": "group_by", "in": "query", "schema": enumSchema("Default tenant when tenants are set up, and key otherwise.", []string{"key", "tenant"})},
+		},
+		"responses": withErrors(map[string]any{"200": jsonResponse("The usage of each key or tenant in the hours starting in the range.", refSchema("UsageReport"))}),
+	}}
+	paths["/admin/audit"] = map[string]any{"get": map[string]any{
+		"summary":     "Search the audit log",
+		"description": "Admins only, when audit_log is set. Returns the matching install records, oldest first, one JSON object per line.",
+		"parameters": []any{
+			map[string]any{"name": "from", "in": "query", "schema": stringSchema("Earliest record, an RFC 3339 time or a date.")},
+			map[string]any{"name": "to", "in": "query", "schema": stringSchema("End of the range, exclusive.")},
+			map[string]any{"name": "caller", "in": "query", "schema": stringSchema("API key label or sub:<subject>.")},
+			map[string]any{"name": "tenant", "in": "query", "schema": stringSchema("")},
+			map[string]any{"name": "ecosystem", "in": "query", "schema": stringSchema("")},
+			map[string]any{"name": "outcome", "in": "query", "schema": enumSchema("", []string{"succeeded", "cached", "failed"})},
+			map[string]any{"name": "package", "in": "query", "schema": stringSchema("Installs that resolved a package, as name or name@version.")},
+			map[string]any{"name": "limit", "in": "query", "schema": &schema{Type: "integer", Description: "Most records returned, the earliest matching; all by default."}},
+		},
+		"responses": withErrors(map[string]any{"200": map[string]any{"description": "The records.", "content": map[string]any{
+			"application/x-ndjson": map[string]any{"schema": refSchema("AuditRecord")},
+		}}}),
+	}}
+	public := []any{}
+	paths["/signing-key"] = map[string]any{"get": map[string]any{
+		"summary":   "Get the artifact signing key",
+		"security":  public,
+		"responses": map[string]any{"200": binaryResponse("The PEM public key.", "application/x-pem-file"), "404": errorResponse("Signing isn't enabled.")},
+	}}
+	paths["/healthz"] = map[string]any{"get": map[string]any{
+		"summary":   "Liveness check",
+		"security":  public,
+		"responses": map[string]any{"200": textResponse("The process is running.")},
+	}}
+	paths["/readyz"] = map[string]any{"get": map[string]any{
+		"summary":  "Readiness check",
+		"security": public,
+		"responses": map[string]any{
+			"200": jsonResponse("The server can take installs.", refSchema("Readiness")),
+			"503": jsonResponse("A check failed or the server is shutting down.", refSchema("Readiness")),
+		},
+	}}
+	paths["/metrics"] = map[string]any{"get": map[string]any{
+		"summary":   "Prometheus metrics",
+		"security":  public,
+		"responses": map[string]any{"200": textResponse("Metrics in the Prometheus text format.")},
+	}}
+	paths["/openapi.json"] = map[string]any{"get": map[string]any{
+		"summary":   "This document",
+		"security":  public,
+		"responses": map[string]any{"200": jsonResponse("The OpenAPI document.", &schema{Type: "object"})},
+	}}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "pip-install",
+			"description": "Runs pip, Poetry, Yarn, pnpm, Bun, Composer and Bundler installs and vendors Deno modules and Rust crates and returns the installed packages as an archive.",
+			"version":     "1",
+		},
+		"paths":    paths,
+		"security": []any{map[string]any{"bearer": []any{}}},
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer", "description": "An API key or, with OIDC configured, a JWT."},
+			},
+			"schemas": componentSchemas(),
+		},
+	}
+}
+
+// installOperation describes an install route for eco
+func installOperation(eco *Ecosystem, summary, description string) map[string]any {
+	formats := make([]string, len(archiveFormats))
+	for i, f := range archiveFormats {
+		formats[i] = f.Name
+	}
+	return map[string]any{
+		"summary":     summary,
+		"description": description,
+		"parameters": []any{
+			map[string]any{"name": "format", "in": "query", "schema": enumSchema("The archive format; the Accept header is used when it is unset.", formats)},
+			map[string]any{"name": "Cache-Control", "in": "header", "schema": stringSchema("no-cache runs the install even if its result is cached.")},
+		},
+		"requestBody": installRequestBody(eco),
+		"responses": withErrors(map[string]any{
+			"200": installResponse(eco),
+			"304": map[string]any{"description": "The archive in If-None-Match was built from the same inputs."},
+			"422": jsonResponse("The install broke a policy: an audit gate, the license denylist or the package policy, or its native modules can't be built.", refSchema("PolicyError")),
+		}),
+	}
+}
+
+// installResponse describes what an install of eco responds with: its
+// archive, or for the ecosystems that support dry_run what it would install
+func installResponse(eco *Ecosystem) map[string]any {
+	resp := archiveResponse()
+	if eco.DryRun != nil {
+		resp["description"] = "The archive, with the output option where it was uploaded, or with dry_run what would be installed."
+		resp["content"].(map[string]any)["application/json"] = map[string]any{"schema": &schema{OneOf: []*schema{refSchema("UploadedArtifact"), refSchema("DryRunResult")}}}
+	}
+	return resp
+}
+
+// installRequestBody describes the bodies an install of eco accepts
+func installRequestBody(eco *Ecosystem) map[string]any {
+	form := &schema{Type: "object", Properties: map[string]*schema{
+		"options":  stringSchema("The options as a JSON object."),
+		"packages": stringSchema("Package specs as a JSON array, instead of a manifest."),
+		"project":  {Type: "string", Format: "binary", Description: "The project directory as a tarball or zip."},
+	}}
+	for _, mf := range eco.Files {
+		form.Properties[mf.Name] = &schema{Type: "string", Format: "binary"}
+	}
+	content := map[string]any{
+		"application/json":    map[string]any{"schema": installBodySchemas()[eco.Name]},
+		"multipart/form-data": map[string]any{"schema": form},
+	}
+	for _, t := range projectContentTypes {
+		content[t] = map[string]any{"schema": &schema{Type: "string", Format: "binary", Description: "The project directory, installed with the default options."}}
+	}
+	return map[string]any{"required": true, "content": content}
+}
+
+// withErrors adds the error responses every authenticated route may give
+func withErrors(responses map[string]any) map[string]any {
+	defaults := map[string]any{
+		"400": errorResponse("The request is invalid. Bodies that don't match their schema set field and reason."),
+		"401": errorResponse("The bearer token is missing or invalid."),
+		"403": errorResponse("The caller's tenant has used up its install minutes or storage, or the route is for admins."),
+		"413": errorResponse("The request body, project or installed directory is too large; max_bytes gives a body's limit."),
+		"429": errorResponse("The client or its tenant is over its rate or concurrency limit; see Retry-After."),
+		"500": errorResponse("The install failed; code says how, such as LOCKFILE_MISMATCH or SCRIPT_FAILED."),
+		"503": errorResponse("The install queue is full, the registry is failing or the server is shutting down; see Retry-After."),
+		"504": errorResponse("The install timed out."),
+	}
+	for code, r := range defaults {
+		if _, ok := responses[code]; !ok {
+			responses[code] = r
+		}
+	}
+	return responses
+}
+
+// usageCountsSchema describes UsageCounts, with the named string fields
+func usageCountsSchema(names ...string) *schema {
+	s := &schema{Type: "object", Properties: map[string]*schema{
+		"requests": {Type: "integer"}, "installs": {Type: "integer"}, "install_seconds": {Type: "number"},
+		"cache_hits": {Type: "integer"}, "bytes_served": {Type: "integer"},
+	}}
+	for _, name := range names {
+		s.Properties[name] = stringSchema("")
+	}
+	return s
+}
+
+func errorResponse(description string) map[string]any {
+	return jsonResponse(description, refSchema("Error"))
+}
+
+func textResponse(description string) map[string]any {
+	return binaryResponse(description, "text/plain")
+}
+
+func binaryResponse(description, contentType string) map[string]any {
+	return map[string]any{"description": description, "content": map[string]any{contentType: map[string]any{"schema": &schema{Type: "string"}}}}
+}
+
+func jsonResponse(description string, s *schema) map[string]any {
+	return map[string]any{"description": description, "content": map[string]any{"application/json": map[string]any{"schema": s}}}
+}
+
+// archiveResponse describes an archive download, or where it was uploaded
+// for installs with the output option
+func archiveResponse() map[string]any {
+	content := map[string]any{"application/json": map[string]any{"schema": refSchema("UploadedArtifact")}}
+	for _, f := range archiveFormats {
+		content[f.ContentType] = map[string]any{"schema": &schema{Type: "string", Format: "binary"}}
+	}
+	header := func(description string) map[string]any {
+		return map[string]any{"description": description, "schema": &schema{Type: "string"}}
+	}
+	return map[string]any{
+		"description": "The archive, or with the output option where it was uploaded.",
+		"headers": map[string]any{
+			"ETag":              header("Identifies the install's inputs, for If-None-Match."),
+			"X-Cache":           header("HIT when the archive came from the result cache, MISS otherwise."),
+			"X-Artifact-Digest": header("The SHA-256 of the archive."),
+			"X-Skipped-Scripts": header("Packages whose install scripts were skipped."),
+			"X-Pruned-Bytes":    header("How many bytes the prune option removed."),
+		},
+		"content": content,
+	}
+}
+
+// componentSchemas describes the JSON responses
+func componentSchemas() map[string]*schema {
+	statuses := []string{string(JobQueued), string(JobRunning), string(JobSucceeded), string(JobFailed)}
+	times := func(description string) *schema {
+		return &schema{Type: "string", Format: "date-time", Description: description}
+	}
+	pkg := &schema{Type: "object", Properties: map[string]*schema{
+		"name": stringSchema(""), "version": stringSchema(""), "license": stringSchema(""), "purl": stringSchema(""),
+	}}
+	return map[string]*schema{
+		"Error": {Type: "object", Required: []string{"code", "error"}, Properties: map[string]*schema{
+			"code":      stringSchema("The kind of failure, such as BAD_REQUEST, INVALID_FIELD, TIMEOUT or REGISTRY_UNREACHABLE."),
+			"error":     stringSchema("The message."),
+			"field":     stringSchema("For INVALID_FIELD, the path to the invalid value, such as output.type or packages[1]; empty for the body itself."),
+			"reason":    stringSchema("For INVALID_FIELD, what is wrong with it."),
+			"exit_code": {Type: "integer", Description: "The exit code of the package manager or other tool that failed."},
+			"log":       stringSchema("The last lines of the failed tool's stderr."),
+			"max_bytes": {Type: "integer", Description: "For a request body over the limit, the limit in bytes."},
+		}},
+		"PolicyError": {Type: "object", Required: []string{"code", "error"}, Description: "Further fields describe what broke the policy.", Properties: map[string]*schema{
+			"code":            enumSchema("", []string{"AUDIT_GATE_FAILED", "LICENSE_DENIED", "PACKAGE_BLOCKED", "POLICY_DENIED", "BUILD_TOOLS_MISSING", "PROVENANCE_FAILED", "LOCKFILE_UNPINNED", "OVERRIDE_UNSATISFIABLE", "ENGINE_INCOMPATIBLE"}),
+			"error":           stringSchema(""),
+			"native_packages": listSchema("", &schema{Type: "string"}),
+			"missing_tools":   listSchema("", &schema{Type: "string"}),
+			"advisories":      listSchema("", refSchema("Advisory")),
+			"threshold":       stringSchema(""),
+			"denied_licenses": listSchema("", &schema{Type: "string"}),
+			"packages":        listSchema("", refSchema("Package")),
+			"violations":      listSchema("", &schema{Type: "object"}),
+			"reasons":         listSchema("", &schema{Type: "string"}),
+			"level":           stringSchema(""),
+			"issues":          listSchema("", refSchema("ProvenanceIssue")),
+			"unpinned": listSchema("", &schema{Type: "object", Properties: map[string]*schema{
+				"package": stringSchema(""), "source": enumSchema("", []string{"git", "local", "tarball"}),
+			}}),
+			"overrides": listSchema("", refSchema("Override")),
+			"engines":   listSchema("", refSchema("EngineMismatch")),
+		}},
+		"EngineMismatch": {Type: "object", Properties: map[string]*schema{
+			"package": stringSchema("The package, as name@version."), "engine": stringSchema("Such as node or npm."),
+			"wanted": stringSchema("The range its engines field requires."), "current": stringSchema("The version the install ran on."),
+		}},
+		"Override": {Type: "object", Properties: map[string]*schema{
+			"selector": stringSchema("The override's key in pnpm.overrides or resolutions."),
+			"package":  stringSchema(""), "version": stringSchema("The version or range it forces."),
+		}},
+		"Package": pkg,
+		"Advisory": {Type: "object", Properties: map[string]*schema{
+			"id": stringSchema(""), "package": stringSchema(""), "versions": listSchema("", &schema{Type: "string"}),
+			"severity": enumSchema("", severityOrder), "title": stringSchema(""), "url": stringSchema(""),
+			"vulnerable_versions": stringSchema(""), "patched_versions": stringSchema(""),
+		}},
+		"AuditReport": {Type: "object", Properties: map[string]*schema{
+			"ecosystem":  stringSchema(""),
+			"advisories": listSchema("", refSchema("Advisory")),
+			"counts":     {Type: "object", Description: "Advisories of each severity.", Values: &schema{Type: "integer"}},
+			"fixed":      listSchema("Advisories an audit fix resolved.", refSchema("Advisory")),
+			"files":      {Type: "object", Description: "Manifests an audit fix changed, by name.", Values: &schema{Type: "string"}},
+		}},
+		"InstallReport": {Type: "object", Properties: map[string]*schema{
+			"ecosystem":     stringSchema(""),
+			"package_count": {Type: "integer"},
+			"total_bytes":   {Type: "integer", Description: "The size of the installed files."},
+			"lockfile":      boolSchema("A lock file was submitted, which added and removed compare the install with."),
+			"added":         listSchema("Installed packages the lock file didn't pin.", refSchema("Package")),
+			"removed":       listSchema("Packages the lock file pinned that weren't installed.", refSchema("Package")),
+			"deprecations": listSchema("Deprecated packages the package manager warned of.", &schema{Type: "object", Properties: map[string]*schema{
+				"package": stringSchema(""), "message": stringSchema(""),
+			}}),
+			"warnings":   listSchema("The package manager's other warnings, such as unmet peer dependencies.", refSchema("InstallWarning")),
+			"provenance": refSchema("ProvenanceReport"),
+			"overrides": listSchema("The manifest's overrides whose packages were installed.", &schema{Type: "object", Properties: map[string]*schema{
+				"selector": stringSchema(""), "package": stringSchema(""), "version": stringSchema(""),
+				"installed": listSchema("The versions of the package installed.", &schema{Type: "string"}),
+			}}),
+			"funding": listSchema("", &schema{Type: "object", Properties: map[string]*schema{
+				"package": stringSchema(""), "url": stringSchema(""),
+			}}),
+			"phases_ms": {Type: "object", Description: "Milliseconds spent in each phase: workspace, install, audit, inspect and archive.", Values: &schema{Type: "integer"}},
+		}},
+		"DryRunResult": {Type: "object", Properties: map[string]*schema{
+			"ecosystem": stringSchema(""),
+			"packages":  listSchema("What the install would install.", refSchema("Package")),
+			"lockfile": {Type: "object", Description: "The lock file the resolution wrote; pip writes none.", Properties: map[string]*schema{
+				"name": stringSchema(""), "content": stringSchema(""),
+			}},
+			"added":       listSchema("Resolved packages the submitted lock file didn't pin.", refSchema("Package")),
+			"removed":     listSchema("Packages the submitted lock file pinned that wouldn't be installed.", refSchema("Package")),
+			"warnings":    listSchema("", refSchema("InstallWarning")),
+			"duration_ms": {Type: "integer"},
+		}},
+		"InstallWarning": {Type: "object", Properties: map[string]*schema{
+			"kind":    enumSchema("", []string{"deprecated", "peer", "unpinned", "warning"}),
+			"package": stringSchema("The deprecated package, as name@version."),
+			"message": stringSchema(""),
+		}},
+		"UploadedArtifact": {Type: "object", Properties: map[string]*schema{
+			"type": stringSchema(""), "bucket": stringSchema(""), "key": stringSchema(""),
+			"url": stringSchema("Downloads the archive without credentials until expires_at."), "expires_at": times(""),
+			"reference": stringSchema(""), "manifest_digest": stringSchema(""), "sha256": stringSchema(""), "size": {Type: "integer"},
+		}},
+		"Job": {Type: "object", Properties: map[string]*schema{
+			"id":                      stringSchema(""),
+			"ecosystem":               stringSchema(""),
+			"status":                  enumSchema("", statuses),
+			"error":                   stringSchema(""),
+			"error_code":              stringSchema("The code of the error response the failure would have been."),
+			"exit_code":               {Type: "integer", Description: "The failed tool's exit code."},
+			"created_at":              times(""),
+			"started_at":              times(""),
+			"finished_at":             times(""),
+			"artifact_sha256":         stringSchema(""),
+			"artifact_url":            stringSchema(""),
+			"cached":                  boolSchema("The archive came from the result cache."),
+			"coalesced_with":          stringSchema("The job whose identical install this one waited for instead of running its own."),
+			"queue_position":          {Type: "integer", Description: "The job's 1-based place in the queue while it waits."},
+			"owner":                   {Type: "object", Description: "Who submitted the job."},
+			"skipped_scripts":         listSchema("", &schema{Type: "string"}),
+			"pruned_bytes":            {Type: "integer", Description: "How many bytes the prune option removed."},
+			"warnings":                listSchema("What the package manager warned of, whether or not the job failed.", refSchema("InstallWarning")),
+			"retries":                 {Type: "integer", Description: "How many times the install was run again after failing to reach the registry."},
+			"provenance":              refSchema("ProvenanceReport"),
+			"advisories":              listSchema("", refSchema("Advisory")),
+			"denied_packages":         listSchema("", refSchema("Package")),
+			"policy_violations":       listSchema("", &schema{Type: "object"}),
+			"policy_reasons":          listSchema("", &schema{Type: "string"}),
+			"unsatisfiable_overrides": listSchema("", refSchema("Override")),
+			"incompatible_engines":    listSchema("", refSchema("EngineMismatch")),
+			"output":                  refSchema("UploadedArtifact"),
+		}},
+		"AdminJob": {Type: "object", Description: "A Job, with where it runs and what it uses.", Properties: map[string]*schema{
+			"id":     stringSchema(""),
+			"status": enumSchema("", statuses),
+			"worker": stringSchema("The replica running the job, with a shared job queue."),
+			"resources": {Type: "object", Properties: map[string]*schema{
+				"workspace_bytes": {Type: "integer"},
+				"step":            stringSchema("The tool's step, such as install."),
+				"pid":             {Type: "integer"},
+				"step_seconds":    {Type: "number"},
+				"memory_bytes":    {Type: "integer", Description: "The tool's process group's resident memory, or its cgroup's."},
+				"cpu_seconds":     {Type: "number"},
+			}},
+		}},
+		"JobEvent": {Type: "object", Properties: map[string]*schema{
+			"id":     {Type: "integer"},
+			"type":   enumSchema("", []string{"status", "log"}),
+			"time":   times(""),
+			"phase":  enumSchema("", []string{PhaseQueued, PhaseInstalling, PhaseAuditing, PhaseArchiving, PhaseUploading, PhaseDone}),
+			"status": enumSchema("", statuses),
+			"stream": stringSchema(""),
+			"line":   stringSchema(""),
+		}},
+		"PackageLock": {Type: "object", Description: "A package-lock.json."},
+		"DependencyTree": {Type: "object", Properties: map[string]*schema{
+			"name": stringSchema(""), "version": stringSchema(""), "packages": {Type: "integer"},
+			"dependencies": listSchema("", &schema{Type: "object"}),
+		}},
+		"OutdatedReport": {Type: "object", Properties: map[string]*schema{
+			"dependencies": listSchema("", &schema{Type: "object", Properties: map[string]*schema{
+				"name": stringSchema(""), "current": stringSchema(""), "wanted": stringSchema(""), "latest": stringSchema(""),
+				"type": stringSchema(""), "location": stringSchema(""),
+			}}),
+		}},
+		"UsageReport": {Type: "object", Properties: map[string]*schema{
+			"from": stringSchema(""), "to": stringSchema(""), "group_by": stringSchema(""),
+			"groups": listSchema("", usageCountsSchema("key", "tenant")),
+			"total":  usageCountsSchema(),
+		}},
+		"TenantAccount": {Type: "object", Properties: map[string]*schema{
+			"tenant": stringSchema(""),
+			"limits": {Type: "object", Description: "Zero or missing limits are unlimited.", Properties: map[string]*schema{
+				"concurrent_jobs": {Type: "integer"}, "install_minutes": {Type: "number"}, "storage_mb": {Type: "integer"},
+			}},
+			"month":           stringSchema("The month install_minutes counts, as YYYY-MM in UTC."),
+			"active_jobs":     {Type: "integer"},
+			"install_minutes": {Type: "number"},
+			"storage_bytes":   {Type: "integer", Description: "The size of the tenant's artifacts that haven't expired."},
+			"cache_namespace": stringSchema("The result cache the tenant's installs share."),
+		}},
+		"ProvenanceReport": {Type: "object", Properties: map[string]*schema{
+			"level":   enumSchema("The policy the packages were held to.", provenanceLevels),
+			"checked": {Type: "integer", Description: "How many installed packages came from a registry and were verified."},
+			"issues":  listSchema("The packages that failed.", refSchema("ProvenanceIssue")),
+		}},
+		"ProvenanceIssue": {Type: "object", Properties: map[string]*schema{
+			"package": stringSchema("As name@version."),
+			"problem": enumSchema("", []string{"invalid_signature", "missing_signature", "invalid_attestation", "missing_attestation"}),
+			"message": stringSchema(""),
+		}},
+		"AuditRecord": {Type: "object", Properties: map[string]*schema{
+			"time":             {Type: "string", Format: "date-time"},
+			"request_id":       stringSchema("For installs answered synchronously."),
+			"job_id":           stringSchema("For jobs."),
+			"caller":           stringSchema("The API key label or sub:<subject>."),
+			"tenant":           stringSchema(""),
+			"client_ip":        stringSchema(""),
+			"ecosystem":        stringSchema(""),
+			"input_sha256":     stringSchema("The hash of the install's inputs the result cache is keyed on."),
+			"files":            {Type: "object", Description: "The SHA-256 of each manifest sent, by name.", Values: &schema{Type: "string"}},
+			"options":          {Type: "object", Description: "The install options, with credentials in URLs removed."},
+			"outcome":          enumSchema("", []string{"succeeded", "cached", "failed"}),
+			"status":           {Type: "integer"},
+			"error_code":       stringSchema(""),
+			"error":            stringSchema(""),
+			"duration_seconds": {Type: "number"},
+			"artifact_sha256":  stringSchema(""),
+			"packages":         listSchema("What the install resolved, for those that succeeded.", refSchema("Package")),
+		}},
+		"Readiness": {Type: "object", Properties: map[string]*schema{
+			"ready": {Type: "boolean"},
+			"checks": listSchema("", &schema{Type: "object", Properties: map[string]*schema{
+				"name": stringSchema(""), "ok": {Type: "boolean"}, "error": stringSchema(""),
+			}}),
+		}},
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+)
+
+// An OutdatedDependency is a dependency with a newer release than the one
+// installed, as npm outdated reports it
+type OutdatedDependency struct {
+	Name string `json:"name"`
+	// Current is the installed version; empty if it isn't installed
+	Current string `json:"current,omitempty"`
+	// Wanted is the newest version package.json's range allows
+	Wanted string `json:"wanted"`
+	// Latest is the version tagged latest in the registry
+	Latest string `json:"latest"`
+	// Type is the package.json section declaring it, such as devDependencies
+	Type     string `json:"type,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// An OutdatedReport is the response of POST /outdated
+type OutdatedReport struct {
+	Dependencies []OutdatedDependency `json:"dependencies"`
+}
+
+// handleOutdated serves POST /outdated: the request's package.json is
+// installed without scripts and npm outdated compares the result against the
+// registry
+func (in *Installer) handleOutdated(w http.ResponseWriter, r *http.Request) {
+	var report *OutdatedReport
+	ok := in.runNpm(w, r, func(ctx context.Context, req *InstallRequest, workDir string) error {
+		// The installed versions are what outdated calls current
+		if err := runNpmStep(ctx, req, workDir, "install", []string{"install", "--ignore-scripts", "--no-audit", "--no-fund"}, nil); err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		err := runNpmStep(ctx, req, workDir, "outdated", []string{"outdated", "--json", "--long"}, &out)
+		// npm outdated exits with an error when anything is outdated
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return err
+		}
+		deps, parseErr := parseNpmOutdated(out.Bytes())
+		if parseErr != nil {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("Failed to read npm outdated output: %v", parseErr)
+		}
+		report = &OutdatedReport{Dependencies: deps}
+		loggerFrom(ctx).Info("checked for outdated dependencies", "outdated", len(deps))
+		return nil
+	})
+	if ok {
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// parseNpmOutdated reads npm outdated --json output, an object keyed by
+// package name. A package installed at several locations has an array.
+func parseNpmOutdated(out []byte) ([]OutdatedDependency, error) {
+	deps := []OutdatedDependency{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return deps, nil
+	}
+	var byName map[string]json.RawMessage
+	if err := json.Unmarshal(out, &byName); err != nil {
+		return nil, err
+	}
+	for name, raw := range byName {
+		var entries []OutdatedDependency
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			if err := json.Unmarshal(raw, &entries); err != nil {
+				return nil, err
+			}
+		} else {
+			var entry OutdatedDependency
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		for _, entry := range entries {
+			entry.Name = name
+			deps = append(deps, entry)
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Name != deps[j].Name {
+			return deps[i].Name < deps[j].Name
+		}
+		return deps[i].Location < deps[j].Location
+	})
+	return deps, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An OutputStore is an object store the output option can upload archives to
+type OutputStore interface {
+	// Put uploads an object; sum is the hex SHA-256 of body
+	Put(ctx context.Context, bucket, key, contentType string, body io.Reader, size int64, sum string) error
+	// SignedURL returns a URL that downloads an object without credentials
+	// until the returned time
+	SignedURL(ctx context.Context, bucket, key string, now time.Time) (string, time.Time, error)
+	// Buckets lists the buckets requests may upload to
+	Buckets() []string
+}
+
+// outputStores are the configured OutputStores by type: s3, gcs or azure
+var outputStores = map[string]OutputStore{}
+
+// outputDefaultType is the store used when the output option names none
+var outputDefaultType string
+
+// maxSignedURLTTL is the longest S3 and GCS signed URLs can last
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// outputTypes lists the output option's types
+var outputTypes = []string{"s3", "gcs", "azure", "oci", "image"}
+
+// An OutputTarget is where the output option uploads an install's archive
+// instead of returning it in the response
+type OutputTarget struct {
+	// Type is the kind of store: s3, gcs, azure, oci or image (default
+	// the server's output_default_type)
+	Type string `json:"type,omitempty"`
+	// Bucket is the bucket, or for Azure the container
+	Bucket string `json:"bucket,omitempty"`
+	// Key is the object name; it defaults to <sha256>/<filename>
+	Key string `json:"key,omitempty"`
+	// Repository is where oci outputs are pushed, such as ghcr.io/acme/deps
+	Repository string `json:"repository,omitempty"`
+	// Tag is the oci or image output's tag; it defaults to the hash of the
+	// install's inputs, so an unchanged lock file gives the same tag
+	Tag string `json:"tag,omitempty"`
+	// BaseImage is the image an image output's layer goes on top of, or
+	// "scratch" for none (default the server's image_default_base)
+	BaseImage string `json:"base_image,omitempty"`
+	// Path is the directory the image output puts the installed
+	// directory in (default /app)
+	Path string `json:"path,omitempty"`
+	// Platform is the image output's os/architecture (default the server's)
+	Platform string `json:"platform,omitempty"`
+}
+
+// An UploadedArtifact describes an archive uploaded to an output target
+type UploadedArtifact struct {
+	Type   string `json:"type"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// URL downloads the archive without credentials until ExpiresAt
+	URL       string     `json:"url,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Reference and ManifestDigest name a pushed OCI artifact
+	Reference      string `json:"reference,omitempty"`
+	ManifestDigest string `json:"manifest_digest,omitempty"`
+	SHA256         string `json:"sha256"`
+	Size           int64  `json:"size"`
+}
+
+// validateOutput checks the output option, filling in the default type
+func validateOutput(target *OutputTarget) error {
+	if target.Type == "" {
+		if outputDefaultType == "" {
+			return badRequest("Invalid output: type is required (one of %s)", strings.Join(outputTypes, ", "))
+		}
+		target.Type = outputDefaultType
+	}
+	if !slices.Contains(outputTypes, target.Type) {
+		return badRequest("Invalid output type %q: must be one of %s", target.Type, strings.Join(outputTypes, ", "))
+	}
+	if target.Type != "image" && (target.BaseImage != "" || target.Path != "" || target.Platform != "") {
+		return badRequest("Invalid output: base_image, path and platform are only for image outputs")
+	}
+	if target.Type == "oci" || target.Type == "image" {
+		return validateOCIOutput(target)
+	}
+	if target.Repository != "" || target.Tag != "" {
+		return badRequest("Invalid output: repository and tag are only for oci and image outputs")
+	}
+	store := outputStores[target.Type]
+	if store == nil {
+		return badRequest("%s output is not configured on this server", target.Type)
+	}
+	if !slices.Contains(store.Buckets(), target.Bucket) {
+		return badRequest("Invalid output bucket %q: must be one of %s", target.Bucket, strings.Join(store.Buckets(), ", "))
+	}
+	if len(target.Key) > 1024 || strings.HasPrefix(target.Key, "/") || slices.Contains(strings.Split(target.Key, "/"), "..") {
+		return badRequest("Invalid output key %q", target.Key)
+	}
+	return nil
+}
+
+// validateOCIOutput checks an output option of type oci or image
+func validateOCIOutput(target *OutputTarget) error {
+	if ociOutput == nil {
+		return badRequest("%s output is not configured on this server", target.Type)
+	}
+	if target.Bucket != "" || target.Key != "" {
+		return badRequest("Invalid output: %s outputs take a repository and tag, not a bucket and key", target.Type)
+	}
+	if _, _, ok := splitRepository(target.Repository); !ok {
+		return badRequest("Invalid output repository %q: must be a registry host and path such as ghcr.io/acme/deps", target.Repository)
+	}
+	if !ociOutput.allowed(target.Repository) {
+		return badRequest("Invalid output repository %q: must be in %s", target.Repository, strings.Join(ociOutput.repositories, ", "))
+	}
+	if target.Tag != "" && !ociTagPattern.MatchString(target.Tag) {
+		return badRequest("Invalid output tag %q", target.Tag)
+	}
+	if target.Type == "image" {
+		return validateImageOutput(target)
+	}
+	return nil
+}
+
+// writeUploaded responds with where an install's archive was uploaded, or
+// with the error that stopped it
+func writeUploaded(w http.ResponseWriter, uploaded *UploadedArtifact, err error) {
+	if err != nil {
+		w.Header().Del("ETag")
+		writeInstallError(w, err)
+		return
+	}
+	w.Header().Set(digestHeader, uploaded.SHA256)
+	writeJSON(w, http.StatusOK, uploaded)
+}
+
+// uploadArtifact copies a stored artifact to the output target; inputKey is
+// the install's cache key. Upload failures are reported as 502, since the
+// install itself succeeded.
+func uploadArtifact(ctx context.Context, store ArtifactStore, digest, inputKey string, target *OutputTarget) (*UploadedArtifact, error) {
+	artifact, err := store.Open(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer artifact.Close()
+	switch target.Type {
+	case "oci":
+		return pushOCIOutput(ctx, artifact, inputKey, target)
+	case "image":
+		return pushImageOutput(ctx, artifact, inputKey, target)
+	}
+	key := target.Key
+	if key == "" {
+		key = digest + "/" + artifact.Filename
+	}
+	start := time.Now()
+	dest := outputStores[target.Type]
+	if err := dest.Put(ctx, target.Bucket, key, artifact.ContentType, artifact, artifact.Size, digest); err != nil {
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to upload artifact: %v", err)}
+	}
+	loggerFrom(ctx).Info("uploaded artifact", "type", target.Type, "bucket", target.Bucket, "key", key, "bytes", artifact.Size,
+		"duration_ms", time.Since(start).Milliseconds())
+	url, expires, err := dest.SignedURL(ctx, target.Bucket, key, time.Now().UTC())
+	if err != nil {
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to sign artifact URL: %v", err)}
+	}
+	return &UploadedArtifact{
+		Type:      target.Type,
+		Bucket:    target.Bucket,
+		Key:       key,
+		URL:       url,
+		ExpiresAt: &expires,
+		SHA256:    digest,
+		Size:      artifact.Size,
+	}, nil
+}
+
+// pushOCIOutput pushes a stored artifact to an output target of type oci
+func pushOCIOutput(ctx context.Context, artifact *Artifact, inputKey string, target *OutputTarget) (*UploadedArtifact, error) {
+	tag := target.Tag
+	if tag == "" {
+		tag = inputKey
+	}
+	layerType := "application/octet-stream"
+	for _, f := range archiveFormats {
+		if f.ContentType == artifact.ContentType {
+			layerType = f.LayerType
+		}
+	}
+	start := time.Now()
+	manifest, err := ociOutput.pushArtifact(ctx, target.Repository, tag, artifact, layerType)
+	if err != nil {
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to push artifact: %v", err)}
+	}
+	loggerFrom(ctx).Info("pushed artifact", "repository", target.Repository, "tag", tag, "manifest", manifest,
+		"bytes", artifact.Size, "duration_ms", time.Since(start).Milliseconds())
+	return &UploadedArtifact{
+		Type:           target.Type,
+		Reference:      target.Repository + ":" + tag,
+		ManifestDigest: manifest,
+		SHA256:         artifact.Digest,
+		Size:           artifact.Size,
+	}, nil
+}
+
+// pushImageOutput builds an image holding a stored artifact's files and
+// pushes it to an output target of type image
+func pushImageOutput(ctx context.Context, artifact *Artifact, inputKey string, target *OutputTarget) (*UploadedArtifact, error) {
+	tag := target.Tag
+	if tag == "" {
+		tag = imageTag(inputKey, target)
+	}
+	start := time.Now()
+	layer, err := buildImageLayer(artifact, target.Path)
+	if err != nil {
+		return nil, fmt.Errorf("building image layer: %v", err)
+	}
+	defer layer.Close()
+	platform, _ := parsePlatform(target.Platform)
+	manifest, err := ociOutput.pushImage(ctx, target.Repository, tag, target.BaseImage, platform, layer)
+	if err != nil {
+		return nil, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to push image: %v", err)}
+	}
+	loggerFrom(ctx).Info("pushed image", "repository", target.Repository, "tag", tag, "manifest", manifest,
+		"base_image", target.BaseImage, "layer_bytes", layer.size, "duration_ms", time.Since(start).Milliseconds())
+	return &UploadedArtifact{
+		Type:           target.Type,
+		Reference:      target.Repository + ":" + tag,
+		ManifestDigest: manifest,
+		SHA256:         artifact.Digest,
+		Size:           artifact.Size,
+	}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// An Override is a version the manifest forces on a dependency, wherever
+// it is in the tree, through pnpm.overrides or resolutions
+type Override struct {
+	// Selector is the override's key, such as "lodash", "a>b" or "**/b"
+	Selector string `json:"selector"`
+	// Package is the package it overrides and Version what it forces
+	Package string `json:"package"`
+	Version string `json:"version"`
+}
+
+// A ForcedOverride is an override and the versions of its package that
+// were installed
+type ForcedOverride struct {
+	Override
+	Installed []string `json:"installed"`
+}
+
+// pnpmOverrides reads the overrides of a pnpm project: pnpm.overrides, and
+// resolutions, which pnpm honours too. Selectors name a package, optionally
+// with a version range, after its parents, as in "a@1>b@<2".
+func pnpmOverrides(files map[string]string) []Override {
+	var m struct {
+		Pnpm struct {
+			Overrides map[string]string `json:"overrides"`
+		} `json:"pnpm"`
+		Resolutions map[string]string `json:"resolutions"`
+	}
+	json.Unmarshal([]byte(files["package.json"]), &m)
+	var overrides []Override
+	for _, set := range []map[string]string{m.Pnpm.Overrides, m.Resolutions} {
+		for selector, version := range set {
+			parts := strings.Split(selector, ">")
+			name, _ := splitNpmSpec(parts[len(parts)-1])
+			overrides = append(overrides, Override{Selector: selector, Package: name, Version: version})
+		}
+	}
+	return sortOverrides(overrides)
+}
+
+// yarnOverrides reads the resolutions of a yarn project. Selectors name a
+// package after a path of parents or **, as in "a/@s/b" or "**/b".
+func yarnOverrides(files map[string]string) []Override {
+	var m struct {
+		Resolutions map[string]string `json:"resolutions"`
+	}
+	json.Unmarshal([]byte(files["package.json"]), &m)
+	var overrides []Override
+	for selector, version := range m.Resolutions {
+		parts := strings.Split(selector, "/")
+		last := parts[len(parts)-1]
+		if len(parts) > 1 && strings.HasPrefix(parts[len(parts)-2], "@") {
+			last = parts[len(parts)-2] + "/" + last
+		}
+		name, _ := splitNpmSpec(last)
+		overrides = append(overrides, Override{Selector: selector, Package: name, Version: version})
+	}
+	return sortOverrides(overrides)
+}
+
+// bunOverrides reads the overrides of a bun project: overrides, and
+// resolutions, which bun honours too. bun only supports them at the top
+// level, so selectors are package names.
+func bunOverrides(files map[string]string) []Override {
+	var m struct {
+		Overrides   map[string]any    `json:"overrides"`
+		Resolutions map[string]string `json:"resolutions"`
+	}
+	json.Unmarshal([]byte(files["package.json"]), &m)
+	var overrides []Override
+	for name, version := range m.Overrides {
+		// npm's nested overrides, which bun ignores, are objects
+		if v, ok := version.(string); ok {
+			overrides = append(overrides, Override{Selector: name, Package: name, Version: v})
+		}
+	}
+	for name, version := range m.Resolutions {
+		overrides = append(overrides, Override{Selector: name, Package: name, Version: version})
+	}
+	return sortOverrides(overrides)
+}
+
+func sortOverrides(overrides []Override) []Override {
+	slices.SortFunc(overrides, func(a, b Override) int { return strings.Compare(a.Selector, b.Selector) })
+	return overrides
+}
+
+// forcedOverrides lists the request's overrides whose packages were
+// installed, with the versions they were installed at
+func forcedOverrides(eco *Ecosystem, files map[string]string, pkgs []Package) []ForcedOverride {
+	if eco.Overrides == nil {
+		return nil
+	}
+	var forced []ForcedOverride
+	for _, o := range eco.Overrides(files) {
+		var installed []string
+		for _, p := range pkgs {
+			if p.Name == o.Package && !slices.Contains(installed, p.Version) {
+				installed = append(installed, p.Version)
+			}
+		}
+		if len(installed) > 0 {
+			forced = append(forced, ForcedOverride{Override: o, Installed: installed})
+		}
+	}
+	return forced
+}
+
+// An overrideError fails an install because overrides force versions that
+// don't exist, explaining the package manager's failure
+type overrideError struct {
+	overrides []Override
+	err       error
+}
+
+func (e *overrideError) Error() string {
+	specs := make([]string, len(e.overrides))
+	for i, o := range e.overrides {
+		specs[i] = fmt.Sprintf("%s forces %s@%s", o.Selector, o.Package, o.Version)
+	}
+	return fmt.Sprintf("Overrides can't be satisfied, as the registry has no matching version: %s", strings.Join(specs, "; "))
+}
+
+func (e *overrideError) Unwrap() error { return e.err }
+
+func (e *overrideError) code() string { return "OVERRIDE_UNSATISFIABLE" }
+
+func (e *overrideError) details() map[string]any {
+	return map[string]any{"overrides": e.overrides}
+}
+
+// checkOverrides looks into an install that failed for want of a version.
+// If the versions missing are ones the manifest's overrides force, it is
+// explained with an overrideError; other failures return installErr as is.
+func checkOverrides(eco *Ecosystem, req *InstallRequest, installErr error) error {
+	var te *toolError
+	if eco.Overrides == nil || !errors.As(installErr, &te) || te.code() != "PACKAGE_NOT_FOUND" {
+		return installErr
+	}
+	stderr := strings.ToLower(te.stderr)
+	var unsatisfiable []Override
+	for _, o := range eco.Overrides(req.Files) {
+		name, version := strings.ToLower(o.Package), strings.ToLower(o.Version)
+		// pnpm and npm say "No matching version found for b@9", yarn
+		// `Couldn't find any versions for "b" that matches "9"`
+		if strings.Contains(stderr, name+"@"+version) || strings.Contains(stderr, fmt.Sprintf("%q that matches %q", name, version)) {
+			unsatisfiable = append(unsatisfiable, o)
+		}
+	}
+	if len(unsatisfiable) == 0 {
+		return installErr
+	}
+	return &overrideError{overrides: unsatisfiable, err: installErr}
+}
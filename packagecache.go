@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// packageCacheDir is where package managers keep the packages they download
+// between installs, with a directory per ecosystem, set from the
+// package_cache_dir setting; empty disables the shared cache
+var packageCacheDir string
+
+// packageCacheSize is the size of the shared cache when it was last collected
+var packageCacheSize atomic.Int64
+
+var (
+	packageCachePackages = newCounterVec("pip_install_package_cache_packages_total",
+		"Packages installs took from the shared package cache (hit) or downloaded (miss), by ecosystem.", "ecosystem", "result")
+	packageCacheEvicted = newCounterVec("pip_install_package_cache_evicted_bytes_total",
+		"Bytes removed from the shared package cache to keep it under package_cache_max_mb.")
+)
+
+// A cacheUsage counts the packages an install took from the shared cache and
+// those it downloaded
+type cacheUsage struct {
+	hits, misses int
+}
+
+// installCacheDir returns the directory of the shared cache an install of
+// eco uses, or "" if it gets none. Package scripts could write anything
+// there for later installs to pick up, so only installs that run none get
+// the shared cache; the others get one of their own in the workspace.
+func installCacheDir(eco *Ecosystem, req *InstallRequest) string {
+	if packageCacheDir == "" || eco.CacheEnv == nil || !req.Options.ignoreScripts() || eco.ScriptsAlwaysRun {
+		return ""
+	}
+	return filepath.Join(packageCacheDir, eco.Name)
+}
+
+// workspaceCacheDir is the package cache, inside its workspace, of an
+// install that doesn't get the shared one
+const workspaceCacheDir = ".package-cache"
+
+// setupPackageCache creates the cache directory of each ecosystem that has
+// one and starts reporting the cache's size
+func setupPackageCache() error {
+	newGaugeFunc("pip_install_package_cache_bytes", "Size of the shared package cache at its last collection.", func() float64 {
+		return float64(packageCacheSize.Load())
+	})
+	for _, eco := range append(ecosystems[:len(ecosystems):len(ecosystems)], npmEcosystem) {
+		if eco.CacheEnv != nil {
+			if err := os.MkdirAll(filepath.Join(packageCacheDir, eco.Name), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pipCacheUsage counts pip's "Using cached" and "Downloading" lines
+func pipCacheUsage(line string, u *cacheUsage) {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "Using cached "):
+		u.hits++
+	case strings.HasPrefix(line, "Downloading "):
+		u.misses++
+	}
+}
+
+// pnpmProgress matches the counts in pnpm's progress lines
+var pnpmProgress = regexp.MustCompile(`reused (\d+), downloaded (\d+)`)
+
+// pnpmCacheUsage reads pnpm's progress lines, each of which has the totals so far
+func pnpmCacheUsage(line string, u *cacheUsage) {
+	if m := pnpmProgress.FindStringSubmatch(line); m != nil {
+		u.hits, _ = strconv.Atoi(m[1])
+		u.misses, _ = strconv.Atoi(m[2])
+	}
+}
+
+// leadingDirs returns a CacheEntry whose entries are the directories n
+// levels down; files above them stand alone
+func leadingDirs(n int) func(rel string) string {
+	return func(rel string) string {
+		parts := strings.SplitN(rel, "/", n+1)
+		if len(parts) <= n {
+			return rel
+		}
+		return strings.Join(parts[:n], "/")
+	}
+}
+
+// collectPackageCache periodically removes the least recently used files
+// from the shared cache while it is larger than max bytes. Files used within
+// the last interval are kept, so running installs don't lose what they just
+// fetched.
+func collectPackageCache(max int64, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := trimPackageCache(max, time.Now().Add(-interval)); err != nil {
+			slog.Error("failed to collect package cache", "error", err)
+		}
+	}
+}
+
+// trimPackageCache removes entries last used before cutoff, oldest first,
+// until the cache fits in max bytes (90% of it, so it isn't trimmed again
+// straight away). An entry is a file, or a directory the ecosystem's
+// CacheEntry groups files into, and was last used when any of its files
+// was. A max of 0 only measures the cache.
+func trimPackageCache(max int64, cutoff time.Time) error {
+	type cacheEntry struct {
+		path string
+		size int64
+		used time.Time
+	}
+	entries := make(map[string]*cacheEntry)
+	var total int64
+	err := filepath.WalkDir(packageCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		used := info.ModTime()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if atime := time.Unix(st.Atim.Sec, st.Atim.Nsec); atime.After(used) {
+				used = atime
+			}
+		}
+		entryPath := cacheEntryPath(path)
+		e := entries[entryPath]
+		if e == nil {
+			e = &cacheEntry{path: entryPath}
+			entries[entryPath] = e
+		}
+		e.size += info.Size()
+		if used.After(e.used) {
+			e.used = used
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	packageCacheSize.Store(total)
+	if max == 0 || total <= max {
+		return nil
+	}
+
+	byUse := make([]*cacheEntry, 0, len(entries))
+	for _, e := range entries {
+		byUse = append(byUse, e)
+	}
+	sort.Slice(byUse, func(i, j int) bool { return byUse[i].used.Before(byUse[j].used) })
+	target := max / 10 * 9
+	var evicted int64
+	for _, e := range byUse {
+		if total <= target || !e.used.Before(cutoff) {
+			break
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			return err
+		}
+		total -= e.size
+		evicted += e.size
+	}
+	packageCacheSize.Store(total)
+	packageCacheEvicted.add(float64(evicted))
+	level := slog.LevelInfo
+	if total > max {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "collected package cache", "evicted_bytes", evicted, "size_bytes", total, "max_bytes", max)
+	return nil
+}
+
+// cacheEntryPath returns the path of the cache entry the file at path is
+// part of, by the CacheEntry of the ecosystem whose directory it is in
+func cacheEntryPath(path string) string {
+	rel, err := filepath.Rel(packageCacheDir, path)
+	if err != nil {
+		return path
+	}
+	name, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	eco := findEcosystem(name)
+	if name == npmEcosystem.Name {
+		eco = npmEcosystem
+	}
+	if eco == nil || eco.CacheEntry == nil || rest == "" {
+		return path
+	}
+	return filepath.Join(packageCacheDir, name, filepath.FromSlash(eco.CacheEntry(rest)))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Package is one package found in an install's output
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// License is the license the package declares, ideally an SPDX
+	// expression; empty if it declares none
+	License string `json:"license,omitempty"`
+	// PURL is the package URL identifying it across tools
+	PURL string `json:"purl"`
+}
+
+// installedPackages lists the packages in outputDir, sorted by name and
+// version
+func installedPackages(eco *Ecosystem, outputDir string) ([]Package, error) {
+	if eco.Packages == nil {
+		return nil, nil
+	}
+	pkgs, err := eco.Packages(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Version < pkgs[j].Version
+	})
+	return pkgs, nil
+}
+
+// An npmManifest is the part of a package.json the server reads
+type npmManifest struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Scripts map[string]string `json:"scripts"`
+	License json.RawMessage   `json:"license"`
+	// Licenses is the deprecated list form of License
+	Licenses []struct {
+		Type string `json:"type"`
+	} `json:"licenses"`
+	// Funding is a URL, an object with one or a list of either
+	Funding json.RawMessage `json:"funding"`
+}
+
+// license returns the declared license, which older packages give as an
+// object or a list of objects
+func (m npmManifest) license() string {
+	var s string
+	if json.Unmarshal(m.License, &s) == nil {
+		return s
+	}
+	var obj struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(m.License, &obj) == nil && obj.Type != "" {
+		return obj.Type
+	}
+	types := make([]string, 0, len(m.Licenses))
+	for _, l := range m.Licenses {
+		if l.Type != "" {
+			types = append(types, l.Type)
+		}
+	}
+	if len(types) > 1 {
+		return "(" + strings.Join(types, " OR ") + ")"
+	}
+	return strings.Join(types, "")
+}
+
+// walkNpmPackages calls fn with the directory and manifest of every package
+// root under a node_modules directory, skipping package.json files packages
+// ship deeper down. Symlinks are not followed, so packages in pnpm's virtual
+// store are visited once.
+func walkNpmPackages(outputDir string, fn func(dir string, pkg npmManifest) error) error {
+	return filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "package.json" {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		parent := filepath.Dir(dir)
+		scoped := strings.HasPrefix(filepath.Base(parent), "@") && filepath.Base(filepath.Dir(parent)) == "node_modules"
+		if filepath.Base(parent) != "node_modules" && !scoped {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var pkg npmManifest
+		if json.Unmarshal(b, &pkg) != nil || pkg.Name == "" {
+			return nil
+		}
+		return fn(dir, pkg)
+	})
+}
+
+// npmPackages lists the packages installed under a node_modules directory.
+// A version installed in several places is listed once.
+func npmPackages(outputDir string) ([]Package, error) {
+	seen := make(map[string]bool)
+	var pkgs []Package
+	err := walkNpmPackages(outputDir, func(dir string, m npmManifest) error {
+		if seen[m.Name+"@"+m.Version] {
+			return nil
+		}
+		seen[m.Name+"@"+m.Version] = true
+		pkgs = append(pkgs, Package{
+			Name:    m.Name,
+			Version: m.Version,
+			License: m.license(),
+			// The @ of a scope is percent-encoded in purls
+			PURL: "pkg:npm/" + strings.Replace(m.Name, "@", "%40", 1) + "@" + url.PathEscape(m.Version),
+		})
+		return nil
+	})
+	return pkgs, err
+}
+
+// pythonNameSeparators are the runs of characters PEP 503 normalizes to "-"
+var pythonNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// pythonPackages lists the distributions installed in a site-packages
+// directory from their .dist-info metadata
+func pythonPackages(outputDir string) ([]Package, error) {
+	matches, err := filepath.Glob(filepath.Join(outputDir, "*.dist-info", "METADATA"))
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]Package, 0, len(matches))
+	for _, p := range matches {
+		pkg, err := readPythonMetadata(p)
+		if err != nil {
+			return nil, err
+		}
+		if pkg.Name == "" {
+			continue
+		}
+		name := strings.ToLower(pythonNameSeparators.ReplaceAllString(pkg.Name, "-"))
+		pkg.PURL = "pkg:pypi/" + name + "@" + url.PathEscape(pkg.Version)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// readPythonMetadata reads a distribution's name, version and license from
+// the headers of its METADATA file. License-Expression is preferred, then a
+// one-line License field, then the last License classifier.
+func readPythonMetadata(p string) (Package, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return Package{}, err
+	}
+	defer f.Close()
+	var pkg Package
+	var expression, license, classifier string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		// The headers end at the first blank line, before the description
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Name":
+			pkg.Name = value
+		case "Version":
+			pkg.Version = value
+		case "License-Expression":
+			expression = value
+		case "License":
+			// Continuation lines start with whitespace and aren't matched
+			license = value
+		case "Classifier":
+			if rest, ok := strings.CutPrefix(value, "License :: "); ok {
+				parts := strings.Split(rest, " :: ")
+				classifier = parts[len(parts)-1]
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Package{}, fmt.Errorf("reading %s: %v", p, err)
+	}
+	switch {
+	case expression != "":
+		pkg.License = expression
+	case license != "" && license != "UNKNOWN" && len(license) < 100:
+		pkg.License = license
+	default:
+		pkg.License = classifier
+	}
+	return pkg, nil
+}
+
+// artifactMeta collects what is recorded with an install's artifact: the
+// packages whose scripts were skipped and the installed packages, which must
+// pass the license denylist. The SBOM and license report the request asks
+// for are written into outputDir to be archived.
+func artifactMeta(ctx context.Context, eco *Ecosystem, req *InstallRequest, outputDir, key string) (ArtifactMeta, error) {
+	start := time.Now()
+	meta := ArtifactMeta{SkippedScripts: skippedScripts(ctx, eco, req, outputDir)}
+	if req.Options.Prune {
+		freed, err := pruneInstalled(outputDir)
+		if err != nil {
+			return meta, fmt.Errorf("Failed to prune installed packages: %v", err)
+		}
+		meta.PrunedBytes = freed
+		prunedBytes.add(float64(freed), eco.Name)
+		loggerFrom(ctx).Info("pruned installed packages", "bytes", freed)
+	}
+	pkgs, err := installedPackages(eco, outputDir)
+	if err != nil {
+		if req.Options.SBOM != "" || req.Options.LicenseReport || len(req.Options.DenyLicenses) > 0 {
+			return meta, fmt.Errorf("Failed to list installed packages: %v", err)
+		}
+		loggerFrom(ctx).Warn("failed to list installed packages", "error", err)
+	}
+	meta.Packages = pkgs
+	if err := checkLicenses(req, pkgs); err != nil {
+		return meta, err
+	}
+	if req.Options.LicenseReport {
+		if err := writeLicenseReport(outputDir, pkgs); err != nil {
+			return meta, err
+		}
+	}
+	if req.Options.SBOM != "" {
+		format := findSBOMFormat(req.Options.SBOM)
+		b, err := json.MarshalIndent(format.Build(eco, pkgs, key, "", time.Now()), "", "  ")
+		if err != nil {
+			return meta, err
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, format.Filename), b, 0644); err != nil {
+			return meta, fmt.Errorf("Failed to write %s: %v", format.Filename, err)
+		}
+	}
+	notesFrom(ctx).phase("inspect", start)
+	meta.Report = buildReport(ctx, eco, req, outputDir, pkgs)
+	if req.Options.Report {
+		if err := writeInstallReport(outputDir, meta.Report); err != nil {
+			return meta, fmt.Errorf("Failed to write %s: %v", installReportName, err)
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// peerDepsModes are the valid peer_deps_mode options. strict fails the
+// install on any peer dependency conflict, legacy ignores peer dependencies
+// as npm 6 did, and auto installs them as the package manager does by
+// default but falls back to legacy if they conflict.
+var peerDepsModes = []string{"strict", "legacy", "auto"}
+
+var peerDepsFallbacks = newCounterVec("pip_install_peer_deps_fallbacks_total",
+	"Runs of auto peer_deps_mode repeated with legacy peer dependencies after a conflict, by ecosystem.", "ecosystem")
+
+// validatePeerDeps checks the peer_deps_mode option. auto needs the
+// ecosystem to have a legacy mode to fall back to.
+func validatePeerDeps(eco *Ecosystem, mode string) error {
+	if !slices.Contains(peerDepsModes, mode) {
+		return badRequest("Invalid peer_deps_mode %q: must be one of %s", mode, strings.Join(peerDepsModes, ", "))
+	}
+	if eco.PeerDepsArgs == nil {
+		return badRequest("peer_deps_mode is not supported for %s installs", eco.Name)
+	}
+	flags := mode
+	if mode == "auto" {
+		flags = "legacy"
+	}
+	if _, ok := eco.PeerDepsArgs[flags]; !ok {
+		return badRequest("peer_deps_mode %q is not supported for %s installs", mode, eco.Name)
+	}
+	return nil
+}
+
+// peerConflict reports whether a tool failed on conflicting peer
+// dependencies
+func peerConflict(err error) bool {
+	var te *toolError
+	return errors.As(err, &te) && te.code() == "PEER_CONFLICT"
+}
+
+// runPeerDeps runs a step that resolves dependencies with fn, adding the
+// flags of the request's peer_deps_mode. In auto mode a run that fails on a
+// peer dependency conflict is run again with legacy peer dependencies, and a
+// peer warning says so. It returns the run that was last tried.
+func runPeerDeps(ctx context.Context, eco *Ecosystem, req *InstallRequest, run toolRun, fn func(toolRun) error) (toolRun, error) {
+	mode := req.Options.PeerDepsMode
+	if mode != "auto" {
+		run.args = append(run.args[:len(run.args):len(run.args)], eco.PeerDepsArgs[mode]...)
+		return run, fn(run)
+	}
+	err := fn(run)
+	if !peerConflict(err) {
+		return run, err
+	}
+	loggerFrom(ctx).Warn(run.step + " failed on conflicting peer dependencies, retrying with legacy peer dependencies")
+	peerDepsFallbacks.inc(eco.Name)
+	notesFrom(ctx).warn(InstallWarning{Kind: "peer",
+		Message: fmt.Sprintf("Peer dependencies conflict, so %s ran again with legacy peer dependencies, which leaves them out", run.step)})
+	run.args = append(run.args[:len(run.args):len(run.args)], eco.PeerDepsArgs["legacy"]...)
+	return run, fn(run)
+}
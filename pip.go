@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// Accept requirements.txt and optional constraints.txt
+// constraints.txt is optional and used for reproducible installs
+// The output is a zip of the installed site-packages
+var pipEcosystem = &Ecosystem{
+	Name:     "pip",
+	Tool:     "pip",
+	Runtime:  "python3",
+	Registry: "https://pypi.org/simple/",
+	Image:    "python:3.12.7-slim-bookworm",
+	Files: []ManifestFile{
+		{Name: "requirements.txt", Required: true},
+		{Name: "constraints.txt"},
+		{Name: "pip.conf", Secret: true, Env: "PIP_CONFIG_FILE"},
+	},
+	Args: func(files map[string]string) []string {
+		args := []string{"install", "-r", "requirements.txt", "--target", "site-packages"}
+		if files["constraints.txt"] != "" {
+			args = append(args, "-c", "constraints.txt")
+		}
+		return args
+	},
+	RegistryArgs: func(registry string) []string {
+		return []string{"--index-url", registry}
+	},
+	FileRegistries: pipRegistries,
+	// Building an sdist runs its setup.py, so only wheels are allowed
+	NoScriptsArgs:  []string{"--only-binary=:all:"},
+	CacheEnv:       func(dir string) []string { return []string{"PIP_CACHE_DIR=" + dir} },
+	CacheUsage:     pipCacheUsage,
+	Audit:          pipAuditor,
+	Packages:       pythonPackages,
+	LockedPackages: pipLockedPackages,
+	FromPackages:   pipFromPackages,
+	// pip writes no lock file, only a report of what it would install
+	DryRun: &DryRun{
+		Args: func(files map[string]string) []string {
+			args := []string{"install", "-r", "requirements.txt", "--dry-run", "--ignore-installed", "--quiet", "--report", "-"}
+			if files["constraints.txt"] != "" {
+				args = append(args, "-c", "constraints.txt")
+			}
+			return args
+		},
+		Packages: pipReportPackages,
+	},
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "site-packages"), nil
+	},
+	ArchiveRoot: "site-packages",
+	ArchiveName: "python_packages",
+}
@@ -0,0 +1,5 @@
+// Package pipinstallpb holds the gRPC API of pip-install, generated from
+// pipinstall.proto.
+package pipinstallpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pipinstall.proto
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// Accept package.json and optional pnpm-lock.yaml
+// When pnpm-lock.yaml is present the install is frozen to it
+// The output is a zip of node_modules, including pnpm's symlinked
+// node_modules/.pnpm virtual store
+var pnpmEcosystem = &Ecosystem{
+	Name:     "pnpm",
+	Tool:     "pnpm",
+	Runtime:  "node",
+	Registry: "https://registry.npmjs.org/",
+	Files: []ManifestFile{
+		{Name: "package.json", Required: true},
+		{Name: "pnpm-lock.yaml"},
+		{Name: "pnpm-workspace.yaml"},
+		{Name: ".npmrc", Secret: true},
+	},
+	Args: func(files map[string]string) []string {
+		args := []string{"install", "--reporter=append-only"}
+		if files["pnpm-lock.yaml"] != "" {
+			args = append(args, "--frozen-lockfile")
+		}
+		return args
+	},
+	RegistryArgs: func(registry string) []string {
+		return []string{"--registry=" + registry}
+	},
+	FileRegistries: npmRegistries,
+	OmitArgs: map[string][]string{
+		"dev":      {"--prod"},
+		"optional": {"--no-optional"},
+		"peer":     {"--config.auto-install-peers=false"},
+	},
+	// pnpm can't leave peer dependencies out of the resolution, so legacy
+	// neither installs them nor fails when they conflict
+	PeerDepsArgs: map[string][]string{
+		"strict": {"--strict-peer-dependencies"},
+		"legacy": {"--config.auto-install-peers=false", "--config.strict-peer-dependencies=false"},
+	},
+	WorkspaceFiles: pnpmWorkspaceFiles,
+	WorkspaceArgs: func(name string) []string {
+		// The trailing ... selects the workspaces it depends on too
+		return []string{"--filter=" + name + "..."}
+	},
+	// --os, --cpu and --libc set supportedArchitectures, which picks the
+	// optional packages that carry prebuilt binaries such as @esbuild/*
+	TargetArgs: func(t *InstallTarget) []string {
+		args := []string{"--os=" + t.platform(), "--cpu=" + t.arch()}
+		if t.Libc != "" {
+			args = append(args, "--libc="+t.Libc)
+		}
+		return args
+	},
+	Engines:       &EngineCheck{Args: []string{"--engine-strict"}, Mismatches: pnpmEngineMismatches},
+	NoScriptsArgs: []string{"--ignore-scripts"},
+	// Files are copied out of the store rather than hard-linked, so a
+	// package script can't change what later installs get
+	CacheEnv: func(dir string) []string {
+		return []string{"npm_config_store_dir=" + dir, "npm_config_package_import_method=clone-or-copy"}
+	},
+	// The store's packages are indexes of files they share with others, so
+	// a version of the store is only evicted whole
+	CacheEntry:     leadingDirs(1),
+	CacheUsage:     pnpmCacheUsage,
+	ScriptPackages: npmScriptPackages,
+	Packages:       npmPackages,
+	FromPackages:   npmFromPackages,
+	LockedPackages: pnpmLockedPackages,
+	LockIntegrity:  &LockIntegrity{File: "pnpm-lock.yaml", Unpinned: pnpmUnpinned},
+	Overrides:      pnpmOverrides,
+	// --lockfile-only resolves the lock file without fetching any packages
+	DryRun: &DryRun{
+		Args: func(files map[string]string) []string {
+			return []string{"install", "--lockfile-only", "--reporter=append-only"}
+		},
+		Lockfile: "pnpm-lock.yaml",
+		Packages: lockedPackagesAt("pnpm-lock.yaml", pnpmLockedPackages),
+	},
+	Audit: &Auditor{
+		Tool:  "pnpm",
+		Args:  func(string) []string { return []string{"audit", "--json"} },
+		Parse: parseNpmAudit,
+		// Adds overrides for patched versions to package.json
+		Fix: &AuditFixer{
+			Args:  []string{"audit", "--fix"},
+			Files: []string{"package.json", "pnpm-lock.yaml"},
+		},
+	},
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "node_modules"), nil
+	},
+	ArchiveRoot: "node_modules",
+	ArchiveName: "node_modules",
+}
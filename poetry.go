@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Accept pyproject.toml and optional poetry.lock
+// When poetry.lock is present poetry installs exactly the locked versions
+// and fails if the lock no longer matches pyproject.toml
+// The output is a zip of the project virtualenv's site-packages
+var poetryEcosystem = &Ecosystem{
+	Name:     "poetry",
+	Tool:     "poetry",
+	Runtime:  "python3",
+	Registry: "https://pypi.org/simple/",
+	Files: []ManifestFile{
+		{Name: "pyproject.toml", Required: true},
+		{Name: "poetry.lock"},
+	},
+	Args: func(files map[string]string) []string {
+		return []string{"install", "--no-root", "--no-interaction", "--no-ansi"}
+	},
+	// Keep the virtualenv inside the work dir so it is archived and cleaned up with it
+	Env: []string{
+		"POETRY_VIRTUALENVS_CREATE=true",
+		"POETRY_VIRTUALENVS_IN_PROJECT=true",
+	},
+	NoScriptsEnv:   []string{"POETRY_INSTALLER_ONLY_BINARY=:all:"},
+	CacheEnv:       func(dir string) []string { return []string{"POETRY_CACHE_DIR=" + dir} },
+	Audit:          pipAuditor,
+	Packages:       pythonPackages,
+	LockedPackages: poetryLockedPackages,
+	// poetry lock keeps the versions an existing lock pins where
+	// pyproject.toml still allows them
+	DryRun: &DryRun{
+		Args: func(files map[string]string) []string {
+			return []string{"lock", "--no-interaction", "--no-ansi"}
+		},
+		Lockfile: "poetry.lock",
+		Packages: lockedPackagesAt("poetry.lock", poetryLockedPackages),
+	},
+	Output: func(workDir string) (string, error) {
+		matches, err := filepath.Glob(filepath.Join(workDir, ".venv", "lib", "python*", "site-packages"))
+		if err != nil {
+			return "", err
+		}
+		if len(matches) != 1 {
+			return "", fmt.Errorf("expected one site-packages directory in .venv, found %d", len(matches))
+		}
+		return matches[0], nil
+	},
+	ArchiveRoot: "site-packages",
+	ArchiveName: "python_packages",
+}
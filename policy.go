@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A PackageRule matches packages by name, scope and version. Empty fields
+// match everything.
+type PackageRule struct {
+	// Ecosystem limits the rule to one ecosystem, such as "pnpm"
+	Ecosystem string `yaml:"ecosystem"`
+	// Package is a name or a glob such as "@types/*"
+	Package string `yaml:"package"`
+	// Scope matches every package in an npm scope, such as "@acme"
+	Scope string `yaml:"scope"`
+	// Versions lists the exact versions the rule applies to
+	Versions []string `yaml:"versions"`
+	// Reason is reported when the rule blocks a package
+	Reason string `yaml:"reason"`
+}
+
+// A packagePolicy blocks installs containing packages that match a deny
+// rule, or, for ecosystems with allow rules, that match none of them
+type packagePolicy struct {
+	Deny  []PackageRule `yaml:"deny"`
+	Allow []PackageRule `yaml:"allow"`
+}
+
+// A PolicyViolation is one package a policy blocked
+type PolicyViolation struct {
+	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// packageName normalizes a name for comparison. Python names are compared
+// after PEP 503 normalization, npm names as they are.
+func packageName(eco *Ecosystem, name string) string {
+	if eco.Runtime == "python3" {
+		return strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+	}
+	return name
+}
+
+// matches reports whether the rule applies to a package
+func (r PackageRule) matches(eco *Ecosystem, pkg Package) bool {
+	if r.Ecosystem != "" && r.Ecosystem != eco.Name {
+		return false
+	}
+	name := packageName(eco, pkg.Name)
+	if r.Scope != "" && !strings.HasPrefix(name, strings.TrimSuffix(r.Scope, "/")+"/") {
+		return false
+	}
+	if r.Package != "" {
+		if ok, _ := path.Match(packageName(eco, r.Package), name); !ok {
+			return false
+		}
+	}
+	if len(r.Versions) > 0 {
+		for _, v := range r.Versions {
+			if v == pkg.Version {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// evaluate returns the packages the policy blocks. Packages without a known
+// version, as in unpinned requirements, only match rules for every version.
+func (p *packagePolicy) evaluate(eco *Ecosystem, pkgs []Package) []PolicyViolation {
+	var allow []PackageRule
+	for _, r := range p.Allow {
+		if r.Ecosystem == "" || r.Ecosystem == eco.Name {
+			allow = append(allow, r)
+		}
+	}
+	var violations []PolicyViolation
+	for _, pkg := range pkgs {
+		if reason, denied := p.denied(eco, pkg); denied {
+			violations = append(violations, PolicyViolation{Package: pkg.Name, Version: pkg.Version, Reason: reason})
+			continue
+		}
+		if len(allow) == 0 {
+			continue
+		}
+		allowed := false
+		for _, r := range allow {
+			allowed = allowed || r.matches(eco, pkg)
+		}
+		if !allowed {
+			violations = append(violations, PolicyViolation{Package: pkg.Name, Version: pkg.Version, Reason: "not in the allowlist"})
+		}
+	}
+	return violations
+}
+
+// denied returns the reason of the first deny rule matching pkg
+func (p *packagePolicy) denied(eco *Ecosystem, pkg Package) (string, bool) {
+	for _, r := range p.Deny {
+		if r.matches(eco, pkg) {
+			if r.Reason == "" {
+				return "denied by policy", true
+			}
+			return r.Reason, true
+		}
+	}
+	return "", false
+}
+
+// A packagePolicyError fails an install with packages the policy blocks
+type packagePolicyError struct {
+	violations []PolicyViolation
+}
+
+func (e *packagePolicyError) Error() string {
+	return fmt.Sprintf("Install has %d packages blocked by policy", len(e.violations))
+}
+
+func (e *packagePolicyError) code() string { return "PACKAGE_BLOCKED" }
+
+func (e *packagePolicyError) details() map[string]any {
+	return map[string]any{"violations": e.violations}
+}
+
+// A policyReloader serves the package policy from a file, reloading it when
+// the file changes
+type policyReloader struct {
+	file string
+
+	mu      sync.RWMutex
+	policy  *packagePolicy
+	modTime time.Time
+}
+
+// packagePolicies is the policy from the policy_file setting; nil if unset
+var packagePolicies *policyReloader
+
+func newPolicyReloader(file string) (*policyReloader, error) {
+	p := &policyReloader{file: file}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// current returns the policy in use
+func (p *policyReloader) current() *packagePolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.policy
+}
+
+// reload loads the file again if it is newer than the policy in use,
+// reporting whether it did
+func (p *policyReloader) reload() (bool, error) {
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return false, err
+	}
+	p.mu.RLock()
+	current := p.policy != nil && !info.ModTime().After(p.modTime)
+	p.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return false, err
+	}
+	var policy packagePolicy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return false, fmt.Errorf("parsing policy file %s: %w", p.file, err)
+	}
+	for _, r := range append(policy.Deny, policy.Allow...) {
+		if r.Ecosystem != "" && findEcosystem(r.Ecosystem) == nil {
+			return false, fmt.Errorf("policy file %s: unknown ecosystem %q", p.file, r.Ecosystem)
+		}
+		if _, err := path.Match(r.Package, ""); err != nil {
+			return false, fmt.Errorf("policy file %s: invalid package pattern %q", p.file, r.Package)
+		}
+	}
+	p.mu.Lock()
+	p.policy, p.modTime = &policy, info.ModTime()
+	p.mu.Unlock()
+	return true, nil
+}
+
+// watch checks the file for changes every interval. A policy that fails to
+// load is retried on the next tick and the previous one stays in use.
+func (p *policyReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := p.reload()
+		if err != nil {
+			slog.Warn("failed to reload package policy", "error", err)
+			continue
+		}
+		if changed {
+			slog.Info("reloaded package policy", "policy_file", p.file)
+		}
+	}
+}
+
+// checkPolicy fails an install containing packages the policy blocks
+func checkPolicy(eco *Ecosystem, pkgs []Package) error {
+	if packagePolicies == nil {
+		return nil
+	}
+	if violations := packagePolicies.current().evaluate(eco, pkgs); len(violations) > 0 {
+		return &packagePolicyError{violations: violations}
+	}
+	return nil
+}
+
+// checkLockedPolicy checks the packages a request's lock file pins before
+// anything is installed, so blocked packages never get to run their scripts.
+// The installed packages are checked again afterwards, since not every
+// request has a lock file.
+func checkLockedPolicy(eco *Ecosystem, req *InstallRequest) error {
+	if packagePolicies == nil || eco.LockedPackages == nil {
+		return nil
+	}
+	pkgs, err := eco.LockedPackages(req.Files)
+	if err != nil {
+		return badRequest("Failed to read lock file: %v", err)
+	}
+	return checkPolicy(eco, pkgs)
+}
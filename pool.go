@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	// defaultMaxInstalls is how many installs run at once by default
+	defaultMaxInstalls = 2
+	// defaultMaxQueued is how many installs may wait for a slot by default
+	defaultMaxQueued = 100
+	// queueRetryAfter is suggested to clients turned away by a full queue
+	queueRetryAfter = "30"
+)
+
+// An installPool bounds how many installs run at once across synchronous
+// requests and jobs. Installs beyond the limit wait in a FIFO queue of
+// bounded length; once that is full new installs are refused.
+type installPool struct {
+	mu       sync.Mutex
+	slots    int
+	maxQueue int
+	running  int
+	waiting  []*ticket
+}
+
+// A ticket is a place in the pool: either running or waiting for a slot
+type ticket struct {
+	pool  *installPool
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newInstallPool(slots, maxQueue int) *installPool {
+	p := &installPool{slots: slots, maxQueue: maxQueue}
+	newGaugeFunc("pip_install_install_queue_depth", "Installs waiting for a slot.", func() float64 {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return float64(len(p.waiting))
+	})
+	return p
+}
+
+// enqueue takes a slot if one is free and joins the queue otherwise. It fails
+// with 503 when the queue is full.
+func (p *installPool) enqueue() (*ticket, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := &ticket{pool: p, ready: make(chan struct{})}
+	if p.running < p.slots && len(p.waiting) == 0 {
+		p.running++
+		close(t.ready)
+		return t, nil
+	}
+	if len(p.waiting) >= p.maxQueue {
+		return nil, &statusError{status: http.StatusServiceUnavailable,
+			err: fmt.Errorf("Install queue is full: %d installs running and %d waiting, try again later", p.running, len(p.waiting))}
+	}
+	p.waiting = append(p.waiting, t)
+	return t, nil
+}
+
+// tryAcquire takes a slot only if one is free and no install is waiting for
+// it, for background work that must never hold up installs
+func (p *installPool) tryAcquire() (*ticket, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running >= p.slots || len(p.waiting) > 0 {
+		return nil, false
+	}
+	p.running++
+	t := &ticket{pool: p, ready: make(chan struct{})}
+	close(t.ready)
+	return t, true
+}
+
+// wait blocks until the ticket holds a slot. If ctx is cancelled first the
+// ticket leaves the queue.
+func (t *ticket) wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		t.release()
+		return ctx.Err()
+	}
+}
+
+// position returns the ticket's 1-based place in the queue, or 0 once it
+// holds a slot
+func (t *ticket) position() int {
+	p := t.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, w := range p.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// promote moves a waiting ticket to the front of the queue, reporting
+// whether it was waiting
+func (t *ticket) promote() bool {
+	p := t.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := slices.Index(p.waiting, t)
+	if i < 0 {
+		return false
+	}
+	copy(p.waiting[1:i+1], p.waiting[:i])
+	p.waiting[0] = t
+	return true
+}
+
+// release gives up the ticket's slot, or its place in the queue, handing the
+// slot to the next waiter. It may be called more than once.
+func (t *ticket) release() {
+	t.once.Do(func() {
+		p := t.pool
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, w := range p.waiting {
+			if w == t {
+				p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+				return
+			}
+		}
+		if len(p.waiting) > 0 {
+			next := p.waiting[0]
+			p.waiting = p.waiting[1:]
+			close(next.ready)
+			return
+		}
+		p.running--
+	})
+}
+
+// poolError reports err from enqueue to the client, suggesting when to retry
+// if the queue was full or the registry's circuit open
+func poolError(w http.ResponseWriter, err error) {
+	var ce *circuitOpenError
+	if !errors.As(err, &ce) && errorStatus(err) == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", queueRetryAfter)
+	}
+	writeInstallError(w, err)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// maxProjectSize caps the unpacked size of a project archive, set from the
+// project_max_mb setting
+var maxProjectSize int64 = 100 << 20
+
+// maxProjectFiles caps the number of files in a project archive
+const maxProjectFiles = 10000
+
+// projectContentTypes are the Content-Types a project archive may be posted
+// with. The archive's format is detected from its contents.
+var projectContentTypes = []string{"application/gzip", "application/x-gzip", "application/x-tar", "application/zip"}
+
+// isProjectArchive reports whether a request body is a project archive
+func isProjectArchive(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range projectContentTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// readProject unpacks a project archive, a tar (optionally gzipped) or a
+// zip, into files keyed by their slash-separated path. When every entry
+// sits in one top-level directory, as in `npm pack` and `git archive
+// --prefix` output, that directory is stripped. Any node_modules in the
+// archive is dropped, since the install replaces it, and so are package
+// managers' settings other than eco's own manifests, which could point the
+// install past the registries it is checked against. The modes returned
+// are those of files that aren't plain 0644 ones, such as executable
+// scripts.
+func readProject(eco *Ecosystem, r io.Reader) (map[string]string, map[string]os.FileMode, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	var (
+		p   *projectReader
+		err error
+	)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		p, err = readProjectZip(br)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, gzErr := gzip.NewReader(br)
+		if gzErr != nil {
+			return nil, nil, badRequest("Error reading project archive: %v", gzErr)
+		}
+		defer gz.Close()
+		p, err = readProjectTar(gz)
+	default:
+		p, err = readProjectTar(br)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	p.stripRoot()
+	p.dropConfig(eco)
+	if err := p.checkPaths(); err != nil {
+		return nil, nil, err
+	}
+	return p.files, p.modes, nil
+}
+
+// projectConfigFiles are the package manager settings a project directory
+// may hold, in any of its directories
+var projectConfigFiles = []string{
+	".npmrc", ".yarnrc", ".yarnrc.yml", ".pnpmfile.cjs", "bunfig.toml",
+	"pip.conf", "pip.ini", "poetry.toml", ".cargo/config", ".cargo/config.toml",
+	".bundle/config", ".gemrc",
+}
+
+// dropConfig removes the package manager settings in the project, keeping
+// those of eco's manifests at its root, whose registries are checked
+func (p *projectReader) dropConfig(eco *Ecosystem) {
+	for name := range p.files {
+		if slices.ContainsFunc(eco.Files, func(mf ManifestFile) bool { return mf.Name == name }) {
+			continue
+		}
+		if slices.ContainsFunc(projectConfigFiles, func(c string) bool { return name == c || strings.HasSuffix(name, "/"+c) }) {
+			delete(p.files, name)
+			delete(p.modes, name)
+		}
+	}
+}
+
+// checkPaths refuses a project with a file where another needs a directory
+func (p *projectReader) checkPaths() error {
+	for name := range p.files {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := p.files[dir]; ok {
+				return badRequest("Project archive has both a file %s and files under it", dir)
+			}
+		}
+	}
+	return nil
+}
+
+// projectReader collects the files of a project archive within the limits
+type projectReader struct {
+	files map[string]string
+	modes map[string]os.FileMode
+	size  int64
+	// entries counts the archive's entries, directories included
+	entries int
+}
+
+func newProjectReader() *projectReader {
+	return &projectReader{files: make(map[string]string), modes: make(map[string]os.FileMode)}
+}
+
+// entry counts one entry of the archive against maxProjectFiles
+func (p *projectReader) entry() error {
+	p.entries++
+	if p.entries > maxProjectFiles {
+		return &statusError{status: http.StatusRequestEntityTooLarge,
+			err: fmt.Errorf("Project archive has more than %d files", maxProjectFiles)}
+	}
+	return nil
+}
+
+// add reads one regular file from the archive. Its permissions are kept
+// up to 0755, and always let the install's user read and write it.
+func (p *projectReader) add(name string, r io.Reader, mode os.FileMode) error {
+	name, err := projectPath(name)
+	if err != nil || name == "" {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxProjectSize-p.size+1))
+	if err != nil {
+		return badRequest("Error reading %s from project archive: %v", name, err)
+	}
+	p.size += int64(len(b))
+	if p.size > maxProjectSize {
+		return &statusError{status: http.StatusRequestEntityTooLarge,
+			err: fmt.Errorf("Project archive unpacks to more than %d MiB", maxProjectSize>>20)}
+	}
+	p.files[name] = string(b)
+	if perm := mode.Perm()&0755 | 0600; perm != 0644 {
+		p.modes[name] = perm
+	} else {
+		delete(p.modes, name)
+	}
+	return nil
+}
+
+func readProjectTar(r io.Reader) (*projectReader, error) {
+	p := newProjectReader()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, badRequest("Error reading project archive: %v", err)
+		}
+		if err := p.entry(); err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = p.add(hdr.Name, tr, hdr.FileInfo().Mode())
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+		default:
+			// Links could point outside the workspace
+			err = badRequest("Project archive entry %q is not a regular file or directory", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readProjectZip(r io.Reader) (*projectReader, error) {
+	// Zip's directory is at the end, so the archive has to be read in full
+	b, err := io.ReadAll(io.LimitReader(r, maxProjectSize+1))
+	if err != nil {
+		return nil, badRequest("Error reading project archive: %v", err)
+	}
+	if int64(len(b)) > maxProjectSize {
+		return nil, &statusError{status: http.StatusRequestEntityTooLarge,
+			err: fmt.Errorf("Project archive is larger than %d MiB", maxProjectSize>>20)}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, badRequest("Error reading project archive: %v", err)
+	}
+	p := newProjectReader()
+	for _, f := range zr.File {
+		if err := p.entry(); err != nil {
+			return nil, err
+		}
+		mode := f.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			return nil, badRequest("Project archive entry %q is not a regular file or directory", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, badRequest("Error reading %s from project archive: %v", f.Name, err)
+		}
+		err = p.add(f.Name, rc, mode)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// projectPath cleans an archive entry's name, refusing any that would land
+// outside the workspace. It returns "" for entries that are skipped.
+func projectPath(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", badRequest("Project archive entry %q is outside the project", name)
+	}
+	if clean == "." {
+		return "", nil
+	}
+	for _, part := range strings.Split(clean, "/") {
+		if part == "node_modules" {
+			return "", nil
+		}
+	}
+	return clean, nil
+}
+
+// stripRoot removes a top-level directory shared by every file
+func (p *projectReader) stripRoot() {
+	root := ""
+	for name := range p.files {
+		dir, _, ok := strings.Cut(name, "/")
+		if !ok || root != "" && dir != root {
+			return
+		}
+		root = dir
+	}
+	if root == "" {
+		return
+	}
+	files := make(map[string]string, len(p.files))
+	for name, content := range p.files {
+		files[strings.TrimPrefix(name, root+"/")] = content
+	}
+	modes := make(map[string]os.FileMode, len(p.modes))
+	for name, mode := range p.modes {
+		modes[strings.TrimPrefix(name, root+"/")] = mode
+	}
+	p.files, p.modes = files, modes
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// tarEntry is one entry of a test archive; a name ending in "/" is a
+// directory
+type tarEntry struct {
+	name    string
+	content string
+	mode    int64
+	link    string
+}
+
+func projectTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Size = tar.TypeDir, 0
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadProject(t *testing.T) {
+	files, modes, err := readProject(yarnEcosystem, projectTar(t,
+		tarEntry{name: "app/"},
+		tarEntry{name: "app/package.json", content: "{}"},
+		tarEntry{name: "app/.npmrc", content: "registry=https://registry.npmjs.org/"},
+		tarEntry{name: "app/bin/run.sh", content: "#!/bin/sh", mode: 0777},
+		tarEntry{name: "app/node_modules/left-pad/index.js", content: "x"},
+		tarEntry{name: "app/.yarnrc", content: "registry \"https://evil/\""},
+		tarEntry{name: "app/packages/lib/.yarnrc.yml", content: "npmRegistryServer: https://evil/"},
+		tarEntry{name: "app/packages/lib/.npmrc", content: "registry=https://evil/"},
+		tarEntry{name: "app/.cargo/config.toml", content: "[source.crates-io]\nreplace-with = \"evil\""},
+		tarEntry{name: "app/bunfig.toml", content: "[install]\nregistry = \"https://evil/\""},
+		tarEntry{name: "app/pip.conf", content: "[global]\nindex-url = https://evil/simple"},
+	))
+	if err != nil {
+		t.Fatalf("readProject() failed: %v", err)
+	}
+	want := []string{".npmrc", "bin/run.sh", "package.json"}
+	if len(files) != len(want) {
+		t.Errorf("readProject() kept %d files, want %v", len(files), want)
+	}
+	for _, name := range want {
+		if _, ok := files[name]; !ok {
+			t.Errorf("readProject() dropped %s", name)
+		}
+	}
+	if modes["bin/run.sh"] != 0755 {
+		t.Errorf("bin/run.sh has mode %v, want 0755", modes["bin/run.sh"])
+	}
+	if _, ok := modes["package.json"]; ok {
+		t.Errorf("package.json has mode %v, want the default", modes["package.json"])
+	}
+}
+
+func TestReadProjectRefuses(t *testing.T) {
+	tooMany := make([]tarEntry, maxProjectFiles+1)
+	for i := range tooMany {
+		tooMany[i] = tarEntry{name: fmt.Sprintf("d%d/", i)}
+	}
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		status  int
+	}{
+		{name: "parent directory", entries: []tarEntry{{name: "../evil", content: "x"}}, status: http.StatusBadRequest},
+		{name: "nested parent directory", entries: []tarEntry{{name: "a/../../evil", content: "x"}}, status: http.StatusBadRequest},
+		{name: "absolute path", entries: []tarEntry{{name: "/etc/evil", content: "x"}}, status: http.StatusBadRequest},
+		{name: "backslashes", entries: []tarEntry{{name: "..\\evil", content: "x"}}, status: http.StatusBadRequest},
+		{name: "symlink", entries: []tarEntry{{name: "evil", link: "/etc/passwd"}}, status: http.StatusBadRequest},
+		{name: "file and directory", entries: []tarEntry{{name: "a", content: "x"}, {name: "a/b", content: "y"}}, status: http.StatusBadRequest},
+		{name: "too many directories", entries: tooMany, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readProject(npmEcosystem, projectTar(t, tt.entries...))
+			var se *statusError
+			if !errors.As(err, &se) || se.status != tt.status {
+				t.Errorf("readProject() = %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadProjectZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, mode := range map[string]os.FileMode{"package.json": 0644, "bin/run.sh": 0755} {
+		hdr := &zip.FileHeader{Name: name}
+		hdr.SetMode(mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("x"))
+	}
+	if _, err := zw.Create("../evil"); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	_, _, err := readProject(npmEcosystem, &buf)
+	var se *statusError
+	if !errors.As(err, &se) || se.status != http.StatusBadRequest {
+		t.Errorf("readProject() = %v, want a 400 for ../evil", err)
+	}
+}
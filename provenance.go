@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifyProvenance is the server's provenance policy for Node.js installs,
+// set from the verify_provenance setting: installs whose packages fail it
+// fail. Empty turns it off unless a request asks for it.
+var verifyProvenance string
+
+// provenanceLevels are the valid policies, from loosest to strictest.
+// signatures requires every package to carry a valid registry signature and
+// any provenance attestation it has to verify; attestations also requires
+// every package to have one.
+var provenanceLevels = []string{"signatures", "attestations"}
+
+// provenanceClient reads package metadata from the registry for the
+// attestations policy
+var provenanceClient = &http.Client{Timeout: registryTimeout}
+
+// maxProvenanceLookups caps the registry requests made at once for an install
+const maxProvenanceLookups = 8
+
+// provenance returns the provenance policy for the request: the stricter of
+// the server's and the request's
+func (o InstallOptions) provenance() string {
+	if slices.Index(provenanceLevels, verifyProvenance) > slices.Index(provenanceLevels, o.VerifyProvenance) {
+		return verifyProvenance
+	}
+	return o.VerifyProvenance
+}
+
+// validateProvenance checks the verify_provenance option, which may only
+// tighten the server's policy
+func validateProvenance(eco *Ecosystem, level string) error {
+	if !slices.Contains(provenanceLevels, level) {
+		return badRequest("Invalid verify_provenance %q: must be one of %s", level, strings.Join(provenanceLevels, ", "))
+	}
+	if eco.Runtime != "node" {
+		return badRequest("verify_provenance is not supported for %s", eco.Name)
+	}
+	if slices.Index(provenanceLevels, level) < slices.Index(provenanceLevels, verifyProvenance) {
+		return badRequest("verify_provenance %q is looser than the server's policy of %q", level, verifyProvenance)
+	}
+	return nil
+}
+
+// A ProvenanceReport is what verifying the provenance of an install's
+// packages found
+type ProvenanceReport struct {
+	// Level is the policy the packages were held to
+	Level string `json:"level"`
+	// Checked is how many installed packages came from a registry and were
+	// verified
+	Checked int `json:"checked"`
+	// Issues lists the packages that failed, if any
+	Issues []ProvenanceIssue `json:"issues,omitempty"`
+}
+
+// A ProvenanceIssue is a package that failed provenance verification
+type ProvenanceIssue struct {
+	// Package is the package as name@version
+	Package string `json:"package"`
+	// Problem is invalid_signature, missing_signature, invalid_attestation
+	// or missing_attestation
+	Problem string `json:"problem"`
+	Message string `json:"message,omitempty"`
+}
+
+// A provenanceError fails an install whose packages failed the provenance
+// policy
+type provenanceError struct {
+	report *ProvenanceReport
+}
+
+func (e *provenanceError) Error() string {
+	return fmt.Sprintf("%d packages failed %s provenance verification", len(e.report.Issues), e.report.Level)
+}
+
+func (e *provenanceError) code() string { return "PROVENANCE_FAILED" }
+
+func (e *provenanceError) details() map[string]any {
+	return map[string]any{"level": e.report.Level, "issues": e.report.Issues}
+}
+
+// checkProvenance verifies an installed node_modules when the request has a
+// provenance policy. npm audit signatures checks the registry signatures,
+// and the attestations of the packages that have them; the attestations
+// policy then looks up each other package's attestations in the registry.
+// The report is added to the install's notes whichever way it goes.
+func checkProvenance(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir, outputDir string) error {
+	level := req.Options.VerifyProvenance
+	if level == "" {
+		return nil
+	}
+	// Like the vulnerability gate, verification fails closed
+	if _, isDocker := installExecutor.(*dockerExecutor); !isDocker {
+		if _, err := exec.LookPath("npm"); err != nil {
+			return &statusError{status: http.StatusNotImplemented, err: fmt.Errorf("npm is not installed on this server")}
+		}
+	}
+	defer notesFrom(ctx).phase("provenance", time.Now())
+	pkgs, err := installedPackages(eco, outputDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list installed packages: %v", err)
+	}
+	pkgs = registryPackages(eco, req, pkgs)
+	report := &ProvenanceReport{Level: level, Checked: len(pkgs)}
+	if len(pkgs) > 0 {
+		var out bytes.Buffer
+		args := append([]string{"audit", "signatures", "--json"}, registryArgs(eco, req)...)
+		err := runTool(ctx, eco, req, workDir, toolRun{step: "audit signatures", tool: "npm", args: args, stdout: &out})
+		issues, parseErr := parseNpmSignatures(out.Bytes())
+		if parseErr != nil {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("Failed to read npm audit signatures output: %v", parseErr)
+		}
+		report.Issues = issues
+	}
+	if level == "attestations" {
+		missing, err := missingAttestations(ctx, installRegistry(eco, req), pkgs, report.Issues)
+		if err != nil {
+			return err
+		}
+		report.Issues = append(report.Issues, missing...)
+	}
+	notesFrom(ctx).addProvenance(report)
+	if len(report.Issues) > 0 {
+		loggerFrom(ctx).Warn("install failed provenance verification", "level", level, "packages", len(report.Issues))
+		return &provenanceError{report: report}
+	}
+	return nil
+}
+
+// registryPackages leaves out of an install's packages those that don't
+// come from a registry: the project's own workspaces
+func registryPackages(eco *Ecosystem, req *InstallRequest, pkgs []Package) []Package {
+	local := make(map[string]bool)
+	for name, content := range req.Files {
+		if name == "package.json" || isWorkspaceManifest(eco, name) {
+			var m npmManifest
+			if json.Unmarshal([]byte(content), &m) == nil && m.Name != "" {
+				local[m.Name] = true
+			}
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(pkgs), func(p Package) bool { return p.Version == "" || local[p.Name] })
+}
+
+// installRegistry returns the registry an install's packages came from
+func installRegistry(eco *Ecosystem, req *InstallRequest) string {
+	if req.Options.Registry != "" {
+		return req.Options.Registry
+	}
+	return eco.Registry
+}
+
+// parseNpmSignatures reads npm audit signatures --json: the packages whose
+// signatures or attestations are invalid, and those missing a signature
+// from a registry that signs them
+func parseNpmSignatures(out []byte) ([]ProvenanceIssue, error) {
+	type entry struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	var result struct {
+		Invalid []entry `json:"invalid"`
+		Missing []entry `json:"missing"`
+		Error   *struct {
+			Code    string `json:"code"`
+			Summary string `json:"summary"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("%s: %s", result.Error.Code, result.Error.Summary)
+	}
+	var issues []ProvenanceIssue
+	for _, e := range result.Invalid {
+		problem := "invalid_signature"
+		if strings.Contains(e.Code, "ATTESTATION") {
+			problem = "invalid_attestation"
+		}
+		issues = append(issues, ProvenanceIssue{Package: e.Name + "@" + e.Version, Problem: problem, Message: e.Message})
+	}
+	for _, e := range result.Missing {
+		issues = append(issues, ProvenanceIssue{Package: e.Name + "@" + e.Version, Problem: "missing_signature"})
+	}
+	return issues, nil
+}
+
+// missingAttestations looks up in the registry which of pkgs have no
+// provenance attestation, leaving out those already failed
+func missingAttestations(ctx context.Context, registry string, pkgs []Package, failed []ProvenanceIssue) ([]ProvenanceIssue, error) {
+	var (
+		mu       sync.Mutex
+		missing  []ProvenanceIssue
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	sem := make(chan struct{}, maxProvenanceLookups)
+	for _, p := range pkgs {
+		id := p.Name + "@" + p.Version
+		if slices.ContainsFunc(failed, func(i ProvenanceIssue) bool { return i.Package == id }) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			ok, err := hasAttestation(ctx, registry, p)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil && firstErr == nil:
+				firstErr = err
+			case err == nil && !ok:
+				missing = append(missing, ProvenanceIssue{Package: id, Problem: "missing_attestation"})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	slices.SortFunc(missing, func(a, b ProvenanceIssue) int { return strings.Compare(a.Package, b.Package) })
+	return missing, nil
+}
+
+// hasAttestation reports whether the registry lists a provenance
+// attestation for a package version. Versions the registry doesn't know,
+// such as those from a scope's own registry, have none.
+func hasAttestation(ctx context.Context, registry string, p Package) (bool, error) {
+	u := strings.TrimSuffix(registry, "/") + "/" + url.PathEscape(p.Name) + "/" + url.PathEscape(p.Version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := provenanceClient.Do(req)
+	if err != nil {
+		return false, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to look up the provenance of %s@%s: %v", p.Name, p.Version, err)}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to look up the provenance of %s@%s: registry returned %s", p.Name, p.Version, resp.Status)}
+	}
+	var manifest struct {
+		Dist struct {
+			Attestations *struct {
+				Provenance *struct {
+					PredicateType string `json:"predicateType"`
+				} `json:"provenance"`
+			} `json:"attestations"`
+		} `json:"dist"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return false, &statusError{status: http.StatusBadGateway, err: fmt.Errorf("Failed to read the metadata of %s@%s: %v", p.Name, p.Version, err)}
+	}
+	a := manifest.Dist.Attestations
+	return a != nil && a.Provenance != nil, nil
+}
+
+// addProvenance records a provenance report. The installs of a targets
+// install are verified one by one, so their reports are added up.
+func (n *installNotes) addProvenance(r *ProvenanceReport) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.provenance == nil {
+		n.provenance = &ProvenanceReport{Level: r.Level}
+	}
+	n.provenance.Checked += r.Checked
+	for _, issue := range r.Issues {
+		if !slices.Contains(n.provenance.Issues, issue) {
+			n.provenance.Issues = append(n.provenance.Issues, issue)
+		}
+	}
+}
+
+// provenanceReport returns the provenance report recorded, if any
+func (n *installNotes) provenanceReport() *ProvenanceReport {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.provenance == nil {
+		return nil
+	}
+	r := *n.provenance
+	r.Issues = slices.Clone(r.Issues)
+	return &r
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultPrunePatterns are the files and directories the prune option
+// removes from node_modules unless the prune_patterns setting replaces them:
+// tests, docs, examples, source maps and tooling configuration that nothing
+// loads at run time. Patterns match a base name; those ending in / match
+// directories.
+var defaultPrunePatterns = []string{
+	"test/", "tests/", "__tests__/", "__mocks__/", "spec/", "example/", "examples/",
+	"doc/", "docs/", "website/", "coverage/", ".github/", ".circleci/", ".idea/", ".vscode/",
+	"*.md", "*.markdown", "*.map", "*.tsbuildinfo",
+	"*.test.js", "*.spec.js", "*.test.ts", "*.spec.ts",
+	"CHANGELOG*", "CHANGES*", "HISTORY*", "AUTHORS*", "CONTRIBUTORS*",
+	".npmignore", ".gitattributes", ".gitignore", ".editorconfig", ".travis.yml", ".nycrc*",
+	".eslintrc*", ".eslintignore", ".prettierrc*", ".prettierignore", ".babelrc*", ".jshintrc",
+	"tsconfig.json", "tslint.json", "jest.config.*", "karma.conf.*", "Makefile", "Gruntfile.js", "Gulpfile.js",
+}
+
+// prunePatterns is what the prune option removes, set from prune_patterns
+var prunePatterns = defaultPrunePatterns
+
+// keptNames are never pruned, so licenses stay with the code they cover
+var keptNames = []string{"LICENSE*", "LICENCE*", "COPYING*", "NOTICE*", "package.json"}
+
+var prunedBytes = newCounterVec("pip_install_pruned_bytes_total",
+	"Bytes the prune option removed from installed packages, by ecosystem.", "ecosystem")
+
+// matchesAny reports whether name matches one of the patterns for files, or
+// with dir set for directories
+func matchesAny(patterns []string, name string, dir bool) bool {
+	for _, pattern := range patterns {
+		pattern, dirOnly := strings.CutSuffix(pattern, "/")
+		if dirOnly && !dir {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		// Names differ in case between packages, such as readme.md
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneInstalled removes the files prunePatterns match from an installed
+// node_modules and returns how many bytes that freed. Package directories,
+// the children of node_modules and of scopes, are never removed themselves,
+// so a package named "test" survives. Symlinks aren't followed.
+func pruneInstalled(outputDir string) (int64, error) {
+	var freed int64
+	err := filepath.WalkDir(outputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == outputDir {
+			return nil
+		}
+		name := d.Name()
+		if matchesAny(keptNames, name, d.IsDir()) || !matchesAny(prunePatterns, name, d.IsDir()) || isPackageDir(p) {
+			return nil
+		}
+		n, err := treeSize(p, d)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		freed += n
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return freed, err
+}
+
+// isPackageDir reports whether p is where a package is installed:
+// node_modules/<name> or node_modules/@scope/<name>
+func isPackageDir(p string) bool {
+	parent := filepath.Base(filepath.Dir(p))
+	if parent == "node_modules" {
+		return true
+	}
+	return strings.HasPrefix(parent, "@") && filepath.Base(filepath.Dir(filepath.Dir(p))) == "node_modules"
+}
+
+// treeSize returns the size of the regular files at or below p
+func treeSize(p string, d fs.DirEntry) (int64, error) {
+	if !d.IsDir() {
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	var n int64
+	err := filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil && info.Mode().IsRegular() {
+			n += info.Size()
+		}
+		return err
+	})
+	return n, err
+}
+
+// setPrunedBytes reports how much the prune option removed in the
+// X-Pruned-Bytes header
+func setPrunedBytes(w http.ResponseWriter, n int64) {
+	if n > 0 {
+		w.Header().Set("X-Pruned-Bytes", strconv.FormatInt(n, 10))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// workspaceQuota caps the disk space an install's workspace may use, in
+// bytes; zero means unlimited. Set from the workspace_quota_mb setting.
+var workspaceQuota int64
+
+// quotaCheckInterval is how often a running install's workspace is measured
+const quotaCheckInterval = 2 * time.Second
+
+// errQuotaExceeded cancels an install whose workspace outgrew the quota
+var errQuotaExceeded = errors.New("disk quota exceeded")
+
+// diskUsage returns the space allocated to the files under dir, like du.
+// Hard-linked files are counted once. Files that vanish while it walks are
+// skipped, as the package manager is still running.
+func diskUsage(dir string) (int64, error) {
+	// A workspace that spilled from tmpfs is a link to where it went
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	seen := make(map[uint64]bool)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			total += info.Size()
+			return nil
+		}
+		if st.Nlink > 1 {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		total += st.Blocks * 512
+		return nil
+	})
+	return total, err
+}
+
+// watchQuota measures workDir until ctx is done, calling cancel with
+// errQuotaExceeded once it uses more than workspaceQuota, or for a workspace
+// on tmpfs with errTmpfsFull once it uses more than tmpfsWorkspaceMax
+func watchQuota(ctx context.Context, workDir string, tmpfs bool, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		used, err := diskUsage(workDir)
+		if err != nil {
+			loggerFrom(ctx).Warn("failed to measure workspace", "error", err)
+			continue
+		}
+		if workspaceQuota > 0 && used > workspaceQuota {
+			cancel(errQuotaExceeded)
+			return
+		}
+		if tmpfs && used > tmpfsWorkspaceMax {
+			cancel(errTmpfsFull)
+			return
+		}
+	}
+}
+
+// overQuota reports whether workDir uses more than workspaceQuota
+func overQuota(ctx context.Context, workDir string) bool {
+	used, err := diskUsage(workDir)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to measure workspace", "error", err)
+		return false
+	}
+	return used > workspaceQuota
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// concurrencyRetryAfter is suggested to clients over their concurrent install
+// limit, since when a slot frees up can't be predicted
+const concurrencyRetryAfter = 10 * time.Second
+
+var rateLimited = newCounterVec("pip_install_rate_limited_total",
+	"Requests rejected by per-client limits, by reason (rate or concurrency).", "reason")
+
+// clientLimits enforces per-client request rates, with a token bucket per
+// client, and caps how many installs each client may have in flight. Clients
+// are identified by API key label or JWT subject, falling back to their IP.
+// A zero limit disables that check.
+type clientLimits struct {
+	perMinute  float64
+	burst      float64
+	concurrent int
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	inflight map[string]int
+}
+
+// A tokenBucket holds up to burst tokens, refilled continuously at the
+// configured rate; each request takes one
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newClientLimits(perMinute, burst float64, concurrent int) *clientLimits {
+	if burst < 1 {
+		burst = math.Max(perMinute, 1)
+	}
+	l := &clientLimits{
+		perMinute:  perMinute,
+		burst:      burst,
+		concurrent: concurrent,
+		buckets:    make(map[string]*tokenBucket),
+		inflight:   make(map[string]int),
+	}
+	if perMinute > 0 {
+		go l.janitor()
+	}
+	return l
+}
+
+// clientID identifies the caller of r
+func clientID(r *http.Request) string {
+	return callerID(r.Context(), clientIP(r))
+}
+
+// callerID identifies the authenticated caller in ctx, or else the client at ip
+func callerID(ctx context.Context, ip string) string {
+	if p, ok := principalFrom(ctx); ok {
+		if p.KeyLabel != "" {
+			return "key:" + p.KeyLabel
+		}
+		return "sub:" + p.Subject
+	}
+	return "ip:" + ip
+}
+
+// take removes a token from client's bucket. When it is empty it returns how
+// long until the next token is available.
+func (l *clientLimits) take(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	perSecond := l.perMinute / 60
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// rate wraps h, rejecting requests from clients over their request rate with
+// 429 and a Retry-After header
+func (l *clientLimits) rate(h http.HandlerFunc) http.HandlerFunc {
+	if l.perMinute <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientID(r)
+		if wait, ok := l.take(client, time.Now()); !ok {
+			rateLimited.inc("rate")
+			loggerFrom(r.Context()).Warn("rate limit exceeded", "client", client)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, "Rate limit exceeded, try again later", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// acquire reserves an install slot for the caller of r, setting Retry-After
+// on w when none is free. The returned function releases the slot and may be
+// called more than once.
+func (l *clientLimits) acquire(w http.ResponseWriter, r *http.Request) (func(), error) {
+	release, err := l.reserve(r.Context(), clientID(r))
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(concurrencyRetryAfter.Seconds())))
+	}
+	return release, err
+}
+
+// reserve is acquire for any client, failing with 429 when it has no free slot
+func (l *clientLimits) reserve(ctx context.Context, client string) (func(), error) {
+	if l.concurrent <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight[client] >= l.concurrent {
+		rateLimited.inc("concurrency")
+		loggerFrom(ctx).Warn("concurrent install limit exceeded", "client", client)
+		return nil, &statusError{status: http.StatusTooManyRequests,
+			err: fmt.Errorf("Too many concurrent installs: at most %d per client", l.concurrent)}
+	}
+	l.inflight[client]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inflight[client]--; l.inflight[client] <= 0 {
+				delete(l.inflight, client)
+			}
+		})
+	}, nil
+}
+
+// janitor forgets buckets that have refilled, since they behave exactly like
+// new ones
+func (l *clientLimits) janitor() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.perMinute/60 >= l.burst {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
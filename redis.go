@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout bounds a Redis command whose context has no deadline
+const redisTimeout = 5 * time.Second
+
+// maxIdleRedisConns is how many connections a redisClient keeps for reuse
+const maxIdleRedisConns = 16
+
+// A redisError is an error reply from the server. The connection is still
+// usable afterwards.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// A redisClient sends commands to one Redis server over RESP, keeping idle
+// connections for reuse. Replies are decoded to string, int64, []any or nil.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient parses a URL such as redis://:password@host:6379/0, or
+// rediss:// for TLS
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" || u.Hostname() == "" {
+		return nil, fmt.Errorf("%q is not a redis:// or rediss:// URL", u.Redacted())
+	}
+	c := &redisClient{addr: u.Host, idle: make(chan *redisConn, maxIdleRedisConns)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("%q: database must be a number", db)
+		}
+	}
+	if u.Scheme == "rediss" {
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	return c, nil
+}
+
+// do sends one command and returns its reply
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.conn.SetDeadline(deadline)
+	reply, err := conn.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// str returns a bulk or simple string reply, or "" for nil
+func (c *redisClient) str(ctx context.Context, args ...string) (string, error) {
+	reply, err := c.do(ctx, args...)
+	s, _ := reply.(string)
+	return s, err
+}
+
+// int returns an integer reply
+func (c *redisClient) int(ctx context.Context, args ...string) (int64, error) {
+	reply, err := c.do(ctx, args...)
+	n, _ := reply.(int64)
+	return n, err
+}
+
+// strings returns an array reply of strings
+func (c *redisClient) strings(ctx context.Context, args ...string) ([]string, error) {
+	reply, err := c.do(ctx, args...)
+	items, _ := reply.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		out = append(out, s)
+	}
+	return out, err
+}
+
+// get returns an idle connection or dials a new one, logging in and
+// selecting the database
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	conn := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	nc.SetDeadline(time.Now().Add(redisTimeout))
+	var setup [][]string
+	switch {
+	case c.username != "" && c.password != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put keeps a connection for reuse, or closes it if enough are idle
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// roundTrip writes a command as an array of bulk strings and reads the reply
+func (rc *redisConn) roundTrip(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) readReply() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %v", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		var firstErr error
+		for i := range items {
+			// An error inside an array, as from EXEC, doesn't end it
+			items[i], err = rc.readReply()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return items, firstErr
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// allowedRegistries lists the registry URLs requests may install from, set
+// from the allowed_registries setting. A request's registry must lie under
+// one of them; with none configured, overrides are refused.
+var allowedRegistries []string
+
+// allowedNpmArgs lists the flags the npm_args option may pass to yarn and
+// pnpm, set from the allowed_npm_args setting. An entry ending in "=*" allows
+// the flag with any value.
+var allowedNpmArgs []string
+
+// validateNpmArgs checks the npm_args option against the allowlist
+func validateNpmArgs(eco *Ecosystem, args []string) error {
+	if eco.Runtime != "node" {
+		return badRequest("npm_args is not supported for %s installs", eco.Name)
+	}
+	for _, arg := range args {
+		if !npmArgAllowed(arg) {
+			return badRequest("npm_args: %q is not in the server's list of allowed flags", arg)
+		}
+	}
+	return nil
+}
+
+func npmArgAllowed(arg string) bool {
+	for _, allowed := range allowedNpmArgs {
+		if arg == allowed {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasSuffix(prefix, "=") && strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRegistry checks a requested registry URL against the allowlist
+func validateRegistry(eco *Ecosystem, raw string) error {
+	if eco.RegistryArgs == nil {
+		return badRequest("registry is not supported for %s installs", eco.Name)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return badRequest("registry must be an absolute http or https URL without credentials")
+	}
+	if registryAllowed(raw) {
+		return nil
+	}
+	return badRequest("registry %s is not in the server's list of allowed registries", raw)
+}
+
+// A fileRegistry is a source of packages named in one of a request's files
+type fileRegistry struct {
+	file string
+	url  string
+}
+
+// validateFileRegistries checks the sources a request's own files name
+// against the allowlist, before the server's files are added
+func validateFileRegistries(eco *Ecosystem, files map[string]string) error {
+	if eco.FileRegistries == nil {
+		return nil
+	}
+	sources, err := eco.FileRegistries(files)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if !registryAllowed(source.url) {
+			return badRequest("%s fetches from %s, which is not in the server's list of allowed registries", source.file, source.url)
+		}
+	}
+	return nil
+}
+
+// npmRegistries lists the registries an .npmrc points installs at: the
+// default registry and those of scopes
+func npmRegistries(files map[string]string) ([]fileRegistry, error) {
+	var sources []fileRegistry
+	for _, line := range strings.Split(files[".npmrc"], "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if ok && (key == "registry" || strings.HasPrefix(key, "@") && strings.HasSuffix(key, ":registry")) {
+			sources = append(sources, fileRegistry{file: ".npmrc", url: strings.Trim(strings.TrimSpace(value), `"'`)})
+		}
+	}
+	return sources, nil
+}
+
+// pipIndexOptions are the pip options naming an index or a page of links to
+// install from, as pip.conf keys and requirements file flags
+var pipIndexOptions = []string{"index-url", "extra-index-url", "find-links"}
+
+// pipRegistries lists the indexes and find-links pages a pip.conf and the
+// options in requirements and constraints files point pip at
+func pipRegistries(files map[string]string) ([]fileRegistry, error) {
+	var sources []fileRegistry
+	// A pip.conf value can go on over indented lines, one URL per line
+	indexKey := false
+	for _, line := range strings.Split(files["pip.conf"], "\n") {
+		if indexKey && line != strings.TrimLeft(line, " \t") {
+			for _, value := range strings.Fields(line) {
+				sources = append(sources, fileRegistry{file: "pip.conf", url: value})
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		indexKey = ok && slices.Contains(pipIndexOptions, key)
+		if indexKey {
+			for _, value := range strings.Fields(value) {
+				sources = append(sources, fileRegistry{file: "pip.conf", url: value})
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range []string{"requirements.txt", "constraints.txt"} {
+		included, err := pipRequirementsRegistries(files, name, seen)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, included...)
+	}
+	return sources, nil
+}
+
+// pipLongOptions are the long options pip reads from requirements files.
+// Like pip, a long option may be given as any prefix naming only one.
+var pipLongOptions = []string{
+	"index-url", "extra-index-url", "no-index", "constraint", "requirement", "editable", "find-links",
+	"no-binary", "only-binary", "prefer-binary", "require-hashes", "pre", "trusted-host", "use-feature",
+	"hash", "config-settings", "global-option",
+}
+
+// pipFlagOptions are the options in pipLongOptions that take no value
+var pipFlagOptions = []string{"no-index", "prefer-binary", "require-hashes", "pre"}
+
+// pipShortOptions are the long options of the short ones requirements files
+// may use, whose value may follow in the same word, as in -ihttps://...
+var pipShortOptions = map[byte]string{'i': "index-url", 'f': "find-links", 'c': "constraint", 'r': "requirement", 'e': "editable", 'C': "config-settings"}
+
+// pipLongOption returns the long option name abbreviates, or "" if it
+// names none or several
+func pipLongOption(name string) string {
+	if slices.Contains(pipLongOptions, name) {
+		return name
+	}
+	match := ""
+	for _, opt := range pipLongOptions {
+		if strings.HasPrefix(opt, name) {
+			if match != "" {
+				return ""
+			}
+			match = opt
+		}
+	}
+	return match
+}
+
+// pipCommentPattern matches a comment in a requirements file, which pip
+// only recognizes at the start of a line or after whitespace
+var pipCommentPattern = regexp.MustCompile(`(^|\s)#.*$`)
+
+// pipRequirementsRegistries lists the indexes and find-links pages the
+// requirements file name points pip at, and those of the files it
+// includes with -r and -c. Included files must be among the request's
+// own, so they can be checked too.
+func pipRequirementsRegistries(files map[string]string, name string, seen map[string]bool) ([]fileRegistry, error) {
+	if seen[name] {
+		return nil, nil
+	}
+	seen[name] = true
+	var sources []fileRegistry
+	// Lines ending in a backslash go on over the next
+	content := strings.ReplaceAll(strings.ReplaceAll(files[name], "\r\n", "\n"), "\\\n", "")
+	for _, line := range strings.Split(content, "\n") {
+		fields := shellFields(pipCommentPattern.ReplaceAllString(line, ""))
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			var opt, value string
+			hasValue := false
+			switch {
+			case strings.HasPrefix(field, "--"):
+				long, v, ok := strings.Cut(field[2:], "=")
+				opt, value, hasValue = pipLongOption(long), v, ok
+			case len(field) > 1 && field[0] == '-':
+				opt = pipShortOptions[field[1]]
+				value, hasValue = field[2:], len(field) > 2
+			}
+			if opt == "" || slices.Contains(pipFlagOptions, opt) {
+				continue
+			}
+			if !hasValue {
+				if i+1 == len(fields) {
+					return nil, badRequest("%s: %s needs a value", name, field)
+				}
+				i++
+				value = fields[i]
+			}
+			switch opt {
+			case "index-url", "extra-index-url", "find-links":
+				sources = append(sources, fileRegistry{file: name, url: value})
+			case "requirement", "constraint":
+				include := path.Join(path.Dir(name), value)
+				if _, ok := files[include]; !ok || path.IsAbs(value) || strings.Contains(value, "://") {
+					return nil, badRequest("%s includes %s, which is not one of the request's files", name, value)
+				}
+				included, err := pipRequirementsRegistries(files, include, seen)
+				if err != nil {
+					return nil, err
+				}
+				sources = append(sources, included...)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// shellFields splits a line into words as pip does, the way a POSIX shell
+// would: quotes group words and are removed, and a backslash escapes the
+// next character
+func shellFields(line string) []string {
+	var (
+		fields []string
+		word   strings.Builder
+		inWord bool
+		quote  rune
+		escape bool
+	)
+	for _, r := range line {
+		switch {
+		case escape:
+			word.WriteRune(r)
+			escape = false
+		case r == '\\' && quote != '\'':
+			escape, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				fields = append(fields, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		fields = append(fields, word.String())
+	}
+	return fields
+}
+
+// registryAllowed reports whether raw lies under one of allowedRegistries
+func registryAllowed(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowedRegistries {
+		if registryWithin(u, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// registryWithin reports whether u is the allowed URL or a path below it.
+// Paths with dot segments are refused, as registries and proxies in front
+// of them may resolve them out of the allowed prefix, counting backslashes
+// as separators since some servers do.
+func registryWithin(u *url.URL, allowed string) bool {
+	a, err := url.Parse(allowed)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, a.Scheme) || !strings.EqualFold(u.Host, a.Host) {
+		return false
+	}
+	decoded, err := url.PathUnescape(u.EscapedPath())
+	if err != nil || slices.ContainsFunc(strings.FieldsFunc(decoded, pathSeparator), func(s string) bool { return s == "." || s == ".." }) {
+		return false
+	}
+	prefix := strings.TrimSuffix(path.Clean("/"+a.Path), "/") + "/"
+	return strings.HasPrefix(strings.TrimSuffix(path.Clean("/"+u.Path), "/")+"/", prefix)
+}
+
+// pathSeparator reports whether r separates path segments to registryWithin
+func pathSeparator(r rune) bool { return r == '/' || r == '\\' }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPipRegistries(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain requirements", files: map[string]string{"requirements.txt": "requests==2.32.3\n"}},
+		{name: "long option", files: map[string]string{"requirements.txt": "--index-url https://evil/simple\n"}, want: []string{"https://evil/simple"}},
+		{name: "long option with =", files: map[string]string{"requirements.txt": "--extra-index-url=https://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "short option", files: map[string]string{"requirements.txt": "-i https://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "attached short index", files: map[string]string{"requirements.txt": "-ihttps://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "attached short find-links", files: map[string]string{"requirements.txt": "-fhttps://evil"}, want: []string{"https://evil"}},
+		{name: "abbreviated index-url", files: map[string]string{"requirements.txt": "--index=https://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "abbreviated extra-index-url", files: map[string]string{"requirements.txt": "--extra https://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "abbreviated find-links", files: map[string]string{"requirements.txt": "--find=https://evil"}, want: []string{"https://evil"}},
+		{name: "ambiguous prefix", files: map[string]string{"requirements.txt": "--pr https://evil"}},
+		{name: "quoted option", files: map[string]string{"requirements.txt": `"--index-url=https://evil/simple"`}, want: []string{"https://evil/simple"}},
+		{name: "continued line", files: map[string]string{"requirements.txt": "--index-url \\\nhttps://evil/simple"}, want: []string{"https://evil/simple"}},
+		{name: "comment", files: map[string]string{"requirements.txt": "requests # --index-url https://evil/simple"}},
+		{name: "constraints", files: map[string]string{"requirements.txt": "requests", "constraints.txt": "-f https://evil"}, want: []string{"https://evil"}},
+		{name: "missing value", files: map[string]string{"requirements.txt": "--index-url"}, wantErr: true},
+		{
+			name:  "included requirements",
+			files: map[string]string{"requirements.txt": "-r other.txt", "other.txt": "-i https://evil/simple"},
+			want:  []string{"https://evil/simple"},
+		},
+		{
+			name:  "included constraints",
+			files: map[string]string{"requirements.txt": "-c sub/c.txt", "sub/c.txt": "-r more.txt", "sub/more.txt": "--find-links=https://evil"},
+			want:  []string{"https://evil"},
+		},
+		{
+			name:  "include cycle",
+			files: map[string]string{"requirements.txt": "-r other.txt", "other.txt": "-r requirements.txt"},
+		},
+		{name: "include outside the request", files: map[string]string{"requirements.txt": "-r ../other/requirements.txt"}, wantErr: true},
+		{name: "absolute include", files: map[string]string{"requirements.txt": "-r/etc/requirements.txt"}, wantErr: true},
+		{name: "URL include", files: map[string]string{"requirements.txt": "--requirement https://evil/requirements.txt"}, wantErr: true},
+		{name: "pip.conf", files: map[string]string{"pip.conf": "[global]\nindex-url = https://evil/simple\nextra_index_url =\n  https://evil2/simple\n"}, want: []string{"https://evil/simple", "https://evil2/simple"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := pipRegistries(tt.files)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("pipRegistries() = %v, want an error", sources)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pipRegistries() failed: %v", err)
+			}
+			var got []string
+			for _, s := range sources {
+				got = append(got, s.url)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pipRegistries() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryAllowed(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://pypi.example.com/simple", true},
+		{"https://pypi.example.com/simple/", true},
+		{"https://pypi.example.com/simple/requests/", true},
+		{"https://PyPI.Example.com/simple/", true},
+		{"HTTPS://pypi.example.com/simple/", true},
+		{"https://pypi.example.com/simple-evil/", false},
+		{"https://pypi.example.com/simplex", false},
+		{"https://pypi.example.com/", false},
+		{"https://pypi.example.com/simple/../admin/", false},
+		{"https://pypi.example.com/simple/./requests/", false},
+		{"https://pypi.example.com/simple/%2e%2e/admin/", false},
+		{"https://pypi.example.com/simple/%2E%2E/admin/", false},
+		{"https://pypi.example.com/simple%2f..%2fadmin/", false},
+		{"https://pypi.example.com/simple/..\\admin/", false},
+		{"https://pypi.example.com:8443/simple/", false},
+		{"http://pypi.example.com/simple/", false},
+		{"https://pypi.example.com.evil/simple/", false},
+		{"https://pypi.example.com@evil/simple/", false},
+		{"https://registry.example.com/", true},
+		{"https://registry.example.com/npm/left-pad", true},
+		{"https://registry.example.com/../x", false},
+	}
+	saved := allowedRegistries
+	defer func() { allowedRegistries = saved }()
+	allowedRegistries = []string{"https://pypi.example.com/simple", "https://registry.example.com"}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := registryAllowed(tt.url); got != tt.want {
+				t.Errorf("registryAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
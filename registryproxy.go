@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// registryProxy is the caching npm registry proxy Node.js installs are
+// pointed at, set up from the registry_proxy_dir setting; nil when off
+var registryProxy *npmRegistryProxy
+
+var registryProxyRequests = newCounterVec("pip_install_registry_proxy_requests_total",
+	"Requests to the registry proxy, by kind (metadata or tarball) and result: hit, miss, stale (served from the cache because the registry failed), error or passthrough.",
+	"kind", "result")
+
+// abbreviatedMetadata is the media type of the package documents package
+// managers ask for, which leave out what installing doesn't need
+const abbreviatedMetadata = "application/vnd.npm.install-v1+json"
+
+// An npmRegistryProxy is a read-through cache of an npm registry. Package
+// documents are kept for ttl, and served past it while the registry fails;
+// tarballs, which never change once published, are kept until the directory
+// is cleared. Everything else, such as audits, goes straight to the registry.
+type npmRegistryProxy struct {
+	dir      string
+	upstream *url.URL
+	ttl      time.Duration
+	client   *http.Client
+	// url is the registry installs are pointed at
+	url  string
+	pass *httputil.ReverseProxy
+}
+
+// startRegistryProxy serves a proxy of upstream on listen, caching in dir.
+// Installs reach it at publicURL, or at the address it listens on.
+func startRegistryProxy(dir, listen, publicURL, upstream string, ttl time.Duration) (*npmRegistryProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("registry_proxy_upstream must be an absolute http or https URL")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	for _, sub := range []string{"metadata", "tarballs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	if publicURL == "" {
+		publicURL = "http://" + lis.Addr().String() + "/"
+	}
+	p := &npmRegistryProxy{
+		dir:      dir,
+		upstream: u,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		url:      strings.TrimSuffix(publicURL, "/") + "/",
+		pass:     httputil.NewSingleHostReverseProxy(u),
+	}
+	director := p.pass.Director
+	p.pass.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+	}
+	srv := &http.Server{Handler: p}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			slog.Error("registry proxy stopped", "error", err)
+		}
+	}()
+	return p, nil
+}
+
+func (p *npmRegistryProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead, strings.HasPrefix(path, "/-/"):
+		registryProxyRequests.inc("other", "passthrough")
+		p.pass.ServeHTTP(w, r)
+	case strings.Contains(path, "/-/") && strings.HasSuffix(path, ".tgz"):
+		p.serveTarball(w, r, path)
+	default:
+		p.serveMetadata(w, r, path)
+	}
+}
+
+// cachePath returns where the response to a request for key is kept. The
+// request's credentials are part of the key, as they are sent upstream: a
+// package one token may read isn't served to requests without it.
+func (p *npmRegistryProxy) cachePath(r *http.Request, kind, key string) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		key += "\x00" + auth
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(p.dir, kind, hex.EncodeToString(sum[:]))
+}
+
+// serveMetadata serves a package document, whose tarball URLs are rewritten
+// to point back at the proxy as the request reached it
+func (p *npmRegistryProxy) serveMetadata(w http.ResponseWriter, r *http.Request, path string) {
+	accept := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), abbreviatedMetadata) {
+		accept = abbreviatedMetadata
+	}
+	cached := p.cachePath(r, "metadata", accept+" "+path)
+	info, statErr := os.Stat(cached)
+	result := "hit"
+	if statErr != nil || time.Since(info.ModTime()) > p.ttl {
+		status, err := p.fetch(r, path, accept, cached)
+		switch {
+		case err == nil && status == http.StatusOK:
+			result = "miss"
+		case err == nil && status < http.StatusInternalServerError:
+			// Packages that don't exist aren't cached, so publishing one is
+			// seen straight away
+			registryProxyRequests.inc("metadata", "miss")
+			writeError(w, fmt.Sprintf("Registry responded %d", status), status)
+			return
+		case statErr == nil:
+			slog.Warn("registry failed, serving cached package document", "path", path, "status", status, "error", err)
+			result = "stale"
+		default:
+			registryProxyRequests.inc("metadata", "error")
+			writeError(w, fmt.Sprintf("Registry unreachable: %v", orStatus(err, status)), http.StatusBadGateway)
+			return
+		}
+	}
+	body, err := os.ReadFile(cached)
+	if err != nil {
+		registryProxyRequests.inc("metadata", "error")
+		writeError(w, "Failed to read cached package document", http.StatusInternalServerError)
+		return
+	}
+	registryProxyRequests.inc("metadata", result)
+	body = bytes.ReplaceAll(body, []byte(p.upstream.String()), []byte("http://"+r.Host+"/"))
+	w.Header().Set("Content-Type", accept)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Write(body)
+}
+
+// serveTarball serves a package tarball from the cache, downloading it into
+// the cache on a miss while it is streamed to the client
+func (p *npmRegistryProxy) serveTarball(w http.ResponseWriter, r *http.Request, path string) {
+	cached := p.cachePath(r, "tarballs", path)
+	if f, err := os.Open(cached); err == nil {
+		defer f.Close()
+		registryProxyRequests.inc("tarball", "hit")
+		info, _ := f.Stat()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	resp, err := p.get(r, path, "")
+	if err != nil {
+		registryProxyRequests.inc("tarball", "error")
+		writeError(w, fmt.Sprintf("Registry unreachable: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		registryProxyRequests.inc("tarball", "error")
+		writeError(w, fmt.Sprintf("Registry responded %d", resp.StatusCode), resp.StatusCode)
+		return
+	}
+	registryProxyRequests.inc("tarball", "miss")
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".download-")
+	if err != nil {
+		writeError(w, "Failed to cache tarball", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(resp.ContentLength))
+	}
+	n, err := io.Copy(io.MultiWriter(w, tmp), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	// Only whole tarballs are kept
+	if err != nil || resp.ContentLength >= 0 && n != resp.ContentLength {
+		slog.Warn("failed to download tarball", "path", path, "error", err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), cached); err != nil {
+		slog.Warn("failed to cache tarball", "path", path, "error", err)
+	}
+}
+
+// fetch downloads a package document into the cache and returns the
+// registry's status
+func (p *npmRegistryProxy) fetch(r *http.Request, path, accept, cached string) (int, error) {
+	resp, err := p.get(r, path, accept)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".download-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, os.Rename(tmp.Name(), cached)
+}
+
+// get requests path from the registry, with the client's credentials
+func (p *npmRegistryProxy) get(r *http.Request, path, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, strings.TrimSuffix(p.upstream.String(), "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	return p.client.Do(req)
+}
+
+// orStatus describes a failed request by its error, or its status if it
+// got a response
+func orStatus(err error, status int) any {
+	if err != nil {
+		return err
+	}
+	return fmt.Sprintf("status %d", status)
+}
+
+// registryArgs returns the arguments pointing eco's package manager at the
+// request's registry, or at the registry proxy when it has none. Requests
+// whose .npmrc sets a registry of their own keep it.
+func registryArgs(eco *Ecosystem, req *InstallRequest) []string {
+	if eco.RegistryArgs == nil {
+		return nil
+	}
+	if req.Options.Registry != "" {
+		return eco.RegistryArgs(req.Options.Registry)
+	}
+	if registryProxy != nil && eco.Runtime == "node" && !npmrcSetsRegistry(req.Files[".npmrc"]) {
+		return eco.RegistryArgs(registryProxy.url)
+	}
+	return nil
+}
+
+// npmrcSetsRegistry reports whether an .npmrc replaces the default registry;
+// scoped registries don't
+func npmrcSetsRegistry(npmrc string) bool {
+	sc := bufio.NewScanner(strings.NewReader(npmrc))
+	for sc.Scan() {
+		key, _, ok := strings.Cut(sc.Text(), "=")
+		if ok && strings.TrimSpace(key) == "registry" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// installReportName is the file the report option adds to the archive
+const installReportName = "install-report.json"
+
+// An InstallReport describes what an install put in its archive and how
+// long each phase of building it took
+type InstallReport struct {
+	Ecosystem    string `json:"ecosystem"`
+	PackageCount int    `json:"package_count"`
+	// TotalBytes is the size of the installed files
+	TotalBytes int64 `json:"total_bytes"`
+	// Added and Removed compare the installed packages with those the
+	// submitted lock file pinned, when there was one
+	Lockfile bool      `json:"lockfile"`
+	Added    []Package `json:"added,omitempty"`
+	Removed  []Package `json:"removed,omitempty"`
+	// Deprecations are the deprecated packages the package manager warned of
+	Deprecations []Deprecation `json:"deprecations,omitempty"`
+	// Warnings are the package manager's other warnings, such as unmet peer
+	// dependencies
+	Warnings []InstallWarning `json:"warnings,omitempty"`
+	// Funding lists where the installed packages ask to be funded
+	Funding []Funding `json:"funding,omitempty"`
+	// Overrides are the manifest's overrides whose packages were installed,
+	// with the versions they were installed at
+	Overrides []ForcedOverride `json:"overrides,omitempty"`
+	// Provenance is what verifying the packages' registry signatures and
+	// attestations found, for installs with a provenance policy
+	Provenance *ProvenanceReport `json:"provenance,omitempty"`
+	// PhasesMillis is how long each phase took, such as workspace, install,
+	// audit, inspect and archive. The report in the archive is written
+	// before it is archived, so it has no archive phase.
+	PhasesMillis map[string]int64 `json:"phases_ms"`
+}
+
+// A Deprecation is a package the package manager warned is deprecated
+type Deprecation struct {
+	Package string `json:"package"`
+	Message string `json:"message"`
+}
+
+// An InstallWarning is a warning the package manager printed
+type InstallWarning struct {
+	// Kind is deprecated, peer for peer dependency conflicts, unpinned for
+	// lock file entries without an integrity hash, or warning
+	Kind string `json:"kind"`
+	// Package is the deprecated package, as name@version
+	Package string `json:"package,omitempty"`
+	Message string `json:"message"`
+}
+
+// maxWarnings is how many warnings an install keeps; installs of large
+// trees can print thousands
+const maxWarnings = 100
+
+// Funding is where an installed package asks to be funded
+type Funding struct {
+	Package string `json:"package"`
+	URL     string `json:"url"`
+}
+
+// installNotes collects what an install's report needs from its phases as
+// they run, carried in the context
+type installNotes struct {
+	mu       sync.Mutex
+	phases   map[string]time.Duration
+	warnings []InstallWarning
+	// retries is how many times a transient failure reran the install
+	retries int
+	// tool is the package manager or other tool running now, if any
+	tool *runningTool
+	// provenance is what verifying the packages' provenance found
+	provenance *ProvenanceReport
+}
+
+// A runningTool is a tool an install is running, for the admin API
+type runningTool struct {
+	step    string
+	pid     int
+	started time.Time
+	// cgroup is the directory of the tool's cgroup, when it has one
+	cgroup string
+}
+
+type notesKey struct{}
+
+// withNotes returns a context that collects an install's notes
+func withNotes(ctx context.Context) context.Context {
+	return context.WithValue(ctx, notesKey{}, &installNotes{phases: make(map[string]time.Duration)})
+}
+
+// notesFrom returns the context's notes, or nil if nothing collects them; a
+// nil *installNotes ignores what it is given
+func notesFrom(ctx context.Context) *installNotes {
+	n, _ := ctx.Value(notesKey{}).(*installNotes)
+	return n
+}
+
+// phase adds the time since start to a phase. The installs of a targets
+// install run in parallel, so their phases add up to more than they took.
+func (n *installNotes) phase(name string, start time.Time) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.phases[name] += time.Since(start)
+}
+
+// line reads a line of the package manager's output for warnings
+func (n *installNotes) line(line string) {
+	if n == nil {
+		return
+	}
+	if w, ok := parseWarning(line); ok {
+		n.warn(w)
+	}
+}
+
+// warn adds a warning, unless it was given already
+func (n *installNotes) warn(w InstallWarning) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.warnings) < maxWarnings && !slices.Contains(n.warnings, w) {
+		n.warnings = append(n.warnings, w)
+	}
+}
+
+// retry counts a run of the package manager again after a transient failure
+func (n *installNotes) retry() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.retries++
+}
+
+// toolStarted records the tool an install has started, and toolExited that
+// it has stopped
+func (n *installNotes) toolStarted(step string, pid int, cgroup string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tool = &runningTool{step: step, pid: pid, started: time.Now(), cgroup: cgroup}
+}
+
+func (n *installNotes) toolExited() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tool = nil
+}
+
+// runningTool returns the tool the install is running, if it is running one
+func (n *installNotes) runningTool() (runningTool, bool) {
+	if n == nil {
+		return runningTool{}, false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.tool == nil {
+		return runningTool{}, false
+	}
+	return *n.tool, true
+}
+
+// retryCount returns how many retries have been counted
+func (n *installNotes) retryCount() int {
+	if n == nil {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.retries
+}
+
+// installWarnings returns the warnings collected so far
+func (n *installNotes) installWarnings() []InstallWarning {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.warnings)
+}
+
+var (
+	// yarnDeprecation matches yarn 1's warnings, which name the dependency
+	// path to transitive packages: "warning a > b@1.0.0: b is deprecated"
+	yarnDeprecation = regexp.MustCompile(`^warning (?:.* > )?(\S+@[^\s:]+): (.*deprecated.*)$`)
+	// npmDeprecation matches pnpm's and npm's: "WARN deprecated b@1.0.0: ..."
+	npmDeprecation = regexp.MustCompile(`(?i:WARN)\s+deprecated (\S+@[^\s:]+): (.*)$`)
+	// npmWarning matches npm's other warnings, "npm WARN ERESOLVE ...", and
+	// pnpm's, " WARN  Issues with peer dependencies found", which a project
+	// in a workspace prefixes with its path
+	npmWarning = regexp.MustCompile(`^(?:npm (?i:warn)|(?:\S+ \| )?WARN)\s+(.*)$`)
+	// yarnWarning matches yarn 1's: "warning \"a > b@1.0.0\" has unmet peer
+	// dependency \"react@^18\"."
+	yarnWarning = regexp.MustCompile(`^warning (.*)$`)
+)
+
+// parseWarning reads a warning from a line of yarn, pnpm or npm output
+func parseWarning(line string) (InstallWarning, bool) {
+	if d, ok := parseDeprecation(line); ok {
+		return InstallWarning{Kind: "deprecated", Package: d.Package, Message: d.Message}, true
+	}
+	line = strings.TrimSpace(line)
+	for _, re := range []*regexp.Regexp{npmWarning, yarnWarning} {
+		if m := re.FindStringSubmatch(line); m != nil {
+			kind := "warning"
+			if strings.Contains(strings.ToLower(m[1]), "peer") {
+				kind = "peer"
+			}
+			return InstallWarning{Kind: kind, Message: strings.TrimSpace(m[1])}, true
+		}
+	}
+	return InstallWarning{}, false
+}
+
+// parseDeprecation reads a deprecation warning from a line of yarn, pnpm or
+// npm output
+func parseDeprecation(line string) (Deprecation, bool) {
+	line = strings.TrimSpace(line)
+	for _, re := range []*regexp.Regexp{npmDeprecation, yarnDeprecation} {
+		if m := re.FindStringSubmatch(line); m != nil {
+			return Deprecation{Package: m[1], Message: strings.TrimSpace(m[2])}, true
+		}
+	}
+	return Deprecation{}, false
+}
+
+// buildReport builds the report of an install in outputDir whose packages
+// are pkgs
+func buildReport(ctx context.Context, eco *Ecosystem, req *InstallRequest, outputDir string, pkgs []Package) *InstallReport {
+	report := &InstallReport{Ecosystem: eco.Name, PackageCount: len(pkgs), PhasesMillis: map[string]int64{}}
+	if info, err := os.Lstat(outputDir); err == nil {
+		report.TotalBytes, _ = treeSize(outputDir, fs.FileInfoToDirEntry(info))
+	}
+	if eco.LockedPackages != nil {
+		if locked, err := eco.LockedPackages(req.Files); err == nil && len(locked) > 0 {
+			report.Lockfile = true
+			report.Added, report.Removed = diffPackages(locked, pkgs)
+		}
+	}
+	if eco.Runtime == "node" {
+		report.Funding = npmFunding(outputDir)
+	}
+	report.Overrides = forcedOverrides(eco, req.Files, pkgs)
+	if n := notesFrom(ctx); n != nil {
+		n.mu.Lock()
+		for _, w := range n.warnings {
+			if w.Kind == "deprecated" {
+				report.Deprecations = append(report.Deprecations, Deprecation{Package: w.Package, Message: w.Message})
+			} else {
+				report.Warnings = append(report.Warnings, w)
+			}
+		}
+		for name, d := range n.phases {
+			report.PhasesMillis[name] = d.Milliseconds()
+		}
+		n.mu.Unlock()
+		report.Provenance = n.provenanceReport()
+	}
+	return report
+}
+
+// installWarnings returns the report's deprecations and warnings together,
+// as jobs list them
+func (r *InstallReport) installWarnings() []InstallWarning {
+	if r == nil {
+		return nil
+	}
+	var warnings []InstallWarning
+	for _, d := range r.Deprecations {
+		warnings = append(warnings, InstallWarning{Kind: "deprecated", Package: d.Package, Message: d.Message})
+	}
+	return append(warnings, r.Warnings...)
+}
+
+// diffPackages returns the packages installed but not locked, and locked
+// but not installed. Requirements that don't pin a version, as
+// requirements.txt may list, aren't locked.
+func diffPackages(locked, installed []Package) (added, removed []Package) {
+	key := func(p Package) string { return p.Name + "@" + p.Version }
+	locked = slices.DeleteFunc(slices.Clone(locked), func(p Package) bool { return p.Version == "" })
+	inLock := make(map[string]bool, len(locked))
+	for _, p := range locked {
+		inLock[key(p)] = true
+	}
+	isInstalled := make(map[string]bool, len(installed))
+	for _, p := range installed {
+		isInstalled[key(p)] = true
+		if !inLock[key(p)] {
+			added = append(added, p)
+		}
+	}
+	for _, p := range locked {
+		if !isInstalled[key(p)] {
+			removed = append(removed, p)
+			isInstalled[key(p)] = true
+		}
+	}
+	return added, removed
+}
+
+// npmFunding lists the funding URLs that the packages under a node_modules
+// directory declare, which may be a URL, an object with one or a list of
+// either
+func npmFunding(outputDir string) []Funding {
+	var funding []Funding
+	seen := make(map[string]bool)
+	walkNpmPackages(outputDir, func(dir string, pkg npmManifest) error {
+		if len(pkg.Funding) == 0 || seen[pkg.Name] {
+			return nil
+		}
+		seen[pkg.Name] = true
+		var entries []json.RawMessage
+		if json.Unmarshal(pkg.Funding, &entries) != nil {
+			entries = []json.RawMessage{pkg.Funding}
+		}
+		for _, entry := range entries {
+			var url string
+			if json.Unmarshal(entry, &url) != nil {
+				var obj struct {
+					URL string `json:"url"`
+				}
+				json.Unmarshal(entry, &obj)
+				url = obj.URL
+			}
+			if url != "" {
+				funding = append(funding, Funding{Package: pkg.Name, URL: url})
+			}
+		}
+		return nil
+	})
+	slices.SortFunc(funding, func(a, b Funding) int { return strings.Compare(a.Package, b.Package) })
+	return funding
+}
+
+// writeInstallReport adds the report to the installed directory, for the
+// report option
+func writeInstallReport(outputDir string, report *InstallReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outputDir, installReportName), b, 0644)
+}
+
+// serveInstallReport responds with the install report of a stored artifact.
+// Artifacts stored before installs were reported have none.
+func serveInstallReport(w http.ResponseWriter, r *http.Request, store ArtifactStore, digest string) {
+	artifact, ok := openArtifactMeta(w, r, store, digest)
+	if !ok {
+		return
+	}
+	if artifact.Report == nil {
+		writeError(w, "The artifact has no install report", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, artifact.Report)
+}
+
+// installReportHandler serves GET /artifacts/{sha}/report
+func installReportHandler(store ArtifactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveInstallReport(w, r, store, strings.ToLower(r.PathValue("sha")))
+	}
+}
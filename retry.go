@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// installRetries is how many more times an install that failed to reach
+// the registry is run before it fails, waiting installRetryBackoff before
+// the first retry and twice as long before each one after. Both are set
+// from INSTALL_RETRIES and INSTALL_RETRY_BACKOFF.
+var (
+	installRetries      = 2
+	installRetryBackoff = 2 * time.Second
+)
+
+var installRetriesTotal = newCounterVec("pip_install_install_retries_total",
+	"Installs run again after a transient registry failure, by ecosystem.", "ecosystem")
+
+// transientFailures are the codes of tool failures worth retrying: the
+// registry timing out, dropping the connection or failing with a 5xx
+var transientFailures = []string{"REGISTRY_UNREACHABLE", "REGISTRY_ERROR"}
+
+// transient reports whether err is a tool failure that may pass if the tool
+// is run again. Timeouts aren't: the retry would get no more time.
+func transient(err error) bool {
+	var te *toolError
+	if !errors.As(err, &te) {
+		return false
+	}
+	for _, code := range transientFailures {
+		if te.code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// runToolRetrying runs a tool like runTool, running it again with
+// exponential backoff while it fails transiently, up to installRetries
+// times. The retries are counted in the context's notes.
+func runToolRetrying(ctx context.Context, eco *Ecosystem, req *InstallRequest, workDir string, run toolRun) error {
+	backoff := installRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := runTool(ctx, eco, req, workDir, run)
+		registryBreaker.record(eco, req, err)
+		if err == nil || attempt > installRetries || !transient(err) {
+			return err
+		}
+		loggerFrom(ctx).Warn(run.step+" failed to reach the registry, retrying", "attempt", attempt, "backoff", backoff, "error", errorCode(err, 0))
+		installRetriesTotal.inc(eco.Name)
+		notesFrom(ctx).retry()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An s3Client uploads artifacts to an S3-compatible object store such as AWS
+// S3 or MinIO, signing requests with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// pathStyle addresses buckets as endpoint/bucket rather than as
+	// bucket.endpoint, as MinIO and most other S3-compatible stores need
+	pathStyle bool
+	// buckets are the buckets requests may upload to
+	buckets []string
+	// presignTTL is how long the download URLs returned for uploads work
+	presignTTL time.Duration
+	client     *http.Client
+}
+
+// s3Endpoint is the endpoint for region when s3_endpoint isn't set
+func s3Endpoint(region string) string {
+	return "https://s3." + region + ".amazonaws.com"
+}
+
+// objectURL returns the URL of an object, with its path escaped as Signature
+// Version 4 expects
+func (c *s3Client) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	p := "/" + key
+	if c.pathStyle {
+		p = "/" + bucket + p
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + p
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+func (c *s3Client) Buckets() []string { return c.buckets }
+
+// Put uploads body, whose SHA-256 is known, as an object
+func (c *s3Client) Put(ctx context.Context, bucket, key, contentType string, body io.Reader, size int64, sum string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(bucket, key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	c.sign(req, sum, time.Now().UTC())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("PUT s3://%s/%s: %s: %s", bucket, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SignedURL returns a presigned URL that downloads the object without
+// credentials until the returned time
+func (c *s3Client) SignedURL(ctx context.Context, bucket, key string, now time.Time) (string, time.Time, error) {
+	u := c.objectURL(bucket, key)
+	amzDate := now.Format("20060102T150405Z")
+	scope := c.scope(now)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(c.presignTTL.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if c.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + c.signature(now, amzDate, scope, canonical)
+	return u.String(), now.Add(c.presignTTL), nil
+}
+
+// sign adds the Authorization header to req, whose body has the given SHA-256
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := c.scope(now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, c.signature(now, amzDate, scope, canonical)))
+}
+
+// scope is the credential scope of requests signed at now
+func (c *s3Client) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request
+func (c *s3Client) signature(now time.Time, amzDate, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{now.Format("20060102"), c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, as Signature
+// Version 4 canonicalizes them
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and "/"
+// unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
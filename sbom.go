@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An sbomFormat is one of the software bill of materials formats an install's
+// packages can be described in
+type sbomFormat struct {
+	// Name is the value of the sbom option and the format query parameter
+	Name        string
+	ContentType string
+	// Filename is where the SBOM is written in the archive
+	Filename string
+	// Build describes pkgs. id seeds the document's identifier, and digest,
+	// if known, is the SHA-256 of the archive holding them.
+	Build func(eco *Ecosystem, pkgs []Package, id, digest string, created time.Time) any
+}
+
+// sbomFormats lists the supported formats; the first is the default
+var sbomFormats = []*sbomFormat{
+	{Name: "cyclonedx", ContentType: "application/vnd.cyclonedx+json", Filename: "sbom.cdx.json", Build: newCycloneDX},
+	{Name: "spdx", ContentType: "application/spdx+json", Filename: "sbom.spdx.json", Build: newSPDX},
+}
+
+// findSBOMFormat returns the format with the given name, or nil
+func findSBOMFormat(name string) *sbomFormat {
+	for _, f := range sbomFormats {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// sbomFormatNames lists the supported formats for error messages
+func sbomFormatNames() string {
+	names := make([]string, len(sbomFormats))
+	for i, f := range sbomFormats {
+		names[i] = f.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// documentUUID derives a stable UUID for an SBOM from id, so the same
+// install is always described by the same serial number
+func documentUUID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	b := sum[:16]
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// spdxExpression matches license strings that can be used as SPDX license
+// expressions as they are: identifiers joined by AND, OR and WITH
+var spdxExpression = regexp.MustCompile(`^\(?[A-Za-z0-9.+-]+( (AND|OR|WITH) \(?[A-Za-z0-9.+-]+\)?)*\)?$`)
+
+// cycloneDXLicense describes a declared license, using the free-form name
+// for licenses that aren't SPDX identifiers or expressions
+func cycloneDXLicense(license string) map[string]any {
+	switch {
+	case !spdxExpression.MatchString(license):
+		return map[string]any{"license": map[string]string{"name": license}}
+	case strings.Contains(license, " "):
+		return map[string]any{"expression": license}
+	default:
+		return map[string]any{"license": map[string]string{"id": license}}
+	}
+}
+
+// newCycloneDX describes pkgs as a CycloneDX 1.5 document
+func newCycloneDX(eco *Ecosystem, pkgs []Package, id, digest string, created time.Time) any {
+	components := make([]map[string]any, len(pkgs))
+	for i, pkg := range pkgs {
+		c := map[string]any{
+			"type":    "library",
+			"bom-ref": pkg.PURL,
+			"name":    pkg.Name,
+			"version": pkg.Version,
+			"purl":    pkg.PURL,
+		}
+		if pkg.License != "" {
+			c["licenses"] = []map[string]any{cycloneDXLicense(pkg.License)}
+		}
+		components[i] = c
+	}
+	subject := map[string]any{"type": "application", "name": eco.ArchiveName}
+	if digest != "" {
+		subject["hashes"] = []map[string]string{{"alg": "SHA-256", "content": digest}}
+	}
+	return map[string]any{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + documentUUID(id),
+		"version":      1,
+		"metadata": map[string]any{
+			"timestamp": created.UTC().Format(time.RFC3339),
+			"tools": map[string]any{
+				"components": []map[string]string{{"type": "application", "name": "pip-install"}},
+			},
+			"component": subject,
+		},
+		"components": components,
+	}
+}
+
+// newSPDX describes pkgs as an SPDX 2.3 document
+func newSPDX(eco *Ecosystem, pkgs []Package, id, digest string, created time.Time) any {
+	packages := make([]map[string]any, len(pkgs))
+	relationships := make([]map[string]string, len(pkgs))
+	for i, pkg := range pkgs {
+		ref := fmt.Sprintf("SPDXRef-Package-%d", i+1)
+		license := "NOASSERTION"
+		if spdxExpression.MatchString(pkg.License) {
+			license = pkg.License
+		}
+		packages[i] = map[string]any{
+			"SPDXID":           ref,
+			"name":             pkg.Name,
+			"versionInfo":      pkg.Version,
+			"downloadLocation": "NOASSERTION",
+			"filesAnalyzed":    false,
+			"licenseConcluded": "NOASSERTION",
+			"licenseDeclared":  license,
+			"copyrightText":    "NOASSERTION",
+			"externalRefs": []map[string]string{{
+				"referenceCategory": "PACKAGE-MANAGER",
+				"referenceType":     "purl",
+				"referenceLocator":  pkg.PURL,
+			}},
+		}
+		relationships[i] = map[string]string{
+			"spdxElementId":      "SPDXRef-DOCUMENT",
+			"relationshipType":   "DESCRIBES",
+			"relatedSpdxElement": ref,
+		}
+	}
+	name := eco.ArchiveName
+	if digest != "" {
+		name += "@sha256:" + digest
+	}
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": "https://spdx.org/spdxdocs/pip-install-" + documentUUID(id),
+		"creationInfo": map[string]any{
+			"created":  created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: pip-install"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+// writeSBOM describes an artifact's packages in the format named by the
+// format query parameter
+func writeSBOM(w http.ResponseWriter, r *http.Request, store ArtifactStore, eco *Ecosystem, digest string) {
+	format := sbomFormats[0]
+	if name := r.URL.Query().Get("format"); name != "" {
+		if format = findSBOMFormat(name); format == nil {
+			writeError(w, fmt.Sprintf("Unsupported SBOM format %q: must be one of %s", name, sbomFormatNames()), http.StatusBadRequest)
+			return
+		}
+	}
+	artifact, ok := openArtifactMeta(w, r, store, digest)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	if err := json.NewEncoder(w).Encode(format.Build(eco, artifact.Packages, digest, digest, artifact.ModTime)); err != nil {
+		loggerFrom(r.Context()).Warn("failed to write SBOM", "digest", digest, "error", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A schema is the subset of JSON Schema the OpenAPI spec describes bodies
+// with. Request body schemas are also what incoming bodies are validated
+// against, so they are written inline, without refs.
+type schema struct {
+	Ref               string             `json:"$ref,omitempty"`
+	Type              string             `json:"type,omitempty"`
+	Description       string             `json:"description,omitempty"`
+	Format            string             `json:"format,omitempty"`
+	Enum              []string           `json:"enum,omitempty"`
+	Pattern           string             `json:"pattern,omitempty"`
+	Minimum           *float64           `json:"minimum,omitempty"`
+	Maximum           *float64           `json:"maximum,omitempty"`
+	MinItems          int                `json:"minItems,omitempty"`
+	MaxItems          int                `json:"maxItems,omitempty"`
+	Items             *schema            `json:"items,omitempty"`
+	Properties        map[string]*schema `json:"properties,omitempty"`
+	PatternProperties map[string]*schema `json:"patternProperties,omitempty"`
+	Required          []string           `json:"required,omitempty"`
+	OneOf             []*schema          `json:"oneOf,omitempty"`
+	// Values is the schema of every property of a map-like object
+	Values *schema `json:"-"`
+	// Closed rejects properties the schema doesn't list
+	Closed bool `json:"-"`
+}
+
+// MarshalJSON writes Values and Closed as additionalProperties
+func (s *schema) MarshalJSON() ([]byte, error) {
+	type plain schema
+	out := struct {
+		*plain
+		AdditionalProperties any `json:"additionalProperties,omitempty"`
+	}{plain: (*plain)(s)}
+	switch {
+	case s.Values != nil:
+		out.AdditionalProperties = s.Values
+	case s.Closed:
+		out.AdditionalProperties = false
+	}
+	return json.Marshal(out)
+}
+
+// A fieldError is a request body value its schema doesn't allow. Field is
+// the path to the value, such as output.type or packages[1], and is empty
+// for the body itself.
+type fieldError struct {
+	field  string
+	reason string
+}
+
+func (e *fieldError) Error() string {
+	if e.field == "" {
+		return "Invalid request body: " + e.reason
+	}
+	return fmt.Sprintf("Invalid request body: %s %s", e.field, e.reason)
+}
+
+func (e *fieldError) code() string { return "INVALID_FIELD" }
+
+// writeFieldError responds 400 with the field and reason in JSON
+func writeFieldError(w http.ResponseWriter, err *fieldError) {
+	writeJSON(w, http.StatusBadRequest, errorBody(err, http.StatusBadRequest))
+}
+
+// validateJSON checks a JSON document against s
+func (s *schema) validateJSON(raw []byte, field string) error {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return &fieldError{field: field, reason: "is not valid JSON: " + err.Error()}
+	}
+	if err := s.validate(v, field); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validate checks a decoded JSON value against s, returning the first value
+// that doesn't match. Nulls are treated as absent.
+func (s *schema) validate(v any, field string) *fieldError {
+	if v == nil {
+		return nil
+	}
+	fail := func(format string, args ...any) *fieldError {
+		return &fieldError{field: field, reason: fmt.Sprintf(format, args...)}
+	}
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return &fieldError{field: joinField(field, name), reason: "is required"}
+			}
+		}
+		for _, name := range sortedKeys(obj) {
+			child := s.property(name)
+			if child == nil {
+				if s.Closed {
+					return &fieldError{field: joinField(field, name), reason: "is not a known field"}
+				}
+				continue
+			}
+			if err := child.validate(obj[name], joinField(field, name)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		if len(items) < s.MinItems {
+			if s.MinItems == 1 {
+				return fail("must not be empty")
+			}
+			return fail("must have at least %d items", s.MinItems)
+		}
+		if s.MaxItems > 0 && len(items) > s.MaxItems {
+			return fail("must have at most %d items", s.MaxItems)
+		}
+		for i, item := range items {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fail("must be one of %s", strings.Join(s.Enum, ", "))
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fail("must match %s", s.Pattern)
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || s.Type == "integer" && n != math.Trunc(n) {
+			return fail("must be %s", map[string]string{"integer": "an integer", "number": "a number"}[s.Type])
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be true or false")
+		}
+	}
+	return nil
+}
+
+// property returns the schema of the named property, if s allows it
+func (s *schema) property(name string) *schema {
+	if p, ok := s.Properties[name]; ok {
+		return p
+	}
+	for pattern, p := range s.PatternProperties {
+		if regexp.MustCompile(pattern).MatchString(name) {
+			return p
+		}
+	}
+	return s.Values
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A scopeCredential sends an npm package scope to a private registry,
+// authenticating with a token the server holds
+type scopeCredential struct {
+	Scope    string
+	Registry *url.URL
+	// TokenRef is "env:NAME" or "file:PATH", or empty for a registry that
+	// needs no token. It is read for every install so rotated secrets are
+	// picked up.
+	TokenRef string
+}
+
+// scopeCredentials are set from the npm_scopes setting
+var scopeCredentials []scopeCredential
+
+// parseScopeCredentials parses entries of the form
+// @scope=https://registry/=env:TOKEN_VAR or @scope=https://registry/=file:/path
+func parseScopeCredentials(entries []string) ([]scopeCredential, error) {
+	var creds []scopeCredential
+	for _, entry := range entries {
+		scope, rest, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(scope, "@") || len(scope) < 2 {
+			return nil, fmt.Errorf("%q: scope must look like @name", entry)
+		}
+		raw, ref := rest, ""
+		if i := strings.LastIndex(rest, "="); i >= 0 {
+			raw, ref = rest[:i], rest[i+1:]
+			if !strings.HasPrefix(ref, "env:") && !strings.HasPrefix(ref, "file:") {
+				return nil, fmt.Errorf("%q: token must be env:NAME or file:PATH", entry)
+			}
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return nil, fmt.Errorf("%q: registry must be an absolute http or https URL without credentials", entry)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		creds = append(creds, scopeCredential{Scope: scope, Registry: u, TokenRef: ref})
+	}
+	return creds, nil
+}
+
+// token reads the credential's token from the environment or its file
+func (c scopeCredential) token() (string, error) {
+	kind, name, _ := strings.Cut(c.TokenRef, ":")
+	switch kind {
+	case "":
+		return "", nil
+	case "env":
+		if v := os.Getenv(name); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("no token for %s: %s is not set", c.Scope, name)
+	default:
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("no token for %s: %v", c.Scope, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// scopedNpmrc returns the .npmrc lines for the configured scopes. They go
+// after any .npmrc the request brought, so the server's settings win.
+func scopedNpmrc() (string, error) {
+	var b strings.Builder
+	for _, c := range scopeCredentials {
+		fmt.Fprintf(&b, "%s:registry=%s\n", c.Scope, c.Registry)
+		token, err := c.token()
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			fmt.Fprintf(&b, "//%s%s:_authToken=%s\n", c.Registry.Host, c.Registry.Path, token)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// scriptsPolicy decides whether installs may run code from the packages they
+// fetch, set from the scripts_policy setting:
+//
+//	ignore: scripts are skipped unless a request sets ignore_scripts to false
+//	force:  scripts are always skipped
+//	allow:  scripts run unless a request sets ignore_scripts to true
+var scriptsPolicy = "ignore"
+
+// scriptsPolicies are the valid values of scriptsPolicy
+var scriptsPolicies = []string{"ignore", "force", "allow"}
+
+// ignoreScripts returns whether the install must skip package scripts
+func (o InstallOptions) ignoreScripts() bool {
+	if scriptsPolicy == "force" {
+		return true
+	}
+	if o.IgnoreScripts != nil {
+		return *o.IgnoreScripts
+	}
+	return scriptsPolicy == "ignore"
+}
+
+// npmLifecycleScripts are the scripts npm-style package managers run when a
+// package is installed
+var npmLifecycleScripts = []string{"preinstall", "install", "postinstall"}
+
+// npmScriptPackages lists the packages under a node_modules directory that
+// declare install lifecycle scripts or a native addon build, which npm runs
+// implicitly
+func npmScriptPackages(outputDir string) ([]string, error) {
+	seen := make(map[string]bool)
+	err := walkNpmPackages(outputDir, func(dir string, pkg npmManifest) error {
+		declares := false
+		for _, s := range npmLifecycleScripts {
+			declares = declares || pkg.Scripts[s] != ""
+		}
+		if !declares {
+			if _, err := os.Stat(filepath.Join(dir, "binding.gyp")); err == nil {
+				declares = true
+			}
+		}
+		if declares {
+			seen[pkg.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// setSkippedScripts reports the packages whose scripts were skipped in the
+// X-Skipped-Scripts header
+func setSkippedScripts(w http.ResponseWriter, skipped []string) {
+	if len(skipped) > 0 {
+		w.Header().Set("X-Skipped-Scripts", strings.Join(skipped, ","))
+	}
+}
+
+// skippedScripts lists the installed packages whose scripts the install
+// skipped. Failing to inspect them isn't fatal to the install.
+func skippedScripts(ctx context.Context, eco *Ecosystem, req *InstallRequest, outputDir string) []string {
+	if eco.ScriptPackages == nil || !req.Options.ignoreScripts() {
+		return nil
+	}
+	names, err := eco.ScriptPackages(outputDir)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to list packages with skipped scripts", "error", err)
+		return nil
+	}
+	if len(names) > 0 {
+		loggerFrom(ctx).Info("skipped package scripts", "packages", names)
+	}
+	return names
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// redacted replaces credentials in package manager output
+const redacted = "[redacted]"
+
+// defaultFiles maps secret manifest file names to server-side files used
+// when a request doesn't send its own, set from the default_npmrc and
+// default_pip_conf settings
+var defaultFiles = map[string]string{}
+
+// secretKeyPattern matches config keys whose values are credentials, such as
+// npm's //registry/:_authToken or pip's password
+var secretKeyPattern = regexp.MustCompile(`(?i)(_authtoken|_auth|_password|password|token|secret)$`)
+
+// urlPattern finds URLs that may carry user info
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// configSecrets returns the credentials found in an .npmrc or pip.conf:
+// values of credential keys and the user info of URLs. A JSON config, such
+// as Composer's auth.json, holds nothing but credentials, so all its
+// strings are.
+func configSecrets(content string) []string {
+	var doc any
+	if strings.HasPrefix(strings.TrimSpace(content), "{") && json.Unmarshal([]byte(content), &doc) == nil {
+		return jsonStrings(doc, nil)
+	}
+	var secrets []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			key, value = strings.TrimSpace(key), strings.Trim(strings.TrimSpace(value), `"'`)
+			if secretKeyPattern.MatchString(key) && value != "" {
+				secrets = append(secrets, value)
+			}
+		}
+		for _, raw := range urlPattern.FindAllString(line, -1) {
+			u, err := url.Parse(raw)
+			if err != nil || u.User == nil {
+				continue
+			}
+			if pw, ok := u.User.Password(); ok {
+				secrets = append(secrets, pw)
+			}
+			secrets = append(secrets, u.User.String())
+		}
+	}
+	return secrets
+}
+
+// jsonStrings appends the strings in a decoded JSON document to out
+func jsonStrings(v any, out []string) []string {
+	switch v := v.(type) {
+	case string:
+		out = append(out, v)
+	case []any:
+		for _, e := range v {
+			out = jsonStrings(e, out)
+		}
+	case map[string]any:
+		for _, e := range v {
+			out = jsonStrings(e, out)
+		}
+	}
+	return out
+}
+
+// A scrubber removes known credentials from text
+type scrubber struct {
+	r *strings.Replacer
+}
+
+// newScrubber collects the credentials in the request's secret files
+func newScrubber(eco *Ecosystem, files map[string]string) *scrubber {
+	var secrets []string
+	for _, mf := range eco.Files {
+		if mf.Secret {
+			secrets = append(secrets, configSecrets(files[mf.Name])...)
+		}
+	}
+	// Longest first so a secret containing another is replaced whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	var pairs []string
+	for _, s := range secrets {
+		// Very short values would mangle unrelated output
+		if len(s) >= 4 {
+			pairs = append(pairs, s, redacted)
+		}
+	}
+	if len(pairs) == 0 {
+		return &scrubber{}
+	}
+	return &scrubber{r: strings.NewReplacer(pairs...)}
+}
+
+func (s *scrubber) scrub(text string) string {
+	if s.r == nil {
+		return text
+	}
+	return s.r.Replace(text)
+}
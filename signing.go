@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// artifactSigner signs artifact digests, loaded from the signing_key_file
+// setting; nil if signing is disabled
+var artifactSigner crypto.Signer
+
+// loadSigningKey reads a PEM-encoded ECDSA or RSA private key, in PKCS #8,
+// SEC 1 or PKCS #1 form. Keys have to sign a SHA-256 digest, so the
+// artifact isn't read again to sign it; that rules out Ed25519.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM block", path)
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s holds a %s, not an unencrypted private key", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s holds a %T; only ECDSA and RSA keys are supported", path, key)
+}
+
+// signDigest signs an artifact's hex SHA-256 digest, returning the
+// signature in base64 as cosign sign-blob writes it
+func signDigest(digest string) (string, error) {
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	sig, err := artifactSigner.Sign(rand.Reader, sum, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// writeSignature responds with the signature of the artifact with the given digest
+func writeSignature(w http.ResponseWriter, r *http.Request, digest string) {
+	if artifactSigner == nil {
+		writeError(w, "Artifact signing is not enabled on this server", http.StatusNotFound)
+		return
+	}
+	sig, err := signDigest(digest)
+	if err != nil {
+		loggerFrom(r.Context()).Error("failed to sign artifact", "digest", digest, "error", err)
+		writeError(w, "Failed to sign artifact", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(digestHeader, digest)
+	fmt.Fprint(w, sig)
+}
+
+// handleSigningKey serves GET /signing-key, the PEM public key artifact
+// signatures verify against
+func handleSigningKey(w http.ResponseWriter, r *http.Request) {
+	if artifactSigner == nil {
+		writeError(w, "Artifact signing is not enabled on this server", http.StatusNotFound)
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(artifactSigner.Public())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// An InstallTarget is the platform a Node.js install's native modules are
+// fetched or built for, when that isn't the server's own. Empty fields are
+// the server's.
+type InstallTarget struct {
+	// Platform is linux, darwin or win32, as Node.js's process.platform
+	Platform string `json:"platform,omitempty"`
+	// Arch is x64, arm64 or arm, as Node.js's process.arch
+	Arch string `json:"arch,omitempty"`
+	// Libc is glibc or musl, for linux targets
+	Libc string `json:"libc,omitempty"`
+}
+
+var (
+	targetPlatforms = []string{"linux", "darwin", "win32"}
+	targetArchs     = []string{"x64", "arm64", "arm"}
+	targetLibcs     = []string{"glibc", "musl"}
+	// dockerPlatforms are the docker --platform values for each arch
+	dockerPlatforms = map[string]string{"x64": "linux/amd64", "arm64": "linux/arm64", "arm": "linux/arm/v7"}
+)
+
+// validate checks the target option for eco
+func (t *InstallTarget) validate(eco *Ecosystem) error {
+	if eco.TargetArgs == nil {
+		return badRequest("target is not supported for %s installs", eco.Name)
+	}
+	if *t == (InstallTarget{}) {
+		return badRequest("Invalid target: must set platform, arch or libc")
+	}
+	if t.Platform != "" && !slices.Contains(targetPlatforms, t.Platform) {
+		return badRequest("Invalid target platform %q: must be one of %s", t.Platform, strings.Join(targetPlatforms, ", "))
+	}
+	if t.Arch != "" && !slices.Contains(targetArchs, t.Arch) {
+		return badRequest("Invalid target arch %q: must be one of %s", t.Arch, strings.Join(targetArchs, ", "))
+	}
+	if t.Libc != "" && !slices.Contains(targetLibcs, t.Libc) {
+		return badRequest("Invalid target libc %q: must be one of %s", t.Libc, strings.Join(targetLibcs, ", "))
+	}
+	if t.Libc != "" && t.platform() != "linux" {
+		return badRequest("Invalid target: libc only applies to linux targets")
+	}
+	return nil
+}
+
+// platform returns the target's platform, defaulting to the server's
+func (t *InstallTarget) platform() string {
+	if t.Platform != "" {
+		return t.Platform
+	}
+	if runtime.GOOS == "windows" {
+		return "win32"
+	}
+	return runtime.GOOS
+}
+
+// arch returns the target's arch, defaulting to the server's
+func (t *InstallTarget) arch() string {
+	if t.Arch != "" {
+		return t.Arch
+	}
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "ia32"
+	}
+	return runtime.GOARCH
+}
+
+// env returns the npm configuration the tools that fetch or build native
+// modules go by: prebuild-install, node-gyp and sharp read npm_config_arch
+// and the like, node-pre-gyp its target_ variants
+func (t *InstallTarget) env() []string {
+	env := []string{
+		"npm_config_platform=" + t.platform(), "npm_config_target_platform=" + t.platform(),
+		"npm_config_arch=" + t.arch(), "npm_config_target_arch=" + t.arch(),
+	}
+	if t.Libc != "" {
+		env = append(env, "npm_config_libc="+t.Libc, "npm_config_target_libc="+t.Libc)
+	}
+	return env
+}
+
+// dockerPlatform returns the docker --platform that runs the install on
+// the target's machine, or "" if containers can't: they only run linux
+func (t *InstallTarget) dockerPlatform() string {
+	if t == nil || t.Arch == "" || t.platform() != "linux" {
+		return ""
+	}
+	return dockerPlatforms[t.Arch]
+}
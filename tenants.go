@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tenants groups callers into tenants with their own limits and result
+// cache, set up from the tenants_file setting; nil when there is none
+var tenants *tenantRegistry
+
+// TenantLimits caps what a tenant's installs may use. Zero fields are
+// unlimited.
+type TenantLimits struct {
+	// ConcurrentJobs caps the installs and jobs a tenant has queued or
+	// running at once
+	ConcurrentJobs int `yaml:"concurrent_jobs" json:"concurrent_jobs,omitempty"`
+	// InstallMinutes caps the time a tenant's package managers run in a
+	// calendar month, UTC
+	InstallMinutes float64 `yaml:"install_minutes" json:"install_minutes,omitempty"`
+	// StorageMB caps the size of the artifacts a tenant has stored that
+	// haven't expired yet
+	StorageMB int64 `yaml:"storage_mb" json:"storage_mb,omitempty"`
+}
+
+// A tenantConfig is one tenant of the tenants file
+type tenantConfig struct {
+	TenantLimits `yaml:",inline"`
+	// APIKeys and Orgs are the API key labels and JWT organisations whose
+	// callers belong to the tenant
+	APIKeys []string `yaml:"api_keys"`
+	Orgs    []string `yaml:"orgs"`
+	// CacheNamespace is the result cache the tenant's installs share; it
+	// defaults to the tenant's name, so tenants naming the same one share
+	CacheNamespace string `yaml:"cache_namespace"`
+}
+
+// A tenantRegistry knows the tenants and what each is using
+type tenantRegistry struct {
+	// defaults are the limits of callers who belong to no listed tenant,
+	// each of whom is a tenant of their own
+	defaults TenantLimits
+	tenants  map[string]*tenantConfig
+	// storageTTL is how long artifacts count against storage, as long as
+	// they are kept
+	storageTTL time.Duration
+
+	mu    sync.Mutex
+	usage map[string]*tenantUsage
+}
+
+// tenantUsage is what a tenant is using
+type tenantUsage struct {
+	active int
+	// month is the month installTime counts, as 2006-01
+	month       string
+	installTime time.Duration
+	// artifacts are the sizes of the tenant's artifacts by digest, with
+	// when they were stored
+	artifacts map[string]storedArtifact
+}
+
+type storedArtifact struct {
+	size     int64
+	storedAt time.Time
+}
+
+// loadTenants reads a tenants file:
+//
+//	default:
+//	  concurrent_jobs: 2
+//	tenants:
+//	  acme:
+//	    api_keys: [acme-ci]
+//	    orgs: [acme]
+//	    concurrent_jobs: 8
+//	    install_minutes: 6000
+//	    storage_mb: 10240
+func loadTenants(path string, storageTTL time.Duration) (*tenantRegistry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Default TenantLimits             `yaml:"default"`
+		Tenants map[string]*tenantConfig `yaml:"tenants"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	owners := make(map[string]string)
+	for name, t := range file.Tenants {
+		if t.CacheNamespace == "" {
+			t.CacheNamespace = name
+		}
+		for _, member := range append(prefixed("key:", t.APIKeys), prefixed("org:", t.Orgs)...) {
+			if other, ok := owners[member]; ok {
+				return nil, fmt.Errorf("%s: %s belongs to both %s and %s", path, member, other, name)
+			}
+			owners[member] = name
+		}
+	}
+	return &tenantRegistry{defaults: file.Default, tenants: file.Tenants, storageTTL: storageTTL, usage: make(map[string]*tenantUsage)}, nil
+}
+
+func prefixed(prefix string, names []string) []string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = prefix + name
+	}
+	return out
+}
+
+// resolve returns the tenant of an authenticated caller: the listed tenant
+// with their API key or organisation, or else one named after either
+func (t *tenantRegistry) resolve(p Principal) string {
+	for name, tc := range t.tenants {
+		if p.KeyLabel != "" && slices.Contains(tc.APIKeys, p.KeyLabel) || p.Org != "" && slices.Contains(tc.Orgs, p.Org) {
+			return name
+		}
+	}
+	switch {
+	case p.KeyLabel != "":
+		return "key:" + p.KeyLabel
+	case p.Org != "":
+		return "org:" + p.Org
+	}
+	return "sub:" + p.Subject
+}
+
+// limits returns a tenant's limits
+func (t *tenantRegistry) limits(name string) TenantLimits {
+	if tc, ok := t.tenants[name]; ok {
+		return tc.TenantLimits
+	}
+	return t.defaults
+}
+
+// cacheNamespace returns the result cache namespace of a tenant
+func (t *tenantRegistry) cacheNamespace(name string) string {
+	if tc, ok := t.tenants[name]; ok {
+		return tc.CacheNamespace
+	}
+	return name
+}
+
+// tenantFrom returns the tenant of the caller in ctx, or "" when tenants
+// are off or the caller isn't authenticated
+func tenantFrom(ctx context.Context) string {
+	if tenants == nil {
+		return ""
+	}
+	p, _ := principalFrom(ctx)
+	return p.Tenant
+}
+
+// cacheNamespaceOf returns the result cache namespace of the caller in ctx,
+// or "" for the shared cache
+func cacheNamespaceOf(ctx context.Context) string {
+	if name := tenantFrom(ctx); name != "" {
+		return tenants.cacheNamespace(name)
+	}
+	return ""
+}
+
+// usageOf returns a tenant's usage for the current month. t.mu must be held.
+func (t *tenantRegistry) usageOf(name string, now time.Time) *tenantUsage {
+	u := t.usage[name]
+	if u == nil {
+		u = &tenantUsage{artifacts: make(map[string]storedArtifact)}
+		t.usage[name] = u
+	}
+	if month := now.UTC().Format("2006-01"); u.month != month {
+		u.month, u.installTime = month, 0
+	}
+	for digest, a := range u.artifacts {
+		if now.Sub(a.storedAt) > t.storageTTL {
+			delete(u.artifacts, digest)
+		}
+	}
+	return u
+}
+
+func (u *tenantUsage) storageBytes() int64 {
+	var total int64
+	for _, a := range u.artifacts {
+		total += a.size
+	}
+	return total
+}
+
+// quotaError fails an install over one of its tenant's limits
+func quotaError(status int, format string, args ...any) error {
+	return &statusError{status: status, errCode: "TENANT_QUOTA_EXCEEDED", err: fmt.Errorf(format, args...)}
+}
+
+// reserve counts an install or job against the caller's tenant, failing
+// with 429 if the tenant has as many going as it may, or 403 if it has used
+// up its install minutes or storage. The returned function releases it and
+// may be called more than once.
+func (t *tenantRegistry) reserve(ctx context.Context) (func(), error) {
+	name := tenantFrom(ctx)
+	if name == "" {
+		return func() {}, nil
+	}
+	limits := t.limits(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.usageOf(name, time.Now())
+	switch {
+	case limits.InstallMinutes > 0 && u.installTime.Minutes() >= limits.InstallMinutes:
+		return nil, quotaError(http.StatusForbidden, "Tenant %s has used its %g install minutes for %s", name, limits.InstallMinutes, u.month)
+	case limits.StorageMB > 0 && u.storageBytes() >= limits.StorageMB<<20:
+		return nil, quotaError(http.StatusForbidden, "Tenant %s has used its %d MiB of artifact storage", name, limits.StorageMB)
+	case limits.ConcurrentJobs > 0 && u.active >= limits.ConcurrentJobs:
+		loggerFrom(ctx).Warn("tenant concurrent job limit exceeded", "tenant", name)
+		return nil, quotaError(http.StatusTooManyRequests, "Tenant %s has %d installs going, as many as it may", name, u.active)
+	}
+	u.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.usage[name].active--
+		})
+	}, nil
+}
+
+// seedInstallTime starts the tenants' install minutes for this month from
+// the usage kept across restarts
+func (t *tenantRegistry) seedInstallTime(l *usageLedger) {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, g := range l.totals(month, now.Add(time.Hour), "tenant") {
+		if g.Tenant != "" {
+			t.usageOf(g.Tenant, now).installTime = time.Duration(g.InstallSeconds * float64(time.Second))
+		}
+	}
+}
+
+// addInstallTime counts a package manager run against the caller's tenant
+func (t *tenantRegistry) addInstallTime(ctx context.Context, d time.Duration) {
+	name := tenantFrom(ctx)
+	if name == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usageOf(name, time.Now()).installTime += d
+}
+
+// addArtifact counts an artifact the caller's tenant stored against its
+// storage until it expires
+func (t *tenantRegistry) addArtifact(ctx context.Context, digest string, size int64) {
+	name := tenantFrom(ctx)
+	if name == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.usageOf(name, now).artifacts[digest] = storedArtifact{size: size, storedAt: now}
+}
+
+// A TenantAccount is a tenant's limits and what it is using
+type TenantAccount struct {
+	Tenant string       `json:"tenant"`
+	Limits TenantLimits `json:"limits"`
+	// Month is the month InstallMinutes counts, such as 2026-10
+	Month          string  `json:"month"`
+	ActiveJobs     int     `json:"active_jobs"`
+	InstallMinutes float64 `json:"install_minutes"`
+	StorageBytes   int64   `json:"storage_bytes"`
+	CacheNamespace string  `json:"cache_namespace"`
+}
+
+// handleTenant serves GET /tenant, the caller's tenant account
+func (t *tenantRegistry) handleTenant(w http.ResponseWriter, r *http.Request) {
+	name := tenantFrom(r.Context())
+	if name == "" {
+		writeError(w, "The caller belongs to no tenant", http.StatusNotFound)
+		return
+	}
+	t.mu.Lock()
+	u := t.usageOf(name, time.Now())
+	account := TenantAccount{
+		Tenant:         name,
+		Limits:         t.limits(name),
+		Month:          u.month,
+		ActiveJobs:     u.active,
+		InstallMinutes: u.installTime.Minutes(),
+		StorageBytes:   u.storageBytes(),
+		CacheNamespace: t.cacheNamespace(name),
+	}
+	t.mu.Unlock()
+	writeJSON(w, http.StatusOK, account)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// A certReloader serves a certificate and key pair from disk, reloading them
+// when either file changes so rotated certificates are picked up without a
+// restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsConfig returns a server configuration that uses the current certificate
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.cert, nil
+		},
+	}
+}
+
+// reload loads the pair again if either file is newer than the one in use,
+// reporting whether it did
+func (c *certReloader) reload() (bool, error) {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	current := c.cert != nil && !modTime.After(c.modTime)
+	c.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch checks the files for changes every interval. A pair that fails to
+// load, for example while only one file has been replaced, is retried on the
+// next tick and the previous certificate stays in use.
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := c.reload()
+		if err != nil {
+			slog.Warn("failed to reload TLS certificate", "error", err)
+			continue
+		}
+		if changed {
+			slog.Info("reloaded TLS certificate", "cert_file", c.certFile)
+		}
+	}
+}
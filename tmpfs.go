@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// tmpfsDir is a tmpfs mount that workspaces are created on while it has
+// room for one, set from the tmpfs_dir setting; empty means they all go in
+// workRoot. tmpfsWorkspaceMax, set from tmpfs_workspace_max_mb, caps a
+// workspace there: an install that outgrows it is killed and run again in
+// workRoot.
+var (
+	tmpfsDir          string
+	tmpfsWorkspaceMax int64 = 512 << 20
+)
+
+var (
+	workspaceInstallDuration = newHistogramVec("pip_install_workspace_install_duration_seconds",
+		"Time spent running the package manager, by ecosystem and where the workspace was: tmpfs, disk, or spilled from tmpfs to disk.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1200}, "ecosystem", "storage")
+	tmpfsSpills = newCounterVec("pip_install_tmpfs_spills_total",
+		"Installs moved from tmpfs to disk for outgrowing tmpfs_workspace_max_mb, by ecosystem.", "ecosystem")
+)
+
+// errTmpfsFull cancels a tool whose workspace outgrew its tmpfs cap
+var errTmpfsFull = errors.New("workspace outgrew tmpfs")
+
+// A workspace records where a workspace's files are
+type workspace struct {
+	// tmpfs is set for workspaces created on tmpfsDir
+	tmpfs bool
+	// spilled is the directory in workRoot a tmpfs workspace was moved to;
+	// the workspace's path is then a link to it
+	spilled string
+}
+
+// tmpfsMagic is the filesystem type statfs reports for tmpfs
+const tmpfsMagic = 0x01021994
+
+// checkTmpfs checks that tmpfs_dir is a directory, warning if it isn't a
+// tmpfs mount and so won't make installs any faster
+func checkTmpfs(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("tmpfs_dir %s is not a directory", dir)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil && st.Type != tmpfsMagic {
+		slog.Warn("tmpfs_dir is not on tmpfs", "tmpfs_dir", dir)
+	}
+	return nil
+}
+
+// workspaceRoot returns where a new workspace goes: tmpfsDir while it has
+// room for a whole one, and workRoot otherwise
+func workspaceRoot() (root string, tmpfs bool) {
+	if tmpfsDir == "" {
+		return workRoot, false
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(tmpfsDir, &st); err != nil || int64(st.Bavail)*int64(st.Bsize) < tmpfsWorkspaceMax {
+		return workRoot, false
+	}
+	return tmpfsDir, true
+}
+
+// workspaceOf returns what is recorded of the workspace at dir
+func workspaceOf(dir string) workspace {
+	ws, _ := workspaces.Load(dir)
+	w, _ := ws.(workspace)
+	return w
+}
+
+// workspaceStorage names where the workspace at dir is, for metrics
+func workspaceStorage(dir string) string {
+	switch w := workspaceOf(dir); {
+	case w.spilled != "":
+		return "spilled"
+	case w.tmpfs:
+		return "tmpfs"
+	}
+	return "disk"
+}
+
+// onTmpfs reports whether the workspace at dir is still on tmpfs
+func onTmpfs(dir string) bool {
+	w := workspaceOf(dir)
+	return w.tmpfs && w.spilled == ""
+}
+
+// spillWorkspace moves the workspace at dir from tmpfs to workRoot so the
+// tool that outgrew it can run again there. What the tool wrote is dropped
+// and the request's files are written afresh; dir becomes a link to the new
+// directory, so it stays the workspace's path.
+func spillWorkspace(ctx context.Context, eco *Ecosystem, req *InstallRequest, dir string) error {
+	spilled, err := os.MkdirTemp(workRoot, workDirPrefix)
+	if err != nil {
+		return fmt.Errorf("Failed to move workspace to disk: %v", err)
+	}
+	w := workspaceOf(dir)
+	w.spilled = spilled
+	workspaces.Store(dir, w)
+	if err := writeWorkspaceFiles(eco, spilled, req.Files, req.modes); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Failed to move workspace to disk: %v", err)
+	}
+	if err := os.Symlink(spilled, dir); err != nil {
+		return fmt.Errorf("Failed to move workspace to disk: %v", err)
+	}
+	tmpfsSpills.inc(eco.Name)
+	loggerFrom(ctx).Info("workspace outgrew tmpfs, moved to disk", "tmpfs_workspace_max_bytes", tmpfsWorkspaceMax, "work_dir", spilled)
+	return nil
+}
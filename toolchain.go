@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeVersionPattern matches the node_version option: a major version, a
+// major.minor prefix or an exact release
+var nodeVersionPattern = regexp.MustCompile(`^v?\d+(\.\d+){0,2}$`)
+
+// rubyVersionPattern matches the ruby_version option
+var rubyVersionPattern = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+
+// nodeIndexTTL is how long the list of Node.js releases is reused
+const nodeIndexTTL = time.Hour
+
+// A nodeToolchains downloads Node.js releases on demand and keeps them in
+// dir, one directory per version. Downloads are checked against the
+// release's SHASUMS256.txt before they are unpacked.
+type nodeToolchains struct {
+	dir     string
+	distURL string
+	client  *http.Client
+
+	mu        sync.Mutex
+	versions  []string
+	fetchedAt time.Time
+	// installing holds a lock per version being downloaded
+	installing map[string]*sync.Mutex
+}
+
+// nodes manages the toolchains for the node_version option, set from the
+// toolchain_dir and node_dist_url settings
+var nodes *nodeToolchains
+
+// rubiesDir holds the Ruby releases for the ruby_version option, one
+// directory per release named as ruby-install and rbenv name them, such as
+// ruby-3.3.6 or 3.3.6; set from the rubies_dir setting. Ruby is built from
+// source, so unlike Node.js its releases are installed ahead of time rather
+// than downloaded.
+var rubiesDir string
+
+// toolchainPath returns the PATH an install runs with: the server's own, with
+// the requested release of eco's runtime first
+func toolchainPath(ctx context.Context, eco *Ecosystem, version string) (string, error) {
+	if version == "" {
+		return os.Getenv("PATH"), nil
+	}
+	var bin string
+	var err error
+	if eco.Runtime == "ruby" {
+		bin, err = rubyBinDir(version)
+	} else {
+		bin, err = nodes.binDir(ctx, version)
+	}
+	if err != nil {
+		return "", err
+	}
+	return bin + string(os.PathListSeparator) + os.Getenv("PATH"), nil
+}
+
+// rubyBinDir returns the bin directory of the newest release in rubiesDir
+// matching the requested version
+func rubyBinDir(requested string) (string, error) {
+	entries, err := os.ReadDir(rubiesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var best []int
+	dir := ""
+	for _, e := range entries {
+		v := strings.TrimPrefix(e.Name(), "ruby-")
+		if !rubyVersionPattern.MatchString(v) || v != requested && !strings.HasPrefix(v, requested+".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(rubiesDir, e.Name(), "bin", "ruby")); err != nil {
+			continue
+		}
+		var parts []int
+		for _, p := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(p)
+			parts = append(parts, n)
+		}
+		if dir == "" || slices.Compare(parts, best) > 0 {
+			best, dir = parts, filepath.Join(rubiesDir, e.Name())
+		}
+	}
+	if dir == "" {
+		return "", badRequest("Unknown ruby_version %q: it is not installed on this server", requested)
+	}
+	return filepath.Join(dir, "bin"), nil
+}
+
+func newNodeToolchains(dir, distURL string) (*nodeToolchains, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &nodeToolchains{
+		dir:        dir,
+		distURL:    strings.TrimSuffix(distURL, "/"),
+		client:     &http.Client{Timeout: 10 * time.Minute},
+		installing: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// binDir returns the bin directory of the newest release matching the
+// requested version, downloading it first if needed
+func (n *nodeToolchains) binDir(ctx context.Context, requested string) (string, error) {
+	version, err := n.resolve(ctx, requested)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(n.dir, "node-v"+version)
+	if _, err := os.Stat(filepath.Join(dir, "bin", "node")); err == nil {
+		return filepath.Join(dir, "bin"), nil
+	}
+
+	n.mu.Lock()
+	lock := n.installing[version]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		n.installing[version] = lock
+	}
+	n.mu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	// Another install may have downloaded it while this one waited
+	if _, err := os.Stat(filepath.Join(dir, "bin", "node")); err == nil {
+		return filepath.Join(dir, "bin"), nil
+	}
+	start := time.Now()
+	if err := n.download(ctx, version, dir); err != nil {
+		return "", fmt.Errorf("Failed to download Node.js %s: %v", version, err)
+	}
+	loggerFrom(ctx).Info("downloaded Node.js", "version", version, "duration_ms", time.Since(start).Milliseconds())
+	return filepath.Join(dir, "bin"), nil
+}
+
+// resolve returns the newest release whose version starts with requested
+func (n *nodeToolchains) resolve(ctx context.Context, requested string) (string, error) {
+	requested = strings.TrimPrefix(requested, "v")
+	versions, err := n.releases(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to list Node.js releases: %v", err)
+	}
+	// The index is sorted newest first
+	for _, v := range versions {
+		if v == requested || strings.HasPrefix(v, requested+".") {
+			return v, nil
+		}
+	}
+	return "", badRequest("Unknown node_version %q", requested)
+}
+
+// releases returns the released versions, newest first, without the v prefix
+func (n *nodeToolchains) releases(ctx context.Context) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.versions != nil && time.Since(n.fetchedAt) < nodeIndexTTL {
+		return n.versions, nil
+	}
+	resp, err := n.get(ctx, n.distURL+"/index.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var index []struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+	versions := make([]string, len(index))
+	for i, r := range index {
+		versions[i] = strings.TrimPrefix(r.Version, "v")
+	}
+	n.versions, n.fetchedAt = versions, time.Now()
+	return versions, nil
+}
+
+func (n *nodeToolchains) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// download fetches, verifies and unpacks a release into dir
+func (n *nodeToolchains) download(ctx context.Context, version, dir string) error {
+	arch, ok := map[string]string{"amd64": "x64", "arm64": "arm64", "ppc64le": "ppc64le", "s390x": "s390x"}[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no Node.js builds for %s", runtime.GOARCH)
+	}
+	name := fmt.Sprintf("node-v%s-%s-%s.tar.gz", version, runtime.GOOS, arch)
+	base := n.distURL + "/v" + version + "/"
+	want, err := n.checksum(ctx, base+"SHASUMS256.txt", name)
+	if err != nil {
+		return err
+	}
+
+	// Download next to dir so the rename into place is atomic
+	tmp, err := os.MkdirTemp(n.dir, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	resp, err := n.get(ctx, base+name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	archive, err := os.Create(filepath.Join(tmp, name))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(archive, h), resp.Body); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%s has SHA-256 %s, expected %s", name, got, want)
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	root := filepath.Join(tmp, "root")
+	if err := extractTarGz(archive, root); err != nil {
+		return err
+	}
+	// The archive holds a single node-v<version>-<os>-<arch> directory
+	return os.Rename(filepath.Join(root, strings.TrimSuffix(name, ".tar.gz")), dir)
+}
+
+// checksum finds name's SHA-256 in a SHASUMS256.txt file
+func (n *nodeToolchains) checksum(ctx context.Context, url, name string) (string, error) {
+	resp, err := n.get(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if sum, file, ok := strings.Cut(sc.Text(), "  "); ok && file == name {
+			return sum, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s is not listed in %s", name, url)
+}
+
+// extractTarGz unpacks a gzipped tar into dir, refusing entries that would
+// land outside it
+func extractTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, hdr.Name)
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q is outside the archive root", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, path)
+			}
+		case tar.TypeReg:
+			err = writeFileFrom(path, tr, os.FileMode(hdr.Mode).Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFileFrom(path string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
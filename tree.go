@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A TreeNode is one package in a resolved dependency tree
+type TreeNode struct {
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	Resolved  string `json:"resolved,omitempty"`
+	Integrity string `json:"integrity,omitempty"`
+	// Path is where the package is installed, such as node_modules/a
+	Path     string `json:"path,omitempty"`
+	Dev      bool   `json:"dev,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+	// Deduped is set where the package was already listed elsewhere in the
+	// tree, which is where its dependencies are
+	Deduped bool `json:"deduped,omitempty"`
+	// Missing is set for dependencies the lock file doesn't resolve
+	Missing      bool        `json:"missing,omitempty"`
+	Dependencies []*TreeNode `json:"dependencies,omitempty"`
+}
+
+// A DependencyTree is the response of POST /tree
+type DependencyTree struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Packages is the number of distinct installed packages
+	Packages     int         `json:"packages"`
+	Dependencies []*TreeNode `json:"dependencies"`
+}
+
+// lockPackage is an entry of a package-lock.json packages map
+type lockPackage struct {
+	Name                 string            `json:"name"`
+	Version              string            `json:"version"`
+	Resolved             string            `json:"resolved"`
+	Integrity            string            `json:"integrity"`
+	Dev                  bool              `json:"dev"`
+	Optional             bool              `json:"optional"`
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	DevDependencies      map[string]string `json:"devDependencies"`
+}
+
+// handleTree serves POST /tree with the dependency tree npm resolves for the
+// request's package.json
+func (in *Installer) handleTree(w http.ResponseWriter, r *http.Request) {
+	lock, ok := in.generateLock(w, r)
+	if !ok {
+		return
+	}
+	tree, err := newDependencyTree(lock)
+	if err != nil {
+		writeError(w, fmt.Sprintf("Failed to read package-lock.json: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
+
+// newDependencyTree builds the tree from a version 2 or 3 package-lock.json,
+// resolving each dependency the way Node.js does: from the nearest
+// node_modules directory up from its dependent
+func newDependencyTree(lock []byte) (*DependencyTree, error) {
+	var doc struct {
+		Packages map[string]lockPackage `json:"packages"`
+	}
+	if err := json.Unmarshal(lock, &doc); err != nil {
+		return nil, err
+	}
+	root, ok := doc.Packages[""]
+	if !ok {
+		return nil, fmt.Errorf("lock file has no packages; version 1 lock files aren't supported")
+	}
+	tree := &DependencyTree{Name: root.Name, Version: root.Version, Packages: len(doc.Packages) - 1}
+	expanded := make(map[string]bool)
+	var walk func(path string, pkg lockPackage, direct bool) []*TreeNode
+	walk = func(path string, pkg lockPackage, direct bool) []*TreeNode {
+		deps := make(map[string]bool)
+		for name := range pkg.Dependencies {
+			deps[name] = false
+		}
+		for name := range pkg.OptionalDependencies {
+			deps[name] = true
+		}
+		// Only the root's dev dependencies are installed
+		if direct {
+			for name := range pkg.DevDependencies {
+				if _, ok := deps[name]; !ok {
+					deps[name] = false
+				}
+			}
+		}
+		names := make([]string, 0, len(deps))
+		for name := range deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		nodes := make([]*TreeNode, 0, len(names))
+		for _, name := range names {
+			depPath, dep, ok := resolveLockDependency(doc.Packages, path, name)
+			if !ok {
+				// Optional dependencies for other platforms aren't installed
+				if !deps[name] {
+					nodes = append(nodes, &TreeNode{Name: name, Missing: true})
+				}
+				continue
+			}
+			node := &TreeNode{
+				Name:      name,
+				Version:   dep.Version,
+				Resolved:  dep.Resolved,
+				Integrity: dep.Integrity,
+				Path:      depPath,
+				Dev:       dep.Dev,
+				Optional:  dep.Optional,
+			}
+			if expanded[depPath] {
+				node.Deduped = true
+			} else {
+				expanded[depPath] = true
+				node.Dependencies = walk(depPath, dep, false)
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+	tree.Dependencies = walk("", root, true)
+	return tree, nil
+}
+
+// resolveLockDependency finds the package name resolves to from the package
+// installed at path
+func resolveLockDependency(pkgs map[string]lockPackage, path, name string) (string, lockPackage, bool) {
+	for {
+		candidate := "node_modules/" + name
+		if path != "" {
+			candidate = path + "/" + candidate
+		}
+		if pkg, ok := pkgs[candidate]; ok {
+			return candidate, pkg, true
+		}
+		if path == "" {
+			return "", lockPackage{}, false
+		}
+		// Step up past the enclosing node_modules directory
+		i := strings.LastIndex(path, "node_modules/")
+		if i <= 0 {
+			path = ""
+		} else {
+			path = strings.TrimSuffix(path[:i], "/")
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageFlushInterval is how often usage is written to usage_file
+const usageFlushInterval = time.Minute
+
+// accounting counts what each caller uses, hour by hour, for GET /usage. It is
+// kept in usage_file, when set, so it survives restarts.
+var accounting = newUsageLedger("", 0)
+
+// UsageCounts are what callers used
+type UsageCounts struct {
+	// Requests counts HTTP requests and gRPC calls
+	Requests int64 `json:"requests"`
+	// Installs counts package manager runs and InstallSeconds how long
+	// they took
+	Installs       int64   `json:"installs"`
+	InstallSeconds float64 `json:"install_seconds"`
+	// CacheHits counts installs and jobs answered from the result cache
+	CacheHits int64 `json:"cache_hits"`
+	// BytesServed counts response bytes, archives included
+	BytesServed int64 `json:"bytes_served"`
+}
+
+func (c *UsageCounts) add(o UsageCounts) {
+	c.Requests += o.Requests
+	c.Installs += o.Installs
+	c.InstallSeconds += o.InstallSeconds
+	c.CacheHits += o.CacheHits
+	c.BytesServed += o.BytesServed
+}
+
+// A usageBucket is one caller's usage in one hour
+type usageBucket struct {
+	Hour   time.Time `json:"hour"`
+	Key    string    `json:"key,omitempty"`
+	Tenant string    `json:"tenant,omitempty"`
+	UsageCounts
+}
+
+type usageKey struct {
+	hour        int64
+	key, tenant string
+}
+
+// A usageLedger holds the usage buckets of the last retention
+type usageLedger struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	buckets map[usageKey]*usageBucket
+	dirty   bool
+}
+
+func newUsageLedger(path string, retention time.Duration) *usageLedger {
+	return &usageLedger{path: path, retention: retention, buckets: make(map[usageKey]*usageBucket)}
+}
+
+// loadUsage reads the usage kept in path, which needn't exist yet
+func loadUsage(path string, retention time.Duration) (*usageLedger, error) {
+	l := newUsageLedger(path, retention)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buckets []*usageBucket
+	if err := json.Unmarshal(b, &buckets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, bucket := range buckets {
+		l.buckets[usageKey{bucket.Hour.Unix(), bucket.Key, bucket.Tenant}] = bucket
+	}
+	return l, nil
+}
+
+// usageCaller names a caller in the usage: their API key label or, for
+// JWTs, their subject. Unauthenticated requests have no key.
+func usageCaller(p Principal) string {
+	if p.KeyLabel != "" || p.Subject == "" {
+		return p.KeyLabel
+	}
+	return "sub:" + p.Subject
+}
+
+// record adds what a caller used now
+func (l *usageLedger) record(p Principal, counts UsageCounts) {
+	hour := time.Now().UTC().Truncate(time.Hour)
+	k := usageKey{hour.Unix(), usageCaller(p), p.Tenant}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.buckets[k]
+	if bucket == nil {
+		bucket = &usageBucket{Hour: hour, Key: k.key, Tenant: k.tenant}
+		l.buckets[k] = bucket
+	}
+	bucket.add(counts)
+	l.dirty = true
+}
+
+// add records what the caller in ctx used now
+func (l *usageLedger) add(ctx context.Context, counts UsageCounts) {
+	p, _ := principalFrom(ctx)
+	l.record(p, counts)
+}
+
+// flush drops the buckets older than the retention and writes the rest to
+// the ledger's file, if it has one and anything changed
+func (l *usageLedger) flush() error {
+	l.mu.Lock()
+	cutoff := time.Now().Add(-l.retention)
+	buckets := make([]*usageBucket, 0, len(l.buckets))
+	for k, bucket := range l.buckets {
+		if l.retention > 0 && bucket.Hour.Before(cutoff) {
+			delete(l.buckets, k)
+			l.dirty = true
+			continue
+		}
+		copied := *bucket
+		buckets = append(buckets, &copied)
+	}
+	dirty := l.dirty
+	l.dirty = false
+	l.mu.Unlock()
+	if l.path == "" || !dirty {
+		return nil
+	}
+	slices.SortFunc(buckets, func(a, b *usageBucket) int {
+		if c := a.Hour.Compare(b.Hour); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key+"\x00"+a.Tenant, b.Key+"\x00"+b.Tenant)
+	})
+	b, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".usage-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// keepFlushing writes the ledger to its file every usageFlushInterval
+func (l *usageLedger) keepFlushing() {
+	for range time.Tick(usageFlushInterval) {
+		if err := l.flush(); err != nil {
+			slog.Error("failed to save usage", "path", l.path, "error", err)
+		}
+	}
+}
+
+// metered counts the requests to h and the bytes it serves in the usage of
+// the caller
+func metered(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		accounting.add(r.Context(), UsageCounts{Requests: 1, BytesServed: rec.bytes})
+	}
+}
+
+// A UsageGroup is the usage of one key or tenant over a report's range
+type UsageGroup struct {
+	Key    string `json:"key,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	UsageCounts
+}
+
+// A UsageReport is the response of GET /usage
+type UsageReport struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	GroupBy string       `json:"group_by"`
+	Groups  []UsageGroup `json:"groups"`
+	Total   UsageCounts  `json:"total"`
+}
+
+// totals adds up the usage of the hours starting in [from, to) by key or by
+// tenant
+func (l *usageLedger) totals(from, to time.Time, groupBy string) []UsageGroup {
+	groups := make(map[string]*UsageGroup)
+	l.mu.Lock()
+	for _, bucket := range l.buckets {
+		if bucket.Hour.Before(from) || !bucket.Hour.Before(to) {
+			continue
+		}
+		name, g := bucket.Key, UsageGroup{Key: bucket.Key}
+		if groupBy == "tenant" {
+			name, g = bucket.Tenant, UsageGroup{Tenant: bucket.Tenant}
+		}
+		if groups[name] == nil {
+			groups[name] = &g
+		}
+		groups[name].add(bucket.UsageCounts)
+	}
+	l.mu.Unlock()
+	out := make([]UsageGroup, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, *g)
+	}
+	slices.SortFunc(out, func(a, b UsageGroup) int { return strings.Compare(a.Key+a.Tenant, b.Key+b.Tenant) })
+	return out
+}
+
+// parseUsageTime reads a from or to parameter, an RFC 3339 time or a date
+func parseUsageTime(name, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, badRequest("%s must be an RFC 3339 time or a date such as 2006-01-02", name)
+}
+
+// handleUsage serves GET /usage?from=&to=&group_by=, the usage of the hours
+// in a range, from the start of the month to now by default, by key or by
+// tenant
+func (l *usageLedger) handleUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now().UTC()
+	report := UsageReport{
+		From:    time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		To:      now,
+		GroupBy: q.Get("group_by"),
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if report.From, err = parseUsageTime("from", v); err != nil {
+			writeInstallError(w, err)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if report.To, err = parseUsageTime("to", v); err != nil {
+			writeInstallError(w, err)
+			return
+		}
+	}
+	if !report.From.Before(report.To) {
+		writeError(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	switch report.GroupBy {
+	case "":
+		report.GroupBy = "key"
+		if tenants != nil {
+			report.GroupBy = "tenant"
+		}
+	case "key", "tenant":
+	default:
+		writeError(w, "group_by must be key or tenant", http.StatusBadRequest)
+		return
+	}
+	report.Groups = l.totals(report.From, report.To, report.GroupBy)
+	for _, g := range report.Groups {
+		report.Total.add(g.UsageCounts)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxQueuedWarmups is how many cache warm-ups may wait to run
+	maxQueuedWarmups = 1000
+	// warmPollInterval is how often queued warm-ups look for an idle slot
+	warmPollInterval = 10 * time.Second
+	// warmRetention is how long finished warm-ups are listed
+	warmRetention = 24 * time.Hour
+)
+
+var cacheWarmups = newCounterVec("pip_install_cache_warmups_total",
+	"Cache warm-ups that have finished, by ecosystem and result (succeeded or failed).", "ecosystem", "result")
+
+// A CacheWarmup is one install run only to fill the shared package cache.
+// Its fields are guarded by the cacheWarmer's mutex.
+type CacheWarmup struct {
+	ID         string     `json:"id"`
+	Ecosystem  string     `json:"ecosystem"`
+	Status     JobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	eco    *Ecosystem
+	req    *InstallRequest
+	key    string
+	logger *slog.Logger
+	span   trace.SpanContext
+}
+
+// A warmWindow is the part of each day warm-ups may run in, as offsets from
+// midnight. A window whose end is before its start runs past midnight.
+type warmWindow struct {
+	start, end time.Duration
+}
+
+// parseWarmWindow parses a window such as "01:00-06:00"
+func parseWarmWindow(s string) (warmWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return warmWindow{}, fmt.Errorf("%q is not a range of times", s)
+	}
+	var w warmWindow
+	for _, part := range []struct {
+		s string
+		d *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part.s))
+		if err != nil {
+			return warmWindow{}, err
+		}
+		*part.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return w, nil
+}
+
+// contains reports whether t, in its own time zone, falls in the window
+func (w warmWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+// A cacheWarmer runs warm-ups one at a time, only while the install pool has
+// a free slot no install is waiting for, and only inside its window if it
+// has one
+type cacheWarmer struct {
+	mu      sync.Mutex
+	pool    *installPool
+	window  *warmWindow
+	queue   []*CacheWarmup
+	warmups map[string]*CacheWarmup
+
+	// ctx is cancelled at shutdown, killing a running warm-up
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// newCacheWarmer starts running warm-ups in the background
+func newCacheWarmer(pool *installPool, window *warmWindow) *cacheWarmer {
+	c := &cacheWarmer{pool: pool, window: window, warmups: make(map[string]*CacheWarmup)}
+	c.ctx, c.stop = context.WithCancel(context.Background())
+	go c.run()
+	return c
+}
+
+// run polls for a chance to run queued warm-ups until shutdown
+func (c *cacheWarmer) run() {
+	ticker := time.NewTicker(warmPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.forget(time.Now().Add(-warmRetention))
+		for c.ctx.Err() == nil && c.runNext() {
+		}
+	}
+}
+
+// runNext runs the oldest queued warm-up if it may run now, and reports
+// whether it did
+func (c *cacheWarmer) runNext() bool {
+	if c.window != nil && !c.window.contains(time.Now()) {
+		return false
+	}
+	c.mu.Lock()
+	empty := len(c.queue) == 0
+	c.mu.Unlock()
+	if empty {
+		return false
+	}
+	slot, ok := c.pool.tryAcquire()
+	if !ok {
+		return false
+	}
+	defer slot.release()
+
+	c.mu.Lock()
+	w := c.queue[0]
+	c.queue = c.queue[1:]
+	w.Status = JobRunning
+	w.StartedAt = timePtr(time.Now().UTC())
+	c.mu.Unlock()
+
+	ctx := withLogger(trace.ContextWithSpanContext(c.ctx, w.span), w.logger)
+	ctx, span := tracer.Start(ctx, "cache warm-up", trace.WithAttributes(ecosystemAttr(w.eco)))
+	w.logger.Info("warming package cache")
+	err := warmPackageCache(ctx, w.eco, w.req)
+	endSpan(span, err)
+
+	c.mu.Lock()
+	w.FinishedAt = timePtr(time.Now().UTC())
+	w.req = nil
+	if err != nil {
+		w.Status = JobFailed
+		w.Error = err.Error()
+		w.logger.Error("cache warm-up failed", "error", err)
+	} else {
+		w.Status = JobSucceeded
+		w.logger.Info("cache warm-up succeeded")
+	}
+	c.mu.Unlock()
+	cacheWarmups.inc(w.eco.Name, string(w.Status))
+	return true
+}
+
+// warmPackageCache runs the package manager for req in a throwaway workspace,
+// which leaves every package it fetched in the shared cache
+func warmPackageCache(ctx context.Context, eco *Ecosystem, req *InstallRequest) error {
+	if err := installExecutor.checkToolchain(eco); err != nil {
+		return err
+	}
+	tmpDir, err := prepareWorkspace(ctx, eco, req)
+	if err != nil {
+		return err
+	}
+	defer removeWorkspace(tmpDir)
+	_, err = runInstall(ctx, eco, req, tmpDir, nil)
+	return err
+}
+
+// forget drops warm-ups that finished before cutoff
+func (c *cacheWarmer) forget(cutoff time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, w := range c.warmups {
+		if w.FinishedAt != nil && w.FinishedAt.Before(cutoff) {
+			delete(c.warmups, id)
+		}
+	}
+}
+
+// shutdown stops running warm-ups; those still queued are dropped
+func (c *cacheWarmer) shutdown() {
+	c.stop()
+}
+
+// list returns snapshots of the known warm-ups, oldest first
+func (c *cacheWarmer) list() []CacheWarmup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	warmups := make([]CacheWarmup, 0, len(c.warmups))
+	for _, w := range c.warmups {
+		warmups = append(warmups, *w)
+	}
+	sort.Slice(warmups, func(i, j int) bool { return warmups[i].CreatedAt.Before(warmups[j].CreatedAt) })
+	return warmups
+}
+
+// decodeWarmups reads the installs of a POST /cache/warm body. Each is an
+// ecosystem name next to the same files, packages and options as an
+// /install/<name> JSON body.
+func decodeWarmups(ctx context.Context, r *http.Request) ([]*CacheWarmup, error) {
+	raw, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Installs []json.RawMessage `json:"installs"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, badRequest("Error decoding request body: %v", err)
+	}
+	if len(body.Installs) == 0 {
+		return nil, badRequest("installs must list at least one install")
+	}
+	now := time.Now().UTC()
+	warmups := make([]*CacheWarmup, 0, len(body.Installs))
+	for i, entry := range body.Installs {
+		w, err := decodeWarmup(entry)
+		var fe *fieldError
+		if errors.As(err, &fe) {
+			field := fmt.Sprintf("installs[%d]", i)
+			if fe.field != "" {
+				field += "." + fe.field
+			}
+			return nil, &fieldError{field: field, reason: fe.reason}
+		}
+		if err != nil {
+			return nil, &statusError{status: errorStatus(err), err: fmt.Errorf("installs[%d]: %v", i, err)}
+		}
+		if w.ID, err = newJobID(); err != nil {
+			return nil, err
+		}
+		w.Status = JobQueued
+		w.CreatedAt = now
+		w.logger = loggerFrom(ctx).With("warmup_id", w.ID, "ecosystem", w.eco.Name)
+		w.span = trace.SpanContextFromContext(ctx)
+		warmups = append(warmups, w)
+	}
+	return warmups, nil
+}
+
+// decodeWarmup reads one install of a warm-up request. Its scripts never
+// run, since only the downloads are kept.
+func decodeWarmup(raw json.RawMessage) (*CacheWarmup, error) {
+	var entry struct {
+		Ecosystem string `json:"ecosystem"`
+	}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, badRequest("must be an object")
+	}
+	eco := findEcosystem(entry.Ecosystem)
+	if eco == nil {
+		return nil, badRequest("Unknown ecosystem %q", entry.Ecosystem)
+	}
+	if eco.CacheEnv == nil {
+		return nil, badRequest("%s has no package cache to warm", eco.Name)
+	}
+	// The ecosystem field isn't part of an install body
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, badRequest("must be an object")
+	}
+	delete(body, "ecosystem")
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req := &InstallRequest{Files: make(map[string]string), Format: archiveFormats[0]}
+	if err := decodeJSONBody(eco, req, raw); err != nil {
+		return nil, err
+	}
+	if req.Options.CallbackURL != "" || req.Options.Output != nil || req.Options.AuditFix {
+		return nil, badRequest("callback_url, output and audit_fix are not supported for cache warm-ups")
+	}
+	if err := completeRequest(eco, req); err != nil {
+		return nil, err
+	}
+	ignore := true
+	req.Options.IgnoreScripts = &ignore
+	return &CacheWarmup{Ecosystem: eco.Name, eco: eco, req: req, key: cacheKey(eco, req)}, nil
+}
+
+// enqueue adds warm-ups to the queue, all or none. One whose inputs match a
+// warm-up still queued is replaced by that one.
+func (c *cacheWarmer) enqueue(warmups []*CacheWarmup) ([]*CacheWarmup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queued := make(map[string]*CacheWarmup, len(c.queue))
+	for _, w := range c.queue {
+		queued[w.key] = w
+	}
+	var added []*CacheWarmup
+	for i, w := range warmups {
+		if existing, ok := queued[w.key]; ok {
+			warmups[i] = existing
+			continue
+		}
+		queued[w.key] = w
+		added = append(added, w)
+	}
+	if len(c.queue)+len(added) > maxQueuedWarmups {
+		return nil, &statusError{status: http.StatusServiceUnavailable,
+			err: fmt.Errorf("Cache warm-up queue is full: %d warm-ups waiting, try again later", len(c.queue))}
+	}
+	for _, w := range added {
+		c.queue = append(c.queue, w)
+		c.warmups[w.ID] = w
+	}
+	snapshots := make([]*CacheWarmup, len(warmups))
+	for i, w := range warmups {
+		snapshot := *w
+		snapshots[i] = &snapshot
+	}
+	return snapshots, nil
+}
+
+// handleWarm serves POST /cache/warm, queueing installs that fill the shared
+// package cache once the server is idle
+func (c *cacheWarmer) handleWarm(w http.ResponseWriter, r *http.Request) {
+	warmups, err := decodeWarmups(r.Context(), r)
+	if err != nil {
+		writeInstallError(w, err)
+		return
+	}
+	warmups, err = c.enqueue(warmups)
+	if err != nil {
+		poolError(w, err)
+		return
+	}
+	loggerFrom(r.Context()).Info("queued cache warm-ups", "installs", len(warmups))
+	writeJSON(w, http.StatusAccepted, map[string]any{"warmups": warmups})
+}
+
+// handleList serves GET /cache/warm
+func (c *cacheWarmer) handleList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"warmups": c.list()})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	// webhookAttempts is how many times a callback is tried before giving up
+	webhookAttempts = 5
+	// webhookBackoff is the delay before the first retry; it doubles each time
+	webhookBackoff = time.Second
+	// signatureHeader carries the hex HMAC-SHA256 of the body, GitHub style
+	signatureHeader = "X-Signature-256"
+)
+
+// A webhookNotifier POSTs job results to client supplied callback URLs
+type webhookNotifier struct {
+	// secret signs payloads when set; callbacks are unsigned otherwise
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookNotifier(secret string) *webhookNotifier {
+	// The address is checked once it has been resolved, so a name that
+	// points at an internal address is refused however it was looked up.
+	// Callbacks go direct, since a proxy's address is all the check would
+	// see.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: checkCallbackAddr}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &webhookNotifier{
+		secret: []byte(secret),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+			// A redirect could lead anywhere, so the 3xx is the response
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// errCallbackAddr is returned for callbacks to addresses inside the
+// server's network
+var errCallbackAddr = errors.New("callback address is not public")
+
+// checkCallbackAddr refuses connections to loopback, link-local, private
+// and unspecified addresses, such as cloud metadata endpoints
+func checkCallbackAddr(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errCallbackAddr, addrPort.Addr())
+	}
+	return nil
+}
+
+// nonPublicPrefixes are ranges publicAddr refuses that netip has no
+// predicate for: "this network", carrier-grade NAT, unique local IPv6 and
+// local-use NAT64, whose gateways reach the operator's own IPv4 network
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// nat64Prefix is the well-known NAT64 prefix; its addresses reach the IPv4
+// address in their last four bytes
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// publicAddr reports whether ip is outside loopback, link-local, private,
+// shared and unspecified ranges, looking through IPv4-mapped and NAT64
+// addresses to the IPv4 address they reach
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	if nat64Prefix.Contains(ip) {
+		b := ip.As16()
+		ip = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	if slices.ContainsFunc(nonPublicPrefixes, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+		return false
+	}
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsPrivate() && !ip.IsUnspecified()
+}
+
+// webhookPayload is the JSON body sent to a callback URL
+type webhookPayload struct {
+	JobID           string            `json:"job_id"`
+	Ecosystem       string            `json:"ecosystem"`
+	Status          JobStatus         `json:"status"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	ArtifactURL     string            `json:"artifact_url,omitempty"`
+	ArtifactDigest  string            `json:"artifact_sha256,omitempty"`
+	Output          *UploadedArtifact `json:"output,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	Warnings        []InstallWarning  `json:"warnings,omitempty"`
+}
+
+// validateCallbackURL checks that a callback URL is an absolute http(s)
+// URL. One naming an internal address outright is refused up front; names
+// are checked when the callback is delivered.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return badRequest("callback_url must be an absolute http or https URL")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !publicAddr(ip) {
+		return badRequest("callback_url must not point at a loopback, link-local or private address")
+	}
+	return nil
+}
+
+// sign returns the signature header value for body
+func (n *webhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify delivers payload to callbackURL, retrying network errors, 429s and
+// 5xx responses with exponential backoff until ctx is done
+func (n *webhookNotifier) notify(ctx context.Context, callbackURL string, payload webhookPayload) {
+	logger := loggerFrom(ctx).With("callback_url", callbackURL)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("failed to encode webhook payload", "error", err)
+		return
+	}
+
+	delay := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		retry, err := n.send(ctx, callbackURL, body)
+		if err == nil {
+			logger.Info("delivered webhook", "attempt", attempt)
+			return
+		}
+		logger.Warn("webhook delivery failed", "attempt", attempt, "max_attempts", webhookAttempts, "error", err)
+		if !retry {
+			return
+		}
+		if attempt < webhookAttempts {
+			select {
+			case <-ctx.Done():
+				logger.Warn("gave up on webhook", "error", ctx.Err())
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+// send makes one delivery attempt and reports whether a failure is worth retrying
+func (n *webhookNotifier) send(ctx context.Context, callbackURL string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pip-install-webhook")
+	if len(n.secret) > 0 {
+		req.Header.Set(signatureHeader, n.sign(body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, errCallbackAddr) && ctx.Err() == nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("callback returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("callback returned %s", resp.Status)
+	}
+}
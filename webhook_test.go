@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"::", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fe80::1%eth0", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fd12:3456::1%eth0", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::6440:1", false},
+		{"64:ff9b::5db8:d822", true},
+		{"64:ff9b:1::5db8:d822", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://ci.example.com/hooks/pip", false},
+		{"http://93.184.216.34:8080/", false},
+		{"ftp://ci.example.com/", true},
+		{"/hooks/pip", true},
+		{"http://127.0.0.1/", true},
+		{"http://100.64.0.1/", true},
+		{"http://0.0.0.0:8080/", true},
+		{"http://[fd00::1]/", true},
+		{"http://[64:ff9b::a9fe:a9fe]/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := validateCallbackURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateCallbackURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookRefusesInternalAddresses(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer srv.Close()
+	retry, err := newWebhookNotifier("").send(context.Background(), srv.URL, []byte("{}"))
+	if err == nil || retry {
+		t.Errorf("send() to %s = %v, %v, want a refusal that isn't retried", srv.URL, retry, err)
+	}
+	if hits != 0 {
+		t.Errorf("send() reached the server %d times", hits)
+	}
+}
+
+func TestNotifyStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	n := &webhookNotifier{client: srv.Client()}
+	start := time.Now()
+	n.notify(ctx, srv.URL, webhookPayload{JobID: "j"})
+	if elapsed := time.Since(start); elapsed >= webhookBackoff {
+		t.Errorf("notify() took %v after being cancelled", elapsed)
+	}
+	if hits != 1 {
+		t.Errorf("notify() made %d attempts, want 1", hits)
+	}
+}
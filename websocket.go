@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds how long a single frame may take to reach a client
+const wsWriteTimeout = 10 * time.Second
+
+var wsUpgrader = websocket.Upgrader{
+	// Log frames carry nothing a cross-origin page couldn't already fetch
+	// from /jobs/{id}/events, so any origin may connect
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// A wsFrame is one structured message sent to WebSocket clients. Source is
+// stdout or stderr for output lines and "status" for lifecycle changes.
+type wsFrame struct {
+	ID        int       `json:"id"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+	Line      string    `json:"line,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Status    JobStatus `json:"status,omitempty"`
+}
+
+func newWSFrame(ev JobEvent) wsFrame {
+	frame := wsFrame{ID: ev.ID, Source: ev.Stream, Timestamp: ev.Time, Line: ev.Line}
+	if ev.Type == "status" {
+		frame.Source = "status"
+		frame.Phase = ev.Phase
+		frame.Status = ev.Status
+	}
+	return frame
+}
+
+// handleWebSocket serves GET /jobs/{id}/ws, pushing the job's events as JSON
+// text frames and closing normally once the job has finished
+func (m *JobManager) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.find(w, r)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		loggerFrom(r.Context()).Warn("websocket upgrade failed", "job_id", job.ID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Read in the background so control frames are handled and we notice
+	// when the client goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	next := 0
+	for {
+		events, done, changed := m.eventLog(job).since(next)
+		for _, ev := range events {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(newWSFrame(ev)); err != nil {
+				return
+			}
+			next = ev.ID
+		}
+		if done && len(events) == 0 {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "job finished")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+			return
+		}
+		if done {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isWorkspaceManifest reports whether a submitted file name is the
+// package.json of a workspace package, such as packages/app/package.json,
+// which Node.js ecosystems accept alongside the root manifest
+func isWorkspaceManifest(eco *Ecosystem, name string) bool {
+	if eco.Runtime != "node" || !strings.HasSuffix(name, "/package.json") {
+		return false
+	}
+	p, err := projectPath(name)
+	return err == nil && p == name
+}
+
+// npmWorkspaceGlobs returns the workspaces field of a package.json, which is
+// either a list of globs or an object with a packages list
+func npmWorkspaceGlobs(manifest string) []string {
+	var pkg struct {
+		Workspaces json.RawMessage `json:"workspaces"`
+	}
+	if json.Unmarshal([]byte(manifest), &pkg) != nil || pkg.Workspaces == nil {
+		return nil
+	}
+	var globs []string
+	if json.Unmarshal(pkg.Workspaces, &globs) == nil {
+		return globs
+	}
+	var object struct {
+		Packages []string `json:"packages"`
+	}
+	json.Unmarshal(pkg.Workspaces, &object)
+	return object.Packages
+}
+
+// pnpmWorkspaceFiles writes a pnpm-workspace.yaml from package.json's
+// workspaces field, which pnpm itself ignores, unless one was submitted
+func pnpmWorkspaceFiles(files map[string]string) error {
+	if files["pnpm-workspace.yaml"] != "" {
+		return nil
+	}
+	globs := npmWorkspaceGlobs(files["package.json"])
+	if len(globs) == 0 {
+		return nil
+	}
+	b, err := yaml.Marshal(map[string][]string{"packages": globs})
+	if err != nil {
+		return err
+	}
+	files["pnpm-workspace.yaml"] = string(b)
+	return nil
+}
+
+// workspaceModules lists the node_modules directories a workspace install
+// created besides the root one, relative to workDir
+func workspaceModules(workDir string) ([]string, error) {
+	// A workspace that spilled from tmpfs is a link to where it went
+	workDir, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return nil, err
+	}
+	var nested []string
+	err = filepath.WalkDir(workDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || d.Name() != "node_modules" {
+			return nil
+		}
+		if rel, _ := filepath.Rel(workDir, path); rel != "node_modules" {
+			nested = append(nested, rel)
+		}
+		return fs.SkipDir
+	})
+	return nested, err
+}
+
+// validateWorkspaces checks the workspaces option
+func validateWorkspaces(eco *Ecosystem, names []string) error {
+	if eco.WorkspaceArgs == nil {
+		return badRequest("workspaces is not supported for %s installs", eco.Name)
+	}
+	for _, name := range names {
+		if !npmNamePattern.MatchString(name) {
+			return badRequest("Invalid workspaces entry %q: must be a package name", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// Accept package.json and optional yarn.lock
+// When yarn.lock is present the install is frozen to it
+// The output is a zip of the installed node_modules
+var yarnEcosystem = &Ecosystem{
+	Name:     "yarn",
+	Tool:     "yarn",
+	Runtime:  "node",
+	Registry: "https://registry.yarnpkg.com/",
+	Image:    "node:20.18.0-bookworm-slim",
+	Files: []ManifestFile{
+		{Name: "package.json", Required: true},
+		{Name: "yarn.lock"},
+		{Name: ".npmrc", Secret: true},
+	},
+	Args: func(files map[string]string) []string {
+		args := []string{"install", "--non-interactive", "--no-progress"}
+		if files["yarn.lock"] != "" {
+			args = append(args, "--frozen-lockfile")
+		}
+		return args
+	},
+	RegistryArgs: func(registry string) []string {
+		return []string{"--registry", registry}
+	},
+	FileRegistries: npmRegistries,
+	// yarn 1 never installs peer dependencies itself
+	OmitArgs: map[string][]string{
+		"dev":      {"--production"},
+		"optional": {"--ignore-optional"},
+		"peer":     {},
+	},
+	// yarn 1 never installs peer dependencies and only warns of conflicts,
+	// which is what legacy asks for
+	PeerDepsArgs: map[string][]string{"legacy": {}},
+	// yarn 1 can't be told another platform's os and cpu, so it installs
+	// the optional packages of every platform instead
+	TargetArgs: func(*InstallTarget) []string { return []string{"--ignore-platform"} },
+	// yarn 1 fails on packages' engines unless told --ignore-engines
+	Engines:       &EngineCheck{Mismatches: yarnEngineMismatches},
+	NoScriptsArgs: []string{"--ignore-scripts"},
+	CacheEnv:      func(dir string) []string { return []string{"YARN_CACHE_FOLDER=" + dir} },
+	// Each package is unpacked into a directory of v6
+	CacheEntry:     leadingDirs(2),
+	ScriptPackages: npmScriptPackages,
+	Packages:       npmPackages,
+	FromPackages:   npmFromPackages,
+	LockedPackages: yarnLockedPackages,
+	LockIntegrity:  &LockIntegrity{File: "yarn.lock", Unpinned: yarnUnpinned},
+	Overrides:      yarnOverrides,
+	Audit: &Auditor{
+		Tool:  "yarn",
+		Args:  func(string) []string { return []string{"audit", "--json"} },
+		Parse: parseYarnAudit,
+	},
+	Output: func(workDir string) (string, error) {
+		return filepath.Join(workDir, "node_modules"), nil
+	},
+	ArchiveRoot: "node_modules",
+	ArchiveName: "node_modules",
+}